@@ -66,6 +66,16 @@ func (log *Elog) LogFile() (w io.Writer) {
 	return log.writer
 }
 
+// Flush the logfile if it can be synced
+func (log *Elog) Flush() error {
+	if syncer, ok := log.writer.(interface {
+		Sync() error
+	}); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
 // Set the log level
 func (log *Elog) SetLogLevel(level int) {
 	log.level = level
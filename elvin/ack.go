@@ -0,0 +1,53 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+)
+
+// Acknowledge a delivery to a Reliable subscription with ManualAck set,
+// so the router stops redelivering it. nv is the notification as
+// delivered, carrying its DeliveryIDAttribute.
+func (client *Client) Ack(sub *Subscription, nv map[string]interface{}) error {
+	id, ok := nv[DeliveryIDAttribute].(int64)
+	if !ok {
+		return LocalError(ErrorsNotReliable)
+	}
+	if client.State() != StateConnected {
+		return LocalError(ErrorsClientNotConnected)
+	}
+	pkt := &DeliveryAck{SubID: sub.subID, DeliveryID: id}
+	writeBuf := new(bytes.Buffer)
+	pkt.Encode(writeBuf)
+	client.writeChannel <- writeBuf
+	return nil
+}
+
+// Ack a delivery once it's handed over, unless the caller will
+func (client *Client) autoAck(sub *Subscription, nv map[string]interface{}) {
+	if !sub.Reliable || sub.ManualAck {
+		return
+	}
+	if _, ok := nv[DeliveryIDAttribute]; ok {
+		client.Ack(sub, nv)
+	}
+}
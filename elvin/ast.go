@@ -20,6 +20,18 @@
 
 package elvin
 
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
 const (
 	EmptyTypeCode               = 0
 	NameTypeCode                = 1
@@ -27,6 +39,7 @@ const (
 	Int64TypeCode               = 3
 	Real64TypeCode              = 4
 	StringTypeCode              = 5
+	OpaqueTypeCode              = 6 // Local to this implementation
 	EqualsTypeCode              = 8
 	NotEqualsTypeCode           = 9
 	LessThanTypeCode            = 10
@@ -68,6 +81,8 @@ const (
 	FuncRequireTypeCode         = 64
 	FuncEqualsTypeCode          = 65
 	FuncSizeTypeCode            = 66
+	FuncHexTypeCode             = 67 // Local, parsed to an OpaqueTypeCode
+	FuncBase64TypeCode          = 68 // Local, parsed to an OpaqueTypeCode
 )
 
 const (
@@ -76,18 +91,126 @@ const (
 	LukBottom = -1
 )
 
+// A node in a parsed subscription. Names and constants keep their
+// value in Value, operators and functions their operands in Children.
 type AST struct {
 	TypeCode int
 	Value    interface{}
 	ID       int
 	BaseType int
+	Children []*AST
+}
+
+// Does the notification match this subscription?
+func (node *AST) Match(n map[string]interface{}) bool {
+	return node.Eval(n) == LukTrue
+}
+
+// The attribute names referenced by this subscription
+func (node *AST) Names() map[string]bool {
+	names := make(map[string]bool)
+	node.names(names)
+	return names
+}
+
+func (node *AST) names(names map[string]bool) {
+	if node.TypeCode == NameTypeCode {
+		if name, ok := node.Value.(string); ok {
+			names[name] = true
+		}
+	}
+	for _, child := range node.Children {
+		child.names(names)
+	}
+}
+
+// Operator spellings for String
+var operators = map[int]string{
+	EqualsTypeCode:              "==",
+	NotEqualsTypeCode:           "!=",
+	LessThanTypeCode:            "<",
+	LessThanOrEqualsTypeCode:    "<=",
+	GreaterThanTypeCode:         ">",
+	GreaterThanOrEqualsTypeCode: ">=",
+	LogicalOrTypeCode:           "||",
+	LogicalExclusiveOrTypeCode:  "^^",
+	LogicalAndTypeCode:          "&&",
+	LogicalNotTypeCode:          "!",
+	UnaryPlusTypeCode:           "+",
+	UnaryMinusTypeCode:          "-",
+	MultiplyTypeCode:            "*",
+	DivideTypeCode:              "/",
+	ModuloTypeCode:              "%",
+	AddTypeCode:                 "+",
+	SubtractTypeCode:            "-",
+	ShiftLeftTypeCode:           "<<",
+	ShiftRightTypeCode:          ">>",
+	LogicalShiftRightTypeCode:   ">>>",
+	BinaryAndTypeCode:           "&",
+	BinaryExclusiveOrTypeCode:   "^",
+	BinaryOrTypeCode:            "|",
+	BinaryNotTypeCode:           "~",
+}
+
+// The subscription in a canonical form with every operation
+// parenthesized, which parses back to an equivalent AST
+func (node *AST) String() string {
+	switch node.TypeCode {
+	case NameTypeCode:
+		name := escape(node.Value.(string), "\\()\"', ")
+		if r, _ := utf8.DecodeRuneInString(name); !isInitialNameChar(r) && r != '\\' {
+			name = "\\" + name
+		}
+		return name
+	case Int32TypeCode:
+		return fmt.Sprintf("%d", node.Value)
+	case Int64TypeCode:
+		return fmt.Sprintf("%dL", node.Value)
+	case Real64TypeCode:
+		// The lexer takes a signed exponent only if it's negative
+		s := strings.Replace(strconv.FormatFloat(node.Value.(float64), 'g', -1, 64), "e+", "e", 1)
+		if !strings.ContainsAny(s, ".eEI") {
+			s += ".0"
+		}
+		return s
+	case StringTypeCode:
+		return "'" + escape(node.Value.(string), "\\'") + "'"
+	case OpaqueTypeCode:
+		return "hex('" + hex.EncodeToString(node.Value.([]byte)) + "')"
+	}
+
+	args := make([]string, len(node.Children))
+	for i, child := range node.Children {
+		args[i] = child.String()
+	}
+	for name, f := range functions {
+		if f.typeCode == node.TypeCode {
+			return name + "(" + strings.Join(args, ", ") + ")"
+		}
+	}
+	op := operators[node.TypeCode]
+	if len(args) == 1 {
+		return op + args[0]
+	}
+	return "(" + strings.Join(args, " "+op+" ") + ")"
 }
 
-func (node *AST) match(n map[string]interface{}) bool {
-	return node.eval(n) == LukTrue
+// Backslash escape any of chars in s
+func escape(s string, chars string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
 }
 
-func (node *AST) eval(n map[string]interface{}) int {
+// Evaluate a boolean node using Lukasiewicz three valued logic,
+// returning LukTrue, LukFalse or LukBottom (undecidable, e.g. a
+// missing attribute)
+func (node *AST) Eval(n map[string]interface{}) int {
 	switch node.TypeCode {
 	case FuncRequireTypeCode:
 		name := node.Value.(string)
@@ -95,7 +218,458 @@ func (node *AST) eval(n map[string]interface{}) int {
 			return LukBottom
 		}
 		return LukTrue
+
+	case LogicalAndTypeCode:
+		result := LukTrue
+		for _, child := range node.Children {
+			switch child.Eval(n) {
+			case LukFalse:
+				return LukFalse
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+
+	case LogicalOrTypeCode:
+		result := LukFalse
+		for _, child := range node.Children {
+			switch child.Eval(n) {
+			case LukTrue:
+				return LukTrue
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+
+	case LogicalExclusiveOrTypeCode:
+		a := node.Children[0].Eval(n)
+		b := node.Children[1].Eval(n)
+		if a == LukBottom || b == LukBottom {
+			return LukBottom
+		}
+		return lukBool(a != b)
+
+	case LogicalNotTypeCode:
+		switch node.Children[0].Eval(n) {
+		case LukTrue:
+			return LukFalse
+		case LukFalse:
+			return LukTrue
+		}
+		return LukBottom
+
+	case EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode,
+		LessThanOrEqualsTypeCode, GreaterThanTypeCode,
+		GreaterThanOrEqualsTypeCode:
+		a := node.Children[0].value(n)
+		b := node.Children[1].value(n)
+		c, ok := compare(a, b)
+		if !ok {
+			return LukBottom
+		}
+		switch node.TypeCode {
+		case EqualsTypeCode:
+			return lukBool(c == 0)
+		case NotEqualsTypeCode:
+			return lukBool(c != 0)
+		case LessThanTypeCode:
+			return lukBool(c < 0)
+		case LessThanOrEqualsTypeCode:
+			return lukBool(c <= 0)
+		case GreaterThanTypeCode:
+			return lukBool(c > 0)
+		default:
+			return lukBool(c >= 0)
+		}
+
+	case FuncInt32TypeCode, FuncInt64TypeCode, FuncReal64TypeCode,
+		FuncStringTypeCode, FuncOpaqueTypeCode:
+		v, ok := n[node.Value.(string)]
+		if !ok {
+			return LukBottom
+		}
+		return lukBool(typeFunctions[node.TypeCode] == NotificationType(v))
+
+	case FuncNanTypeCode:
+		v, ok := n[node.Value.(string)].(float64)
+		if !ok {
+			return LukBottom
+		}
+		return lukBool(math.IsNaN(v))
+
+	case FuncBeginsWithTypeCode, FuncContainsTypeCode, FuncEndsWithTypeCode:
+		if patterns, ok := node.Value.([][]byte); ok {
+			b, ok := node.Children[0].value(n).([]byte)
+			if !ok {
+				return LukBottom
+			}
+			for _, pattern := range patterns {
+				switch {
+				case node.TypeCode == FuncBeginsWithTypeCode && bytes.HasPrefix(b, pattern),
+					node.TypeCode == FuncContainsTypeCode && bytes.Contains(b, pattern),
+					node.TypeCode == FuncEndsWithTypeCode && bytes.HasSuffix(b, pattern):
+					return LukTrue
+				}
+			}
+			return LukFalse
+		}
+
+		s, ok := node.Children[0].value(n).(string)
+		if !ok {
+			return LukBottom
+		}
+		for _, pattern := range node.Value.([]string) {
+			switch {
+			case node.TypeCode == FuncBeginsWithTypeCode && strings.HasPrefix(s, pattern),
+				node.TypeCode == FuncContainsTypeCode && strings.Contains(s, pattern),
+				node.TypeCode == FuncEndsWithTypeCode && strings.HasSuffix(s, pattern):
+				return LukTrue
+			}
+		}
+		return LukFalse
+
+	case FuncWildcardTypeCode, FuncRegexTypeCode:
+		s, ok := node.Children[0].value(n).(string)
+		if !ok {
+			return LukBottom
+		}
+		for _, re := range node.Value.([]*regexp.Regexp) {
+			if re.MatchString(s) {
+				return LukTrue
+			}
+		}
+		return LukFalse
+
+	case FuncEqualsTypeCode:
+		a := node.Children[0].value(n)
+		if a == nil {
+			return LukBottom
+		}
+		for _, child := range node.Children[1:] {
+			if c, ok := compare(a, child.value(n)); ok && c == 0 {
+				return LukTrue
+			}
+		}
+		return LukFalse
 	}
 
 	return LukBottom
 }
+
+// A static estimate of the cost of evaluating a node, used to test
+// cheap operands of AND and OR first
+func (node *AST) Cost() int {
+	cost := node.ownCost()
+	for _, child := range node.Children {
+		cost += child.Cost()
+	}
+	return cost
+}
+
+// The cost of evaluating a node, not counting its children
+func (node *AST) ownCost() int {
+	cost := 1
+	switch node.TypeCode {
+	case FuncBeginsWithTypeCode, FuncContainsTypeCode, FuncEndsWithTypeCode:
+		if patterns, ok := node.Value.([][]byte); ok {
+			cost = 4 * len(patterns)
+		} else {
+			cost = 4 * len(node.Value.([]string))
+		}
+	case FuncWildcardTypeCode, FuncRegexTypeCode:
+		cost = 20 * len(node.Value.([]*regexp.Regexp))
+	case FuncFoldCaseTypeCode:
+		cost = 4
+	}
+	return cost
+}
+
+// Flatten chains of AND and OR and sort their operands so the
+// cheapest are evaluated first. As AND and OR don't depend on the
+// order of their operands under three valued logic this doesn't
+// change the result, only how soon evaluation can short-circuit.
+func (node *AST) Reorder() {
+	node.reorder()
+}
+
+// Reorder a subtree, returning its cost so each node's is worked out
+// only once
+func (node *AST) reorder() int {
+	cost := node.ownCost()
+	if node.TypeCode != LogicalAndTypeCode && node.TypeCode != LogicalOrTypeCode {
+		for _, child := range node.Children {
+			cost += child.reorder()
+		}
+		return cost
+	}
+
+	// Gather the whole chain's operands in one pass
+	type operand struct {
+		node *AST
+		cost int
+	}
+	var operands []operand
+	var flatten func(chain *AST)
+	flatten = func(chain *AST) {
+		for _, child := range chain.Children {
+			if child.TypeCode == node.TypeCode {
+				flatten(child)
+			} else {
+				operands = append(operands, operand{child, child.reorder()})
+			}
+		}
+	}
+	flatten(node)
+
+	sort.SliceStable(operands, func(i, j int) bool {
+		return operands[i].cost < operands[j].cost
+	})
+	node.Children = make([]*AST, len(operands))
+	for i, op := range operands {
+		node.Children[i] = op.node
+		cost += op.cost
+	}
+	return cost
+}
+
+// The type a type checking function tests for
+var typeFunctions = map[int]int{
+	FuncInt32TypeCode:  NotificationInt32,
+	FuncInt64TypeCode:  NotificationInt64,
+	FuncReal64TypeCode: NotificationFloat64,
+	FuncStringTypeCode: NotificationString,
+	FuncOpaqueTypeCode: NotificationOpaque,
+}
+
+func lukBool(b bool) int {
+	if b {
+		return LukTrue
+	}
+	return LukFalse
+}
+
+// Evaluate a value node, returning nil if it's undecidable
+func (node *AST) value(n map[string]interface{}) interface{} {
+	switch node.TypeCode {
+	case NameTypeCode:
+		return n[node.Value.(string)]
+
+	case Int32TypeCode, Int64TypeCode, Real64TypeCode, StringTypeCode, OpaqueTypeCode:
+		return node.Value
+
+	case UnaryPlusTypeCode:
+		v := node.Children[0].value(n)
+		switch v.(type) {
+		case int32, int64, float64:
+			return v
+		}
+		return nil
+
+	case UnaryMinusTypeCode:
+		switch v := node.Children[0].value(n).(type) {
+		case int32:
+			return -v
+		case int64:
+			return -v
+		case float64:
+			return -v
+		}
+		return nil
+
+	case BinaryNotTypeCode:
+		switch v := node.Children[0].value(n).(type) {
+		case int32:
+			return ^v
+		case int64:
+			return ^v
+		}
+		return nil
+
+	case MultiplyTypeCode, DivideTypeCode, ModuloTypeCode, AddTypeCode,
+		SubtractTypeCode, ShiftLeftTypeCode, ShiftRightTypeCode,
+		LogicalShiftRightTypeCode, BinaryAndTypeCode,
+		BinaryExclusiveOrTypeCode, BinaryOrTypeCode:
+		return arithmetic(node.TypeCode, node.Children[0].value(n), node.Children[1].value(n))
+
+	case FuncFoldCaseTypeCode:
+		if s, ok := node.Children[0].value(n).(string); ok {
+			return strings.ToLower(s)
+		}
+		return nil
+
+	case FuncSizeTypeCode:
+		switch v := node.Children[0].value(n).(type) {
+		case string:
+			return int32(len(v))
+		case []byte:
+			return int32(len(v))
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// Numeric type promotion: int32 < int64 < real64
+func promote(a, b interface{}) (interface{}, interface{}, bool) {
+	switch x := a.(type) {
+	case int32:
+		switch y := b.(type) {
+		case int32:
+			return x, y, true
+		case int64:
+			return int64(x), y, true
+		case float64:
+			return float64(x), y, true
+		}
+	case int64:
+		switch y := b.(type) {
+		case int32:
+			return x, int64(y), true
+		case int64:
+			return x, y, true
+		case float64:
+			return float64(x), y, true
+		}
+	case float64:
+		switch y := b.(type) {
+		case int32:
+			return x, float64(y), true
+		case int64:
+			return x, float64(y), true
+		case float64:
+			return x, y, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Compare two values returning -1, 0 or 1 and whether they were comparable
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(x, y), true
+	}
+
+	x, y, ok := promote(a, b)
+	if !ok {
+		return 0, false
+	}
+	switch x := x.(type) {
+	case int32:
+		return compareInt64(int64(x), int64(y.(int32))), true
+	case int64:
+		return compareInt64(x, y.(int64)), true
+	case float64:
+		y := y.(float64)
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Apply a binary arithmetic or bitwise operator
+func arithmetic(op int, a, b interface{}) interface{} {
+	x, y, ok := promote(a, b)
+	if !ok {
+		return nil
+	}
+
+	switch x := x.(type) {
+	case int32:
+		r, ok := integerOp(op, int64(x), int64(y.(int32)), 32)
+		if !ok {
+			return nil
+		}
+		return int32(r)
+	case int64:
+		r, ok := integerOp(op, x, y.(int64), 64)
+		if !ok {
+			return nil
+		}
+		return r
+	case float64:
+		y := y.(float64)
+		switch op {
+		case MultiplyTypeCode:
+			return x * y
+		case DivideTypeCode:
+			return x / y
+		case ModuloTypeCode:
+			return math.Mod(x, y)
+		case AddTypeCode:
+			return x + y
+		case SubtractTypeCode:
+			return x - y
+		}
+	}
+	return nil
+}
+
+// Integer arithmetic at the given width
+func integerOp(op int, x, y int64, width uint) (int64, bool) {
+	switch op {
+	case MultiplyTypeCode:
+		return x * y, true
+	case DivideTypeCode:
+		if y == 0 {
+			return 0, false
+		}
+		return x / y, true
+	case ModuloTypeCode:
+		if y == 0 {
+			return 0, false
+		}
+		return x % y, true
+	case AddTypeCode:
+		return x + y, true
+	case SubtractTypeCode:
+		return x - y, true
+	case ShiftLeftTypeCode:
+		return x << uint64(y&int64(width-1)), true
+	case ShiftRightTypeCode:
+		return x >> uint64(y&int64(width-1)), true
+	case LogicalShiftRightTypeCode:
+		if width == 32 {
+			return int64(uint32(x) >> uint64(y&31)), true
+		}
+		return int64(uint64(x) >> uint64(y&63)), true
+	case BinaryAndTypeCode:
+		return x & y, true
+	case BinaryExclusiveOrTypeCode:
+		return x ^ y, true
+	case BinaryOrTypeCode:
+		return x | y, true
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// How long to wait between connection attempts. The delay before
+// attempt n is Initial * Multiplier^(n-1), capped at Max, of which
+// the Jitter fraction is randomized. A Jitter of 1 is full jitter,
+// a delay anywhere from zero to the capped value.
+type BackoffPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64 // At least 1
+	Jitter     float64 // 0 to 1
+}
+
+// Used when a client has no Backoff of its own
+var DefaultBackoffPolicy = BackoffPolicy{
+	Initial:    50 * time.Millisecond,
+	Max:        2 * time.Minute,
+	Multiplier: 4,
+	Jitter:     1,
+}
+
+// Check the policy makes sense
+func (policy BackoffPolicy) Validate() error {
+	switch {
+	case policy.Initial <= 0:
+		return LocalError(ErrorsBadBackoffPolicy, "Initial not positive")
+	case policy.Max < policy.Initial:
+		return LocalError(ErrorsBadBackoffPolicy, "Max less than Initial")
+	case policy.Multiplier < 1:
+		return LocalError(ErrorsBadBackoffPolicy, "Multiplier less than 1")
+	case policy.Jitter < 0 || policy.Jitter > 1:
+		return LocalError(ErrorsBadBackoffPolicy, "Jitter outside 0 to 1")
+	}
+	return nil
+}
+
+// The delay before an attempt, counting from 1
+func (policy BackoffPolicy) Delay(attempt int) time.Duration {
+	delay := float64(policy.Initial) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if delay > float64(policy.Max) {
+		delay = float64(policy.Max)
+	}
+	delay -= delay * policy.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// The client's policy or the default
+func (client *Client) backoffPolicy() BackoffPolicy {
+	if client.Backoff != nil {
+		return *client.Backoff
+	}
+	return DefaultBackoffPolicy
+}
+
+// Connect, retrying with the client's BackoffPolicy. Will retry
+// forever if retries is 0.
+func (client *Client) ConnectWithRetry(retries int) (err error) {
+	policy := client.backoffPolicy()
+	if err = policy.Validate(); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		if err = client.Connect(); err == nil {
+			return nil
+		}
+		if attempt == retries {
+			return err
+		}
+		time.Sleep(policy.Delay(attempt))
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffValidate(t *testing.T) {
+	if err := DefaultBackoffPolicy.Validate(); err != nil {
+		t.Fatalf("Default policy invalid: %v", err)
+	}
+
+	bad := []BackoffPolicy{
+		{Initial: -1, Max: time.Second, Multiplier: 2},
+		{Initial: 0, Max: time.Second, Multiplier: 2},
+		{Initial: time.Second, Max: time.Millisecond, Multiplier: 2},
+		{Initial: time.Millisecond, Max: time.Second, Multiplier: 0.5},
+		{Initial: time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: -0.1},
+		{Initial: time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 1.5},
+	}
+	for _, policy := range bad {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	policy := BackoffPolicy{
+		Initial:    100 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+	}
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000, 1000}
+	for i, want := range expected {
+		if got := policy.Delay(i + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: expected %v got %v", i+1, want*time.Millisecond, got)
+		}
+	}
+
+	// Jitter takes up to that fraction off the capped delay
+	for _, jitter := range []float64{0.25, 1} {
+		policy.Jitter = jitter
+		for i, want := range expected {
+			upper := want * time.Millisecond
+			lower := time.Duration(float64(upper) * (1 - jitter))
+			for n := 0; n < 100; n++ {
+				if got := policy.Delay(i + 1); got < lower || got > upper {
+					t.Fatalf("jitter %v attempt %d: %v outside [%v, %v]", jitter, i+1, got, lower, upper)
+				}
+			}
+		}
+	}
+}
+
+func TestConnectWithRetryInvalid(t *testing.T) {
+	client := NewClient("elvin://localhost:1", nil, nil, nil)
+	client.Backoff = &BackoffPolicy{Initial: time.Second, Max: time.Millisecond, Multiplier: 2}
+	if err := client.ConnectWithRetry(1); err == nil {
+		t.Fatalf("Expected an invalid policy to be refused")
+	}
+}
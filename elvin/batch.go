@@ -0,0 +1,94 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Why one notification of a batch was rejected
+type BatchProblem struct {
+	Index int // into the batch
+	Err   error
+}
+
+// The notifications of a batch that failed validation. If Sent is set
+// the rest of the batch was sent, otherwise none of it was.
+type BatchError struct {
+	Problems []BatchProblem
+	Sent     bool
+}
+
+func (err *BatchError) Error() string {
+	problems := make([]string, len(err.Problems))
+	for i, problem := range err.Problems {
+		problems[i] = fmt.Sprintf("%d: %v", problem.Index, problem.Err)
+	}
+	return fmt.Sprintf("%d notifications rejected (%s)", len(err.Problems), strings.Join(problems, "; "))
+}
+
+// The indexes of the rejected notifications, in order
+func (err *BatchError) Indexes() (indexes []int) {
+	for _, problem := range err.Problems {
+		indexes = append(indexes, problem.Index)
+	}
+	return indexes
+}
+
+// Send a batch of notifications, validating them all first. If any
+// are invalid a *BatchError lists them and, unless bestEffort is set,
+// nothing is sent. With bestEffort the valid notifications are sent.
+func (client *Client) NotifyBatch(nvs []map[string]interface{}, deliverInsecure bool, keys KeyBlock, bestEffort bool) (err error) {
+
+	if client.offline() {
+		return LocalError(ErrorsClientNotConnected)
+	}
+
+	var batchErr *BatchError
+	valid := make([]bool, len(nvs))
+	prepared := make([]map[string]interface{}, len(nvs))
+	for i, nv := range nvs {
+		if p, e := client.prepareNotification(nv); e != nil {
+			if batchErr == nil {
+				batchErr = &BatchError{Sent: bestEffort}
+			}
+			batchErr.Problems = append(batchErr.Problems, BatchProblem{i, e})
+		} else {
+			prepared[i], valid[i] = p, true
+		}
+	}
+	if batchErr != nil && !bestEffort {
+		return batchErr
+	}
+
+	for i, nv := range prepared {
+		if valid[i] {
+			if err = client.emit(nv, nil, deliverInsecure, keys); err != nil {
+				return err
+			}
+		}
+	}
+	if batchErr != nil {
+		return batchErr
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func batch() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"a": int32(1)},
+		{"a": true}, // unsupported
+		{"a": "three"},
+		{"a": []int{4}}, // unsupported
+	}
+}
+
+// Count what's sent for a short while
+func sent(written chan bool) (count int) {
+	for {
+		select {
+		case <-written:
+			count++
+		case <-time.After(50 * time.Millisecond):
+			return count
+		}
+	}
+}
+
+func TestNotifyBatchAllOrNothing(t *testing.T) {
+	written := make(chan bool, 8)
+	client := fakeConnectedClient(func() { written <- true })
+
+	err := client.NotifyBatch(batch(), true, nil, false)
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("Expected a BatchError, got: %v", err)
+	}
+	if !reflect.DeepEqual(batchErr.Indexes(), []int{1, 3}) || batchErr.Sent {
+		t.Fatalf("Unexpected BatchError: %+v", batchErr)
+	}
+	if batchErr.Problems[0].Err.Error() != LocalError(ErrorsBadAttributeType, "a", "bool").Error() {
+		t.Fatalf("Expected a bad attribute type, got: %v", batchErr.Problems[0].Err)
+	}
+	if count := sent(written); count != 0 {
+		t.Fatalf("Rejected batch sent %d notifications", count)
+	}
+
+	if err := client.NotifyBatch(batch()[2:3], true, nil, false); err != nil {
+		t.Fatalf("Valid batch failed: %v", err)
+	}
+	if count := sent(written); count != 1 {
+		t.Fatalf("Valid batch sent %d notifications", count)
+	}
+}
+
+func TestNotifyBatchBestEffort(t *testing.T) {
+	written := make(chan bool, 8)
+	client := fakeConnectedClient(func() { written <- true })
+	client.Schema = &Schema{Required: map[string]int{"a": NotificationString}}
+
+	err := client.NotifyBatch(batch(), true, nil, true)
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("Expected a BatchError, got: %v", err)
+	}
+	if !reflect.DeepEqual(batchErr.Indexes(), []int{0, 1, 3}) || !batchErr.Sent {
+		t.Fatalf("Unexpected BatchError: %+v", batchErr)
+	}
+	if count := sent(written); count != 1 {
+		t.Fatalf("Best effort batch sent %d notifications", count)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How much longer the router asked us to hold off notifying, zero
+// if it hasn't or that's passed. A router that's overloaded drops
+// notifications and replies with a Busy, reported on the
+// AnomalyChannel, and Notify fails with ErrorsRouterBusy until the
+// suggested back-off has passed.
+func (client *Client) Busy() time.Duration {
+	remaining := time.Until(time.Unix(0, atomic.LoadInt64(&client.busyUntil)))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// An error if we're backing off from a busy router
+func (client *Client) backingOff() error {
+	if remaining := client.Busy(); remaining > 0 {
+		return LocalError(ErrorsRouterBusy, remaining)
+	}
+	return nil
+}
+
+// Handle a Busy, noting the back-off
+func (client *Client) handleBusy(buffer []byte) (err error) {
+	busy := new(Busy)
+	if err = busy.Decode(buffer); err != nil {
+		return err
+	}
+
+	backoff := time.Duration(busy.Backoff) * time.Millisecond
+	atomic.StoreInt64(&client.busyUntil, time.Now().Add(backoff).UnixNano())
+	client.anomaly(AnomalyRouterBusy, "Router busy, notification dropped, back off for %v", backoff)
+	return nil
+}
@@ -0,0 +1,324 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// Attributes of the chunk notifications NotifyLarge splits a payload
+// into. Each chunk also carries the message's metadata so that it's
+// routed like the message would be.
+const (
+	ChunkIDAttribute    = "elvin:ChunkID"    // string shared by a message's chunks
+	ChunkIndexAttribute = "elvin:ChunkIndex" // int32 from 0
+	ChunkTotalAttribute = "elvin:ChunkTotal" // int32 chunks in the message, 0 until the final chunk
+	ChunkFinalAttribute = "elvin:ChunkFinal" // int32 1 on the final chunk, otherwise 0
+	ChunkDataAttribute  = "elvin:ChunkData"  // opaque part of the payload
+)
+
+// Chunking defaults, see MaxPacketSize and NewReassembler
+const (
+	DefaultMaxPacketSize = 1 << 20
+	DefaultChunkWindow   = 16
+	DefaultChunkTimeout  = 30 * time.Second
+)
+
+// Send a payload of any size as numbered chunk notifications, each
+// carrying metadata and a part of what's read from r, and each encoded
+// within the client's MaxPacketSize. A Reassembler puts them back
+// together. Chunks are sent as they're read, so a failure part way
+// through leaves the message incomplete.
+func (client *Client) NotifyLarge(metadata map[string]interface{}, deliverInsecure bool, keys KeyBlock, r io.Reader) error {
+	size, err := client.chunkSize(metadata, deliverInsecure, keys)
+	if err != nil {
+		return err
+	}
+	return sendChunks(metadata, r, size, func(nv map[string]interface{}) error {
+		return client.Notify(nv, deliverInsecure, keys)
+	})
+}
+
+// How much of the payload fits in each chunk, being what's left of
+// MaxPacketSize (including its length) once the rest is encoded
+func (client *Client) chunkSize(metadata map[string]interface{}, deliverInsecure bool, keys KeyBlock) (int, error) {
+	max := client.MaxPacketSize
+	if max <= 0 {
+		max = DefaultMaxPacketSize
+	}
+
+	nv, err := CoerceNotification(metadata)
+	if err != nil {
+		return 0, err
+	}
+	nv = chunkNotification(nv, newChunkID(), 0, 0, false, []byte{})
+	if client.Sequence {
+		nv[SequenceAttribute] = int64(0)
+	}
+	buf := new(bytes.Buffer)
+	pkt := &NotifyEmit{NameValue: nv, DeliverInsecure: deliverInsecure, Keys: keys}
+	pkt.Encode(buf)
+
+	// The opaque's length is already counted, and its data is padded
+	// to 4 bytes
+	size := (max - 4 - buf.Len()) &^ 3
+	if size <= 0 {
+		return 0, LocalError(ErrorsChunkTooSmall, max)
+	}
+	return size, nil
+}
+
+// A random ID for a chunked message
+func newChunkID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// A copy of metadata with the chunk attributes added
+func chunkNotification(metadata map[string]interface{}, id string, index int32, total int32, final bool, data []byte) map[string]interface{} {
+	nv := make(map[string]interface{}, len(metadata)+5)
+	for name, value := range metadata {
+		nv[name] = value
+	}
+	nv[ChunkIDAttribute] = id
+	nv[ChunkIndexAttribute] = index
+	nv[ChunkTotalAttribute] = total
+	nv[ChunkFinalAttribute] = int32(0)
+	if final {
+		nv[ChunkFinalAttribute] = int32(1)
+	}
+	nv[ChunkDataAttribute] = data
+	return nv
+}
+
+// Read r in size pieces, passing each to send as a chunk. It reads a
+// piece ahead so that the final chunk is marked as such, an empty
+// payload being sent as one empty final chunk.
+func sendChunks(metadata map[string]interface{}, r io.Reader, size int, send func(map[string]interface{}) error) error {
+	id := newChunkID()
+	read := func() ([]byte, error) {
+		data := make([]byte, size)
+		n, err := io.ReadFull(r, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return data[:n], err
+	}
+
+	data, err := read()
+	if err != nil {
+		return err
+	}
+	for index := int32(0); ; index++ {
+		var next []byte
+		if len(data) == size {
+			if next, err = read(); err != nil {
+				return err
+			}
+		}
+		if len(next) == 0 {
+			return send(chunkNotification(metadata, id, index, index+1, true, data))
+		}
+		if err = send(chunkNotification(metadata, id, index, 0, false, data)); err != nil {
+			return err
+		}
+		data = next
+	}
+}
+
+// Reassembles the chunk notifications sent by NotifyLarge, holding
+// up to a window of chunks that arrive ahead of their turn
+type Reassembler struct {
+	mu        sync.Mutex
+	window    int
+	timeout   time.Duration
+	messages  map[string]*LargeMessage // incomplete, by chunk id
+	completed map[string]time.Time     // finished within the timeout, by chunk id
+}
+
+// Create a Reassembler holding up to window chunks per message out
+// of order, DefaultChunkWindow if window is zero. A message is failed
+// if timeout passes without one of its chunks arriving,
+// DefaultChunkTimeout if timeout is zero.
+func NewReassembler(window int, timeout time.Duration) *Reassembler {
+	if window <= 0 {
+		window = DefaultChunkWindow
+	}
+	if timeout <= 0 {
+		timeout = DefaultChunkTimeout
+	}
+	return &Reassembler{
+		window:    window,
+		timeout:   timeout,
+		messages:  make(map[string]*LargeMessage),
+		completed: make(map[string]time.Time),
+	}
+}
+
+// A message being reassembled. Reading it returns the payload in
+// order as its chunks arrive, blocking for those still to come.
+type LargeMessage struct {
+	ID       string
+	Metadata map[string]interface{} // the attributes of its chunks, less the chunk attributes
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	data bytes.Buffer     // in order and unread
+	next int32            // index of the chunk expected next
+	last int32            // index of the final chunk, -1 until it arrives
+	held map[int32][]byte // chunks that arrived early, by index
+	done bool
+	err  error       // once done, what reading returns after the data
+	idle *time.Timer // fails the message if no chunk arrives in time
+}
+
+// Add a notification. If it's a chunk it's returned with the message
+// it belongs to, and first is set if it's the first seen of that
+// message. Notifications that aren't chunks return a nil message.
+// A chunk beyond the window, or the timeout passing without a chunk,
+// fails the message, which returns the error from Read once what
+// arrived in order has been read. Chunks of a message finished within
+// the timeout are ignored as duplicates.
+func (reassembler *Reassembler) Add(nv map[string]interface{}) (message *LargeMessage, first bool, err error) {
+	id, ok := nv[ChunkIDAttribute].(string)
+	if !ok {
+		return nil, false, nil
+	}
+	index, iok := nv[ChunkIndexAttribute].(int32)
+	final, fok := nv[ChunkFinalAttribute].(int32)
+	data, dok := nv[ChunkDataAttribute].([]byte)
+	if !iok || !fok || !dok || index < 0 {
+		return nil, false, LocalError(ErrorsBadChunk, id)
+	}
+
+	reassembler.mu.Lock()
+	now := time.Now()
+	for finished, at := range reassembler.completed {
+		if now.Sub(at) >= reassembler.timeout {
+			delete(reassembler.completed, finished)
+		}
+	}
+	if _, ok = reassembler.completed[id]; ok {
+		reassembler.mu.Unlock()
+		return nil, false, nil
+	}
+	message, ok = reassembler.messages[id]
+	if !ok {
+		first = true
+		message = &LargeMessage{ID: id, Metadata: make(map[string]interface{}), held: make(map[int32][]byte), last: -1}
+		message.cond = sync.NewCond(&message.mu)
+		for name, value := range nv {
+			switch name {
+			case ChunkIDAttribute, ChunkIndexAttribute, ChunkTotalAttribute, ChunkFinalAttribute, ChunkDataAttribute:
+			default:
+				message.Metadata[name] = value
+			}
+		}
+		reassembler.messages[id] = message
+		message.idle = time.AfterFunc(reassembler.timeout, func() { reassembler.expire(message) })
+	}
+	reassembler.mu.Unlock()
+
+	if done, err := message.add(index, final == 1, data, reassembler.window); done {
+		reassembler.finish(message)
+		return message, first, err
+	}
+	message.idle.Reset(reassembler.timeout)
+	return message, first, nil
+}
+
+// Fail a message that's had no chunk within the timeout
+func (reassembler *Reassembler) expire(message *LargeMessage) {
+	message.mu.Lock()
+	if !message.done {
+		message.done = true
+		message.err = LocalError(ErrorsChunkTimeout, message.ID, reassembler.timeout)
+		message.cond.Broadcast()
+	}
+	message.mu.Unlock()
+	reassembler.finish(message)
+}
+
+// Forget a completed or failed message, remembering its id for a
+// while so late duplicates of its chunks are ignored
+func (reassembler *Reassembler) finish(message *LargeMessage) {
+	message.idle.Stop()
+	reassembler.mu.Lock()
+	defer reassembler.mu.Unlock()
+	if reassembler.messages[message.ID] == message {
+		delete(reassembler.messages, message.ID)
+		reassembler.completed[message.ID] = time.Now()
+	}
+}
+
+// Add a chunk, returning true once the message is complete or failed
+func (message *LargeMessage) add(index int32, final bool, data []byte, window int) (bool, error) {
+	message.mu.Lock()
+	defer message.mu.Unlock()
+	defer message.cond.Broadcast()
+
+	if message.done || index < message.next {
+		return message.done, nil // a duplicate
+	}
+	if index >= message.next+int32(window) {
+		message.done = true
+		message.err = LocalError(ErrorsChunkWindow, index, message.ID, window)
+		return true, message.err
+	}
+	if final {
+		message.last = index
+	}
+	message.held[index] = data
+
+	for {
+		data, ok := message.held[message.next]
+		if !ok {
+			return false, nil
+		}
+		delete(message.held, message.next)
+		message.data.Write(data)
+		if message.next == message.last {
+			message.done = true
+			message.err = io.EOF
+			return true, nil
+		}
+		message.next++
+	}
+}
+
+// Read the payload, blocking until more of it arrives
+func (message *LargeMessage) Read(p []byte) (int, error) {
+	message.mu.Lock()
+	defer message.mu.Unlock()
+	for message.data.Len() == 0 && !message.done {
+		message.cond.Wait()
+	}
+	if message.data.Len() > 0 {
+		return message.data.Read(p)
+	}
+	return 0, message.err
+}
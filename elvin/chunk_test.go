@@ -0,0 +1,128 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestChunkedReassembly(t *testing.T) {
+	payload := make([]byte, 10000)
+	rand.Read(payload)
+	metadata := map[string]interface{}{"File": "payload.bin"}
+
+	client := NewClient("elvin://", nil, nil, nil)
+	client.MaxPacketSize = 1024
+	size, err := client.chunkSize(metadata, true, nil)
+	if err != nil {
+		t.Fatalf("chunkSize failed: %v", err)
+	}
+
+	var chunks []map[string]interface{}
+	err = sendChunks(metadata, bytes.NewReader(payload), size, func(nv map[string]interface{}) error {
+		buf := new(bytes.Buffer)
+		(&NotifyEmit{NameValue: nv, DeliverInsecure: true}).Encode(buf)
+		if buf.Len()+4 > client.MaxPacketSize {
+			t.Fatalf("Chunk of %d bytes exceeds the packet size", buf.Len()+4)
+		}
+		chunks = append(chunks, nv)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	if len(chunks) < 10 {
+		t.Fatalf("Expected many chunks, got %d", len(chunks))
+	}
+	if final := chunks[len(chunks)-1]; final[ChunkFinalAttribute] != int32(1) || final[ChunkTotalAttribute] != int32(len(chunks)) {
+		t.Fatalf("Final chunk not marked: %v", final)
+	}
+
+	// Swap neighbouring chunks so most arrive ahead of their turn
+	for i := 0; i+1 < len(chunks); i += 2 {
+		chunks[i], chunks[i+1] = chunks[i+1], chunks[i]
+	}
+
+	reassembler := NewReassembler(4, 0)
+	var message *LargeMessage
+	for i, nv := range chunks {
+		m, first, err := reassembler.Add(nv)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		if first != (i == 0) {
+			t.Fatalf("Chunk %d first is %v", i, first)
+		}
+		message = m
+	}
+	if message.Metadata["File"] != "payload.bin" || len(message.Metadata) != 1 {
+		t.Fatalf("Unexpected metadata: %v", message.Metadata)
+	}
+	reassembled, err := ioutil.ReadAll(message)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(reassembled, payload) {
+		t.Fatalf("Reassembled %d bytes differ from the %d sent", len(reassembled), len(payload))
+	}
+
+	// Chunks arriving after the message is complete are duplicates
+	if m, _, err := reassembler.Add(chunks[0]); m != nil || err != nil {
+		t.Fatalf("Duplicate chunk after completion returned %v, %v", m, err)
+	}
+
+	// Two ahead of the next expected is beyond a window of two
+	reassembler = NewReassembler(2, 0)
+	beyond := chunkNotification(metadata, "windowed", 2, 0, false, payload[:size])
+	if _, _, err := reassembler.Add(beyond); err == nil {
+		t.Fatalf("Chunk beyond the window accepted")
+	}
+
+	// A message missing its remaining chunks fails once idle
+	reassembler = NewReassembler(2, 20*time.Millisecond)
+	message, _, err = reassembler.Add(chunkNotification(metadata, "idle", 0, 0, false, payload[:size]))
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := ioutil.ReadAll(message); err == nil {
+		t.Fatalf("Read of an idle message succeeded")
+	}
+}
+
+func TestChunkedNotifyLarge(t *testing.T) {
+	client := fakeConnectedClient(func() {})
+	client.MaxPacketSize = 512
+	if err := client.NotifyLarge(map[string]interface{}{"File": "empty"}, true, nil, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("NotifyLarge failed: %v", err)
+	}
+	if err := client.NotifyLarge(map[string]interface{}{"File": "large"}, true, nil, bytes.NewReader(make([]byte, 2000))); err != nil {
+		t.Fatalf("NotifyLarge failed: %v", err)
+	}
+
+	client.MaxPacketSize = 64
+	if err := client.NotifyLarge(map[string]interface{}{"File": "large"}, true, nil, bytes.NewReader(make([]byte, 2000))); err == nil {
+		t.Fatalf("NotifyLarge without room for data succeeded")
+	}
+}
@@ -22,6 +22,7 @@ package elvin
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/cobaro/elvin/elog"
@@ -29,6 +30,9 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -49,9 +53,103 @@ type Client struct {
 	KeysNfn  KeyBlock               // Connections keys for outgoing notifications
 	KeysSub  KeyBlock               // Connections keys for incoming notifications
 	Events   chan Packet            // Clients may listen here for connectionq events
+	Schema   *Schema                // Optional validation of outgoing notifications
 	elog     elog.Elog              // Logging
 
+	// Optional callback on each reconnection attempt. It's run in
+	// its own goroutine so may be slow without delaying reconnection.
+	OnReconnect func(attempt int, err error, success bool)
+
+	// Delays between connection attempts, DefaultBackoffPolicy if nil
+	Backoff *BackoffPolicy
+
+	// TCP tuning for the connections we dial, nil for the defaults
+	Socket *SocketOptions
+
+	// Dials the URL's address for Connect and reconnection, net.Dial
+	// if nil. Useful for in-memory transports in tests.
+	Dial func(network, address string) (net.Conn, error)
+
+	// When set, subscriptions that AcceptInsecure but have no keys
+	// (and so accept everything) are refused unless InsecureOK
+	StrictInsecure bool
+
+	// When set, Notify refuses values that aren't Elvin types rather
+	// than coercing them, see CoerceNotification
+	StrictTypes bool
+
+	// When set, Subscribe parses expressions before sending them,
+	// returning a *ParseError rather than waiting for the router's Nack
+	CheckExpressions bool
+
+	// The largest packet NotifyLarge sends, DefaultMaxPacketSize if zero
+	MaxPacketSize int
+
+	// Optional, buffered. Non-fatal protocol anomalies are reported
+	// here. If it's full they're only logged.
+	AnomalyChannel chan Anomaly
+
+	// When set, a ConnRequest Nacked as an incompatible protocol
+	// version is retried with the next lower minor version, down to
+	// MinVersionMinor
+	Downgrade       bool
+	MinVersionMinor uint32
+
+	// Reconnect-aware publishing. While reconnecting Notify queues up
+	// to PublishQueue notifications to send once reconnected or, if
+	// that's zero, waits up to PublishWait for the reconnection.
+	// Otherwise it fails as not connected. Queued notifications are
+	// lost if reconnection fails.
+	PublishQueue int
+	PublishWait  time.Duration
+
+	// What Subscribe and Notify do while not connected, see
+	// OfflineFailFast (the default) and OfflineQueue
+	OfflinePolicy int
+
+	// When set, ask the router for credit based flow control
+	// allowing this many notifications in flight. The router may
+	// grant fewer. Sending notifications pauses while we're out of
+	// credit, other packets pass up to a window's worth held back.
+	CreditWindow int32
+
+	// When set, Notify stamps each notification with an increasing
+	// SequenceAttribute, counted per value of SequenceKey if that's
+	// set, otherwise per client
+	Sequence    bool
+	SequenceKey string
+
+	// Handling of subscriptions Equal to an existing one, see DedupOff
+	DedupSubscriptions int
+
+	// When set, a connection idle this long is checked with a
+	// TestConn and closed if there's no reply within KeepaliveTimeout.
+	// Values the router gives in its ConnReply take precedence, see
+	// Keepalive.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
 	// Private
+	stats          ClientStats
+	busyUntil      int64           // atomic, UnixNano, see Busy
+	resumed        int32           // atomic, see Resumed
+	sessionToken   string          // from the ConnReply, see SessionToken
+	connectionID   string          // from the ConnReply, see ConnectionID
+	subQuota       int             // see SubscriptionQuotaRemaining
+	wantMarshal    string          // see WithMarshal
+	marshal        string          // see EffectiveMarshal
+	reconnecting   int32           // atomic, set during reconnect
+	reconnected    chan struct{}   // closed when a reconnect finishes
+	stopReconnect  chan struct{}   // closed by Disconnect to cancel a reconnect
+	disconnected   int32           // atomic, set by Disconnect until Connect or Reconnect
+	pending        []*bytes.Buffer // notifications queued during reconnect
+	queued         []*Subscription // subscriptions held while offline
+	sequences      sequences       // see Sequence
+	credits        credits         // see CreditWindow
+	keepalive      keepalive       // see KeepaliveInterval
+	versionMajor   uint32          // negotiated protocol version
+	versionMinor   uint32
+	tracing        int32 // atomic, see SetTracing
 	reader         io.Reader
 	writer         io.Writer
 	closer         io.Closer
@@ -59,14 +157,17 @@ type Client struct {
 	writeChannel   chan *bytes.Buffer
 	readTerminate  chan int
 	writeTerminate chan int
+	writerDone     chan struct{} // closed as the write handler exits
 	mu             sync.Mutex
 	wg             sync.WaitGroup
 
 	// Maps of all current subscriptions used for mapping
 	// NotifyDelivers and for maintaining subscriptions across
 	// reconnection
-	subReplies    map[uint32]*Subscription // map SubAdd/Mod/Del/Nack
-	subscriptions map[int64]*Subscription  // All our subscriptions
+	subReplies    map[uint32]*Subscription      // map SubAdd/Mod/Del/Nack
+	subscriptions map[int64]*Subscription       // All our subscriptions
+	abandoned     map[uint32]bool               // XIDs given up on, true if a late reply's subscription or quench must be deleted
+	settlers      map[uint32]func(Packet) error // XIDs given up on whose late reply still updates local state
 
 	// Maps of all current quenches used for mapping quench
 	// Notifications and for maintaining quenches across
@@ -79,6 +180,16 @@ type Client struct {
 	connXID     uint32      // XID of any outstanding connrqst
 	disconnXID  uint32      // XID of any outstanding disconnrqst
 	confConn    chan bool   // signal testConn complete
+
+	// Connection key changes
+	secMu      sync.Mutex  // one SecRequest at a time
+	secReplies chan Packet // receive SecReply
+	secXID     uint32      // XID of any outstanding SecRequest
+
+	// Match count queries
+	matchMu      sync.Mutex  // one MatchCountRequest at a time
+	matchReplies chan Packet // receive MatchCountReply
+	matchXID     uint32      // XID of any outstanding MatchCountRequest
 }
 
 // FIXME: define and maybe make configurable?
@@ -86,6 +197,8 @@ const ConnectTimeout = (10 * time.Second)
 const DisconnectTimeout = (10 * time.Second)
 const SubscriptionTimeout = (10 * time.Second)
 const QuenchTimeout = (10 * time.Second)
+const SecurityTimeout = (10 * time.Second)
+const MatchCountTimeout = (10 * time.Second)
 const TestConnTimeout = (10 * time.Second)
 
 // Transaction IDs on packets
@@ -119,11 +232,185 @@ func (client *Client) SetState(val uint32) {
 type Subscription struct {
 	Expression     string                      // Subscription Expression
 	AcceptInsecure bool                        // Do we accept notifications with no security keys
+	InsecureOK     bool                        // Allow AcceptInsecure without Keys under StrictInsecure
 	Keys           KeyBlock                    // Keys for this subscriptions
 	Notifications  chan map[string]interface{} // Notifications delivered on this channel
 
-	subID  int64       // private id
-	events chan Packet // synchronous replies
+	// Typed delivery. When a Decoder is set the value of the Payload
+	// attribute is decoded and delivered on Typed instead. If the
+	// payload is missing or fails to decode the map is delivered on
+	// Notifications as usual.
+	Payload string           // Name of the opaque payload attribute
+	Decoder Decoder          // Payload decoder
+	Typed   chan interface{} // Decoded notifications delivered on this channel
+
+	// When set, notifications are delivered here along with how
+	// they matched instead of on Notifications or Typed
+	Deliveries chan Delivery
+
+	// When set, notifications are delivered here as name/value
+	// pairs in the order they arrived on the wire instead of on
+	// Notifications, Typed or Deliveries
+	Ordered chan []NameValuePair
+
+	// When set, a consumer that falls behind is only delivered the
+	// latest notification for each value of this attribute
+	CoalesceKey string
+
+	// When set, gaps in SequenceAttribute are reported on the
+	// client's AnomalyChannel
+	Sequence *SequenceTracker
+
+	// Delivery options, only accepted by routers that understand
+	// SubAddOptionsRequest. When MaxNotificationSize is positive the
+	// router withholds notifications whose encoded attributes are
+	// larger than that many bytes. When Projection is set only those
+	// attributes are delivered.
+	MaxNotificationSize int
+	Projection          []string
+
+	// When Reliable is set the router buffers each delivery until
+	// it's acked, redelivering it if the ack doesn't arrive in time.
+	// Deliveries are acked once they're handed over on the
+	// subscription's channel unless ManualAck is set, in which case
+	// the caller acks them with Client.Ack.
+	Reliable  bool
+	ManualAck bool
+
+	// Close the delivery channels once SubscriptionDelete succeeds,
+	// so consumers ranging over them finish. They mustn't be shared
+	// with another subscription, or subscribed again.
+	CloseOnDelete bool
+
+	subID     int64       // private id
+	events    chan Packet // synchronous replies
+	coalescer *coalescer  // set up by Subscribe if CoalesceKey is set
+	paused    int32       // atomic, see SubscriptionPause
+
+	// See lifecycle.go
+	life    sync.RWMutex  // held by senders, see send
+	retired int32         // atomic, set once deleted
+	halting sync.Mutex    // guards stop and halted
+	stop    chan struct{} // closed to abandon sends
+	halted  bool
+
+	// See WaitEstablished
+	establish    sync.Mutex
+	established  chan struct{} // closed once the latest SubAddRequest settles
+	settled      bool
+	establishErr error
+}
+
+// Kinds of non-fatal protocol anomaly
+const (
+	AnomalyUnexpectedPacket      = iota // A packet not valid in our state
+	AnomalyUnknownXID                   // A reply to no outstanding request
+	AnomalyDropWarn                     // The router dropped packets for us
+	AnomalySequenceGap                  // A subscription missed sequence numbers
+	AnomalyDuplicateSubscription        // A subscription duplicated an existing one
+	AnomalyRouterBusy                   // The router dropped a notification as it's overloaded
+	AnomalySubscriptionRemoved          // The router removed a subscription
+)
+
+// A non-fatal protocol anomaly seen on the read path
+type Anomaly struct {
+	Type        int
+	Description string
+}
+
+func (anomaly Anomaly) String() string {
+	return anomaly.Description
+}
+
+// Log and report an anomaly if anyone is listening
+func (client *Client) anomaly(kind int, format string, args ...interface{}) {
+	description := fmt.Sprintf(format, args...)
+	client.elog.Logf(elog.LogLevelInfo1, "Anomaly: %s", description)
+	if client.AnomalyChannel != nil {
+		select {
+		case client.AnomalyChannel <- Anomaly{kind, description}:
+		default:
+		}
+	}
+}
+
+// A notification with details of how it matched a subscription
+type Delivery struct {
+	NameValue map[string]interface{}
+	Secure    bool // Delivered because of a key match
+	Key       Key  // The subscription or connection key that matched
+}
+
+// A Decoder converts a notification's opaque payload into a typed value
+type Decoder func(payload []byte) (interface{}, error)
+
+// Types that can unmarshal themselves from a byte slice, such as
+// generated protocol buffer messages.
+type Unmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Return a Decoder that unmarshals each payload into a new value of
+// the same type as msg, which must be a pointer.
+func UnmarshalDecoder(msg Unmarshaler) Decoder {
+	t := reflect.TypeOf(msg).Elem()
+	return func(payload []byte) (interface{}, error) {
+		m := reflect.New(t).Interface().(Unmarshaler)
+		if err := m.Unmarshal(payload); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// The router's id for this subscription, zero until subscribed
+func (sub *Subscription) SubID() int64 {
+	return sub.subID
+}
+
+// Deliver a notification to a subscription, decoding it if the
+// subscription is typed
+func (sub *Subscription) deliver(nv map[string]interface{}, secure bool, key Key) {
+	if sub.Deliveries != nil {
+		sub.send(func(stop <-chan struct{}) {
+			select {
+			case sub.Deliveries <- Delivery{nv, secure, key}:
+			case <-stop:
+			}
+		})
+		return
+	}
+	if sub.coalescer != nil {
+		sub.coalescer.put(nv)
+		return
+	}
+	sub.deliverNow(nv, nil)
+}
+
+// Deliver a notification on Typed or Notifications, blocking until
+// it's read, the subscription is deleted or abandon is closed
+func (sub *Subscription) deliverNow(nv map[string]interface{}, abandon <-chan bool) {
+	if sub.Decoder != nil && sub.Typed != nil {
+		if payload, ok := nv[sub.Payload].([]byte); ok {
+			if v, err := sub.Decoder(payload); err == nil {
+				sub.send(func(stop <-chan struct{}) {
+					select {
+					case sub.Typed <- v:
+					case <-stop:
+					case <-abandon:
+					}
+				})
+				return
+			}
+		}
+	}
+	sub.send(func(stop <-chan struct{}) {
+		select {
+		case sub.Notifications <- nv:
+		case <-stop:
+		case <-abandon:
+		}
+	})
 }
 
 func (sub *Subscription) addKeys(keys KeyBlock) {
@@ -144,6 +431,8 @@ type QuenchNotification struct {
 // The Quench type used by clients.
 type Quench struct {
 	Names           map[string]bool         // Quench terms
+	All             bool                    // Quench every subscription change, ignoring Names
+	NotifySelf      bool                    // Include changes to our own subscriptions
 	DeliverInsecure bool                    // Deliver with no security keys?
 	Keys            KeyBlock                // Keys for this quench
 	Notifications   chan QuenchNotification // Sub{Add|Del|Mod}Notify delivers
@@ -151,6 +440,11 @@ type Quench struct {
 	events          chan Packet             // synchronous replies
 }
 
+// The router's id for this quench, zero until quenched
+func (quench *Quench) QuenchID() int64 {
+	return quench.quenchID
+}
+
 func (quench *Quench) addKeys(keys KeyBlock) {
 	// FIXME: implement
 	return
@@ -161,6 +455,42 @@ func (quench *Quench) delKeys(keys KeyBlock) {
 	return
 }
 
+// Client statistics
+type ClientStats struct {
+	ReconnectAttempts uint64 // Reconnection attempts
+	Reconnects        uint64 // Successful reconnections
+	WriteQueueDepth   int    // Writes queued for the connection
+}
+
+// Return a snapshot of the client's statistics
+func (client *Client) Stats() ClientStats {
+	var stats ClientStats
+	stats.ReconnectAttempts = atomic.LoadUint64(&client.stats.ReconnectAttempts)
+	stats.Reconnects = atomic.LoadUint64(&client.stats.Reconnects)
+	stats.WriteQueueDepth = client.WriteQueueDepth()
+	return stats
+}
+
+// Buffer up to size writes to the connection so callers aren't held
+// up by a slow link. Unbuffered by default and may only be changed
+// while the client is closed.
+func (client *Client) SetWriteQueueSize(size int) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.State() != StateClosed {
+		return LocalError(ErrorsClientIsConnected)
+	}
+	client.writeChannel = make(chan *bytes.Buffer, size)
+	return nil
+}
+
+// The number of writes queued for the connection, including
+// notifications waiting for credit. A queue that stays full means
+// we're producing faster than the link can carry.
+func (client *Client) WriteQueueDepth() int {
+	return len(client.writeChannel) + int(atomic.LoadInt32(&client.credits.held))
+}
+
 // Create a new client.
 // Using new(Client) will not result in proper initialization
 func NewClient(url string, options map[string]interface{}, keysNfn KeyBlock, keysSub KeyBlock) (conn *Client) {
@@ -174,13 +504,19 @@ func NewClient(url string, options map[string]interface{}, keysNfn KeyBlock, key
 	client.writeTerminate = make(chan int)
 	client.subscriptions = make(map[int64]*Subscription)
 	client.quenches = make(map[int64]*Quench)
+	client.subQuota = -1
 	// Sync Packets
-	client.connReplies = make(chan Packet)
+	client.connReplies = make(chan Packet, 1)
+	client.secReplies = make(chan Packet, 1)
+	client.matchReplies = make(chan Packet, 1)
 	client.subReplies = make(map[uint32]*Subscription)
 	client.quenchReplies = make(map[uint32]*Quench)
+	client.abandoned = make(map[uint32]bool)
+	client.settlers = make(map[uint32]func(Packet) error)
 	// Async Events (Disconn, ECONN, DropWarn, Protocol, ConfConn etc)
 	client.Events = make(chan Packet)
 	client.confConn = make(chan bool)
+	client.keepalive.reset = make(chan struct{}, 1)
 	return client
 }
 
@@ -213,6 +549,20 @@ func (client *Client) SetLogDateFormat(format int) {
 	client.elog.SetLogDateFormat(format)
 }
 
+// Trace every packet sent and received, logged at LogLevelDebug1
+func (client *Client) SetTracing(tracing bool) {
+	var on int32
+	if tracing {
+		on = 1
+	}
+	atomic.StoreInt32(&client.tracing, on)
+}
+
+// Are packets being traced?
+func (client *Client) Tracing() bool {
+	return atomic.LoadInt32(&client.tracing) != 0
+}
+
 // Connect this client
 // Note this is not thread safe and hence not public
 // Client's should call Unotify() or Connect()
@@ -223,21 +573,38 @@ func (client *Client) open() (err error) {
 		return err
 	}
 
-	conn, err := net.Dial("tcp", protocol.Address)
+	dial := net.Dial
+	if client.Dial != nil {
+		dial = client.Dial
+	}
+	conn, err := dial("tcp", protocol.Address)
 	if err != nil {
 		return err
 	}
+	if err = client.Socket.Apply(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	client.attach(conn)
+
+	return nil
+}
+
+// Use an established connection and start the handlers
+func (client *Client) attach(conn io.ReadWriteCloser) {
 	client.SetState(StateOpen)
 
 	client.reader = conn
 	client.writer = conn
 	client.closer = conn
+	client.touch()
 
+	done := make(chan struct{})
+	client.writerDone = done
 	client.wg.Add(2)
 	go client.readHandler()
-	go client.writeHandler()
-
-	return nil
+	go client.writeHandler(done)
+	go client.checkIdle(conn, done)
 }
 
 // This closes a client's sockets/endpoints and cleans state
@@ -246,23 +613,52 @@ func (client *Client) open() (err error) {
 // so it can be re-established on re-connection
 func (client *Client) close() {
 	client.mu.Lock()
+	client.shut()
+	client.mu.Unlock()
+	client.wg.Wait() // Wait for reader and writer to finish
+}
+
+// Close the connection a write handler served as it exits, unless
+// it's already been closed and replaced by a new one
+func (client *Client) writerExited(done chan struct{}) {
+	client.mu.Lock()
+	if client.writerDone != done {
+		client.mu.Unlock()
+		return
+	}
+	client.shut()
+	client.mu.Unlock()
+	client.wg.Wait()
+}
+
+// The work of close. Called with client.mu held.
+func (client *Client) shut() {
 	client.SetState(StateClosed)
+	// Closing the socket stops a write in progress, but a write
+	// handler that's idle must be told, as must one waiting for
+	// credit, or wg.Wait never returns
+	client.closer.Close()
 	select {
-	case client.writeTerminate <- 1: // Will close the socket
-	default:
-		client.closer.Close()
+	case client.writeTerminate <- 1:
+	case <-client.writerDone:
 	}
 	// client.readTerminate <- 1
 	client.subReplies = make(map[uint32]*Subscription)
 	client.quenchReplies = make(map[uint32]*Quench)
+	client.abandoned = make(map[uint32]bool)
+	client.settlers = make(map[uint32]func(Packet) error)
 	client.connXID = 0
 	client.disconnXID = 0
-	client.mu.Unlock()
-	client.wg.Wait() // Wait for reader and writer to finish
 }
 
 // Connect this client
 func (client *Client) Connect() (err error) {
+	atomic.StoreInt32(&client.disconnected, 0)
+	return client.connect()
+}
+
+// Connect without clearing a Disconnect, as reconnecting does
+func (client *Client) connect() (err error) {
 
 	client.mu.Lock()
 	// log.Printf("connect:%s, %d", client.Endpoint, client.State())
@@ -280,13 +676,150 @@ func (client *Client) Connect() (err error) {
 		return LocalError(ErrorsClientIsConnected)
 	}
 
+	return client.connected(client.handshake())
+}
+
+// Send anything held while offline once a Connect succeeds. During
+// a reconnection that waits until subscriptions are restored.
+func (client *Client) connected(err error) error {
+	if err == nil && atomic.LoadInt32(&client.reconnecting) == 0 {
+		client.flushQueued()
+	}
+	return err
+}
+
+// Connect this client over an already established connection
+// (e.g. through a tunnel or with custom dial options) rather than
+// dialing the client's URL. Note that reconnection will dial the URL.
+func (client *Client) ConnectOver(conn io.ReadWriteCloser) (err error) {
+
+	client.mu.Lock()
+
+	if client.State() != StateClosed {
+		client.mu.Unlock()
+		return LocalError(ErrorsClientIsConnected)
+	}
+	client.attach(conn)
+
+	return client.connected(client.handshake())
+}
+
+// Send a ConnRequest and await the reply, downgrading the protocol
+// version if allowed. Called with client.mu held which is released
+func (client *Client) handshake() (err error) {
 	client.SetState(StateConnecting)
+	minor := ProtocolVersionMinor()
+	for {
+		var nack *Nack
+		nack, err = client.connRequest(ProtocolVersionMajor(), minor)
+		if nack == nil || nack.ErrorCode != ErrorsProtocolIncompatible ||
+			!client.Downgrade || minor <= client.MinVersionMinor {
+			return err
+		}
+		minor--
+		client.elog.Logf(elog.LogLevelInfo1, "Downgrading to protocol version %d.%d", ProtocolVersionMajor(), minor)
+		client.mu.Lock()
+		client.SetState(StateConnecting)
+	}
+}
+
+// The protocol version agreed with the router by the last Connect
+func (client *Client) NegotiatedVersion() (major uint32, minor uint32) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.versionMajor, client.versionMinor
+}
+
+// Did the router resume the session named by SessionOption on the
+// last Connect? If so, subscribing again with the same expressions
+// delivers the notifications they missed.
+func (client *Client) Resumed() bool {
+	return atomic.LoadInt32(&client.resumed) != 0
+}
+
+// The secret the router gave in its last ConnReply for the session
+// named by SessionOption, or "" if it gave none. Reconnecting sends it
+// back to resume the session. A new Client resumes it only if this is
+// passed in its Options as SessionTokenOption.
+func (client *Client) SessionToken() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.sessionToken
+}
+
+// The ID the router gave this connection in its last ConnReply, for
+// matching it against the router's logs and admin interface, or "" if
+// it gave none.
+func (client *Client) ConnectionID() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.connectionID
+}
+
+// Ask the router for the named marshal in the ConnRequest, from the
+// next Connect on, returning the client so it can follow NewClient. ""
+// is the default. Only MarshalXDR is implemented, so for now any other
+// falls back to it, see EffectiveMarshal.
+func (client *Client) WithMarshal(marshal string) *Client {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.wantMarshal = marshal
+	return client
+}
+
+// The marshal the connection uses, which is MarshalXDR unless the
+// router agreed to another the client requested and implements, or ""
+// if it's not connected
+func (client *Client) EffectiveMarshal() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.State() != StateConnected {
+		return ""
+	}
+	return client.marshal
+}
+
+// How many more subscriptions the router will accept from this
+// connection, as it said in its ConnReply and counted down and up as
+// subscriptions are added and deleted, or -1 if it gave no quota
+func (client *Client) SubscriptionQuotaRemaining() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.subQuota
+}
+
+// Count a subscription added (-1) or deleted (+1) against the quota.
+// Called with client.mu held.
+func (client *Client) spendQuota(delta int) {
+	if client.subQuota >= 0 {
+		client.subQuota += delta
+	}
+}
+
+// Send one ConnRequest and await the reply, returning any Nack as
+// well as the error. Called with client.mu held which is released
+func (client *Client) connRequest(major uint32, minor uint32) (nack *Nack, err error) {
 	pkt := new(ConnRequest)
 	pkt.XID = XID()
 	client.connXID = pkt.XID
-	pkt.VersionMajor = ProtocolVersionMajor()
-	pkt.VersionMinor = ProtocolVersionMinor()
+	pkt.VersionMajor = major
+	pkt.VersionMinor = minor
 	pkt.Options = client.Options
+	if client.CreditWindow > 0 || len(client.sessionToken) > 0 || len(client.wantMarshal) > 0 {
+		pkt.Options = make(map[string]interface{})
+		for name, value := range client.Options {
+			pkt.Options[name] = value
+		}
+		if client.CreditWindow > 0 {
+			pkt.Options[CreditsOption] = client.CreditWindow
+		}
+		if len(client.sessionToken) > 0 {
+			pkt.Options[SessionTokenOption] = client.sessionToken
+		}
+		if len(client.wantMarshal) > 0 {
+			pkt.Options[MarshalOption] = client.wantMarshal
+		}
+	}
 	pkt.KeysNfn = client.KeysNfn
 	pkt.KeysSub = client.KeysSub
 
@@ -307,24 +840,67 @@ func (client *Client) Connect() (err error) {
 				err = LocalError(ErrorsMismatchedXIDs, pkt.XID, connReply.XID)
 			} else {
 				// FIXME: Options check/save?
+				client.mu.Lock()
+				client.versionMajor = major
+				client.versionMinor = minor
+				client.mu.Unlock()
+				window, _ := connReply.Options[CreditsGrantedOption].(int32)
+				client.setCredits(window)
+				client.setKeepalive(connReply.Options)
+				resumed, _ := connReply.Options[SessionResumedOption].(int32)
+				atomic.StoreInt32(&client.resumed, resumed)
+				connectionID, _ := connReply.Options[ConnectionIDOption].(string)
+				sessionToken, _ := connReply.Options[SessionTokenOption].(string)
+				client.mu.Lock()
+				client.connectionID = connectionID
+				client.sessionToken = sessionToken
+				client.subQuota = -1
+				if quota, ok := connReply.Options[SubscriptionQuotaOption].(int32); ok {
+					client.subQuota = int(quota)
+				}
+				client.marshal, _ = connReply.Options[MarshalOption].(string)
+				if !supportedMarshal(client.marshal) {
+					client.marshal = MarshalXDR
+				}
+				client.mu.Unlock()
 				client.SetState(StateConnected)
 			}
 		case *Nack:
 			client.SetState(StateClosed)
-			err = NackError(*reply.(*Nack))
+			nack = reply.(*Nack)
+			err = NackError(*nack)
 		default:
 			client.SetState(StateClosed)
 			err = LocalError(ErrorsBadPacket)
 		}
 	case <-time.After(ConnectTimeout):
 		err = LocalError(ErrorsTimeout)
+		client.close()
+		// Drop any reply that raced us
+		select {
+		case <-client.connReplies:
+		default:
+		}
 	}
 
-	return err
+	return nack, err
 }
 
-// Disonnect this client from it's endpoint
+// Disonnect this client from it's endpoint. Any reconnection under
+// way is cancelled first, and the connection isn't reconnected
+// automatically until Connect or Reconnect is called again.
 func (client *Client) Disconnect() (err error) {
+	atomic.StoreInt32(&client.disconnected, 1)
+	cancelled := client.cancelReconnect()
+
+	if client.State() != StateConnected && cancelled {
+		return nil
+	}
+	return client.disconnect()
+}
+
+// Disconnect without touching reconnection, as a failed reconnect does
+func (client *Client) disconnect() (err error) {
 
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
@@ -334,7 +910,9 @@ func (client *Client) Disconnect() (err error) {
 	// FIXME: in a generous world we might unsubscribe, unquench etc
 	pkt := new(DisconnRequest)
 	pkt.XID = XID()
+	client.mu.Lock()
 	client.disconnXID = pkt.XID
+	client.mu.Unlock()
 
 	writeBuf := new(bytes.Buffer)
 	pkt.Encode(writeBuf)
@@ -350,18 +928,21 @@ func (client *Client) Disconnect() (err error) {
 			if disconnReply.XID != pkt.XID {
 				err = LocalError(ErrorsMismatchedXIDs, pkt.XID, disconnReply.XID)
 			}
-			client.close()
-			return err
 		default:
-			// Didn't hear back, let the client deal with that
 			err = LocalError(ErrorsBadPacket)
-			return err
 		}
 
 	case <-time.After(DisconnectTimeout):
 		err = LocalError(ErrorsTimeout)
 	}
 
+	// We're going regardless, and leaving the connection open would
+	// leak its handlers
+	client.close()
+	select {
+	case <-client.connReplies:
+	default:
+	}
 	return err
 }
 
@@ -384,28 +965,339 @@ func (client *Client) TestConn() (err error) {
 
 }
 
-// Send a notification
-func (client *Client) Notify(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (err error) {
+// Add connection level keys for notifications (producer) and
+// subscriptions (consumer). The client's KeysNfn and KeysSub are kept
+// in sync with the router, and as they are sent in the ConnRequest
+// they are replayed on reconnection. If the client isn't connected
+// the keys are simply recorded for the next connection.
+func (client *Client) AddConnectionKeys(nfnKeys KeyBlock, subKeys KeyBlock) (err error) {
+	return client.connectionKeys(nfnKeys, nil, subKeys, nil)
+}
 
-	if client.State() != StateConnected {
-		return LocalError(ErrorsClientNotConnected)
+// Remove connection level keys, see AddConnectionKeys()
+func (client *Client) RemoveConnectionKeys(nfnKeys KeyBlock, subKeys KeyBlock) (err error) {
+	return client.connectionKeys(nil, nfnKeys, nil, subKeys)
+}
+
+func (client *Client) connectionKeys(addNfn, delNfn, addSub, delSub KeyBlock) (err error) {
+	client.secMu.Lock()
+	defer client.secMu.Unlock()
+
+	if client.State() == StateConnected {
+		pkt := new(SecRequest)
+		pkt.AddNfnKeys = addNfn
+		pkt.DelNfnKeys = delNfn
+		pkt.AddSubKeys = addSub
+		pkt.DelSubKeys = delSub
+
+		writeBuf := new(bytes.Buffer)
+		client.mu.Lock()
+		client.secXID = pkt.Encode(writeBuf)
+		client.mu.Unlock()
+
+		client.writeChannel <- writeBuf
+
+		select {
+		case reply := <-client.secReplies:
+			switch reply.(type) {
+			case *SecReply:
+			case *Nack:
+				err = NackError(*reply.(*Nack))
+			default:
+				err = LocalError(ErrorsBadPacket)
+			}
+		case <-time.After(SecurityTimeout):
+			err = LocalError(ErrorsTimeout)
+		}
+
+		client.mu.Lock()
+		client.secXID = 0
+		client.mu.Unlock()
+		if err != nil {
+			return err
+		}
 	}
 
-	pkt := new(NotifyEmit)
-	pkt.NameValue = nv
-	pkt.Keys = keys
-	pkt.DeliverInsecure = deliverInsecure
+	// Track the keys so they're sent on reconnection
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.KeysNfn == nil {
+		client.KeysNfn = make(KeyBlock)
+	}
+	if client.KeysSub == nil {
+		client.KeysSub = make(KeyBlock)
+	}
+	KeyBlockAddKeys(client.KeysNfn, copyKeyBlock(addNfn))
+	KeyBlockDeleteKeys(client.KeysNfn, delNfn)
+	KeyBlockAddKeys(client.KeysSub, copyKeyBlock(addSub))
+	KeyBlockDeleteKeys(client.KeysSub, delSub)
+
+	return nil
+}
+
+// How many subscriptions at the router currently share an attribute
+// name with expr, or all of them if expr is empty. Unlike a quench
+// this is a one off count rather than a stream of changes.
+func (client *Client) MatchCount(expr string) (count int, err error) {
+	return client.matchCount(&MatchCountRequest{Expression: expr})
+}
+
+// How many subscriptions at the router would currently be delivered
+// the notification, were it sent with deliverInsecure and keys
+func (client *Client) MatchCountNotification(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (count int, err error) {
+	return client.matchCount(&MatchCountRequest{NameValue: nv, DeliverInsecure: deliverInsecure, Keys: keys})
+}
 
+func (client *Client) matchCount(pkt *MatchCountRequest) (count int, err error) {
+	client.matchMu.Lock()
+	defer client.matchMu.Unlock()
+
+	if client.State() != StateConnected {
+		return 0, LocalError(ErrorsClientNotConnected)
+	}
+
+	pkt.XID = XID()
 	writeBuf := new(bytes.Buffer)
 	pkt.Encode(writeBuf)
+	client.mu.Lock()
+	client.matchXID = pkt.XID
+	client.mu.Unlock()
+
 	client.writeChannel <- writeBuf
 
-	return nil
+	select {
+	case reply := <-client.matchReplies:
+		switch reply.(type) {
+		case *MatchCountReply:
+			count = int(reply.(*MatchCountReply).Count)
+		case *Nack:
+			err = NackError(*reply.(*Nack))
+		default:
+			err = LocalError(ErrorsBadPacket)
+		}
+	case <-time.After(MatchCountTimeout):
+		err = LocalError(ErrorsTimeout)
+	}
+
+	client.mu.Lock()
+	client.matchXID = 0
+	client.mu.Unlock()
+	// Drop any reply that raced the timeout
+	select {
+	case <-client.matchReplies:
+	default:
+	}
+	return count, err
+}
+
+// Copy a KeyBlock so we don't share the caller's slices
+func copyKeyBlock(keys KeyBlock) KeyBlock {
+	copied := make(KeyBlock)
+	for scheme, ksl := range keys {
+		for _, ks := range ksl {
+			copied[scheme] = append(copied[scheme], append(KeySet(nil), ks...))
+		}
+	}
+	return copied
+}
+
+// Send a notification
+func (client *Client) Notify(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (err error) {
+
+	if client.offline() {
+		return LocalError(ErrorsClientNotConnected)
+	}
+	if err = client.backingOff(); err != nil {
+		return err
+	}
+
+	if nv, err = client.prepareNotification(nv); err != nil {
+		return err
+	}
+	return client.emit(nv, nil, deliverInsecure, keys)
+}
+
+// Send a notification whose attributes reach Ordered subscriptions in
+// the order given. A repeated name keeps its first place and last value.
+func (client *Client) NotifyOrdered(pairs []NameValuePair, deliverInsecure bool, keys KeyBlock) (err error) {
+
+	if client.offline() {
+		return LocalError(ErrorsClientNotConnected)
+	}
+	if err = client.backingOff(); err != nil {
+		return err
+	}
+
+	nv := make(map[string]interface{}, len(pairs))
+	order := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if _, dup := nv[pair.Name]; !dup {
+			order = append(order, pair.Name)
+		}
+		nv[pair.Name] = pair.Value
+	}
+	if nv, err = client.prepareNotification(nv); err != nil {
+		return err
+	}
+	return client.emit(nv, order, deliverInsecure, keys)
+}
+
+// Check a notification can be sent, returning it with its values
+// coerced to Elvin types unless StrictTypes is set
+func (client *Client) prepareNotification(nv map[string]interface{}) (map[string]interface{}, error) {
+	if client.StrictTypes {
+		for name, value := range nv {
+			if NotificationType(value) == NotificationReserved {
+				return nil, LocalError(ErrorsBadAttributeType, name, fmt.Sprintf("%T", value))
+			}
+		}
+	} else {
+		var err error
+		if nv, err = CoerceNotification(nv); err != nil {
+			return nil, err
+		}
+	}
+	if client.Schema != nil {
+		if err := client.Schema.Validate(nv); err != nil {
+			return nil, err
+		}
+	}
+	return nv, nil
+}
+
+// Encode and send a validated notification
+func (client *Client) emit(nv map[string]interface{}, order []string, deliverInsecure bool, keys KeyBlock) error {
+	send := func(nv map[string]interface{}) error {
+		pkt := new(NotifyEmit)
+		pkt.NameValue = nv
+		pkt.Keys = keys
+		pkt.DeliverInsecure = deliverInsecure
+		pkt.Order = order
+
+		writeBuf := new(bytes.Buffer)
+		pkt.Encode(writeBuf)
+		return client.publish(writeBuf)
+	}
+	if client.Sequence {
+		return client.sendSequenced(nv, send)
+	}
+	return send(nv)
+}
+
+// Send an encoded notification, riding out any reconnection as
+// configured by PublishQueue and PublishWait
+func (client *Client) publish(writeBuf *bytes.Buffer) error {
+	if client.State() == StateConnected && atomic.LoadInt32(&client.reconnecting) == 0 {
+		client.writeChannel <- writeBuf
+		return nil
+	}
+
+	// Once reconnected a notification still queues until those
+	// queued before it have been sent
+	client.mu.Lock()
+	queueing := client.PublishQueue > 0 || client.OfflinePolicy == OfflineQueue
+	if client.State() == StateConnected && (atomic.LoadInt32(&client.reconnecting) == 0 || !queueing) {
+		client.mu.Unlock()
+		client.writeChannel <- writeBuf
+		return nil
+	}
+	if atomic.LoadInt32(&client.reconnecting) == 0 && client.OfflinePolicy != OfflineQueue {
+		client.mu.Unlock()
+		return LocalError(ErrorsClientNotConnected)
+	}
+	if queueing {
+		defer client.mu.Unlock()
+		if client.PublishQueue > 0 && len(client.pending) >= client.PublishQueue {
+			return LocalError(ErrorsPublishQueueFull)
+		}
+		client.pending = append(client.pending, writeBuf)
+		return nil
+	}
+	reconnected := client.reconnected
+	client.mu.Unlock()
+
+	if client.PublishWait > 0 {
+		select {
+		case <-reconnected:
+			if client.State() == StateConnected {
+				client.writeChannel <- writeBuf
+				return nil
+			}
+		case <-time.After(client.PublishWait):
+			return LocalError(ErrorsTimeout)
+		}
+	}
+	return LocalError(ErrorsClientNotConnected)
+}
+
+// Note we're reconnecting so Notify can hold on to notifications
+// unless Disconnect has been called since
+func (client *Client) startReconnecting() (stop chan struct{}, err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if atomic.LoadInt32(&client.disconnected) != 0 {
+		return nil, LocalError(ErrorsReconnectCancelled)
+	}
+	client.reconnected = make(chan struct{})
+	client.stopReconnect = make(chan struct{})
+	atomic.StoreInt32(&client.reconnecting, 1)
+	return client.stopReconnect, nil
+}
+
+// Cancel any reconnection, returning once it's finished. Returns
+// true if there was one.
+func (client *Client) cancelReconnect() bool {
+	client.mu.Lock()
+	if atomic.LoadInt32(&client.reconnecting) == 0 {
+		client.mu.Unlock()
+		return false
+	}
+	stop, reconnected := client.stopReconnect, client.reconnected
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	client.mu.Unlock()
+	<-reconnected
+	return true
+}
+
+// Send anything queued while reconnecting, or unless OfflineQueue
+// drop it if we failed, and wake anyone waiting. Notify keeps
+// queueing until the queue's empty so nothing overtakes it.
+func (client *Client) stopReconnecting() {
+	if client.State() == StateConnected {
+		client.flushQueued()
+	}
+
+	client.mu.Lock()
+	for client.State() == StateConnected && len(client.pending) > 0 {
+		pending := client.pending
+		client.pending = nil
+		client.mu.Unlock()
+		for _, writeBuf := range pending {
+			client.writeChannel <- writeBuf
+		}
+		client.mu.Lock()
+	}
+	atomic.StoreInt32(&client.reconnecting, 0)
+	close(client.reconnected)
+	if client.State() != StateConnected && client.OfflinePolicy != OfflineQueue {
+		client.pending = nil
+	}
+	client.mu.Unlock()
 }
 
 // Send a notification
 func (client *Client) UNotify(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (err error) {
 
+	if client.Schema != nil {
+		if err = client.Schema.Validate(nv); err != nil {
+			return err
+		}
+	}
+
 	switch client.State() {
 	case StateClosed:
 		if err = client.open(); err != nil {
@@ -444,20 +1336,68 @@ func (client *Client) UNotify(nv map[string]interface{}, deliverInsecure bool, k
 
 // Subscribe this client to the subscription
 func (client *Client) Subscribe(sub *Subscription) (err error) {
+	return client.SubscribeContext(context.Background(), sub)
+}
 
-	if client.State() != StateConnected {
+// As Subscribe but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) SubscribeContext(ctx context.Context, sub *Subscription) (err error) {
+
+	if sub == nil {
+		return LocalError(ErrorsNilSubscription)
+	}
+	if len(strings.TrimSpace(sub.Expression)) == 0 {
+		return LocalError(ErrorsEmptyExpression)
+	}
+	if client.CheckExpressions {
+		if _, err = ParseSubscription(sub.Expression); err != nil {
+			return err
+		}
+	}
+	if client.State() != StateConnected && client.OfflinePolicy != OfflineQueue {
 		return LocalError(ErrorsClientNotConnected)
 	}
+	if client.StrictInsecure && sub.AcceptInsecure && !sub.InsecureOK && KeyBlockEmpty(sub.Keys) {
+		return LocalError(ErrorsInsecureSubscription)
+	}
+	if err = client.dedupSubscription(sub); err != nil {
+		return err
+	}
+	if client.OfflinePolicy == OfflineQueue && client.queueSubscription(sub) {
+		return nil
+	}
+	sub.establishing()
 
 	pkt := new(SubAddRequest)
 	pkt.Expression = sub.Expression
 	pkt.AcceptInsecure = sub.AcceptInsecure
 	pkt.Keys = sub.Keys
 
-	sub.events = make(chan Packet)
+	client.mu.Lock()
+	sub.subID = 0 // assigned by the reply
+	client.mu.Unlock()
+	sub.events = make(chan Packet, 1)
+	sub.resume()
+	coalescing := len(sub.CoalesceKey) > 0 && sub.coalescer == nil
+	if coalescing {
+		sub.coalescer = newCoalescer(sub.CoalesceKey, sub.deliverNow)
+	}
 
 	writeBuf := new(bytes.Buffer)
-	xID := pkt.Encode(writeBuf)
+	var xID uint32
+	if sub.MaxNotificationSize > 0 || len(sub.Projection) > 0 || sub.Reliable {
+		optioned := &SubAddOptionsRequest{
+			Expression:     pkt.Expression,
+			AcceptInsecure: pkt.AcceptInsecure,
+			Keys:           pkt.Keys,
+			MaxSize:        int32(sub.MaxNotificationSize),
+			Projection:     sub.Projection,
+			Reliable:       sub.Reliable,
+		}
+		xID = optioned.Encode(writeBuf)
+	} else {
+		xID = pkt.Encode(writeBuf)
+	}
 
 	// Map the XID back to this request along with the notifications
 	client.mu.Lock()
@@ -473,37 +1413,103 @@ func (client *Client) Subscribe(sub *Subscription) (err error) {
 		case *SubReply:
 			subReply := reply.(*SubReply)
 			// Track the subscription id
-			sub.subID = subReply.SubID
 			client.mu.Lock()
+			sub.subID = subReply.SubID
 			client.subscriptions[sub.subID] = sub
+			client.spendQuota(-1)
 			client.mu.Unlock()
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
 
+	case <-ctx.Done():
+		err = ctx.Err()
+
 	case <-time.After(SubscriptionTimeout):
 		err = LocalError(ErrorsTimeout)
 	}
 
 	client.mu.Lock()
 	delete(client.subReplies, xID)
+	var subDel *bytes.Buffer
+	if err != nil {
+		subDel = client.abandonSubscribe(xID, sub)
+	}
 	client.mu.Unlock()
+	if subDel != nil {
+		client.writeChannel <- subDel
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-sub.events:
+	default:
+	}
+
+	// Nothing will be delivered so don't leave a coalescer running
+	if err != nil && coalescing {
+		sub.coalescer.stop()
+		sub.coalescer = nil
+	}
 
+	sub.settle(err)
 	return err
 }
 
+// Give up on a subscribe whose reply we didn't take. A SubReply that
+// raced us, or that arrives later, is answered with a SubDelRequest
+// so the router doesn't keep a subscription nobody owns. Returns a
+// request to send. Called with client.mu held.
+func (client *Client) abandonSubscribe(xID uint32, sub *Subscription) *bytes.Buffer {
+	if sub.subID != 0 {
+		delete(client.subscriptions, sub.subID)
+		subDel := client.orphanSubDel(sub.subID)
+		sub.subID = 0
+		return subDel
+	}
+	select {
+	case reply := <-sub.events:
+		if _, ok := reply.(*Nack); ok {
+			return nil // The router didn't subscribe
+		}
+	default:
+	}
+	client.abandoned[xID] = true
+	return nil
+}
+
+// Encode a SubDelRequest for a subscription nobody owns, noting its
+// reply is to be ignored. Called with client.mu held.
+func (client *Client) orphanSubDel(subID int64) *bytes.Buffer {
+	pkt := &SubDelRequest{SubID: subID}
+	writeBuf := new(bytes.Buffer)
+	client.abandoned[pkt.Encode(writeBuf)] = false
+	return writeBuf
+}
+
 // Modify a subscription
 // If the expression is empty ("") it will remain unchanged
 // Similarly the keysets to add and delete may be empty. It is not an
 // error if the added keys already exist or to delete keys that do not
 // already exist
 func (client *Client) SubscriptionModify(sub *Subscription, expr string, acceptInsecure bool, AddKeys KeyBlock, DelKeys KeyBlock) (err error) {
+	return client.SubscriptionModifyContext(context.Background(), sub, expr, acceptInsecure, AddKeys, DelKeys)
+}
+
+// As SubscriptionModify but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) SubscriptionModifyContext(ctx context.Context, sub *Subscription, expr string, acceptInsecure bool, AddKeys KeyBlock, DelKeys KeyBlock) (err error) {
 
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
+	if client.StrictInsecure && acceptInsecure && !sub.InsecureOK && KeyBlockEmpty(sub.Keys) && KeyBlockEmpty(AddKeys) {
+		return LocalError(ErrorsInsecureSubscription)
+	}
 
 	pkt := new(SubModRequest)
 	pkt.SubID = sub.subID
@@ -522,15 +1528,16 @@ func (client *Client) SubscriptionModify(sub *Subscription, expr string, acceptI
 
 	client.writeChannel <- writeBuf
 
-	// Wait for the reply
-	select {
-	case reply := <-sub.events:
+	// Apply the router's reply, whenever it arrives
+	settle := func(reply Packet) (err error) {
 		switch reply.(type) {
 		case *SubReply:
 			subReply := reply.(*SubReply)
-			// Check the subscription id
+			// Check the subscription id, leaving local state
+			// alone if it's not ours
 			if sub.subID != subReply.SubID {
-				client.elog.Logf(elog.LogLevelError, "FIXME: Protocol violation (%v)", reply)
+				client.elog.Logf(elog.LogLevelError, "Protocol violation (%v)", reply)
+				return LocalError(ErrorsMismatchedIDs, sub.subID, subReply.SubID)
 			}
 
 			// Update the local subscription details
@@ -542,28 +1549,109 @@ func (client *Client) SubscriptionModify(sub *Subscription, expr string, acceptI
 			sub.delKeys(DelKeys)
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
+		return err
+	}
+
+	// Wait for the reply
+	abandon := false
+	select {
+	case reply := <-sub.events:
+		err = settle(reply)
+
+	case <-ctx.Done():
+		err = ctx.Err()
+		abandon = true
 
 	case <-time.After(SubscriptionTimeout):
 		err = LocalError(ErrorsTimeout)
+		abandon = true
 	}
 
 	client.mu.Lock()
 	delete(client.subReplies, xID)
+	var raced Packet
+	if abandon {
+		raced = client.abandonChange(xID, sub.events, settle)
+	}
 	client.mu.Unlock()
+	if raced != nil {
+		settle(raced)
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-sub.events:
+	default:
+	}
 
 	return err
 }
 
+// Give up on a modify or delete whose reply we didn't take. The router
+// may still make the change so a reply that raced us is returned for
+// the caller to settle once it's released client.mu, and one that
+// arrives later is settled by the read handler. Called with client.mu
+// held.
+func (client *Client) abandonChange(xID uint32, events chan Packet, settle func(Packet) error) Packet {
+	select {
+	case reply := <-events:
+		return reply
+	default:
+	}
+	client.settlers[xID] = settle
+	return nil
+}
+
+// Remove and return the settle func for a late reply, if any
+func (client *Client) takeSettler(xID uint32) func(Packet) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	settle, ok := client.settlers[xID]
+	if ok {
+		delete(client.settlers, xID)
+	}
+	return settle
+}
+
 // Delete a subscription
 func (client *Client) SubscriptionDelete(sub *Subscription) (err error) {
+	return client.SubscriptionDeleteContext(context.Background(), sub)
+}
+
+// As SubscriptionDelete but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) SubscriptionDeleteContext(ctx context.Context, sub *Subscription) (err error) {
 
+	if client.unqueueSubscription(sub) {
+		sub.retire()
+		return nil
+	}
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
 
+	// Abandon deliveries now so a consumer that's stopped reading
+	// can't hold up the reply. If we give up waiting they stay
+	// halted until the router answers.
+	sub.halt()
+	return client.subscriptionDelete(ctx, sub, func(err error) {
+		if err != nil {
+			sub.resume()
+		} else {
+			sub.retire()
+		}
+	})
+}
+
+// Send a SubDelRequest and forget the subscription once it's
+// confirmed. If finish isn't nil it's called with the outcome, which
+// for a request given up on is when the late reply arrives.
+func (client *Client) subscriptionDelete(ctx context.Context, sub *Subscription, finish func(error)) (err error) {
 	pkt := new(SubDelRequest)
 	pkt.SubID = sub.subID
 
@@ -577,50 +1665,119 @@ func (client *Client) SubscriptionDelete(sub *Subscription) (err error) {
 
 	client.writeChannel <- writeBuf
 
-	// Wait for the reply
-	select {
-	case reply := <-sub.events:
+	// Apply the router's reply, whenever it arrives
+	settle := func(reply Packet) (err error) {
 		switch reply.(type) {
 		case *SubReply:
 			subReply := reply.(*SubReply)
-			// Check the subscription id
+			// Check the subscription id, leaving local state
+			// alone if it's not ours
 			if sub.subID != subReply.SubID {
-				client.elog.Logf(elog.LogLevelError, "FIXME: Protocol violation (%v)", reply)
+				client.elog.Logf(elog.LogLevelError, "Protocol violation (%v)", reply)
+				err = LocalError(ErrorsMismatchedIDs, sub.subID, subReply.SubID)
+				break
 			}
 			// Delete the local subscription details
 			client.mu.Lock()
 			delete(client.subscriptions, sub.subID)
+			client.spendQuota(1)
 			client.mu.Unlock()
+			if sub.coalescer != nil {
+				sub.coalescer.stop()
+				sub.coalescer = nil
+			}
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
+		if finish != nil {
+			finish(err)
+		}
+		return err
+	}
+
+	// Wait for the reply
+	abandon := false
+	select {
+	case reply := <-sub.events:
+		err = settle(reply)
+
+	case <-ctx.Done():
+		err = ctx.Err()
+		abandon = true
 
 	case <-time.After(SubscriptionTimeout):
 		err = LocalError(ErrorsTimeout)
+		abandon = true
 	}
 
 	client.mu.Lock()
 	delete(client.subReplies, xID)
+	var raced Packet
+	if abandon {
+		raced = client.abandonChange(xID, sub.events, settle)
+	}
 	client.mu.Unlock()
+	if raced != nil {
+		settle(raced)
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-sub.events:
+	default:
+	}
 
 	return err
 }
 
+// A copy of names without the NotifySelf pseudo-name, which is only
+// ever sent for Quench.NotifySelf
+func withoutNotifySelf(names map[string]bool) map[string]bool {
+	if names == nil {
+		return nil
+	}
+	copied := make(map[string]bool, len(names))
+	for name := range names {
+		if name != QuenchNotifySelfName {
+			copied[name] = true
+		}
+	}
+	return copied
+}
+
 // Subscribe this client to the subscription
 func (client *Client) Quench(quench *Quench) (err error) {
+	return client.QuenchContext(context.Background(), quench)
+}
+
+// As Quench but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) QuenchContext(ctx context.Context, quench *Quench) (err error) {
 
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
 
 	pkt := new(QuenchAddRequest)
-	pkt.Names = quench.Names
+	pkt.Names = withoutNotifySelf(quench.Names)
+	if quench.All {
+		// A wildcard quench is requested with an empty name set
+		pkt.Names = nil
+	}
+	if quench.NotifySelf {
+		if pkt.Names == nil {
+			pkt.Names = make(map[string]bool)
+		}
+		pkt.Names[QuenchNotifySelfName] = true
+	}
 	pkt.DeliverInsecure = quench.DeliverInsecure
 	pkt.Keys = quench.Keys
 
-	quench.events = make(chan Packet)
+	quench.events = make(chan Packet, 1)
 
 	writeBuf := new(bytes.Buffer)
 	xID := pkt.Encode(writeBuf)
@@ -645,28 +1802,84 @@ func (client *Client) Quench(quench *Quench) (err error) {
 			client.mu.Unlock()
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
 
+	case <-ctx.Done():
+		err = ctx.Err()
+
 	case <-time.After(QuenchTimeout):
 		err = LocalError(ErrorsTimeout)
 	}
 
 	client.mu.Lock()
 	delete(client.quenchReplies, xID)
+	var quenchDel *bytes.Buffer
+	if err != nil {
+		quenchDel = client.abandonQuench(xID, quench)
+	}
 	client.mu.Unlock()
+	if quenchDel != nil {
+		client.writeChannel <- quenchDel
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-quench.events:
+	default:
+	}
 
 	return err
 }
 
+// Give up on a quench whose reply we didn't take. A QuenchReply that
+// raced us, or that arrives later, is answered with a QuenchDelRequest
+// so the router doesn't keep a quench nobody owns. Returns a request
+// to send. Called with client.mu held.
+func (client *Client) abandonQuench(xID uint32, quench *Quench) *bytes.Buffer {
+	select {
+	case reply := <-quench.events:
+		switch reply.(type) {
+		case *QuenchReply:
+			return client.orphanQuenchDel(reply.(*QuenchReply).QuenchID)
+		case *Nack:
+			return nil // The router didn't quench
+		}
+	default:
+	}
+	client.abandoned[xID] = true
+	return nil
+}
+
+// Encode a QuenchDelRequest for a quench nobody owns, noting its reply
+// is to be ignored. Called with client.mu held.
+func (client *Client) orphanQuenchDel(quenchID int64) *bytes.Buffer {
+	pkt := &QuenchDelRequest{QuenchID: quenchID}
+	writeBuf := new(bytes.Buffer)
+	client.abandoned[pkt.Encode(writeBuf)] = false
+	return writeBuf
+}
+
 // Modify a Quench
 func (client *Client) QuenchModify(quench *Quench, addNames map[string]bool, delNames map[string]bool, deliverInsecure bool, addKeys KeyBlock, delKeys KeyBlock) (err error) {
+	return client.QuenchModifyContext(context.Background(), quench, addNames, delNames, deliverInsecure, addKeys, delKeys)
+}
+
+// As QuenchModify but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) QuenchModifyContext(ctx context.Context, quench *Quench, addNames map[string]bool, delNames map[string]bool, deliverInsecure bool, addKeys KeyBlock, delKeys KeyBlock) (err error) {
 
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
 
+	// NotifySelf is fixed when the quench is added
+	addNames = withoutNotifySelf(addNames)
+	delNames = withoutNotifySelf(delNames)
+
 	pkt := new(QuenchModRequest)
 	pkt.QuenchID = quench.quenchID
 	pkt.AddNames = addNames
@@ -685,15 +1898,16 @@ func (client *Client) QuenchModify(quench *Quench, addNames map[string]bool, del
 
 	client.writeChannel <- writeBuf
 
-	// Wait for the reply
-	select {
-	case reply := <-quench.events:
+	// Apply the router's reply, whenever it arrives
+	settle := func(reply Packet) (err error) {
 		switch reply.(type) {
 		case *QuenchReply:
 			quenchReply := reply.(*QuenchReply)
-			// Check the quench id
+			// Check the quench id, leaving local state
+			// alone if it's not ours
 			if quench.quenchID != quenchReply.QuenchID {
-				client.elog.Logf(elog.LogLevelError, "FIXME: Protocol violation (%v)", reply)
+				client.elog.Logf(elog.LogLevelError, "Protocol violation (%v)", reply)
+				return LocalError(ErrorsMismatchedIDs, quench.quenchID, quenchReply.QuenchID)
 			}
 
 			quench.DeliverInsecure = deliverInsecure
@@ -708,22 +1922,56 @@ func (client *Client) QuenchModify(quench *Quench, addNames map[string]bool, del
 
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
+		return err
+	}
+
+	// Wait for the reply
+	abandon := false
+	select {
+	case reply := <-quench.events:
+		err = settle(reply)
+
+	case <-ctx.Done():
+		err = ctx.Err()
+		abandon = true
 
 	case <-time.After(QuenchTimeout):
 		err = LocalError(ErrorsTimeout)
+		abandon = true
 	}
 
 	client.mu.Lock()
 	delete(client.quenchReplies, xID)
+	var raced Packet
+	if abandon {
+		raced = client.abandonChange(xID, quench.events, settle)
+	}
 	client.mu.Unlock()
+	if raced != nil {
+		settle(raced)
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-quench.events:
+	default:
+	}
 
 	return err
 }
 
 func (client *Client) QuenchDelete(quench *Quench) (err error) {
+	return client.QuenchDeleteContext(context.Background(), quench)
+}
+
+// As QuenchDelete but returns ctx.Err() if ctx is done before the reply
+// arrives. The connection is left intact.
+func (client *Client) QuenchDeleteContext(ctx context.Context, quench *Quench) (err error) {
 
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
@@ -742,15 +1990,16 @@ func (client *Client) QuenchDelete(quench *Quench) (err error) {
 
 	client.writeChannel <- writeBuf
 
-	// Wait for the reply
-	select {
-	case reply := <-quench.events:
+	// Apply the router's reply, whenever it arrives
+	settle := func(reply Packet) (err error) {
 		switch reply.(type) {
 		case *QuenchReply:
 			quenchReply := reply.(*QuenchReply)
-			// Check the quench id
+			// Check the quench id, leaving local state
+			// alone if it's not ours
 			if quench.quenchID != quenchReply.QuenchID {
-				client.elog.Logf(elog.LogLevelError, "FIXME: Protocol violation (%v)", reply)
+				client.elog.Logf(elog.LogLevelError, "Protocol violation (%v)", reply)
+				return LocalError(ErrorsMismatchedIDs, quench.quenchID, quenchReply.QuenchID)
 			}
 			// Delete the local quench details
 			client.mu.Lock()
@@ -759,21 +2008,104 @@ func (client *Client) QuenchDelete(quench *Quench) (err error) {
 
 		case *Nack:
 			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
 		default:
 			err = LocalError(ErrorsBadPacket)
 		}
+		return err
+	}
+
+	// Wait for the reply
+	abandon := false
+	select {
+	case reply := <-quench.events:
+		err = settle(reply)
+
+	case <-ctx.Done():
+		err = ctx.Err()
+		abandon = true
 
 	case <-time.After(QuenchTimeout):
 		err = LocalError(ErrorsTimeout)
+		abandon = true
 	}
 
 	client.mu.Lock()
 	delete(client.quenchReplies, xID)
+	var raced Packet
+	if abandon {
+		raced = client.abandonChange(xID, quench.events, settle)
+	}
 	client.mu.Unlock()
+	if raced != nil {
+		settle(raced)
+	}
+
+	// Drop any reply that raced us
+	select {
+	case <-quench.events:
+	default:
+	}
 
 	return err
 }
 
+// An outstanding subscription or quench request
+type RequestInfo struct {
+	XID          uint32
+	Subscription *Subscription // Set for subscription requests
+	Quench       *Quench       // Set for quench requests
+}
+
+// List the subscription and quench requests awaiting a reply
+func (client *Client) PendingRequests() (pending []RequestInfo) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for xID, sub := range client.subReplies {
+		pending = append(pending, RequestInfo{XID: xID, Subscription: sub})
+	}
+	for xID, quench := range client.quenchReplies {
+		pending = append(pending, RequestInfo{XID: xID, Quench: quench})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].XID < pending[j].XID })
+	return pending
+}
+
+// Cancel all outstanding subscription and quench requests. Their
+// callers return err. Any late replies from the router are ignored.
+func (client *Client) CancelPending(err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for xID, sub := range client.subReplies {
+		delete(client.subReplies, xID)
+		select {
+		case sub.events <- &cancelPacket{err}:
+		default: // already has its reply
+		}
+	}
+	for xID, quench := range client.quenchReplies {
+		delete(client.quenchReplies, xID)
+		select {
+		case quench.events <- &cancelPacket{err}:
+		default: // already has its reply
+		}
+	}
+}
+
+// Passed to a waiting request to cancel it. Never on the wire.
+type cancelPacket struct {
+	err error
+}
+
+func (pkt *cancelPacket) ID() int                         { return 0 }
+func (pkt *cancelPacket) IDString() string                { return "Cancel" }
+func (pkt *cancelPacket) String() string                  { return pkt.err.Error() }
+func (pkt *cancelPacket) Decode(bytes []byte) (err error) { return nil }
+func (pkt *cancelPacket) Encode(buffer *bytes.Buffer)     {}
+
 // Read n bytes from reader into buffer which must be big enough
 func readBytes(reader io.Reader, buffer []byte, numToRead int) (int, error) {
 	offset := 0
@@ -814,6 +2146,11 @@ func (client *Client) readHandler() {
 			break // We're done
 		}
 
+		client.touch()
+		if client.Tracing() {
+			client.elog.Logf(elog.LogLevelDebug1, "trace recv %s", PacketSummary(buffer[:packetSize]))
+		}
+
 		// Deal with the packet
 		if err = client.handlePacket(buffer); err != nil {
 			client.elog.Logf(elog.LogLevelError, "Read Handler error: %v", err)
@@ -847,38 +2184,72 @@ func (client *Client) readHandler() {
 }
 
 // Handle writing for now run as a goroutine
-func (client *Client) writeHandler() {
+func (client *Client) writeHandler(done chan struct{}) {
 	header := make([]byte, 4)
+	var held []*bytes.Buffer // notifications waiting for credit
 
-	defer client.close()
+	defer client.writerExited(done)
+	defer close(done)
+	defer client.credits.holding(0) // lost with the connection
 	for {
-		select {
-		case buffer := <-client.writeChannel:
-
-			// Write the frame header (packetsize)
-			binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
-			_, err := client.writer.Write(header)
-			if err != nil {
-				// Deal with more errors
-				if err != io.EOF {
-					client.elog.Logf(elog.LogLevelWarning, "Unexpected write error: %v", err)
+		var buffer *bytes.Buffer
+		tokens := client.creditTokens()
+		if len(held) > 0 && tokens == nil {
+			// Flow control's stopped so send what's held
+			buffer, held = held[0], held[1:]
+			client.credits.holding(len(held))
+		} else {
+			// Other packets pass those waiting for credit until
+			// a window's worth are waiting
+			writes := client.writeChannel
+			var credit chan struct{}
+			if len(held) > 0 {
+				credit = tokens
+				if len(held) >= cap(tokens) {
+					writes = nil
 				}
-				client.wg.Done()
-				return
 			}
-
-			// Write the packet
-			_, err = buffer.WriteTo(client.writer)
-			if err != nil {
-				// Deal with more errors
-				if err != io.EOF {
-					client.elog.Logf(elog.LogLevelWarning, "Unexpected write error: %v", err)
+			select {
+			case buffer = <-writes:
+				// Flow control may have started while we waited
+				tokens = client.creditTokens()
+				if tokens != nil && needsCredit(buffer.Bytes()) && (len(held) > 0 || !takeCredit(tokens)) {
+					held = append(held, buffer)
+					client.credits.holding(len(held))
+					continue
 				}
+			case <-credit:
+				buffer, held = held[0], held[1:]
+				client.credits.holding(len(held))
+			case <-client.writeTerminate:
+				client.elog.Logf(elog.LogLevelDebug2, "Write handler exiting")
 				client.wg.Done()
 				return
 			}
-		case <-client.writeTerminate:
-			client.elog.Logf(elog.LogLevelDebug2, "Write handler exiting")
+		}
+		if client.Tracing() {
+			client.elog.Logf(elog.LogLevelDebug1, "trace send %s", PacketSummary(buffer.Bytes()))
+		}
+
+		// Write the frame header (packetsize)
+		binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
+		_, err := client.writer.Write(header)
+		if err != nil {
+			// Deal with more errors
+			if err != io.EOF {
+				client.elog.Logf(elog.LogLevelWarning, "Unexpected write error: %v", err)
+			}
+			client.wg.Done()
+			return
+		}
+
+		// Write the packet
+		_, err = buffer.WriteTo(client.writer)
+		if err != nil {
+			// Deal with more errors
+			if err != io.EOF {
+				client.elog.Logf(elog.LogLevelWarning, "Unexpected write error: %v", err)
+			}
 			client.wg.Done()
 			return
 		}
@@ -911,7 +2282,7 @@ func (client *Client) handlePacket(buffer []byte) (err error) {
 		case PacketConnReply:
 			return client.handleConnReply(buffer)
 		default:
-			return LocalError(ErrorsProtocolPacketStateNotConnected, PacketIDString(PacketID(buffer)))
+			return client.unexpectedPacket(LocalError(ErrorsProtocolPacketStateNotConnected, PacketIDString(PacketID(buffer))))
 		}
 
 	case StateDisconnecting:
@@ -926,6 +2297,8 @@ func (client *Client) handlePacket(buffer []byte) (err error) {
 			return client.handleSubReply(buffer)
 		case PacketQuenchReply:
 			return client.handleQuenchReply(buffer)
+		case PacketSecReply:
+			return client.handleSecReply(buffer)
 		case PacketNotifyDeliver:
 			return client.handleNotifyDeliver(buffer)
 		case PacketSubAddNotify:
@@ -936,15 +2309,29 @@ func (client *Client) handlePacket(buffer []byte) (err error) {
 			return client.handleSubDelNotify(buffer)
 		case PacketDropWarn:
 			return client.handleDropWarn(buffer)
+		case PacketCredit:
+			return client.handleCredit(buffer)
+		case PacketBusy:
+			return client.handleBusy(buffer)
+		case PacketSubRemoved:
+			return client.handleSubRemoved(buffer)
+		case PacketMatchCountReply:
+			return client.handleMatchCountReply(buffer)
 		default:
-			return LocalError(ErrorsProtocolPacketStateIsConnected, PacketIDString(PacketID(buffer)))
+			return client.unexpectedPacket(LocalError(ErrorsProtocolPacketStateIsConnected, PacketIDString(PacketID(buffer))))
 		}
 
 	case StateClosed:
-		return LocalError(ErrorsProtocolPacketStateNotConnected, PacketIDString(PacketID(buffer)))
+		return client.unexpectedPacket(LocalError(ErrorsProtocolPacketStateNotConnected, PacketIDString(PacketID(buffer))))
 	}
 
-	return LocalError(ErrorsBadPacketType, PacketIDString(PacketID(buffer)))
+	return client.unexpectedPacket(LocalError(ErrorsBadPacketType, PacketIDString(PacketID(buffer))))
+}
+
+// Report an unexpected packet as an anomaly, returning err
+func (client *Client) unexpectedPacket(err error) error {
+	client.anomaly(AnomalyUnexpectedPacket, "%v", err)
+	return err
 }
 
 // This function is called by the library if the client has not
@@ -965,6 +2352,9 @@ func (client *Client) ConnectionEventsDefault(event Packet) {
 			client.elog.Logf(elog.LogLevelError, "router detected protocol violation")
 			os.Exit(1)
 
+		case DisconnReasonRouterAdmin:
+			client.elog.Logf(elog.LogLevelWarning, "disconnected by the router's administrator")
+
 		case DisconnReasonRouterRedirect:
 			if len(disconn.Args) > 0 {
 				client.elog.Logf(elog.LogLevelInfo1, "redirected to %s", disconn.Args)
@@ -983,7 +2373,11 @@ func (client *Client) ConnectionEventsDefault(event Packet) {
 
 		case DisconnReasonClientConnectionLost:
 			client.elog.Logf(elog.LogLevelWarning, "Lost connection to %s, reconnecting", client.URL)
-			if err := client.DefaultReconnect(10, time.Duration(0), time.Minute*2); err != nil {
+			if err := client.reconnect(10, client.backoffPolicy()); err != nil {
+				if atomic.LoadInt32(&client.disconnected) != 0 {
+					client.elog.Logf(elog.LogLevelInfo1, "Reconnect cancelled by Disconnect")
+					break
+				}
 				client.elog.Logf(elog.LogLevelError, "Giving up reconnecting")
 				os.Exit(1)
 			}
@@ -996,23 +2390,69 @@ func (client *Client) ConnectionEventsDefault(event Packet) {
 	case *DropWarn:
 		client.elog.Logf(elog.LogLevelWarning, "DropWarn (lost one or more packets)")
 
+	case *Nack:
+		client.elog.Logf(elog.LogLevelWarning, "Router rejected request: %s", event.(*Nack))
+
 	default:
 		client.elog.Logf(elog.LogLevelError, "FIXME: bad connection notification")
 		os.Exit(1)
 	}
 }
 
-// The default behaviour for reconnection handling.
-// Will retry forever if retries is 0.
+// The default behaviour for reconnection handling, using the client's
+// BackoffPolicy between initial and maximum waits of minWait and maxWait.
+// A minWait of 0 keeps the policy's, up to maxWait. Will retry forever
+// if retries is 0.
 func (client *Client) DefaultReconnect(retries int, minWait time.Duration, maxWait time.Duration) (err error) {
+	policy := client.backoffPolicy()
+	policy.Max = maxWait
+	if minWait > 0 {
+		policy.Initial = minWait
+	} else if policy.Initial > maxWait {
+		policy.Initial = maxWait
+	}
+	atomic.StoreInt32(&client.disconnected, 0)
+	return client.reconnect(retries, policy)
+}
 
-	// Add up to 50ms randomness to initial backoff
-	wait := minWait + time.Duration(rand.Intn(50))*time.Millisecond
+// Reconnect using the client's BackoffPolicy, restoring subscriptions
+// and quenches. Will retry forever if retries is 0.
+func (client *Client) Reconnect(retries int) (err error) {
+	atomic.StoreInt32(&client.disconnected, 0)
+	return client.reconnect(retries, client.backoffPolicy())
+}
 
-	for {
-		time.Sleep(wait)
-		err = client.Connect()
+// Reconnect unless Disconnect is called before or during it, in which
+// case ErrorsReconnectCancelled is returned. If Disconnect comes after
+// a connection is made it's left for Disconnect to close.
+func (client *Client) reconnect(retries int, policy BackoffPolicy) (err error) {
+	if err = policy.Validate(); err != nil {
+		return err
+	}
+	stop, err := client.startReconnecting()
+	if err != nil {
+		return err
+	}
+	defer client.stopReconnecting()
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(policy.Delay(attempt)):
+		case <-stop:
+			return LocalError(ErrorsReconnectCancelled)
+		}
+		atomic.AddUint64(&client.stats.ReconnectAttempts, 1)
+		err = client.connect()
+		if client.OnReconnect != nil {
+			go client.OnReconnect(attempt, err, err == nil)
+		}
+		select {
+		case <-stop:
+			return LocalError(ErrorsReconnectCancelled)
+		default:
+		}
 		if err == nil {
+			atomic.AddUint64(&client.stats.Reconnects, 1)
 			// We connected, so resubscribe, requench
 			// If anything fails here we cleanup
 			subs := client.subscriptions
@@ -1020,9 +2460,12 @@ func (client *Client) DefaultReconnect(retries int, minWait time.Duration, maxWa
 			for _, sub := range subs {
 				if err = client.Subscribe(sub); err != nil {
 					client.subscriptions = subs
-					client.Disconnect()
+					client.disconnect()
 					return
 				}
+				if sub.Paused() {
+					client.subscriptionPause(sub, true)
+				}
 			}
 			// We connected, so resubscribe, requench
 			// If anything fails here we cleanup
@@ -1031,7 +2474,7 @@ func (client *Client) DefaultReconnect(retries int, minWait time.Duration, maxWa
 			for _, quench := range quenches {
 				if err = client.Quench(quench); err != nil {
 					client.quenches = quenches
-					client.Disconnect()
+					client.disconnect()
 					return
 				}
 			}
@@ -1043,11 +2486,6 @@ func (client *Client) DefaultReconnect(retries int, minWait time.Duration, maxWa
 		if retries == 0 {
 			return
 		}
-
-		wait *= 4
-		if wait > maxWait {
-			wait = maxWait
-		}
 	}
 }
 
@@ -1074,14 +2512,19 @@ func (client *Client) handleConnReply(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
-	// We're now connected
-	client.SetState(StateConnected)
-
 	// FIXME; check options
 	// connReply.Options
 
-	// Signal the connection requestor
-	client.connReplies <- connReply
+	// Signal the connection requestor, unless it gave up
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.connXID != 0 && client.connXID == connReply.XID {
+		client.connXID = 0
+		client.SetState(StateConnected)
+		client.connReplies <- connReply
+	} else {
+		client.anomaly(AnomalyUnknownXID, "ConnReply for unknown xid=%d", connReply.XID)
+	}
 	return nil
 }
 
@@ -1091,8 +2534,15 @@ func (client *Client) handleDisconnReply(buffer []byte) (err error) {
 	if err = disconnReply.Decode(buffer); err != nil {
 		client.ProtocolError(err)
 	}
-	// Signal the disconnection requestor
-	client.connReplies <- disconnReply
+	// Signal the disconnection requestor, unless it gave up
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.disconnXID != 0 && client.disconnXID == disconnReply.XID {
+		client.disconnXID = 0
+		client.connReplies <- disconnReply
+	} else {
+		client.anomaly(AnomalyUnknownXID, "DisconnReply for unknown xid=%d", disconnReply.XID)
+	}
 	return nil
 }
 
@@ -1103,6 +2553,12 @@ func (client *Client) handleDisconn(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
+	// The router closes the connection after an administrator's
+	// Disconn so it's not lost
+	if disconn.Reason == DisconnReasonRouterAdmin {
+		client.SetState(StateClosed)
+	}
+
 	// Signal the disconect
 	// If a client library isn't listening we just close the client
 	select {
@@ -1119,6 +2575,8 @@ func (client *Client) handleDropWarn(buffer []byte) (err error) {
 	dropWarn := new(DropWarn)
 	// Nothing to decode
 
+	client.anomaly(AnomalyDropWarn, "DropWarn")
+
 	// Signal the DropWarn
 	// If a client library isn't listening we ignore it
 	select {
@@ -1163,6 +2621,12 @@ func (client *Client) handleNack(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
+	// A late Nack for a change given up on leaves local state alone
+	if settle := client.takeSettler(nack.XID); settle != nil {
+		settle(nack)
+		return nil
+	}
+
 	// A Nack can belong to multiple places so hunt it down
 	client.mu.Lock()
 	defer client.mu.Unlock()
@@ -1181,15 +2645,80 @@ func (client *Client) handleNack(buffer []byte) (err error) {
 		return nil
 	}
 
-	if client.connXID == nack.XID {
+	if client.secXID != 0 && client.secXID == nack.XID {
+		client.secXID = 0
+		client.secReplies <- Packet(nack)
+		return nil
+	}
+
+	if client.matchXID != 0 && client.matchXID == nack.XID {
+		client.matchXID = 0
+		client.matchReplies <- Packet(nack)
+		return nil
+	}
+
+	// Requests without an XID (e.g. NotifyEmit) are Nacked with
+	// XID 0 so pass them on as an event
+	if nack.XID == 0 {
+		select {
+		case client.Events <- nack:
+		default:
+			go client.ConnectionEventsDefault(nack)
+		}
+		return nil
+	}
+
+	if client.connXID != 0 && client.connXID == nack.XID {
 		client.connXID = 0
 		client.connReplies <- Packet(nack)
 		return nil
 	}
 
+	if _, ok := client.abandoned[nack.XID]; ok {
+		delete(client.abandoned, nack.XID)
+		return nil // Nobody's waiting
+	}
+
+	client.anomaly(AnomalyUnknownXID, "Nack for unknown xid=%d", nack.XID)
 	return fmt.Errorf("Unhandled nack xid=%d, (conn:%d)\n", nack.XID, client.connXID)
 }
 
+// Handle a SecReply
+func (client *Client) handleSecReply(buffer []byte) (err error) {
+	secReply := new(SecReply)
+	if err = secReply.Decode(buffer); err != nil {
+		client.ProtocolError(err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.secXID != 0 && client.secXID == secReply.XID {
+		client.secXID = 0
+		client.secReplies <- Packet(secReply)
+	} else {
+		client.anomaly(AnomalyUnknownXID, "SecReply for unknown xid=%d", secReply.XID)
+	}
+	return nil
+}
+
+// Handle a MatchCountReply
+func (client *Client) handleMatchCountReply(buffer []byte) (err error) {
+	matchReply := new(MatchCountReply)
+	if err = matchReply.Decode(buffer); err != nil {
+		client.ProtocolError(err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.matchXID != 0 && client.matchXID == matchReply.XID {
+		client.matchXID = 0
+		client.matchReplies <- Packet(matchReply)
+	} else {
+		client.anomaly(AnomalyUnknownXID, "MatchCountReply for unknown xid=%d", matchReply.XID)
+	}
+	return nil
+}
+
 // Handle a Subscription reply
 func (client *Client) handleSubReply(buffer []byte) (err error) {
 	subReply := new(SubReply)
@@ -1197,14 +2726,40 @@ func (client *Client) handleSubReply(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
+	if settle := client.takeSettler(subReply.XID); settle != nil {
+		if err := settle(subReply); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Late SubReply xid=%d not applied: %v", subReply.XID, err)
+		}
+		return nil
+	}
+
 	client.mu.Lock()
 	sub, ok := client.subReplies[subReply.XID]
-	client.mu.Unlock()
 	if ok {
-		// Signal the subscription
+		if sub.subID == 0 {
+			// Track a new subscription now as notifications
+			// for it may follow immediately
+			sub.subID = subReply.SubID
+			client.subscriptions[sub.subID] = sub
+		}
+		// Signal the subscription while a waiter giving up can
+		// see it
 		delete(client.subReplies, subReply.XID)
 		sub.events <- Packet(subReply)
-	} // else it will time out
+	}
+	orphaned, abandoned := client.abandoned[subReply.XID]
+	delete(client.abandoned, subReply.XID)
+	var subDel *bytes.Buffer
+	if orphaned {
+		subDel = client.orphanSubDel(subReply.SubID)
+	}
+	client.mu.Unlock()
+	if subDel != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Deleting subscription %d subscribed too late", subReply.SubID)
+		client.writeChannel <- subDel
+	} else if !ok && !abandoned {
+		client.anomaly(AnomalyUnknownXID, "SubReply for unknown xid=%d", subReply.XID)
+	}
 	return nil
 }
 
@@ -1215,13 +2770,33 @@ func (client *Client) handleQuenchReply(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
+	if settle := client.takeSettler(quenchReply.XID); settle != nil {
+		if err := settle(quenchReply); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Late QuenchReply xid=%d not applied: %v", quenchReply.XID, err)
+		}
+		return nil
+	}
+
 	client.mu.Lock()
 	quench, ok := client.quenchReplies[quenchReply.XID]
-	client.mu.Unlock()
 	if ok {
+		// Signal the quench while a waiter giving up can see it
 		delete(client.quenchReplies, quenchReply.XID)
 		quench.events <- Packet(quenchReply)
-	} // else it will time out
+	}
+	orphaned, abandoned := client.abandoned[quenchReply.XID]
+	delete(client.abandoned, quenchReply.XID)
+	var quenchDel *bytes.Buffer
+	if orphaned {
+		quenchDel = client.orphanQuenchDel(quenchReply.QuenchID)
+	}
+	client.mu.Unlock()
+	if quenchDel != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Deleting quench %d quenched too late", quenchReply.QuenchID)
+		client.writeChannel <- quenchDel
+	} else if !ok && !abandoned {
+		client.anomaly(AnomalyUnknownXID, "QuenchReply for unknown xid=%d", quenchReply.XID)
+	}
 	return nil
 }
 
@@ -1232,31 +2807,90 @@ func (client *Client) handleNotifyDeliver(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
-	// Sync the map of subIDs. We can do this once as:
-	// * If one disappears it's ok (we don't deliver)
-	// * If one appears it's ok (they're sparse)
-	client.mu.Lock()
-	subscriptions := client.subscriptions
-	client.mu.Unlock()
+	// A secure delivery may say which of our keys matched
+	var key Key
+	if matched, ok := notifyDeliver.NameValue[MatchedKeyAttribute].([]byte); ok {
+		key = matched
+		delete(notifyDeliver.NameValue, MatchedKeyAttribute)
+	}
+
+	// Ordered subscriptions need the notification decoded again,
+	// which we do at most once
+	var pairs []NameValuePair
+	ordered := func(sub *Subscription) (bool, error) {
+		if sub.Ordered == nil {
+			return false, nil
+		}
+		if pairs == nil {
+			var err error
+			if pairs, _, err = XdrGetNotificationOrdered(buffer[4:]); err != nil {
+				return true, err
+			}
+			for i := 0; i < len(pairs); i++ {
+				if pairs[i].Name == MatchedKeyAttribute {
+					pairs = append(pairs[:i], pairs[i+1:]...)
+					break
+				}
+			}
+		}
+		sub.send(func(stop <-chan struct{}) {
+			select {
+			case sub.Ordered <- pairs:
+			case <-stop:
+			}
+		})
+		return true, nil
+	}
 
 	// foreach matching subscription deliver it
 	for _, subID := range notifyDeliver.Secure {
 		client.elog.Logf(elog.LogLevelDebug3, "NotifyDeliver secure for %d", subID)
-		sub, ok := subscriptions[subID]
-		if ok && sub.subID == subID {
-			sub.Notifications <- notifyDeliver.NameValue
+		sub, ok := client.subscription(subID)
+		if !ok || sub.Paused() {
+			continue
+		}
+		client.checkSequence(sub, notifyDeliver.NameValue)
+		isOrdered, err := ordered(sub)
+		if err != nil {
+			client.ProtocolError(err)
+			return err
 		}
+		if !isOrdered {
+			sub.deliver(notifyDeliver.NameValue, true, key)
+		}
+		client.autoAck(sub, notifyDeliver.NameValue)
 	}
 	for _, subID := range notifyDeliver.Insecure {
 		client.elog.Logf(elog.LogLevelDebug3, "NotifyDeliver insecure for %d", subID)
-		sub, ok := client.subscriptions[subID]
-		if ok && sub.subID == subID {
-			sub.Notifications <- notifyDeliver.NameValue
+		sub, ok := client.subscription(subID)
+		if !ok || sub.Paused() {
+			continue
+		}
+		client.checkSequence(sub, notifyDeliver.NameValue)
+		isOrdered, err := ordered(sub)
+		if err != nil {
+			client.ProtocolError(err)
+			return err
 		}
+		if !isOrdered {
+			sub.deliver(notifyDeliver.NameValue, false, nil)
+		}
+		client.autoAck(sub, notifyDeliver.NameValue)
 	}
 	return nil
 }
 
+// The subscription with subID, unless it's been deleted or replaced
+func (client *Client) subscription(subID int64) (*Subscription, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	sub, ok := client.subscriptions[subID]
+	if !ok || sub.subID != subID {
+		return nil, false
+	}
+	return sub, true
+}
+
 // Handle a quench's SubAddNotify
 func (client *Client) handleSubAddNotify(buffer []byte) (err error) {
 	subAddNotify := new(SubAddNotify)
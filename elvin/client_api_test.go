@@ -0,0 +1,677 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A client that looks connected and whose requests are answered
+// directly by reply
+func fakeConnectedClient(reply func()) *Client {
+	client := NewClient("elvin://", nil, nil, nil)
+	client.SetState(StateConnected)
+	go func() {
+		for range client.writeChannel {
+			reply()
+		}
+	}()
+	return client
+}
+
+func TestSubReplyMismatch(t *testing.T) {
+	sub := &Subscription{Expression: "a == 1", subID: 42}
+	sub.events = make(chan Packet, 1)
+	client := fakeConnectedClient(func() { sub.events <- &SubReply{SubID: 43} })
+	client.subscriptions[sub.subID] = sub
+
+	if err := client.SubscriptionModify(sub, "b == 2", true, nil, nil); err == nil {
+		t.Fatalf("Modify with mismatched SubID passed")
+	}
+	if sub.Expression != "a == 1" || sub.AcceptInsecure {
+		t.Fatalf("Modify applied local changes: %+v", sub)
+	}
+
+	if err := client.SubscriptionDelete(sub); err == nil {
+		t.Fatalf("Delete with mismatched SubID passed")
+	}
+	if _, ok := client.subscriptions[sub.subID]; !ok {
+		t.Fatalf("Delete removed the local subscription")
+	}
+}
+
+func TestQuenchReplyMismatch(t *testing.T) {
+	quench := &Quench{Names: map[string]bool{"a": true}, quenchID: 42}
+	quench.events = make(chan Packet, 1)
+	client := fakeConnectedClient(func() { quench.events <- &QuenchReply{QuenchID: 43} })
+	client.quenches[quench.quenchID] = quench
+
+	if err := client.QuenchModify(quench, map[string]bool{"b": true}, nil, true, nil, nil); err == nil {
+		t.Fatalf("Modify with mismatched QuenchID passed")
+	}
+	if quench.Names["b"] || quench.DeliverInsecure {
+		t.Fatalf("Modify applied local changes: %+v", quench)
+	}
+
+	if err := client.QuenchDelete(quench); err == nil {
+		t.Fatalf("Delete with mismatched QuenchID passed")
+	}
+	if _, ok := client.quenches[quench.quenchID]; !ok {
+		t.Fatalf("Delete removed the local quench")
+	}
+}
+
+func TestCancelPending(t *testing.T) {
+	client := fakeConnectedClient(func() {}) // never replies
+
+	sub := &Subscription{Expression: "a == 1"}
+	done := make(chan error)
+	go func() { done <- client.Subscribe(sub) }()
+
+	// Wait for it to be in flight
+	var pending []RequestInfo
+	for i := 0; i < 100 && len(pending) == 0; i++ {
+		time.Sleep(time.Millisecond)
+		pending = client.PendingRequests()
+	}
+	if len(pending) != 1 || pending[0].Subscription != sub {
+		t.Fatalf("Expected the subscription pending, got: %+v", pending)
+	}
+
+	cancelled := errors.New("cancelled")
+	client.CancelPending(cancelled)
+	select {
+	case err := <-done:
+		if err != cancelled {
+			t.Fatalf("Expected cancellation, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribe still blocked after CancelPending")
+	}
+	if len(client.PendingRequests()) != 0 {
+		t.Fatalf("Requests still pending after CancelPending")
+	}
+}
+
+// A client that looks connected, passing on what it writes
+func fakeWritingClient() (*Client, chan *bytes.Buffer) {
+	client := NewClient("elvin://", nil, nil, nil)
+	client.SetState(StateConnected)
+	client.AnomalyChannel = make(chan Anomaly, 1)
+	written := make(chan *bytes.Buffer, 4)
+	go func() {
+		for buf := range client.writeChannel {
+			written <- buf
+		}
+	}()
+	return client, written
+}
+
+func TestCancelPendingLateReply(t *testing.T) {
+	client, written := fakeWritingClient()
+
+	sub := &Subscription{Expression: "a == 1"}
+	done := make(chan error)
+	go func() { done <- client.Subscribe(sub) }()
+	xID := binary.BigEndian.Uint32((<-written).Bytes()[4:])
+	client.CancelPending(errors.New("cancelled"))
+	<-done
+
+	// The router subscribed after all so it's told to delete it
+	buf := new(bytes.Buffer)
+	(&SubReply{XID: xID, SubID: 7}).Encode(buf)
+	client.handlePacket(buf.Bytes())
+	subDel := new(SubDelRequest)
+	select {
+	case buf := <-written:
+		if err := subDel.Decode(buf.Bytes()); err != nil || subDel.SubID != 7 {
+			t.Fatalf("Expected a SubDelRequest for 7, got %v: %v", subDel, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No SubDelRequest for a late SubReply")
+	}
+	if len(client.subscriptions) != 0 {
+		t.Fatalf("Late SubReply tracked: %v", client.subscriptions)
+	}
+
+	// Whose reply nobody's waiting for
+	buf.Reset()
+	(&SubReply{XID: subDel.XID, SubID: 7}).Encode(buf)
+	client.handlePacket(buf.Bytes())
+	select {
+	case anomaly := <-client.AnomalyChannel:
+		t.Fatalf("Unexpected anomaly: %v", anomaly)
+	default:
+	}
+	if len(client.abandoned) != 0 {
+		t.Fatalf("Abandoned requests remain: %v", client.abandoned)
+	}
+}
+
+func TestQuenchContextLateReply(t *testing.T) {
+	client, written := fakeWritingClient()
+
+	quench := &Quench{Names: map[string]bool{"a": true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.QuenchContext(ctx, quench) }()
+	xID := binary.BigEndian.Uint32((<-written).Bytes()[4:])
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The router quenched after all so it's told to delete it
+	buf := new(bytes.Buffer)
+	(&QuenchReply{XID: xID, QuenchID: 9}).Encode(buf)
+	client.handlePacket(buf.Bytes())
+	quenchDel := new(QuenchDelRequest)
+	select {
+	case buf := <-written:
+		if err := quenchDel.Decode(buf.Bytes()); err != nil || quenchDel.QuenchID != 9 {
+			t.Fatalf("Expected a QuenchDelRequest for 9, got %v: %v", quenchDel, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No QuenchDelRequest for a late QuenchReply")
+	}
+
+	// Whose reply nobody's waiting for
+	buf.Reset()
+	(&QuenchReply{XID: quenchDel.XID, QuenchID: 9}).Encode(buf)
+	client.handlePacket(buf.Bytes())
+	select {
+	case anomaly := <-client.AnomalyChannel:
+		t.Fatalf("Unexpected anomaly: %v", anomaly)
+	default:
+	}
+	if len(client.quenches) != 0 || len(client.abandoned) != 0 {
+		t.Fatalf("Late quench left behind: %v %v", client.quenches, client.abandoned)
+	}
+}
+
+func TestChangeContextLateReply(t *testing.T) {
+	client, written := fakeWritingClient()
+
+	sub := &Subscription{Expression: "a == 1", subID: 5, events: make(chan Packet, 1)}
+	client.subscriptions[sub.subID] = sub
+	quench := &Quench{Names: map[string]bool{"a": true}, quenchID: 6, events: make(chan Packet, 1)}
+	client.quenches[quench.quenchID] = quench
+
+	// Give up on a request once it's written, returning its XID
+	abandon := func(request func(ctx context.Context) error) uint32 {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- request(ctx) }()
+		xID := binary.BigEndian.Uint32((<-written).Bytes()[4:])
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		return xID
+	}
+	late := func(reply Packet) {
+		buf := new(bytes.Buffer)
+		switch reply.(type) {
+		case *SubReply:
+			reply.(*SubReply).Encode(buf)
+		case *QuenchReply:
+			reply.(*QuenchReply).Encode(buf)
+		case *Nack:
+			reply.(*Nack).Encode(buf)
+		}
+		client.handlePacket(buf.Bytes())
+		select {
+		case anomaly := <-client.AnomalyChannel:
+			t.Fatalf("Unexpected anomaly: %v", anomaly)
+		default:
+		}
+	}
+
+	// The router modified the subscription after all
+	xID := abandon(func(ctx context.Context) error {
+		return client.SubscriptionModifyContext(ctx, sub, "b == 2", false, nil, nil)
+	})
+	late(&SubReply{XID: xID, SubID: 5})
+	if sub.Expression != "b == 2" {
+		t.Fatalf("Late SubReply not applied: %v", sub.Expression)
+	}
+
+	// A refused delete leaves the subscription delivering
+	xID = abandon(func(ctx context.Context) error {
+		return client.SubscriptionDeleteContext(ctx, sub)
+	})
+	late(&Nack{XID: xID, ErrorCode: ErrorsUnknownSubID, Message: "Unknown subscription id %1", Args: []interface{}{int64(5)}})
+	if _, ok := client.subscription(5); !ok || sub.halted {
+		t.Fatalf("Nacked delete applied: %v %v", client.subscriptions, sub.halted)
+	}
+
+	// A confirmed one forgets it
+	xID = abandon(func(ctx context.Context) error {
+		return client.SubscriptionDeleteContext(ctx, sub)
+	})
+	late(&SubReply{XID: xID, SubID: 5})
+	if _, ok := client.subscription(5); ok || atomic.LoadInt32(&sub.retired) == 0 {
+		t.Fatalf("Late delete not applied: %v", client.subscriptions)
+	}
+
+	// Likewise for quenches
+	xID = abandon(func(ctx context.Context) error {
+		return client.QuenchModifyContext(ctx, quench, map[string]bool{"b": true}, nil, false, nil, nil)
+	})
+	late(&QuenchReply{XID: xID, QuenchID: 6})
+	if !quench.Names["b"] {
+		t.Fatalf("Late QuenchReply not applied: %v", quench.Names)
+	}
+	xID = abandon(func(ctx context.Context) error {
+		return client.QuenchDeleteContext(ctx, quench)
+	})
+	late(&QuenchReply{XID: xID, QuenchID: 6})
+	if len(client.quenches) != 0 || len(client.settlers) != 0 {
+		t.Fatalf("Late quench delete not applied: %v %v", client.quenches, client.settlers)
+	}
+}
+
+func TestAnomalyUnknownXID(t *testing.T) {
+	client := fakeConnectedClient(func() {})
+	client.AnomalyChannel = make(chan Anomaly, 1)
+
+	buf := new(bytes.Buffer)
+	reply := &SubReply{XID: 4242, SubID: 1}
+	reply.Encode(buf)
+	client.handlePacket(buf.Bytes())
+
+	select {
+	case anomaly := <-client.AnomalyChannel:
+		if anomaly.Type != AnomalyUnknownXID {
+			t.Fatalf("Expected an unknown XID anomaly, got: %v", anomaly)
+		}
+	default:
+		t.Fatalf("No anomaly reported for an unknown XID")
+	}
+}
+
+func TestStrictInsecure(t *testing.T) {
+	sub := &Subscription{Expression: "a == 1", AcceptInsecure: true}
+	client := fakeConnectedClient(func() { sub.events <- &SubReply{SubID: 1} })
+	client.StrictInsecure = true
+
+	err := client.Subscribe(sub)
+	if err == nil || err.Error() != LocalError(ErrorsInsecureSubscription).Error() {
+		t.Fatalf("Expected insecure subscription refused, got: %v", err)
+	}
+	if len(client.PendingRequests()) != 0 {
+		t.Fatalf("Refused subscription was sent")
+	}
+
+	sub.InsecureOK = true
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Explicitly insecure subscription failed: %v", err)
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	client := fakeConnectedClient(func() { t.Errorf("Invalid subscription was sent") })
+
+	if err := client.Subscribe(nil); err == nil || err.Error() != LocalError(ErrorsNilSubscription).Error() {
+		t.Fatalf("Expected nil subscription refused, got: %v", err)
+	}
+	for _, expr := range []string{"", "  \t"} {
+		sub := &Subscription{Expression: expr}
+		if err := client.Subscribe(sub); err == nil || err.Error() != LocalError(ErrorsEmptyExpression).Error() {
+			t.Fatalf("Expected empty expression %q refused, got: %v", expr, err)
+		}
+	}
+
+	client.CheckExpressions = true
+	if err := client.Subscribe(&Subscription{Expression: "a =="}); err == nil {
+		t.Fatalf("Expected unparsable expression refused")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("Expected a ParseError, got: %v", err)
+	}
+	if len(client.PendingRequests()) != 0 {
+		t.Fatalf("Refused subscriptions were sent")
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	client := fakeConnectedClient(func() {})
+	ordered := &Subscription{Expression: "require(z)", subID: 7}
+	ordered.Ordered = make(chan []NameValuePair, 1)
+	plain := &Subscription{Expression: "require(z)", subID: 8}
+	plain.Notifications = make(chan map[string]interface{}, 1)
+	client.subscriptions[7] = ordered
+	client.subscriptions[8] = plain
+
+	pairs := []NameValuePair{{"z", int32(1)}, {"a", "two"}, {"m", float64(3)}, {"b", int64(4)}}
+	buf := new(bytes.Buffer)
+	XdrPutInt32(buf, PacketNotifyDeliver)
+	XdrPutNotificationOrdered(buf, pairs)
+	XdrPutInt32(buf, 0) // secure
+	XdrPutInt32(buf, 2) // insecure
+	XdrPutInt64(buf, 7)
+	XdrPutInt64(buf, 8)
+	if err := client.handlePacket(buf.Bytes()); err != nil {
+		t.Fatalf("NotifyDeliver failed: %v", err)
+	}
+
+	select {
+	case received := <-ordered.Ordered:
+		if !reflect.DeepEqual(received, pairs) {
+			t.Fatalf("Expected %v, got %v", pairs, received)
+		}
+	default:
+		t.Fatalf("Ordered subscription got nothing")
+	}
+	select {
+	case nv := <-plain.Notifications:
+		if len(nv) != len(pairs) {
+			t.Fatalf("Plain subscription got %v", nv)
+		}
+	default:
+		t.Fatalf("Plain subscription got nothing")
+	}
+}
+
+// A router on the far end of conn that Nacks ConnRequests above
+// version 4.0 as incompatible and accepts 4.0
+func versionMockRouter(conn net.Conn) {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		buffer := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		var request ConnRequest
+		if err := request.Decode(buffer); err != nil {
+			return
+		}
+
+		var reply Packet
+		if request.VersionMinor > 0 {
+			reply = &Nack{XID: request.XID, ErrorCode: ErrorsProtocolIncompatible,
+				Message: ProtocolErrors[ErrorsProtocolIncompatible].Message}
+		} else {
+			reply = &ConnReply{XID: request.XID}
+		}
+		out := new(bytes.Buffer)
+		reply.Encode(out)
+		binary.BigEndian.PutUint32(header, uint32(out.Len()))
+		conn.Write(header)
+		conn.Write(out.Bytes())
+	}
+}
+
+func TestConnectDowngrade(t *testing.T) {
+	clientEnd, routerEnd := net.Pipe()
+	go versionMockRouter(routerEnd)
+	client := NewClient("elvin://", nil, nil, nil)
+	if err := client.ConnectOver(clientEnd); err == nil {
+		t.Fatalf("Connected at 4.1 without Downgrade")
+	}
+
+	clientEnd, routerEnd = net.Pipe()
+	go versionMockRouter(routerEnd)
+	client = NewClient("elvin://", nil, nil, nil)
+	client.Downgrade = true
+	if err := client.ConnectOver(clientEnd); err != nil {
+		t.Fatalf("Downgrade failed: %v", err)
+	}
+	if major, minor := client.NegotiatedVersion(); major != 4 || minor != 0 {
+		t.Fatalf("Expected version 4.0, got %d.%d", major, minor)
+	}
+}
+
+func TestWriteQueueDepth(t *testing.T) {
+	client := NewClient("elvin://", nil, nil, nil)
+	if err := client.SetWriteQueueSize(4); err != nil {
+		t.Fatalf("SetWriteQueueSize failed: %v", err)
+	}
+
+	// No connection so nothing drains the queue
+	for i := 1; i <= 4; i++ {
+		client.writeChannel <- new(bytes.Buffer)
+		if depth := client.WriteQueueDepth(); depth != i {
+			t.Fatalf("Expected depth %d, got %d", i, depth)
+		}
+	}
+	if stats := client.Stats(); stats.WriteQueueDepth != 4 {
+		t.Fatalf("Expected Stats depth 4, got %d", stats.WriteQueueDepth)
+	}
+
+	client.SetState(StateConnected)
+	if err := client.SetWriteQueueSize(8); err == nil {
+		t.Fatalf("Resized the queue while connected")
+	}
+}
+
+func TestCreditHeldNotifications(t *testing.T) {
+	clientEnd, routerEnd := net.Pipe()
+	client := NewClient("elvin://", nil, nil, nil)
+	client.setCredits(2)
+	client.mu.Lock()
+	client.attach(clientEnd)
+	client.mu.Unlock()
+	defer client.close()
+
+	// The types of packet the router receives
+	received := make(chan int, 8)
+	go func() {
+		header := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(routerEnd, header); err != nil {
+				return
+			}
+			buffer := make([]byte, binary.BigEndian.Uint32(header))
+			if _, err := io.ReadFull(routerEnd, buffer); err != nil {
+				return
+			}
+			received <- PacketID(buffer)
+		}
+	}()
+	send := func(pkt interface{ Encode(*bytes.Buffer) }) {
+		buf := new(bytes.Buffer)
+		pkt.Encode(buf)
+		client.writeChannel <- buf
+	}
+	expect := func(packetType int) {
+		select {
+		case got := <-received:
+			if got != packetType {
+				t.Fatalf("Expected %s, got %s", PacketIDString(packetType), PacketIDString(got))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No %s sent", PacketIDString(packetType))
+		}
+	}
+
+	nv := map[string]interface{}{"a": int32(1)}
+	for i := 0; i < 3; i++ {
+		send(&NotifyEmit{NameValue: nv})
+	}
+	expect(PacketNotifyEmit)
+	expect(PacketNotifyEmit)
+
+	// Out of credit the third is held while others pass it,
+	// including a UNotify which isn't credited
+	send(new(TestConn))
+	expect(PacketTestConn)
+	send(&UNotify{NameValue: nv})
+	expect(PacketUNotify)
+	if depth := client.WriteQueueDepth(); depth != 1 {
+		t.Fatalf("Expected 1 held, got %d", depth)
+	}
+
+	// until the router credits us
+	buf := new(bytes.Buffer)
+	(&Credit{Credits: 1}).Encode(buf)
+	if err := client.handleCredit(buf.Bytes()); err != nil {
+		t.Fatalf("handleCredit failed: %v", err)
+	}
+	expect(PacketNotifyEmit)
+}
+
+func TestWaitEstablished(t *testing.T) {
+	client := NewClient("elvin://", nil, nil, nil)
+	client.OfflinePolicy = OfflineQueue
+	sub := &Subscription{Expression: "a == 1"}
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Queued Subscribe failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sub.WaitEstablished(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected a queued subscription unconfirmed, got: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- sub.WaitEstablished(context.Background()) }()
+
+	// Connect to a router that confirms it
+	client.SetState(StateConnected)
+	go func() {
+		for range client.writeChannel {
+			sub.events <- &SubReply{SubID: 42}
+		}
+	}()
+	client.flushQueued()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitEstablished failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitEstablished still blocked after the SubReply")
+	}
+	if sub.SubID() != 42 {
+		t.Fatalf("Expected SubID 42, got %d", sub.SubID())
+	}
+	if err := sub.WaitEstablished(context.Background()); err != nil {
+		t.Fatalf("WaitEstablished failed once established: %v", err)
+	}
+
+	// and one the router refuses
+	refused := &Subscription{Expression: "a == 2"}
+	nacking := fakeConnectedClient(func() { refused.events <- &Nack{ErrorCode: ErrorsParsing} })
+	if err := nacking.Subscribe(refused); err == nil {
+		t.Fatalf("Nacked Subscribe passed")
+	}
+	if err := refused.WaitEstablished(context.Background()); err == nil {
+		t.Fatalf("WaitEstablished passed after a Nack")
+	}
+}
+
+func TestReconnectFlushOrder(t *testing.T) {
+	client, written := fakeWritingClient()
+	client.PublishQueue = 4
+
+	// Connected again but still resubscribing, so notifications
+	// queue behind any held while we were disconnected
+	if _, err := client.startReconnecting(); err != nil {
+		t.Fatalf("startReconnecting failed: %v", err)
+	}
+	if err := client.publish(bytes.NewBufferString("held")); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if err := client.publish(bytes.NewBufferString("later")); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case buf := <-written:
+		t.Fatalf("Sent %q before the queue was flushed", buf)
+	default:
+	}
+
+	client.stopReconnecting()
+	if err := client.publish(bytes.NewBufferString("after")); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	for _, expected := range []string{"held", "later", "after"} {
+		select {
+		case buf := <-written:
+			if buf.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, buf)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not sent", expected)
+		}
+	}
+}
+
+func TestDisconnectWhileReconnecting(t *testing.T) {
+	client := NewClient("elvin://localhost:3999", nil, nil, nil)
+	client.Backoff = &BackoffPolicy{Initial: 5 * time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 1}
+	dials := make(chan struct{}, 100)
+	client.Dial = func(network, address string) (net.Conn, error) {
+		dials <- struct{}{}
+		return nil, errors.New("unreachable")
+	}
+
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- client.Reconnect(0) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-dials:
+		case <-time.After(time.Second):
+			t.Fatalf("Reconnect isn't dialing")
+		}
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("Disconnect while reconnecting failed: %v", err)
+	}
+	select {
+	case err := <-reconnected:
+		if err == nil || err.Error() != LocalError(ErrorsReconnectCancelled).Error() {
+			t.Fatalf("Expected the reconnect cancelled, got: %v", err)
+		}
+	default:
+		t.Fatalf("Disconnect returned before the reconnect finished")
+	}
+	if client.State() != StateClosed {
+		t.Fatalf("Expected the client closed, got state %d", client.State())
+	}
+
+	// Nor does a lost connection reconnect it until asked
+	if err := client.reconnect(0, client.backoffPolicy()); err == nil {
+		t.Fatalf("Automatic reconnect after Disconnect succeeded")
+	}
+	for len(dials) > 0 {
+		<-dials
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(dials) != 0 || client.State() != StateClosed {
+		t.Fatalf("Client dialed after Disconnect")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync"
+)
+
+// A conflating buffer between the read handler and a subscription's
+// consumer. Only the latest notification for each value of the key
+// attribute is kept while the consumer is behind. Keys are delivered
+// in the order they first became pending.
+type coalescer struct {
+	key     string
+	deliver func(nv map[string]interface{}, abandon <-chan bool)
+
+	mu      sync.Mutex
+	order   []interface{}
+	latest  map[interface{}]map[string]interface{}
+	unkeyed int // unique keys for notifications without the attribute
+	ready   chan bool
+	done    chan bool
+}
+
+// Opaque values aren't hashable so are keyed by their contents
+type opaqueKey string
+
+// Notifications without the key attribute are never coalesced
+type unkeyedKey int
+
+// Start delivering coalesced notifications. deliver must give up if
+// abandon is closed, which stop does.
+func newCoalescer(key string, deliver func(nv map[string]interface{}, abandon <-chan bool)) *coalescer {
+	c := new(coalescer)
+	c.key = key
+	c.deliver = deliver
+	c.latest = make(map[interface{}]map[string]interface{})
+	c.ready = make(chan bool, 1)
+	c.done = make(chan bool)
+	go c.pump()
+	return c
+}
+
+// Add a notification, replacing any pending one with the same key
+func (c *coalescer) put(nv map[string]interface{}) {
+	var k interface{}
+	switch v := nv[c.key].(type) {
+	case nil:
+		c.unkeyed++
+		k = unkeyedKey(c.unkeyed)
+	case []byte:
+		k = opaqueKey(v)
+	default:
+		k = v
+	}
+
+	c.mu.Lock()
+	if _, ok := c.latest[k]; !ok {
+		c.order = append(c.order, k)
+	}
+	c.latest[k] = nv
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- true:
+	default:
+	}
+}
+
+// Take the oldest pending notification
+func (c *coalescer) take() (nv map[string]interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.order) == 0 {
+		return nil, false
+	}
+	k := c.order[0]
+	c.order = c.order[1:]
+	nv = c.latest[k]
+	delete(c.latest, k)
+	return nv, true
+}
+
+// Deliver pending notifications as the consumer reads them
+func (c *coalescer) pump() {
+	for {
+		select {
+		case <-c.ready:
+		case <-c.done:
+			return
+		}
+		for {
+			nv, ok := c.take()
+			if !ok {
+				break
+			}
+			c.deliver(nv, c.done)
+		}
+	}
+}
+
+// Stop delivering, abandoning any delivery the consumer hasn't read.
+// Anything pending is dropped.
+func (c *coalescer) stop() {
+	close(c.done)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	sub := &Subscription{CoalesceKey: "Symbol"}
+	sub.Notifications = make(chan map[string]interface{})
+	sub.coalescer = newCoalescer(sub.CoalesceKey, sub.deliverNow)
+	defer sub.coalescer.stop()
+
+	// Flood without reading
+	symbols := []string{"A", "B", "C"}
+	for i := 0; i < 999; i++ {
+		sub.deliver(map[string]interface{}{"Symbol": symbols[i%3], "Value": int32(i)}, false, nil)
+	}
+	sub.deliver(map[string]interface{}{"Value": int32(-1)}, false, nil)
+
+	latest := make(map[string]int32)
+	count := 0
+	unkeyed := false
+	for done := false; !done; {
+		select {
+		case nv := <-sub.Notifications:
+			count++
+			if symbol, ok := nv["Symbol"].(string); ok {
+				latest[symbol] = nv["Value"].(int32)
+			} else {
+				unkeyed = true
+			}
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+
+	// At most one stale notification was already on its way
+	if count > 5 {
+		t.Fatalf("Expected coalesced delivery, got %d notifications", count)
+	}
+	if latest["A"] != 996 || latest["B"] != 997 || latest["C"] != 998 {
+		t.Fatalf("Expected latest values, got %v", latest)
+	}
+	if !unkeyed {
+		t.Fatalf("Notification without the key was dropped")
+	}
+}
+
+func TestCoalesceStop(t *testing.T) {
+	sub := &Subscription{CoalesceKey: "Symbol"}
+	sub.Notifications = make(chan map[string]interface{})
+	returned := make(chan bool, 1)
+	c := newCoalescer(sub.CoalesceKey, func(nv map[string]interface{}, abandon <-chan bool) {
+		sub.deliverNow(nv, abandon)
+		returned <- true
+	})
+
+	// Nobody reads so the delivery blocks until it's abandoned
+	c.put(map[string]interface{}{"Symbol": "A"})
+	time.Sleep(10 * time.Millisecond)
+	c.stop()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("Stopping didn't abandon the delivery")
+	}
+}
+
+func TestCoalesceSubscribeRefused(t *testing.T) {
+	sub := &Subscription{Expression: "a ==", CoalesceKey: "Symbol"}
+	sub.Notifications = make(chan map[string]interface{})
+	client := fakeConnectedClient(func() { sub.events <- &Nack{ErrorCode: ErrorsParsing} })
+	if err := client.Subscribe(sub); err == nil {
+		t.Fatalf("Nacked Subscribe passed")
+	}
+	if sub.coalescer != nil {
+		t.Fatalf("Coalescer left running after a refused Subscribe")
+	}
+}
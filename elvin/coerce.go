@@ -0,0 +1,94 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+	"math"
+)
+
+// Notify coerces Go types with no Elvin equivalent to the nearest one,
+// unless the client sets StrictTypes:
+//
+//	int8, int16, uint8, uint16  int32
+//	int, uint32                 int64
+//	uint, uint64                int64, an error if it overflows
+//	float32                     float64
+//
+// int32, int64, float64, string and []byte are sent as they are and
+// anything else is an error.
+
+// Return nv with its values coerced to Elvin types. The map is only
+// copied if something changes.
+func CoerceNotification(nv map[string]interface{}) (map[string]interface{}, error) {
+	var coerced map[string]interface{}
+	for name, value := range nv {
+		if NotificationType(value) != NotificationReserved {
+			continue
+		}
+		elvinValue, err := coerce(name, value)
+		if err != nil {
+			return nil, err
+		}
+		if coerced == nil {
+			coerced = make(map[string]interface{}, len(nv))
+			for k, v := range nv {
+				coerced[k] = v
+			}
+		}
+		coerced[name] = elvinValue
+	}
+	if coerced == nil {
+		return nv, nil
+	}
+	return coerced, nil
+}
+
+// Coerce one value to its Elvin type
+func coerce(name string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int8:
+		return int32(v), nil
+	case int16:
+		return int32(v), nil
+	case uint8:
+		return int32(v), nil
+	case uint16:
+		return int32(v), nil
+	case int:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return nil, LocalError(ErrorsAttributeOverflow, name, v)
+		}
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, LocalError(ErrorsAttributeOverflow, name, v)
+		}
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, LocalError(ErrorsBadAttributeType, name, fmt.Sprintf("%T", value))
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceNotification(t *testing.T) {
+	nv := map[string]interface{}{
+		"int8":    int8(-8),
+		"int16":   int16(-16),
+		"uint8":   uint8(8),
+		"uint16":  uint16(16),
+		"int":     int(-1),
+		"uint32":  uint32(math.MaxUint32),
+		"uint":    uint(math.MaxInt64),
+		"uint64":  uint64(64),
+		"float32": float32(0.5),
+		"int32":   int32(32),
+		"string":  "string",
+	}
+	expected := map[string]interface{}{
+		"int8":    int32(-8),
+		"int16":   int32(-16),
+		"uint8":   int32(8),
+		"uint16":  int32(16),
+		"int":     int64(-1),
+		"uint32":  int64(math.MaxUint32),
+		"uint":    int64(math.MaxInt64),
+		"uint64":  int64(64),
+		"float32": float64(0.5),
+		"int32":   int32(32),
+		"string":  "string",
+	}
+	coerced, err := CoerceNotification(nv)
+	if err != nil {
+		t.Fatalf("CoerceNotification failed: %v", err)
+	}
+	if !reflect.DeepEqual(coerced, expected) {
+		t.Fatalf("Expected %v got %v", expected, coerced)
+	}
+	if _, ok := nv["int"].(int); !ok {
+		t.Fatalf("Caller's notification modified")
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"a": uint64(math.MaxInt64) + 1},
+		{"a": uint(math.MaxUint64)},
+	} {
+		if _, err := CoerceNotification(bad); err == nil || !strings.HasPrefix(err.Error(), "[2524]") {
+			t.Fatalf("Expected an overflow for %v, got %v", bad, err)
+		}
+	}
+	if _, err := CoerceNotification(map[string]interface{}{"a": true}); err == nil || !strings.HasPrefix(err.Error(), "[2521]") {
+		t.Fatalf("Expected a bad type, got %v", err)
+	}
+}
+
+func TestStrictTypes(t *testing.T) {
+	client := fakeConnectedClient(func() {})
+	if err := client.Notify(map[string]interface{}{"a": 1}, true, nil); err != nil {
+		t.Fatalf("Coerced Notify failed: %v", err)
+	}
+	client.StrictTypes = true
+	if err := client.Notify(map[string]interface{}{"a": 1}, true, nil); err == nil || !strings.HasPrefix(err.Error(), "[2521]") {
+		t.Fatalf("Expected a bad type, got %v", err)
+	}
+}
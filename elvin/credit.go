@@ -0,0 +1,105 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Credit based flow control state, see Client.CreditWindow
+type credits struct {
+	mu     sync.Mutex
+	tokens chan struct{} // one per notification we may send, nil if unused
+	held   int32         // atomic, notifications the writer holds for credit
+}
+
+// Note how many notifications the writer holds waiting for credit
+func (credits *credits) holding(n int) {
+	atomic.StoreInt32(&credits.held, int32(n))
+}
+
+// Start flow control with a full window, or stop it if window is 0
+func (client *Client) setCredits(window int32) {
+	client.credits.mu.Lock()
+	defer client.credits.mu.Unlock()
+	if window <= 0 {
+		client.credits.tokens = nil
+		return
+	}
+	client.credits.tokens = make(chan struct{}, window)
+	for i := int32(0); i < window; i++ {
+		client.credits.tokens <- struct{}{}
+	}
+}
+
+func (client *Client) creditTokens() chan struct{} {
+	client.credits.mu.Lock()
+	defer client.credits.mu.Unlock()
+	return client.credits.tokens
+}
+
+// The credits we have left, or -1 if flow control isn't in use
+func (client *Client) CreditsAvailable() int {
+	tokens := client.creditTokens()
+	if tokens == nil {
+		return -1
+	}
+	return len(tokens)
+}
+
+// Whether a packet needs a credit to be sent. Only NotifyEmits do as
+// the router credits nothing else. The write handler holds them while
+// we're out of credit and lets control packets pass.
+func needsCredit(buffer []byte) bool {
+	return PacketID(buffer) == PacketNotifyEmit
+}
+
+// Take a credit to send a notification if there's one left
+func takeCredit(tokens chan struct{}) bool {
+	select {
+	case <-tokens:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handle a Credit, topping up our window
+func (client *Client) handleCredit(buffer []byte) (err error) {
+	credit := new(Credit)
+	if err = credit.Decode(buffer); err != nil {
+		return err
+	}
+
+	tokens := client.creditTokens()
+	if tokens == nil {
+		return client.unexpectedPacket(LocalError(ErrorsBadPacketType, credit.IDString()))
+	}
+	for i := uint32(0); i < credit.Credits; i++ {
+		select {
+		case tokens <- struct{}{}:
+		default:
+			return nil // Never more than the window
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+)
+
+// How Subscribe treats a subscription Equal to one the client already
+// has, typically from retry logic subscribing again
+const (
+	DedupOff   = iota // Subscribe again, doubling deliveries
+	DedupWarn         // Subscribe again but report AnomalyDuplicateSubscription
+	DedupReuse        // Don't subscribe, return a DuplicateSubscriptionError
+)
+
+// Returned by Subscribe under DedupReuse. Existing is the subscription
+// to use instead.
+type DuplicateSubscriptionError struct {
+	Existing *Subscription
+}
+
+func (e *DuplicateSubscriptionError) Error() string {
+	return fmt.Sprintf("Duplicates subscription %d (%s)", e.Existing.subID, e.Existing.Expression)
+}
+
+// Find a current subscription Equal to sub, if any
+func (client *Client) equalSubscription(sub *Subscription) *Subscription {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, existing := range client.subscriptions {
+		if existing != sub && existing.Equal(sub) {
+			return existing
+		}
+	}
+	return nil
+}
+
+// Apply the client's DedupSubscriptions mode to a new subscription
+func (client *Client) dedupSubscription(sub *Subscription) error {
+	if client.DedupSubscriptions == DedupOff {
+		return nil
+	}
+	existing := client.equalSubscription(sub)
+	if existing == nil {
+		return nil
+	}
+	if client.DedupSubscriptions == DedupWarn {
+		client.anomaly(AnomalyDuplicateSubscription, "Subscription duplicates %d (%s)", existing.subID, existing.Expression)
+		return nil
+	}
+	return &DuplicateSubscriptionError{existing}
+}
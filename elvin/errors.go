@@ -82,6 +82,31 @@ const (
 	ErrorsClientDisconnecting             = 2507
 	ErrorsProtocolPacketStateNotConnected = 2508
 	ErrorsProtocolPacketStateIsConnected  = 2509
+	ErrorsSchemaMissing                   = 2510
+	ErrorsSchemaType                      = 2511
+	ErrorsSchemaExtra                     = 2512
+	ErrorsMismatchedIDs                   = 2513
+	ErrorsStringTooLong                   = 2514
+	ErrorsOpaqueTooLong                   = 2515
+	ErrorsTooManyNameValues               = 2516
+	ErrorsInsecureSubscription            = 2517
+	ErrorsBadBackoffPolicy                = 2518
+	ErrorsPublishQueueFull                = 2519
+	ErrorsReadOnly                        = 2520
+	ErrorsBadAttributeType                = 2521
+	ErrorsNotSubscribed                   = 2522
+	ErrorsRouterBusy                      = 2523
+	ErrorsAttributeOverflow               = 2524
+	ErrorsNotReliable                     = 2525
+	ErrorsXdrLength                       = 2526
+	ErrorsXdrRange                        = 2527
+	ErrorsNilSubscription                 = 2528
+	ErrorsEmptyExpression                 = 2529
+	ErrorsChunkTooSmall                   = 2530
+	ErrorsChunkWindow                     = 2531
+	ErrorsBadChunk                        = 2532
+	ErrorsReconnectCancelled              = 2533
+	ErrorsChunkTimeout                    = 2534
 )
 
 // Provide a map of error code to string Each error string has a
@@ -151,6 +176,31 @@ func init() {
 	LocalErrors[ErrorsClientIsConnected] = "Client is connected"
 	LocalErrors[ErrorsProtocolPacketStateNotConnected] = "Protocol Error. Received %1 when not connected"
 	LocalErrors[ErrorsProtocolPacketStateIsConnected] = "Protocol Error. Received %1 when connected"
+	LocalErrors[ErrorsSchemaMissing] = "Required attribute %1 is missing"
+	LocalErrors[ErrorsSchemaType] = "Attribute %1 is %2, expected %3"
+	LocalErrors[ErrorsSchemaExtra] = "Attribute %1 is not in the schema"
+	LocalErrors[ErrorsMismatchedIDs] = "Reply for the wrong id, expected:%1, received:%2"
+	LocalErrors[ErrorsStringTooLong] = "String length %1 exceeds limit %2"
+	LocalErrors[ErrorsOpaqueTooLong] = "Opaque length %1 exceeds limit %2"
+	LocalErrors[ErrorsTooManyNameValues] = "Name/value count %1 exceeds limit %2"
+	LocalErrors[ErrorsInsecureSubscription] = "Subscription accepts insecure notifications and has no keys"
+	LocalErrors[ErrorsBadBackoffPolicy] = "Invalid backoff policy: %1"
+	LocalErrors[ErrorsPublishQueueFull] = "Publish queue full while reconnecting"
+	LocalErrors[ErrorsReadOnly] = "Router is read-only"
+	LocalErrors[ErrorsBadAttributeType] = "Attribute %1 has unsupported type %2"
+	LocalErrors[ErrorsNotSubscribed] = "Subscription is not active"
+	LocalErrors[ErrorsRouterBusy] = "Router busy, back off for %1"
+	LocalErrors[ErrorsAttributeOverflow] = "Attribute %1 value %2 overflows int64"
+	LocalErrors[ErrorsNotReliable] = "Notification has no delivery id to acknowledge"
+	LocalErrors[ErrorsXdrLength] = "Implausible %1 %2 with %3 bytes remaining, check the peer's byte order"
+	LocalErrors[ErrorsXdrRange] = "%1 %2 out of range, check the peer's byte order"
+	LocalErrors[ErrorsNilSubscription] = "Subscription is nil"
+	LocalErrors[ErrorsEmptyExpression] = "Subscription expression is empty"
+	LocalErrors[ErrorsChunkTooSmall] = "No room for chunk data within a packet size of %1"
+	LocalErrors[ErrorsChunkWindow] = "Chunk %1 of message %2 is beyond the window of %3"
+	LocalErrors[ErrorsBadChunk] = "Malformed chunk of message %1"
+	LocalErrors[ErrorsReconnectCancelled] = "Reconnect cancelled by Disconnect"
+	LocalErrors[ErrorsChunkTimeout] = "No chunk of message %1 for %2"
 }
 
 // Convert elvin positional formatting to golang style
@@ -0,0 +1,74 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"context"
+)
+
+// Block until the router has confirmed the subscription with a
+// SubReply, returning nil, or its latest SubAddRequest failed,
+// returning why. A subscription held by OfflineQueue is confirmed
+// once it's sent after connecting. Returns ctx.Err() if ctx is done
+// first.
+func (sub *Subscription) WaitEstablished(ctx context.Context) error {
+	sub.establish.Lock()
+	if sub.established == nil {
+		sub.established = make(chan struct{})
+	}
+	established := sub.established
+	sub.establish.Unlock()
+
+	select {
+	case <-established:
+		sub.establish.Lock()
+		defer sub.establish.Unlock()
+		return sub.establishErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Note that a SubAddRequest is about to be made or held, so
+// WaitEstablished waits for its outcome rather than an earlier one
+func (sub *Subscription) establishing() {
+	sub.establish.Lock()
+	defer sub.establish.Unlock()
+	if sub.established == nil || sub.settled {
+		sub.established = make(chan struct{})
+		sub.settled = false
+	}
+}
+
+// Record the outcome of the latest SubAddRequest and release anyone
+// in WaitEstablished
+func (sub *Subscription) settle(err error) {
+	sub.establish.Lock()
+	defer sub.establish.Unlock()
+	if sub.established == nil {
+		sub.established = make(chan struct{})
+	}
+	if !sub.settled {
+		close(sub.established)
+		sub.settled = true
+	}
+	sub.establishErr = err
+}
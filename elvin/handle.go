@@ -0,0 +1,73 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync"
+)
+
+// A subscription along with the client it belongs to, so callers can
+// defer Close rather than track both
+type SubscriptionHandle struct {
+	Subscription *Subscription
+
+	client *Client
+	once   sync.Once
+	err    error
+}
+
+// As Subscribe but returns a handle whose Close deletes the subscription
+func (client *Client) SubscribeHandle(sub *Subscription) (*SubscriptionHandle, error) {
+	if err := client.Subscribe(sub); err != nil {
+		return nil, err
+	}
+	return &SubscriptionHandle{Subscription: sub, client: client}, nil
+}
+
+// Delete the subscription and stop any coalescing of its
+// notifications. If the client isn't connected, say it's reconnecting,
+// the subscription is forgotten so it won't be restored. Only the
+// first call does anything, later calls return its result.
+func (h *SubscriptionHandle) Close() error {
+	h.once.Do(func() {
+		h.err = h.client.SubscriptionDelete(h.Subscription)
+		if h.client.State() != StateConnected {
+			h.client.forgetSubscription(h.Subscription)
+			h.Subscription.retire()
+			h.err = nil
+		}
+	})
+	return h.err
+}
+
+// Drop local state for a subscription without telling the router
+func (client *Client) forgetSubscription(sub *Subscription) {
+	client.unqueueSubscription(sub)
+	client.mu.Lock()
+	if client.subscriptions[sub.subID] == sub {
+		delete(client.subscriptions, sub.subID)
+	}
+	client.mu.Unlock()
+	if sub.coalescer != nil {
+		sub.coalescer.stop()
+		sub.coalescer = nil
+	}
+}
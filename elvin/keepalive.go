@@ -0,0 +1,142 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elog"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// By default clients don't check idle connections
+const DefaultKeepaliveInterval = time.Duration(0)
+
+// Keepalive state, see Client.KeepaliveInterval
+type keepalive struct {
+	interval int64         // atomic, effective interval in ns
+	timeout  int64         // atomic, effective timeout in ns
+	lastRead int64         // atomic, UnixNano of the last packet read
+	reset    chan struct{} // wakes the checker when the values change
+}
+
+// The idle interval and TestConn timeout in effect. These are those
+// the router gave in its ConnReply, otherwise the client's
+// KeepaliveInterval and KeepaliveTimeout, otherwise the package
+// defaults. An interval of zero means idle connections aren't checked.
+func (client *Client) Keepalive() (interval time.Duration, timeout time.Duration) {
+	return time.Duration(atomic.LoadInt64(&client.keepalive.interval)),
+		time.Duration(atomic.LoadInt64(&client.keepalive.timeout))
+}
+
+// Adopt any keepalive the router gave us in a ConnReply
+func (client *Client) setKeepalive(options map[string]interface{}) {
+	interval := DefaultKeepaliveInterval
+	if client.KeepaliveInterval > 0 {
+		interval = client.KeepaliveInterval
+	}
+	if ms, ok := options[TestConnIntervalOption].(int32); ok && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	timeout := TestConnTimeout
+	if client.KeepaliveTimeout > 0 {
+		timeout = client.KeepaliveTimeout
+	}
+	if ms, ok := options[TestConnTimeoutOption].(int32); ok && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	atomic.StoreInt64(&client.keepalive.interval, int64(interval))
+	atomic.StoreInt64(&client.keepalive.timeout, int64(timeout))
+	select {
+	case client.keepalive.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Note that the connection is alive
+func (client *Client) touch() {
+	atomic.StoreInt64(&client.keepalive.lastRead, time.Now().UnixNano())
+}
+
+// How long since we last heard from the router
+func (client *Client) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&client.keepalive.lastRead)))
+}
+
+// Send a TestConn whenever the connection has been idle for the
+// keepalive interval, closing it if the router doesn't respond
+// within the timeout. Runs until done is closed (run as goroutine).
+func (client *Client) checkIdle(conn io.Closer, done chan struct{}) {
+	for {
+		interval, timeout := client.Keepalive()
+		wait := time.Duration(math.MaxInt64)
+		if interval > 0 {
+			wait = interval - client.idle()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-client.keepalive.reset:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		if interval <= 0 || client.idle() < interval {
+			continue
+		}
+
+		if !client.probe(timeout, done) {
+			client.elog.Logf(elog.LogLevelWarning, "No response to TestConn within %v, closing", timeout)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Send a TestConn and wait for the ConfConn, or any other packet, for
+// up to timeout
+func (client *Client) probe(timeout time.Duration, done chan struct{}) bool {
+	writeBuf := new(bytes.Buffer)
+	new(TestConn).Encode(writeBuf)
+	select {
+	case client.writeChannel <- writeBuf:
+	case <-done:
+		return true
+	}
+	sent := time.Now()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-client.confConn:
+	case <-done:
+	case <-timer.C:
+		return client.idle() < time.Since(sent)
+	}
+	return true
+}
@@ -206,10 +206,10 @@ func KeyBlockDeleteKeys(existing KeyBlock, del KeyBlock) {
 		case KeySchemeSha256Producer:
 			fallthrough
 		case KeySchemeSha256Consumer:
-			// If we don't have this scheme already then we can
-			// just copy it in, otherwise check every key
+			// If we don't have this scheme already then ignore
+			// otherwise check every key
 			if kslExisting, ok := existing[scheme]; !ok {
-				existing[scheme] = del[scheme]
+				continue
 			} else {
 				for _, keyDel := range kslDel[KeySetDualProducer] {
 					KeySetDeleteKey(&kslExisting[KeySetDualProducer], keyDel)
@@ -218,3 +218,67 @@ func KeyBlockDeleteKeys(existing KeyBlock, del KeyBlock) {
 		}
 	}
 }
+
+// A copy of a keyblock that may be changed without changing the
+// original. The keys themselves are shared.
+func KeyBlockCopy(keys KeyBlock) KeyBlock {
+	copied := make(KeyBlock, len(keys))
+	for scheme, ksl := range keys {
+		copied[scheme] = make(KeySetList, len(ksl))
+		for i, ks := range ksl {
+			copied[scheme][i] = append(KeySet(nil), ks...)
+		}
+	}
+	return copied
+}
+
+// Does a keyblock hold no keys at all?
+func KeyBlockEmpty(keys KeyBlock) bool {
+	for _, ksl := range keys {
+		for _, ks := range ksl {
+			if len(ks) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Are two keysets equal? Order is irrelevant
+func KeySetEqual(a KeySet, b KeySet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, keyA := range a {
+		found := false
+		for _, keyB := range b {
+			if bytes.Equal(keyA, keyB) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Are two keyblocks equal? Key order within each keyset is irrelevant
+func KeyBlockEqual(a KeyBlock, b KeyBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for scheme, kslA := range a {
+		kslB, ok := b[scheme]
+		if !ok || len(kslA) != len(kslB) {
+			return false
+		}
+		for i := range kslA {
+			if !KeySetEqual(kslA[i], kslB[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -125,4 +125,10 @@ func TestKeyBlock(t *testing.T) {
 		t.Fatalf("KeyBlockDeleteKeys() failed: %v", b1)
 	}
 
+	// Test changing a copy leaves the original alone
+	b3 := KeyBlockCopy(b1)
+	KeyBlockDeleteKeys(b3, b1)
+	if len(b1[KeySchemeSha1Producer][KeySetProducer]) != 1 || !KeyBlockEmpty(b3) {
+		t.Fatalf("KeyBlockCopy() failed: %v %v", b1, b3)
+	}
 }
@@ -36,8 +36,11 @@ const (
 	inNumber
 )
 
-// Pseudo-terminal, used to report a lexing error to the parser.
-const terminalError = -1
+// Pseudo-terminals, used to report a lexing error to the parser.
+const (
+	terminalError              = -1
+	terminalUnterminatedString = -2 // missing its closing quote
+)
 
 // Structure used to pass tokens to the parser.
 type tokenInfo struct {
@@ -201,7 +204,8 @@ func Lexer(buf string) []tokenInfo {
 				mode = inLimbo
 			} else if eof {
 				err := fmt.Sprintf("String missing closing single quote at index %d", i)
-				tokens = append(tokens, tokenInfo{terminalError, err})
+				tokens = append(tokens, tokenInfo{terminalUnterminatedString, err})
+				break
 			} else {
 				tokenValue.WriteRune(rune1)
 			}
@@ -216,7 +220,8 @@ func Lexer(buf string) []tokenInfo {
 				mode = inLimbo
 			} else if eof {
 				err := fmt.Sprintf("String missing closing double quote at index %d", i)
-				tokens = append(tokens, tokenInfo{terminalError, err})
+				tokens = append(tokens, tokenInfo{terminalUnterminatedString, err})
+				break
 			} else {
 				tokenValue.WriteRune(rune1)
 			}
@@ -0,0 +1,103 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync/atomic"
+)
+
+// A subscription's deliveries stop when SubscriptionDelete is called:
+// a send the consumer isn't taking is abandoned, by the read handler
+// or any coalescer, so the consumer may stop reading first. If the
+// delete fails deliveries resume, otherwise nothing more is sent on
+// the subscription's channels once SubscriptionDelete returns, and if
+// CloseOnDelete is set they're closed.
+
+// Send on one of the subscription's channels unless it's deleted.
+// send must also select on stop and give up when it's closed.
+func (sub *Subscription) send(send func(stop <-chan struct{})) {
+	sub.life.RLock()
+	defer sub.life.RUnlock()
+	if atomic.LoadInt32(&sub.retired) != 0 {
+		return
+	}
+	sub.halting.Lock()
+	stop := sub.stop
+	sub.halting.Unlock()
+	send(stop)
+}
+
+// Abandon sends in progress and any made until resume or retire
+func (sub *Subscription) halt() {
+	sub.halting.Lock()
+	defer sub.halting.Unlock()
+	if sub.stop == nil {
+		sub.stop = make(chan struct{})
+	}
+	if !sub.halted {
+		close(sub.stop)
+		sub.halted = true
+	}
+}
+
+// Allow sends again, as the subscription is (re)subscribed or its
+// delete failed
+func (sub *Subscription) resume() {
+	if atomic.LoadInt32(&sub.retired) != 0 {
+		// Nothing's sending so this won't wait
+		sub.life.Lock()
+		atomic.StoreInt32(&sub.retired, 0)
+		sub.life.Unlock()
+	}
+	sub.halting.Lock()
+	defer sub.halting.Unlock()
+	if sub.stop == nil || sub.halted {
+		sub.stop = make(chan struct{})
+		sub.halted = false
+	}
+}
+
+// Stop sends for good, waiting for any in progress to give up, and
+// close the channels if asked to
+func (sub *Subscription) retire() {
+	sub.halt()
+	sub.life.Lock()
+	defer sub.life.Unlock()
+	if atomic.LoadInt32(&sub.retired) != 0 {
+		return
+	}
+	atomic.StoreInt32(&sub.retired, 1)
+	if !sub.CloseOnDelete {
+		return
+	}
+	if sub.Notifications != nil {
+		close(sub.Notifications)
+	}
+	if sub.Typed != nil {
+		close(sub.Typed)
+	}
+	if sub.Deliveries != nil {
+		close(sub.Deliveries)
+	}
+	if sub.Ordered != nil {
+		close(sub.Ordered)
+	}
+}
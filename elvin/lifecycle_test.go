@@ -0,0 +1,110 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// A client that looks connected to a router streaming notifications
+// to subID from its read handler, which also answers each request with
+// a SubReply for subID as a real one would, in turn
+func streamingClient(subID int64) (client *Client, stop func()) {
+	client = NewClient("elvin://", nil, nil, nil)
+	client.SetState(StateConnected)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := int32(0); ; i++ {
+			buf := new(bytes.Buffer)
+			select {
+			case <-done:
+				return
+			case <-client.writeChannel:
+				client.mu.Lock()
+				var xID uint32
+				for xID = range client.subReplies {
+				}
+				client.mu.Unlock()
+				reply := &SubReply{XID: xID, SubID: subID}
+				reply.Encode(buf)
+			default:
+				deliver := &NotifyDeliver{NameValue: map[string]interface{}{"n": i}, Insecure: []int64{subID}}
+				deliver.Encode(buf)
+			}
+			client.handlePacket(buf.Bytes())
+		}
+	}()
+	return client, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestDeleteWhileStreaming(t *testing.T) {
+	for _, closeOnDelete := range []bool{false, true} {
+		client, stop := streamingClient(42)
+		sub := &Subscription{
+			Expression:    "require(n)",
+			Notifications: make(chan map[string]interface{}),
+			CloseOnDelete: closeOnDelete,
+		}
+		if err := client.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+
+		// Read a few then stop, as a consumer that's going away would
+		for i := 0; i < 10; i++ {
+			select {
+			case <-sub.Notifications:
+			case <-time.After(time.Second):
+				t.Fatalf("Notification wasn't delivered")
+			}
+		}
+
+		deleted := make(chan error)
+		go func() { deleted <- client.SubscriptionDelete(sub) }()
+		select {
+		case err := <-deleted:
+			if err != nil {
+				t.Fatalf("SubscriptionDelete failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("SubscriptionDelete blocked by the unread channel")
+		}
+
+		// Still streaming, but nothing more is delivered
+		select {
+		case nv, ok := <-sub.Notifications:
+			if ok || !closeOnDelete {
+				t.Fatalf("Delivered %v after SubscriptionDelete", nv)
+			}
+		case <-time.After(20 * time.Millisecond):
+			if closeOnDelete {
+				t.Fatalf("Notifications not closed")
+			}
+		}
+		stop()
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"context"
+	"github.com/cobaro/elvin/elog"
+	"sync/atomic"
+)
+
+// Move every subscription from this client to newClient, say to leave
+// a draining router. Each is subscribed on newClient and confirmed
+// before any is deleted here, so nothing is missed. Until the deletes
+// are confirmed both connections deliver, so a notification arriving
+// in that window may be delivered twice. Afterwards the caller's
+// Subscriptions belong to newClient, with new SubIDs.
+//
+// If any subscription fails on newClient those already made there
+// are deleted and this client is left as it was.
+func (client *Client) MigrateSubscriptions(newClient *Client) (err error) {
+	client.mu.Lock()
+	subs := make([]*Subscription, 0, len(client.subscriptions))
+	for _, sub := range client.subscriptions {
+		subs = append(subs, sub)
+	}
+	queued := client.queued
+	client.queued = nil
+	client.mu.Unlock()
+
+	// Held subscriptions were never sent so simply move
+	for _, sub := range queued {
+		if err = newClient.Subscribe(sub); err != nil {
+			client.elog.Logf(elog.LogLevelWarning, "Migrating queued subscription %q failed: %v", sub.Expression, err)
+		}
+	}
+
+	// Establish stand-ins delivering to the same channels
+	migrants := make([]*Subscription, len(subs))
+	for i, sub := range subs {
+		migrants[i] = sub.migrant()
+		if err = newClient.Subscribe(migrants[i]); err != nil {
+			for _, migrant := range migrants[:i] {
+				newClient.SubscriptionDelete(migrant)
+				newClient.forgetSubscription(migrant)
+			}
+			return err
+		}
+		if sub.Paused() {
+			newClient.subscriptionPause(migrants[i], true)
+		}
+	}
+
+	// Tear down the originals, which live on, and have them take over
+	for i, sub := range subs {
+		err := LocalError(ErrorsClientNotConnected)
+		if client.State() == StateConnected {
+			err = client.subscriptionDelete(context.Background(), sub, nil)
+		}
+		if err != nil {
+			client.elog.Logf(elog.LogLevelWarning, "Deleting migrated subscription %d failed: %v", sub.subID, err)
+			client.forgetSubscription(sub)
+		}
+
+		migrant := migrants[i]
+		newClient.mu.Lock()
+		sub.subID = migrant.subID
+		sub.events = migrant.events
+		sub.coalescer = migrant.coalescer
+		newClient.subscriptions[sub.subID] = sub
+		newClient.mu.Unlock()
+	}
+	return nil
+}
+
+// A copy of a subscription, sharing its channels, to establish on
+// another connection
+func (sub *Subscription) migrant() *Subscription {
+	migrant := &Subscription{
+		Expression:          sub.Expression,
+		AcceptInsecure:      sub.AcceptInsecure,
+		InsecureOK:          sub.InsecureOK,
+		Keys:                sub.Keys,
+		Notifications:       sub.Notifications,
+		Payload:             sub.Payload,
+		Decoder:             sub.Decoder,
+		Typed:               sub.Typed,
+		Deliveries:          sub.Deliveries,
+		Ordered:             sub.Ordered,
+		CoalesceKey:         sub.CoalesceKey,
+		Sequence:            sub.Sequence,
+		MaxNotificationSize: sub.MaxNotificationSize,
+		Projection:          sub.Projection,
+		Reliable:            sub.Reliable,
+		ManualAck:           sub.ManualAck,
+	}
+	atomic.StoreInt32(&migrant.paused, atomic.LoadInt32(&sub.paused))
+	return migrant
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A client that looks connected to a router answering each request
+// with a SubReply, for a new subscription with its expression's id.
+// before is called with the request's subscription first.
+func mockRouterClient(ids map[string]int64, before func(*Subscription)) *Client {
+	client := NewClient("elvin://", nil, nil, nil)
+	client.SetState(StateConnected)
+	go func() {
+		for range client.writeChannel {
+			client.mu.Lock()
+			var xID uint32
+			var sub *Subscription
+			for xID, sub = range client.subReplies {
+			}
+			client.mu.Unlock()
+			if before != nil {
+				before(sub)
+			}
+
+			reply := &SubReply{XID: xID, SubID: sub.subID}
+			if reply.SubID == 0 {
+				reply.SubID = ids[sub.Expression]
+			}
+			buf := new(bytes.Buffer)
+			reply.Encode(buf)
+			client.handlePacket(buf.Bytes())
+		}
+	}()
+	return client
+}
+
+// Deliver nv to subID as though the router sent it
+func mockDeliver(client *Client, subID int64, nv map[string]interface{}) {
+	buf := new(bytes.Buffer)
+	deliver := &NotifyDeliver{NameValue: nv, Insecure: []int64{subID}}
+	deliver.Encode(buf)
+	client.handlePacket(buf.Bytes())
+}
+
+func TestMigrateSubscriptions(t *testing.T) {
+	var newClient *Client
+	old := mockRouterClient(map[string]int64{"require(n)": 1, "require(m)": 2}, func(sub *Subscription) {
+		if sub.subID != 0 && newClient != nil {
+			// Deleting the original, the stand-in is already live
+			mockDeliver(newClient, sub.subID+100, map[string]interface{}{"n": int32(2)})
+		}
+	})
+	newClient = mockRouterClient(map[string]int64{"require(n)": 101, "require(m)": 102}, nil)
+
+	sub := &Subscription{Expression: "require(n)", Notifications: make(chan map[string]interface{}, 4)}
+	other := &Subscription{Expression: "require(m)", Notifications: make(chan map[string]interface{}, 4)}
+	for _, s := range []*Subscription{sub, other} {
+		if err := old.Subscribe(s); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	oldID := sub.SubID()
+	mockDeliver(old, oldID, map[string]interface{}{"n": int32(1)})
+
+	if err := old.MigrateSubscriptions(newClient); err != nil {
+		t.Fatalf("MigrateSubscriptions failed: %v", err)
+	}
+	if sub.SubID() != oldID+100 || other.SubID() == 0 {
+		t.Fatalf("Expected new SubIDs, got %d and %d", sub.SubID(), other.SubID())
+	}
+	if len(old.subscriptions) != 0 || newClient.subscriptions[sub.SubID()] != sub {
+		t.Fatalf("Subscriptions not moved: old %v new %v", old.subscriptions, newClient.subscriptions)
+	}
+
+	// Now only the new connection delivers
+	mockDeliver(old, oldID, map[string]interface{}{"n": int32(0)})
+	mockDeliver(newClient, sub.SubID(), map[string]interface{}{"n": int32(3)})
+
+	for expected := int32(1); expected <= 3; expected++ {
+		select {
+		case nv := <-sub.Notifications:
+			if nv["n"] != expected {
+				t.Fatalf("Expected n == %d, got %v", expected, nv)
+			}
+		default:
+			t.Fatalf("Missing n == %d", expected)
+		}
+	}
+	select {
+	case nv := <-sub.Notifications:
+		t.Fatalf("Unexpected %v", nv)
+	default:
+	}
+}
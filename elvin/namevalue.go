@@ -32,6 +32,30 @@ import (
 
 const DefaultNameValueTimeFormat = "2006-01-02T15:04:05.999999999-0700"
 
+// A reserved attribute carrying a notification's time-to-live in
+// milliseconds. Routers remove it and drop the notification for any
+// consumer it can't be queued to within the TTL.
+const TTLAttribute = "elvin:TTL"
+
+// A reserved attribute the router adds to a secure delivery carrying
+// the subscriber's key that matched. Clients remove it and report it
+// in the Delivery.
+const MatchedKeyAttribute = "elvin:MatchedKey"
+
+// A reserved attribute the router adds to a delivery to a Reliable
+// subscription, an int64 identifying it for the DeliveryAck. A
+// redelivery has the same id.
+const DeliveryIDAttribute = "elvin:DeliveryID"
+
+// A reserved quench name asking the router to include the quencher's
+// own subscriptions. Routers remove it from the quench's names.
+const QuenchNotifySelfName = "elvin:NotifySelf"
+
+// Set a notification's time-to-live
+func SetTTL(nv map[string]interface{}, ttl time.Duration) {
+	nv[TTLAttribute] = int64(ttl / time.Millisecond)
+}
+
 // Pretty print a NameValue in a standardized format
 // separator is appended to the output
 // If timsta
@@ -0,0 +1,93 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"github.com/cobaro/elvin/elog"
+	"sync/atomic"
+)
+
+// What Subscribe and Notify do while the client isn't connected, see
+// Client.OfflinePolicy
+const (
+	// Fail with ErrorsClientNotConnected. While reconnecting Notify
+	// still follows PublishQueue and PublishWait.
+	OfflineFailFast = iota
+	// Hold subscriptions and notifications until the next Connect or
+	// reconnection succeeds and then send them, subscriptions first.
+	// Held notifications are limited by PublishQueue if that's set.
+	OfflineQueue
+)
+
+// Whether Notify should fail as we're not connected
+func (client *Client) offline() bool {
+	return client.State() != StateConnected &&
+		atomic.LoadInt32(&client.reconnecting) == 0 &&
+		client.OfflinePolicy != OfflineQueue
+}
+
+// Hold a subscription until we're connected, returning false if we
+// already are
+func (client *Client) queueSubscription(sub *Subscription) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.State() == StateConnected {
+		return false
+	}
+	sub.establishing()
+	client.queued = append(client.queued, sub)
+	return true
+}
+
+// Forget a held subscription, returning false if it wasn't held
+func (client *Client) unqueueSubscription(sub *Subscription) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for i, queued := range client.queued {
+		if queued == sub {
+			client.queued = append(client.queued[:i], client.queued[i+1:]...)
+			sub.settle(LocalError(ErrorsNotSubscribed))
+			return true
+		}
+	}
+	return false
+}
+
+// Send the subscriptions and notifications held while we weren't
+// connected. A held subscription that now fails is only logged as
+// its Subscribe has long since returned.
+func (client *Client) flushQueued() {
+	client.mu.Lock()
+	queued := client.queued
+	client.queued = nil
+	pending := client.pending
+	client.pending = nil
+	client.mu.Unlock()
+
+	for _, sub := range queued {
+		if err := client.Subscribe(sub); err != nil {
+			client.elog.Logf(elog.LogLevelWarning, "Queued subscription %q failed: %v", sub.Expression, err)
+		}
+	}
+	for _, writeBuf := range pending {
+		client.writeChannel <- writeBuf
+	}
+}
@@ -23,66 +23,75 @@ package elvin
 import (
 	"bytes"
 	"encoding/binary"
+	"strings"
 )
 
 const (
-	PacketReserved            = 0
-	PacketSvrRequest          = 16
-	PacketSvrAdvt             = 17
-	PacketSvrAdvtClose        = 18
-	PacketUNotify             = 32
-	PacketNack                = 48
-	PacketConnRequest         = 49
-	PacketConnReply           = 50
-	PacketDisconnRequest      = 51
-	PacketDisconnReply        = 52
-	PacketDisconn             = 53
-	PacketSecRequest          = 54
-	PacketSecReply            = 55
-	PacketNotifyEmit          = 56
-	PacketNotifyDeliver       = 57
-	PacketSubAddRequest       = 58
-	PacketSubModRequest       = 59
-	PacketSubDelRequest       = 60
-	PacketSubReply            = 61
-	PacketDropWarn            = 62
-	PacketTestConn            = 63
-	PacketConfConn            = 64
-	PacketAck                 = 65
-	PacketStatusUpdate        = 66
-	PacketAuthRequest         = 67
-	PacketAuthCont            = 68
-	PacketAuthAck             = 69
-	PacketQosRequest          = 70
-	PacketQosReply            = 71
-	PacketQuenchAddRequest    = 80
-	PacketQuenchModRequest    = 81
-	PacketQuenchDelRequest    = 82
-	PacketQuenchReply         = 83
-	PacketSubAddNotify        = 84
-	PacketSubModNotify        = 85
-	PacketSubDelNotify        = 86
-	PacketActivate            = 128
-	PacketStandby             = 129
-	PacketRestart             = 130
-	PacketShutdown            = 131
-	PacketServerReport        = 132
-	PacketServerNack          = 133
-	PacketServerStatsReport   = 134
-	PacketClstJoinRequest     = 160
-	PacketClstJoinReply       = 161
-	PacketClstTerms           = 162
-	PacketClstNotify          = 163
-	PacketClstRedir           = 164
-	PacketClstLeave           = 165
-	PacketFedConnRequest      = 192
-	PacketFedConnReply        = 193
-	PacketFedSubReplace       = 194
-	PacketFedNotify           = 195
-	PacketFedSubDiff          = 196
-	PacketFailoverConnRequest = 224
-	PacketFailoverConnReply   = 225
-	PacketFailoverMaster      = 226
+	PacketReserved             = 0
+	PacketSvrRequest           = 16
+	PacketSvrAdvt              = 17
+	PacketSvrAdvtClose         = 18
+	PacketUNotify              = 32
+	PacketNack                 = 48
+	PacketConnRequest          = 49
+	PacketConnReply            = 50
+	PacketDisconnRequest       = 51
+	PacketDisconnReply         = 52
+	PacketDisconn              = 53
+	PacketSecRequest           = 54
+	PacketSecReply             = 55
+	PacketNotifyEmit           = 56
+	PacketNotifyDeliver        = 57
+	PacketSubAddRequest        = 58
+	PacketSubModRequest        = 59
+	PacketSubDelRequest        = 60
+	PacketSubReply             = 61
+	PacketDropWarn             = 62
+	PacketTestConn             = 63
+	PacketConfConn             = 64
+	PacketAck                  = 65
+	PacketStatusUpdate         = 66
+	PacketAuthRequest          = 67
+	PacketAuthCont             = 68
+	PacketAuthAck              = 69
+	PacketQosRequest           = 70
+	PacketQosReply             = 71
+	PacketQuenchAddRequest     = 80
+	PacketQuenchModRequest     = 81
+	PacketQuenchDelRequest     = 82
+	PacketQuenchReply          = 83
+	PacketSubAddNotify         = 84
+	PacketSubModNotify         = 85
+	PacketSubDelNotify         = 86
+	PacketCredit               = 96  // Local to this implementation
+	PacketMatchCountRequest    = 97  // Local to this implementation
+	PacketMatchCountReply      = 98  // Local to this implementation
+	PacketSubAddOptionsRequest = 99  // Local to this implementation
+	PacketSubPauseRequest      = 100 // Local to this implementation
+	PacketBusy                 = 101 // Local to this implementation
+	PacketDeliveryAck          = 102 // Local to this implementation
+	PacketSubRemoved           = 103 // Local to this implementation
+	PacketActivate             = 128
+	PacketStandby              = 129
+	PacketRestart              = 130
+	PacketShutdown             = 131
+	PacketServerReport         = 132
+	PacketServerNack           = 133
+	PacketServerStatsReport    = 134
+	PacketClstJoinRequest      = 160
+	PacketClstJoinReply        = 161
+	PacketClstTerms            = 162
+	PacketClstNotify           = 163
+	PacketClstRedir            = 164
+	PacketClstLeave            = 165
+	PacketFedConnRequest       = 192
+	PacketFedConnReply         = 193
+	PacketFedSubReplace        = 194
+	PacketFedNotify            = 195
+	PacketFedSubDiff           = 196
+	PacketFailoverConnRequest  = 224
+	PacketFailoverConnReply    = 225
+	PacketFailoverMaster       = 226
 )
 
 // In a protocol packet the type is encoded
@@ -165,6 +174,22 @@ func PacketIDString(packetID int) string {
 		return "SubModNotify"
 	case PacketSubDelNotify:
 		return "SubDelNotify"
+	case PacketCredit:
+		return "Credit"
+	case PacketMatchCountRequest:
+		return "MatchCountRequest"
+	case PacketMatchCountReply:
+		return "MatchCountReply"
+	case PacketSubAddOptionsRequest:
+		return "SubAddOptionsRequest"
+	case PacketSubPauseRequest:
+		return "SubPauseRequest"
+	case PacketBusy:
+		return "Busy"
+	case PacketDeliveryAck:
+		return "DeliveryAck"
+	case PacketSubRemoved:
+		return "SubRemoved"
 	case PacketActivate:
 		return "Activate"
 	case PacketStandby:
@@ -212,6 +237,86 @@ func PacketIDString(packetID int) string {
 	}
 }
 
+// Decode a packet returning a one line summary of its type and
+// contents, e.g., for tracing a conversation
+func PacketSummary(buffer []byte) string {
+	var pkt interface {
+		Decode(bytes []byte) (err error)
+		String() string
+	}
+
+	switch PacketID(buffer) {
+	case PacketUNotify:
+		pkt = new(UNotify)
+	case PacketNack:
+		pkt = new(Nack)
+	case PacketConnRequest:
+		pkt = new(ConnRequest)
+	case PacketConnReply:
+		pkt = new(ConnReply)
+	case PacketDisconnRequest:
+		pkt = new(DisconnRequest)
+	case PacketDisconnReply:
+		pkt = new(DisconnReply)
+	case PacketDisconn:
+		pkt = new(Disconn)
+	case PacketSecRequest:
+		pkt = new(SecRequest)
+	case PacketSecReply:
+		pkt = new(SecReply)
+	case PacketNotifyEmit:
+		pkt = new(NotifyEmit)
+	case PacketNotifyDeliver:
+		pkt = new(NotifyDeliver)
+	case PacketSubAddRequest:
+		pkt = new(SubAddRequest)
+	case PacketSubModRequest:
+		pkt = new(SubModRequest)
+	case PacketSubDelRequest:
+		pkt = new(SubDelRequest)
+	case PacketSubReply:
+		pkt = new(SubReply)
+	case PacketQuenchAddRequest:
+		pkt = new(QuenchAddRequest)
+	case PacketQuenchModRequest:
+		pkt = new(QuenchModRequest)
+	case PacketQuenchDelRequest:
+		pkt = new(QuenchDelRequest)
+	case PacketQuenchReply:
+		pkt = new(QuenchReply)
+	case PacketSubAddNotify:
+		pkt = new(SubAddNotify)
+	case PacketSubModNotify:
+		pkt = new(SubModNotify)
+	case PacketSubDelNotify:
+		pkt = new(SubDelNotify)
+	case PacketCredit:
+		pkt = new(Credit)
+	case PacketMatchCountRequest:
+		pkt = new(MatchCountRequest)
+	case PacketMatchCountReply:
+		pkt = new(MatchCountReply)
+	case PacketSubAddOptionsRequest:
+		pkt = new(SubAddOptionsRequest)
+	case PacketSubPauseRequest:
+		pkt = new(SubPauseRequest)
+	case PacketBusy:
+		pkt = new(Busy)
+	case PacketDeliveryAck:
+		pkt = new(DeliveryAck)
+	case PacketSubRemoved:
+		pkt = new(SubRemoved)
+	default:
+		// DropWarn, TestConn, ConfConn etc have no contents
+		return PacketIDString(PacketID(buffer))
+	}
+
+	if err := pkt.Decode(buffer); err != nil {
+		return PacketIDString(PacketID(buffer)) + " (undecodable: " + err.Error() + ")"
+	}
+	return PacketIDString(PacketID(buffer)) + " " + strings.Replace(strings.TrimSpace(pkt.String()), "\n", ", ", -1)
+}
+
 // All packets must implement these
 type Packet interface {
 	ID() int
@@ -33,11 +33,90 @@ const (
 	DisconnReasonRouterRedirect       = 2
 	DisconnReasonRouterProtocolErrors = 4
 
+	// Local to this router
+	DisconnReasonRouterAdmin = 50 // An administrator disconnected us
+
 	// Local to client library
 	DisconnReasonClientConnectionLost = 100 // e.g., econnlost
 	DisconnReasonClientProtocolErrors = 101 // e.g., packet decoding failed
 )
 
+// A ConnRequest option giving the connection's delivery priority as
+// an int32, 0 by default. Under back-pressure a router may drop
+// deliveries to lower priority connections rather than wait for them.
+const PriorityOption = "elvin:Priority"
+
+// A ConnRequest option asking for credit based flow control with a
+// window of this many (int32) notifications in flight. A router that
+// supports it replies with CreditsGrantedOption giving the window it
+// allows and sends Credit packets as it processes notifications.
+const (
+	CreditsOption        = "elvin:Credits"
+	CreditsGrantedOption = "elvin:CreditsGranted"
+)
+
+// A ConnRequest option choosing how deliveries to the connection are
+// ordered. With DeliveryOrderFIFO, the default, notifications arrive
+// in the order they were emitted across all the connection's
+// subscriptions, one NotifyDeliver covering every subscription a
+// notification matches. With DeliveryOrderSubscription they're only
+// ordered within each subscription and arrive as a NotifyDeliver per
+// subscription, so a client may hand each subscription's deliveries
+// to its own consumer without a slow one holding up the others, at
+// the cost of more packets. Either way the router waits on a backed
+// up connection.
+const (
+	DeliveryOrderOption       = "elvin:DeliveryOrder"
+	DeliveryOrderFIFO         = "FIFO"
+	DeliveryOrderSubscription = "Subscription"
+)
+
+// A ConnRequest option naming a session. A router that supports them
+// retains a session's subscriptions for a while after its connection
+// is lost, buffering the notifications they match, and gives the
+// session's secret with SessionTokenOption (string) in the ConnReply.
+// A connection naming the session again and sending that secret back
+// with SessionTokenOption is told with SessionResumedOption (int32 1)
+// in the ConnReply, and as it subscribes again with the same
+// expressions it's sent what each subscription missed. A clean
+// Disconnect ends the session.
+const (
+	SessionOption        = "elvin:Session"
+	SessionTokenOption   = "elvin:SessionToken"
+	SessionResumedOption = "elvin:SessionResumed"
+)
+
+// A ConnReply option (string) a router may give, identifying the
+// connection in its logs and admin interface. See Client.ConnectionID.
+const ConnectionIDOption = "elvin:ConnectionID"
+
+// A ConnRequest option (string) naming the marshal a client would
+// like to use, which the router's ConnReply confirms or replaces with
+// the one it'll use instead. Both currently only implement MarshalXDR.
+const (
+	MarshalOption = "elvin:Marshal"
+	MarshalXDR    = "xdr"
+)
+
+// Can packets be encoded with the named marshal?
+func supportedMarshal(marshal string) bool {
+	return marshal == MarshalXDR
+}
+
+// A ConnReply option (int32) a router limiting each connection's
+// subscriptions may give, saying how many more it may add. See
+// Client.SubscriptionQuotaRemaining.
+const SubscriptionQuotaOption = "elvin:SubscriptionQuota"
+
+// ConnReply options a router may give, as int32 milliseconds, saying
+// how long it lets a connection idle before sending a TestConn and how
+// long it then waits for the ConfConn. Clients adopt these for their
+// own keepalive.
+const (
+	TestConnIntervalOption = "elvin:TestConnInterval"
+	TestConnTimeoutOption  = "elvin:TestConnTimeout"
+)
+
 // Packet: Connection Request
 type ConnRequest struct {
 	XID          uint32
@@ -441,3 +520,84 @@ func (pkt *ConfConn) Decode(bytes []byte) (err error) {
 func (pkt *ConfConn) Encode(buffer *bytes.Buffer) {
 	XdrPutInt32(buffer, int32(pkt.ID()))
 }
+
+// Packet: Credit
+type Credit struct {
+	Credits uint32 // Further notifications the client may send
+}
+
+// Integer value of packet type
+func (pkt *Credit) ID() int {
+	return PacketCredit
+}
+
+// String representation of packet type
+func (pkt *Credit) IDString() string {
+	return "Credit"
+}
+
+// Pretty print with indent
+func (pkt *Credit) IString(indent string) string {
+	return fmt.Sprintf(
+		"%sCredits: %d\n",
+		indent, pkt.Credits)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *Credit) String() string {
+	return pkt.IString("")
+}
+
+// Decode a Credit packet from a byte array
+func (pkt *Credit) Decode(bytes []byte) (err error) {
+	offset := 4 // header
+
+	pkt.Credits, _, err = XdrGetUint32(bytes[offset:])
+	return err
+}
+
+func (pkt *Credit) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.Credits)
+}
+
+// Packet: Busy, sent instead of accepting a NotifyEmit while the
+// router is overloaded. The notification is dropped.
+type Busy struct {
+	Backoff uint32 // Suggested milliseconds to wait before notifying again
+}
+
+// Integer value of packet type
+func (pkt *Busy) ID() int {
+	return PacketBusy
+}
+
+// String representation of packet type
+func (pkt *Busy) IDString() string {
+	return "Busy"
+}
+
+// Pretty print with indent
+func (pkt *Busy) IString(indent string) string {
+	return fmt.Sprintf(
+		"%sBackoff: %d\n",
+		indent, pkt.Backoff)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *Busy) String() string {
+	return pkt.IString("")
+}
+
+// Decode a Busy packet from a byte array
+func (pkt *Busy) Decode(bytes []byte) (err error) {
+	offset := 4 // header
+
+	pkt.Backoff, _, err = XdrGetUint32(bytes[offset:])
+	return err
+}
+
+func (pkt *Busy) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.Backoff)
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Packet: MatchCountRequest. Asks how many subscriptions currently
+// match NameValue and would accept it sent with DeliverInsecure and
+// Keys, or if NameValue is empty, share an attribute name with
+// Expression. With neither all subscriptions are counted.
+type MatchCountRequest struct {
+	XID             uint32
+	Expression      string
+	NameValue       map[string]interface{}
+	DeliverInsecure bool     // as for a NotifyEmit of NameValue
+	Keys            KeyBlock // as for a NotifyEmit of NameValue
+}
+
+// Integer value of packet type
+func (pkt *MatchCountRequest) ID() int {
+	return PacketMatchCountRequest
+}
+
+// String representation of packet type
+func (pkt *MatchCountRequest) IDString() string {
+	return "MatchCountRequest"
+}
+
+// Pretty print with indent
+func (pkt *MatchCountRequest) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n%sExpression %v\n%sNameValue %v\n%sDeliverInsecure %v\n%sKeys %v\n",
+		indent, pkt.XID,
+		indent, pkt.Expression,
+		indent, pkt.NameValue,
+		indent, pkt.DeliverInsecure,
+		indent, pkt.Keys)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *MatchCountRequest) String() string {
+	return pkt.IString("")
+}
+
+// Decode a MatchCountRequest packet from a byte array
+func (pkt *MatchCountRequest) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Expression, used, err = XdrGetString(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.NameValue, used, err = XdrGetNotification(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DeliverInsecure, used, err = XdrGetBool(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Keys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a MatchCountRequest from a buffer
+func (pkt *MatchCountRequest) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.XID)
+	XdrPutString(buffer, pkt.Expression)
+	XdrPutNotification(buffer, pkt.NameValue)
+	XdrPutBool(buffer, pkt.DeliverInsecure)
+	XdrPutKeys(buffer, pkt.Keys)
+}
+
+// Packet: MatchCountReply, answering a MatchCountRequest
+type MatchCountReply struct {
+	XID   uint32
+	Count uint32
+}
+
+// Integer value of packet type
+func (pkt *MatchCountReply) ID() int {
+	return PacketMatchCountReply
+}
+
+// String representation of packet type
+func (pkt *MatchCountReply) IDString() string {
+	return "MatchCountReply"
+}
+
+// Pretty print with indent
+func (pkt *MatchCountReply) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n%sCount %v\n",
+		indent, pkt.XID,
+		indent, pkt.Count)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *MatchCountReply) String() string {
+	return pkt.IString("")
+}
+
+// Decode a MatchCountReply packet from a byte array
+func (pkt *MatchCountReply) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Count, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a MatchCountReply from a buffer
+func (pkt *MatchCountReply) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.XID)
+	XdrPutUint32(buffer, pkt.Count)
+}
@@ -84,6 +84,9 @@ func (pkt *Nack) Decode(bytes []byte) (err error) {
 		return err
 	}
 	offset += used
+	if err = xdrPlausible("nack argument count", int64(argCount), 8, len(bytes)-offset); err != nil {
+		return err
+	}
 
 	// Arg values
 	pkt.Args = make([]interface{}, argCount)
@@ -30,6 +30,7 @@ type NotifyEmit struct {
 	NameValue       map[string]interface{}
 	DeliverInsecure bool
 	Keys            KeyBlock
+	Order           []string // NameValue's names in wire order, if known
 }
 
 // Integer value of packet type
@@ -60,7 +61,7 @@ func (pkt *NotifyEmit) Decode(bytes []byte) (err error) {
 	var used int
 	offset := 4 // header
 
-	if pkt.NameValue, used, err = XdrGetNotification(bytes[offset:]); err != nil {
+	if pkt.NameValue, pkt.Order, used, err = XdrGetNotificationOrder(bytes[offset:]); err != nil {
 		return err
 	}
 	offset += used
@@ -83,7 +84,7 @@ func (pkt *NotifyEmit) Decode(bytes []byte) (err error) {
 // Encode a NotifyEmit from a buffer
 func (pkt *NotifyEmit) Encode(buffer *bytes.Buffer) {
 	XdrPutInt32(buffer, int32(pkt.ID()))
-	XdrPutNotification(buffer, pkt.NameValue)
+	XdrPutNotificationInOrder(buffer, pkt.NameValue, pkt.Order)
 	XdrPutBool(buffer, pkt.DeliverInsecure)
 	XdrPutKeys(buffer, pkt.Keys)
 }
@@ -172,6 +173,7 @@ type NotifyDeliver struct {
 	NameValue map[string]interface{}
 	Secure    []int64
 	Insecure  []int64
+	Order     []string // NameValue's names in the order to encode them, if any
 }
 
 // Integer value of packet type
@@ -246,7 +248,7 @@ func (pkt *NotifyDeliver) Decode(bytes []byte) (err error) {
 // Encode a NotifyDeliver from a buffer
 func (pkt *NotifyDeliver) Encode(buffer *bytes.Buffer) {
 	XdrPutInt32(buffer, int32(pkt.ID()))
-	XdrPutNotification(buffer, pkt.NameValue)
+	XdrPutNotificationInOrder(buffer, pkt.NameValue, pkt.Order)
 	XdrPutInt32(buffer, int32(len(pkt.Secure)))
 	for i := 0; i < len(pkt.Secure); i++ {
 		XdrPutInt64(buffer, pkt.Secure[i])
@@ -256,3 +258,54 @@ func (pkt *NotifyDeliver) Encode(buffer *bytes.Buffer) {
 		XdrPutInt64(buffer, pkt.Insecure[i])
 	}
 }
+
+// Packet: DeliveryAck, acknowledging a delivery to a Reliable subscription.
+// The DeliveryID is the delivery's DeliveryIDAttribute.
+type DeliveryAck struct {
+	SubID      int64
+	DeliveryID int64
+}
+
+// Integer value of packet type
+func (pkt *DeliveryAck) ID() int {
+	return PacketDeliveryAck
+}
+
+// String representation of packet type
+func (pkt *DeliveryAck) IDString() string {
+	return "DeliveryAck"
+}
+
+// Pretty print with indent
+func (pkt *DeliveryAck) IString(indent string) string {
+	return fmt.Sprintf(
+		"%sSubID: %d\n%sDeliveryID: %d\n",
+		indent, pkt.SubID,
+		indent, pkt.DeliveryID)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *DeliveryAck) String() string {
+	return pkt.IString("")
+}
+
+// Decode a DeliveryAck packet from a byte array
+func (pkt *DeliveryAck) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.SubID, used, err = XdrGetInt64(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DeliveryID, _, err = XdrGetInt64(bytes[offset:])
+	return err
+}
+
+func (pkt *DeliveryAck) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutInt64(buffer, pkt.SubID)
+	XdrPutInt64(buffer, pkt.DeliveryID)
+}
@@ -425,6 +425,7 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
+	pkt.SecureQuenchIDs = make([]int64, secureQidsCount)
 	for i := uint32(0); i < secureQidsCount; i++ {
 		pkt.SecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
@@ -439,6 +440,7 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
+	pkt.InsecureQuenchIDs = make([]int64, insecureQidsCount)
 	for i := uint32(0); i < insecureQidsCount; i++ {
 		pkt.InsecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
@@ -461,6 +463,7 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 
 // Encode from a buffer
 func (pkt *SubAddNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.SecureQuenchIDs)))
 	for i := 0; i < len(pkt.SecureQuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.SecureQuenchIDs[i])
@@ -524,6 +527,7 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
+	pkt.SecureQuenchIDs = make([]int64, secureQidsCount)
 	for i := uint32(0); i < secureQidsCount; i++ {
 		pkt.SecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
@@ -538,6 +542,7 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
+	pkt.InsecureQuenchIDs = make([]int64, insecureQidsCount)
 	for i := uint32(0); i < insecureQidsCount; i++ {
 		pkt.InsecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
@@ -560,6 +565,7 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 
 // Encode from a buffer
 func (pkt *SubModNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.SecureQuenchIDs)))
 	for i := 0; i < len(pkt.SecureQuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.SecureQuenchIDs[i])
@@ -617,6 +623,7 @@ func (pkt *SubDelNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
+	pkt.QuenchIDs = make([]int64, qidCount)
 	for i := uint32(0); i < qidCount; i++ {
 		pkt.QuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
@@ -636,6 +643,7 @@ func (pkt *SubDelNotify) Decode(bytes []byte) (err error) {
 
 // Encode from a buffer
 func (pkt *SubDelNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.QuenchIDs)))
 	for i := 0; i < len(pkt.QuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.QuenchIDs[i])
@@ -0,0 +1,157 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Packet: SecRequest
+type SecRequest struct {
+	XID        uint32
+	AddNfnKeys KeyBlock
+	DelNfnKeys KeyBlock
+	AddSubKeys KeyBlock
+	DelSubKeys KeyBlock
+}
+
+// Integer value of packet type
+func (pkt *SecRequest) ID() int {
+	return PacketSecRequest
+}
+
+// String representation of packet type
+func (pkt *SecRequest) IDString() string {
+	return "SecRequest"
+}
+
+// Pretty print with indent
+func (pkt *SecRequest) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n%sAddNfnKeys %v\n%sDelNfnKeys %v\n%sAddSubKeys %v\n%sDelSubKeys %v\n",
+		indent, pkt.XID,
+		indent, pkt.AddNfnKeys,
+		indent, pkt.DelNfnKeys,
+		indent, pkt.AddSubKeys,
+		indent, pkt.DelSubKeys,
+	)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SecRequest) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SecRequest packet from a byte array
+func (pkt *SecRequest) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.AddNfnKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DelNfnKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.AddSubKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DelSubKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a SecRequest from a buffer
+func (pkt *SecRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
+	xID = XID()
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, xID)
+	XdrPutKeys(buffer, pkt.AddNfnKeys)
+	XdrPutKeys(buffer, pkt.DelNfnKeys)
+	XdrPutKeys(buffer, pkt.AddSubKeys)
+	XdrPutKeys(buffer, pkt.DelSubKeys)
+
+	return
+}
+
+// Packet: SecReply
+type SecReply struct {
+	XID uint32
+}
+
+// Integer value of packet type
+func (pkt *SecReply) ID() int {
+	return PacketSecReply
+}
+
+// String representation of packet type
+func (pkt *SecReply) IDString() string {
+	return "SecReply"
+}
+
+// Pretty print with indent
+func (pkt *SecReply) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n", indent, pkt.XID)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SecReply) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SecReply packet from a byte array
+func (pkt *SecReply) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a SecReply from a buffer
+func (pkt *SecReply) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.XID)
+}
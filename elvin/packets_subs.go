@@ -102,6 +102,193 @@ func (pkt *SubAddRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
 	return
 }
 
+// Packet: SubAddOptionsRequest. A SubAddRequest with options for the
+// subscription's delivery. If MaxSize is positive the router withholds
+// notifications whose encoded attributes exceed that many bytes. If
+// Projection isn't empty only those attributes are delivered.
+type SubAddOptionsRequest struct {
+	XID            uint32
+	Expression     string
+	AcceptInsecure bool
+	Keys           KeyBlock
+	MaxSize        int32
+	Projection     []string
+	Reliable       bool // Deliveries are acked and redelivered until they are
+}
+
+// Integer value of packet type
+func (pkt *SubAddOptionsRequest) ID() int {
+	return PacketSubAddOptionsRequest
+}
+
+// String representation of packet type
+func (pkt *SubAddOptionsRequest) IDString() string {
+	return "SubAddOptionsRequest"
+}
+
+// Pretty print with indent
+func (pkt *SubAddOptionsRequest) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n%sExpression %v\n%sAcceptInsecure %v\n%sKeys %v\n%sMaxSize %v\n%sProjection %v\n%sReliable %v\n",
+		indent, pkt.XID,
+		indent, pkt.Expression,
+		indent, pkt.AcceptInsecure,
+		indent, pkt.Keys,
+		indent, pkt.MaxSize,
+		indent, pkt.Projection,
+		indent, pkt.Reliable,
+	)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SubAddOptionsRequest) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SubAddOptionsRequest packet from a byte array
+func (pkt *SubAddOptionsRequest) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Expression, used, err = XdrGetString(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.AcceptInsecure, used, err = XdrGetBool(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Keys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.MaxSize, used, err = XdrGetInt32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	var count int32
+	count, used, err = XdrGetInt32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+	if count < 0 || int(count) > (len(bytes)-offset)/4 {
+		return fmt.Errorf("Bad projection length %d", count)
+	}
+	pkt.Projection = make([]string, count)
+	for i := range pkt.Projection {
+		pkt.Projection[i], used, err = XdrGetString(bytes[offset:])
+		if err != nil {
+			return err
+		}
+		offset += used
+	}
+
+	pkt.Reliable, _, err = XdrGetBool(bytes[offset:])
+	return err
+}
+
+// Encode a SubAddOptionsRequest from a buffer
+func (pkt *SubAddOptionsRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
+	xID = XID()
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, xID)
+	XdrPutString(buffer, pkt.Expression)
+	XdrPutBool(buffer, pkt.AcceptInsecure)
+	XdrPutKeys(buffer, pkt.Keys)
+	XdrPutInt32(buffer, pkt.MaxSize)
+	XdrPutInt32(buffer, int32(len(pkt.Projection)))
+	for _, name := range pkt.Projection {
+		XdrPutString(buffer, name)
+	}
+	XdrPutBool(buffer, pkt.Reliable)
+
+	return
+}
+
+// Packet: SubPauseRequest. Asks the router to suspend, or resume,
+// delivery for a subscription without deleting it. The router replies
+// with a SubReply.
+type SubPauseRequest struct {
+	XID    uint32
+	SubID  int64
+	Paused bool
+}
+
+// Integer value of packet type
+func (pkt *SubPauseRequest) ID() int {
+	return PacketSubPauseRequest
+}
+
+// String representation of packet type
+func (pkt *SubPauseRequest) IDString() string {
+	return "SubPauseRequest"
+}
+
+// Pretty print with indent
+func (pkt *SubPauseRequest) IString(indent string) string {
+	return fmt.Sprintf("%sXID %v\n%sSubID %v\n%sPaused %v\n",
+		indent, pkt.XID,
+		indent, pkt.SubID,
+		indent, pkt.Paused,
+	)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SubPauseRequest) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SubPauseRequest packet from a byte array
+func (pkt *SubPauseRequest) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.SubID, used, err = XdrGetInt64(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Paused, used, err = XdrGetBool(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a SubPauseRequest from a buffer
+func (pkt *SubPauseRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
+	xID = XID()
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, xID)
+	XdrPutInt64(buffer, pkt.SubID)
+	XdrPutBool(buffer, pkt.Paused)
+
+	return
+}
+
 // Packet: SubReply
 type SubReply struct {
 	XID   uint32
@@ -310,3 +497,66 @@ func (pkt *SubModRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
 
 	return
 }
+
+// Why a router removed a subscription, see SubRemoved
+const (
+	SubRemovedReasonAdmin = 1 // By the router's administrator
+)
+
+// Packet: SubRemoved, telling a client the router removed one of its
+// subscriptions, which will match no more notifications
+type SubRemoved struct {
+	SubID   int64
+	Reason  uint32
+	Message string
+}
+
+// Integer value of packet type
+func (pkt *SubRemoved) ID() int {
+	return PacketSubRemoved
+}
+
+// String representation of packet type
+func (pkt *SubRemoved) IDString() string {
+	return "SubRemoved"
+}
+
+// Pretty print with indent
+func (pkt *SubRemoved) IString(indent string) string {
+	return fmt.Sprintf(
+		"%sSubID: %d\n%sReason: %d\n%sMessage: %s\n",
+		indent, pkt.SubID,
+		indent, pkt.Reason,
+		indent, pkt.Message)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SubRemoved) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SubRemoved packet from a byte array
+func (pkt *SubRemoved) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	if pkt.SubID, used, err = XdrGetInt64(bytes[offset:]); err != nil {
+		return err
+	}
+	offset += used
+
+	if pkt.Reason, used, err = XdrGetUint32(bytes[offset:]); err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.Message, _, err = XdrGetString(bytes[offset:])
+	return err
+}
+
+func (pkt *SubRemoved) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutInt64(buffer, pkt.SubID)
+	XdrPutUint32(buffer, pkt.Reason)
+	XdrPutString(buffer, pkt.Message)
+}
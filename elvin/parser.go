@@ -20,5 +20,522 @@
 
 package elvin
 
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A recursive descent parser for the subscription grammar described
+// in elvin4.go. It extends the grammar so that a bare attribute name
+// used where a boolean is expected is an existence test, equivalent
+// to require(name), and with opaque constants written hex('0a0b') or
+// base64('Cgs=').
 type Parser struct {
+	Reorder bool // Reorder AND/OR operands cheapest first, see AST.Reorder
+	tokens  []tokenInfo
+	pos     int
+}
+
+// A subscription expression that failed to parse. Positions are
+// token offsets.
+type ParseError struct {
+	ErrorCode uint16
+	Args      []interface{}
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("[%d] %s", err.ErrorCode, fmt.Sprintf(ElvinStringToFormatString(ProtocolErrors[err.ErrorCode].Message), err.Args...))
+}
+
+// Function names and their minimum argument count
+var functions = map[string]struct {
+	typeCode int
+	minArgs  int
+}{
+	"int32":            {FuncInt32TypeCode, 1},
+	"int64":            {FuncInt64TypeCode, 1},
+	"real64":           {FuncReal64TypeCode, 1},
+	"string":           {FuncStringTypeCode, 1},
+	"opaque":           {FuncOpaqueTypeCode, 1},
+	"nan":              {FuncNanTypeCode, 1},
+	"begins-with":      {FuncBeginsWithTypeCode, 2},
+	"contains":         {FuncContainsTypeCode, 2},
+	"ends-with":        {FuncEndsWithTypeCode, 2},
+	"wildcard":         {FuncWildcardTypeCode, 2},
+	"regex":            {FuncRegexTypeCode, 2},
+	"fold-case":        {FuncFoldCaseTypeCode, 1},
+	"decompose":        {FuncDecomposeTypeCode, 1},
+	"decompose-compat": {FuncDecomposeCompatTypeCode, 1},
+	"require":          {FuncRequireTypeCode, 1},
+	"equals":           {FuncEqualsTypeCode, 2},
+	"size":             {FuncSizeTypeCode, 1},
+	"hex":              {FuncHexTypeCode, 1},
+	"base64":           {FuncBase64TypeCode, 1},
+}
+
+// Parse a subscription expression into an AST. Errors are returned as
+// a *ParseError.
+func ParseSubscription(expr string) (*AST, error) {
+	var parser Parser
+	return parser.Parse(expr)
+}
+
+// Parse a subscription expression into an AST
+func (p *Parser) Parse(expr string) (ast *AST, err error) {
+	p.tokens = Lexer(expr)
+	p.pos = 0
+
+	for i, tok := range p.tokens {
+		switch tok.token {
+		case terminalUnterminatedString:
+			return nil, &ParseError{ErrorsUnterminatedString, []interface{}{int32(i)}}
+		case terminalError:
+			return nil, &ParseError{ErrorsInvalidToken, []interface{}{tok.value, int32(i)}}
+		}
+	}
+
+	if ast, err = p.disjunction(); err != nil {
+		return nil, err
+	}
+	if p.peek() != TerminalEOF {
+		return nil, p.parseError()
+	}
+	if ast, err = p.boolean(ast); err != nil {
+		return nil, err
+	}
+	if p.Reorder {
+		ast.Reorder()
+	}
+	return ast, nil
+}
+
+// Current token
+func (p *Parser) peek() int {
+	if p.pos >= len(p.tokens) {
+		return TerminalEOF
+	}
+	return p.tokens[p.pos].token
+}
+
+// Consume the current token
+func (p *Parser) next() tokenInfo {
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok
+}
+
+func (p *Parser) parseError() error {
+	value := ""
+	if p.pos < len(p.tokens) {
+		value = p.tokens[p.pos].value
+	}
+	return &ParseError{ErrorsParsing, []interface{}{value, int32(p.pos)}}
+}
+
+// Is this node boolean (rather than a value)?
+func isBoolean(node *AST) bool {
+	switch node.TypeCode {
+	case EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode,
+		LessThanOrEqualsTypeCode, GreaterThanTypeCode,
+		GreaterThanOrEqualsTypeCode, LogicalOrTypeCode,
+		LogicalExclusiveOrTypeCode, LogicalAndTypeCode,
+		LogicalNotTypeCode, FuncInt32TypeCode, FuncInt64TypeCode,
+		FuncReal64TypeCode, FuncStringTypeCode, FuncOpaqueTypeCode,
+		FuncNanTypeCode, FuncBeginsWithTypeCode, FuncContainsTypeCode,
+		FuncEndsWithTypeCode, FuncWildcardTypeCode, FuncRegexTypeCode,
+		FuncRequireTypeCode, FuncEqualsTypeCode:
+		return true
+	}
+	return false
+}
+
+// Return node as a boolean, turning a bare name into an existence test
+func (p *Parser) boolean(node *AST) (*AST, error) {
+	if isBoolean(node) {
+		return node, nil
+	}
+	if node.TypeCode == NameTypeCode {
+		return &AST{TypeCode: FuncRequireTypeCode, Value: node.Value, Children: []*AST{node}}, nil
+	}
+	return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"value", "boolean", int32(p.pos)}}
+}
+
+// Return node if it is a value
+func (p *Parser) value(node *AST) (*AST, error) {
+	if isBoolean(node) {
+		return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"boolean", "value", int32(p.pos)}}
+	}
+	return node, nil
+}
+
+// Parse a left associative chain of boolean operators
+func (p *Parser) logical(operand func() (*AST, error), terminal int, typeCode int) (*AST, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == terminal {
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.boolean(left); err != nil {
+			return nil, err
+		}
+		if right, err = p.boolean(right); err != nil {
+			return nil, err
+		}
+		left = &AST{TypeCode: typeCode, Children: []*AST{left, right}}
+	}
+	return left, nil
+}
+
+// <disjunction> ::= <disjunction> OR <xor-exp>
+func (p *Parser) disjunction() (*AST, error) {
+	return p.logical(p.xorExp, TerminalOR, LogicalOrTypeCode)
+}
+
+// <xor-exp> ::= <xor-exp> XOR <conjunction>
+func (p *Parser) xorExp() (*AST, error) {
+	return p.logical(p.conjunction, TerminalXOR, LogicalExclusiveOrTypeCode)
+}
+
+// <conjunction> ::= <conjunction> AND <bool-exp>
+func (p *Parser) conjunction() (*AST, error) {
+	return p.logical(p.boolExp, TerminalAND, LogicalAndTypeCode)
+}
+
+var comparisons = map[int]int{
+	TerminalEQ:  EqualsTypeCode,
+	TerminalNEQ: NotEqualsTypeCode,
+	TerminalLT:  LessThanTypeCode,
+	TerminalLE:  LessThanOrEqualsTypeCode,
+	TerminalGT:  GreaterThanTypeCode,
+	TerminalGE:  GreaterThanOrEqualsTypeCode,
+}
+
+// <bool-exp> ::= <value> <comparison> <value> | BANG <bool-exp> | ...
+// A value that is not compared is returned as is for the caller to check
+func (p *Parser) boolExp() (*AST, error) {
+	if p.peek() == TerminalBANG {
+		p.next()
+		operand, err := p.boolExp()
+		if err != nil {
+			return nil, err
+		}
+		if operand, err = p.boolean(operand); err != nil {
+			return nil, err
+		}
+		return &AST{TypeCode: LogicalNotTypeCode, Children: []*AST{operand}}, nil
+	}
+
+	left, err := p.bitDisjunction()
+	if err != nil {
+		return nil, err
+	}
+	typeCode, ok := comparisons[p.peek()]
+	if !ok {
+		return left, nil
+	}
+	p.next()
+	right, err := p.bitDisjunction()
+	if err != nil {
+		return nil, err
+	}
+	if left, err = p.value(left); err != nil {
+		return nil, err
+	}
+	if right, err = p.value(right); err != nil {
+		return nil, err
+	}
+	return &AST{TypeCode: typeCode, Children: []*AST{left, right}}, nil
+}
+
+// Parse a left associative chain of binary value operators
+func (p *Parser) binary(operand func() (*AST, error), operators map[int]int) (*AST, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		typeCode, ok := operators[p.peek()]
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.value(left); err != nil {
+			return nil, err
+		}
+		if right, err = p.value(right); err != nil {
+			return nil, err
+		}
+		left = &AST{TypeCode: typeCode, Children: []*AST{left, right}}
+	}
+}
+
+// <bit-disjunction> ::= <bit-disjunction> BIT_OR <bit-xor-exp>
+func (p *Parser) bitDisjunction() (*AST, error) {
+	return p.binary(p.bitXorExp, map[int]int{TerminalBIT_OR: BinaryOrTypeCode})
+}
+
+// <bit-xor-exp> ::= <bit-xor-exp> BIT_XOR <bit-conjunction>
+func (p *Parser) bitXorExp() (*AST, error) {
+	return p.binary(p.bitConjunction, map[int]int{TerminalBIT_XOR: BinaryExclusiveOrTypeCode})
+}
+
+// <bit-conjunction> ::= <bit-conjunction> BIT_AND <bit-shift-exp>
+func (p *Parser) bitConjunction() (*AST, error) {
+	return p.binary(p.bitShiftExp, map[int]int{TerminalBIT_AND: BinaryAndTypeCode})
+}
+
+// <bit-shift-exp> ::= <bit-shift-exp> BIT_SHL|BIT_SHR|BIT_LSR <sum>
+func (p *Parser) bitShiftExp() (*AST, error) {
+	return p.binary(p.sum, map[int]int{
+		TerminalBIT_SHL: ShiftLeftTypeCode,
+		TerminalBIT_SHR: ShiftRightTypeCode,
+		TerminalBIT_LSR: LogicalShiftRightTypeCode,
+	})
+}
+
+// <sum> ::= <sum> PLUS|MINUS <product>
+func (p *Parser) sum() (*AST, error) {
+	return p.binary(p.product, map[int]int{
+		TerminalPLUS:  AddTypeCode,
+		TerminalMINUS: SubtractTypeCode,
+	})
+}
+
+// <product> ::= <product> TIMES|DIV|MOD <num-value>
+func (p *Parser) product() (*AST, error) {
+	return p.binary(p.numValue, map[int]int{
+		TerminalTIMES: MultiplyTypeCode,
+		TerminalDIV:   DivideTypeCode,
+		TerminalMOD:   ModuloTypeCode,
+	})
+}
+
+var unary = map[int]int{
+	TerminalPLUS:  UnaryPlusTypeCode,
+	TerminalMINUS: UnaryMinusTypeCode,
+	TerminalNEG:   BinaryNotTypeCode,
+}
+
+// <num-value> ::= INT32 | <name> | <function-exp> | PLUS|MINUS|NEG <num-value> | LPAREN <value> RPAREN
+// Strings are also accepted here for simplicity.
+func (p *Parser) numValue() (*AST, error) {
+	if typeCode, ok := unary[p.peek()]; ok {
+		p.next()
+		operand, err := p.numValue()
+		if err != nil {
+			return nil, err
+		}
+		if operand, err = p.value(operand); err != nil {
+			return nil, err
+		}
+		return &AST{TypeCode: typeCode, Children: []*AST{operand}}, nil
+	}
+
+	switch p.peek() {
+	case TerminalLPAREN:
+		p.next()
+		node, err := p.disjunction()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != TerminalRPAREN {
+			return nil, p.parseError()
+		}
+		p.next()
+		return node, nil
+
+	case TerminalINT32, TerminalINT64, TerminalREAL64:
+		return p.number(p.next())
+
+	case TerminalSTRING:
+		return &AST{TypeCode: StringTypeCode, Value: p.next().value}, nil
+
+	case TerminalID:
+		tok := p.next()
+		if p.peek() == TerminalLPAREN {
+			return p.function(tok.value)
+		}
+		return &AST{TypeCode: NameTypeCode, Value: tok.value}, nil
+	}
+
+	return nil, p.parseError()
+}
+
+// Convert a numeric token. The lexer doesn't distinguish number types
+// so that happens here.
+func (p *Parser) number(tok tokenInfo) (*AST, error) {
+	text := tok.value
+	overflow := &ParseError{ErrorsOverflow, []interface{}{int32(p.pos - 1)}}
+
+	if strings.HasSuffix(text, "L") {
+		i, err := strconv.ParseInt(strings.TrimSuffix(text, "L"), 0, 64)
+		if err != nil {
+			return nil, overflow
+		}
+		return &AST{TypeCode: Int64TypeCode, Value: i}, nil
+	}
+	if strings.ContainsAny(text, ".eEI") {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, overflow
+		}
+		return &AST{TypeCode: Real64TypeCode, Value: f}, nil
+	}
+	i, err := strconv.ParseInt(text, 0, 32)
+	if err != nil {
+		return nil, overflow
+	}
+	return &AST{TypeCode: Int32TypeCode, Value: int32(i)}, nil
+}
+
+// <function> ::= ID LPAREN <args> RPAREN | ID LPAREN RPAREN
+func (p *Parser) function(name string) (*AST, error) {
+	start := p.pos - 1
+	p.next() // LPAREN
+
+	f, ok := functions[name]
+	if !ok {
+		return nil, &ParseError{ErrorsUnknownFunction, []interface{}{int32(start)}}
+	}
+
+	var args []*AST
+	if p.peek() != TerminalRPAREN {
+		for {
+			arg, err := p.bitDisjunction()
+			if err != nil {
+				return nil, err
+			}
+			if arg, err = p.value(arg); err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != TerminalCOMMA {
+				break
+			}
+			p.next()
+		}
+	}
+	if p.peek() != TerminalRPAREN {
+		return nil, p.parseError()
+	}
+	p.next()
+
+	if len(args) < f.minArgs {
+		return nil, &ParseError{ErrorsTooFewArgs, []interface{}{name, int32(start)}}
+	}
+
+	node := &AST{TypeCode: f.typeCode, Children: args}
+	switch f.typeCode {
+	case FuncRequireTypeCode, FuncInt32TypeCode, FuncInt64TypeCode,
+		FuncReal64TypeCode, FuncStringTypeCode, FuncOpaqueTypeCode,
+		FuncNanTypeCode:
+		// These take an attribute name
+		if args[0].TypeCode != NameTypeCode {
+			return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"value", "name", int32(start)}}
+		}
+		node.Value = args[0].Value
+
+	case FuncBeginsWithTypeCode, FuncContainsTypeCode, FuncEndsWithTypeCode,
+		FuncWildcardTypeCode, FuncRegexTypeCode:
+		// The patterns must be string constants, or for all but
+		// wildcard and regex opaque constants
+		if f.typeCode != FuncWildcardTypeCode && f.typeCode != FuncRegexTypeCode && args[1].TypeCode == OpaqueTypeCode {
+			var patterns [][]byte
+			for _, arg := range args[1:] {
+				if arg.TypeCode != OpaqueTypeCode {
+					return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"value", "opaque", int32(start)}}
+				}
+				patterns = append(patterns, arg.Value.([]byte))
+			}
+			node.Value = patterns
+			break
+		}
+		var patterns []string
+		for _, arg := range args[1:] {
+			if arg.TypeCode != StringTypeCode {
+				return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"value", "string", int32(start)}}
+			}
+			patterns = append(patterns, arg.Value.(string))
+		}
+		if f.typeCode == FuncWildcardTypeCode || f.typeCode == FuncRegexTypeCode {
+			var compiled []*regexp.Regexp
+			for _, pattern := range patterns {
+				if f.typeCode == FuncWildcardTypeCode {
+					pattern = wildcardToRegex(pattern)
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, &ParseError{ErrorsInvalidRegexp, []interface{}{pattern, int32(start)}}
+				}
+				compiled = append(compiled, re)
+			}
+			node.Value = compiled
+		} else {
+			node.Value = patterns
+		}
+
+	case FuncHexTypeCode, FuncBase64TypeCode:
+		// Opaque constants, decoded from a string constant
+		if args[0].TypeCode != StringTypeCode {
+			return nil, &ParseError{ErrorsTypeMismatch, []interface{}{"value", "string", int32(start)}}
+		}
+		text := args[0].Value.(string)
+		var b []byte
+		var err error
+		if f.typeCode == FuncHexTypeCode {
+			b, err = hex.DecodeString(text)
+		} else {
+			b, err = base64.StdEncoding.DecodeString(text)
+		}
+		if err != nil {
+			return nil, &ParseError{ErrorsInvalidToken, []interface{}{text, int32(start)}}
+		}
+		return &AST{TypeCode: OpaqueTypeCode, Value: b}, nil
+
+	case FuncDecomposeTypeCode, FuncDecomposeCompatTypeCode:
+		// FIXME: needs unicode normalization
+		return nil, &ParseError{ErrorsNotImplemented, nil}
+	}
+
+	return node, nil
+}
+
+// Convert a wildcard pattern (*, ? and [...]) to an anchored regex
+func wildcardToRegex(pattern string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	inClass := false
+	for _, r := range pattern {
+		switch {
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+			re.WriteRune(r)
+		case r == '*':
+			re.WriteString(".*")
+		case r == '?':
+			re.WriteString(".")
+		case r == '[':
+			inClass = true
+			re.WriteRune(r)
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
 }
@@ -0,0 +1,415 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	bad := map[string]uint16{
+		"bogus ==":                       ErrorsParsing,
+		"(a == 1":                        ErrorsParsing,
+		"a == 1 b":                       ErrorsParsing,
+		"a == 'open":                     ErrorsUnterminatedString,
+		"frobnicate(a)":                  ErrorsUnknownFunction,
+		"begins-with(a)":                 ErrorsTooFewArgs,
+		"regex(a, '[')":                  ErrorsInvalidRegexp,
+		"a == 99999999999":               ErrorsOverflow,
+		"a + 1":                          ErrorsTypeMismatch,
+		"(a == 1) == 2":                  ErrorsTypeMismatch,
+		"require(a == 1)":                ErrorsParsing,
+		"require('a')":                   ErrorsTypeMismatch,
+		"decompose(a) == b":              ErrorsNotImplemented,
+		"a == hex('0g')":                 ErrorsInvalidToken,
+		"a == base64('!')":               ErrorsInvalidToken,
+		"a == hex(b)":                    ErrorsTypeMismatch,
+		"begins-with(a, hex('01'), 'x')": ErrorsTypeMismatch,
+		"regex(a, hex('01'))":            ErrorsTypeMismatch,
+	}
+
+	for expr, code := range bad {
+		_, err := ParseSubscription(expr)
+		if err == nil {
+			t.Errorf("%s: parsed", expr)
+			continue
+		}
+		if e := err.(*ParseError); e.ErrorCode != code {
+			t.Errorf("%s: expected error %d got %v", expr, code, err)
+		}
+	}
+}
+
+func TestParseExistence(t *testing.T) {
+	zero := map[string]interface{}{"X": int32(0)}
+	empty := map[string]interface{}{"X": ""}
+	absent := map[string]interface{}{"Y": int32(1)}
+
+	for _, expr := range []string{"X", "require(X)", "(X)"} {
+		ast, err := ParseSubscription(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if !ast.Match(zero) {
+			t.Errorf("%s: didn't match zero value", expr)
+		}
+		if !ast.Match(empty) {
+			t.Errorf("%s: didn't match empty value", expr)
+		}
+		if ast.Match(absent) {
+			t.Errorf("%s: matched absent attribute", expr)
+		}
+		if ast.Eval(absent) != LukBottom {
+			t.Errorf("%s: absent attribute isn't bottom", expr)
+		}
+	}
+
+	// Bare names combine with other expressions
+	ast, err := ParseSubscription("X && Y == 1 || !Z")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !ast.Match(map[string]interface{}{"X": int32(0), "Y": int32(1)}) {
+		t.Errorf("X && Y == 1 didn't match")
+	}
+	if ast.Match(map[string]interface{}{"Y": int32(1), "Z": int32(1)}) {
+		t.Errorf("Matched without X or with Z")
+	}
+}
+
+func TestEval(t *testing.T) {
+	nfn := map[string]interface{}{
+		"i32":  int32(10),
+		"i64":  int64(20),
+		"r64":  float64(2.5),
+		"str":  "Hello World",
+		"data": []byte{1, 2, 3},
+	}
+
+	matches := map[string]bool{
+		"i32 == 10":                               true,
+		"i32 != 10":                               false,
+		"i32 < i64":                               true,
+		"i64 >= 20L":                              true,
+		"r64 > 2":                                 true,
+		"i32 * 2 == i64":                          true,
+		"(i32 + 5) % 4 == 3":                      true,
+		"i32 / 0 == 1":                            false,
+		"-i32 == -10":                             true,
+		"~i32 == -11":                             true,
+		"1 << 4 == 16 && 16 >> 2 == 4":            true,
+		"-1 >>> 28 == 15":                         true,
+		"(i32 | 5) == 15 && (i32 & 2) == 2":       true,
+		"(i32 ^ 10) == 0":                         true,
+		"str == 'Hello World'":                    true,
+		"str < \"World\"":                         true,
+		"str == 10":                               false,
+		"missing == 10 || i32 == 10":              true,
+		"i32 == 10 ^^ i64 == 20":                  false,
+		"begins-with(str, 'Bye', 'Hello')":        true,
+		"ends-with(str, 'World')":                 true,
+		"contains(str, 'o W')":                    true,
+		"contains(str, 'xyz')":                    false,
+		"wildcard(str, 'H*o W?rld')":              true,
+		"wildcard(str, 'H*x')":                    false,
+		"regex(str, '^H.*d$')":                    true,
+		"fold-case(str) == 'hello world'":         true,
+		"size(str) == 11 && size(data) == 3":      true,
+		"int32(i32) && int64(i64)":                true,
+		"real64(r64) && string(str)":              true,
+		"opaque(data) && !int32(str)":             true,
+		"nan(r64)":                                false,
+		"equals(i32, 1, 2, 10)":                   true,
+		"equals(str, 'a', 'b')":                   false,
+		"!(i32 == 10)":                            false,
+		"i32 == 10 && (str == 'x' || i64 > 1)":    true,
+		"data == hex('010203')":                   true,
+		"data == base64('AQID')":                  true,
+		"data != hex('0102')":                     true,
+		"data < hex('0103')":                      true,
+		"str == hex('01')":                        false,
+		"str != hex('01')":                        false,
+		"missing == hex('01')":                    false,
+		"begins-with(data, hex('0102'))":          true,
+		"ends-with(data, hex('ff'), hex('0203'))": true,
+		"contains(data, hex('09'))":               false,
+		"begins-with(str, hex('48'))":             false,
+		"equals(data, hex('ff'), hex('010203'))":  true,
+	}
+
+	for expr, expected := range matches {
+		ast, err := ParseSubscription(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if ast.Match(nfn) != expected {
+			t.Errorf("%s: expected %v", expr, expected)
+		}
+	}
+}
+
+func TestEvalAttributeComparison(t *testing.T) {
+	tests := []struct {
+		expr     string
+		nfn      map[string]interface{}
+		expected bool
+	}{
+		// Both present, promoted as for literals
+		{"High > Low", map[string]interface{}{"High": int32(10), "Low": int32(5)}, true},
+		{"High > Low", map[string]interface{}{"High": int32(5), "Low": int32(10)}, false},
+		{"High > Low", map[string]interface{}{"High": int64(10), "Low": int32(5)}, true},
+		{"High > Low", map[string]interface{}{"High": float64(5.5), "Low": int64(5)}, true},
+		{"High == Low", map[string]interface{}{"High": float64(5), "Low": int32(5)}, true},
+		{"High <= Low", map[string]interface{}{"High": "abc", "Low": "abd"}, true},
+		{"High - Low > 2", map[string]interface{}{"High": int32(10), "Low": float64(7.5)}, true},
+
+		// One absent
+		{"High > Low", map[string]interface{}{"High": int32(10)}, false},
+		{"High > Low", map[string]interface{}{"Low": int32(5)}, false},
+		{"High != Low", map[string]interface{}{"High": int32(10)}, false},
+		{"!(High > Low)", map[string]interface{}{"High": int32(10)}, false},
+
+		// Type mismatched
+		{"High > Low", map[string]interface{}{"High": "10", "Low": int32(5)}, false},
+		{"High != Low", map[string]interface{}{"High": "10", "Low": int32(5)}, false},
+		{"!(High < Low)", map[string]interface{}{"High": int32(1), "Low": "5"}, false},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseSubscription(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		if ast.Match(test.nfn) != test.expected {
+			t.Errorf("%s with %v: expected %v", test.expr, test.nfn, test.expected)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	nfns := []map[string]interface{}{
+		{"A": int32(1), "B": int32(2), "C": int32(3)},
+		{"A": int32(1), "B": int32(2), "C": int32(4)},
+		{"A": int32(0), "B": int32(2)},
+		{},
+	}
+	tests := []struct {
+		expr      string
+		canonical string
+		results   []int // for each of nfns
+	}{
+		{"!(A == 1 && B == 2) || C == 3", "(!((A == 1) && (B == 2)) || (C == 3))",
+			[]int{LukTrue, LukFalse, LukTrue, LukBottom}},
+		{"!A == 1 && B == 2", "(!(A == 1) && (B == 2))",
+			[]int{LukFalse, LukFalse, LukTrue, LukBottom}},
+		{"A == 1 || B == 3 && C == 4", "((A == 1) || ((B == 3) && (C == 4)))",
+			[]int{LukTrue, LukTrue, LukFalse, LukBottom}},
+		{"(A == 1 || B == 3) && C == 4", "(((A == 1) || (B == 3)) && (C == 4))",
+			[]int{LukFalse, LukTrue, LukFalse, LukBottom}},
+		{"A == 0 ^^ B == 2 && C == 3", "((A == 0) ^^ ((B == 2) && (C == 3)))",
+			[]int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"A == 1 || B == 2 ^^ C == 3", "((A == 1) || ((B == 2) ^^ (C == 3)))",
+			[]int{LukTrue, LukTrue, LukBottom, LukBottom}},
+		{"!!A == 1", "!!(A == 1)", []int{LukTrue, LukTrue, LukFalse, LukBottom}},
+		{"!!!A == 1", "!!!(A == 1)", []int{LukFalse, LukFalse, LukTrue, LukBottom}},
+		{"!(!(!(A == 1)))", "!!!(A == 1)", []int{LukFalse, LukFalse, LukTrue, LukBottom}},
+		{"!A || !C", "(!require(A) || !require(C))", []int{LukFalse, LukFalse, LukBottom, LukBottom}},
+		{"((((A)))) == 1", "(A == 1)", []int{LukTrue, LukTrue, LukFalse, LukBottom}},
+		{"C - A - 1 == 1", "(((C - A) - 1) == 1)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"C - (A - 1) == 3", "((C - (A - 1)) == 3)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"16 / B / B == 4", "(((16 / B) / B) == 4)", []int{LukTrue, LukTrue, LukTrue, LukBottom}},
+		{"A + B * C == 7", "((A + (B * C)) == 7)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"-B * C == -6", "((-B * C) == -6)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"1 << B + A == 8", "((1 << (B + A)) == 8)", []int{LukTrue, LukTrue, LukFalse, LukBottom}},
+		{"A | B & C == 3", "((A | (B & C)) == 3)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"C ^ A | B == 2", "(((C ^ A) | B) == 2)", []int{LukTrue, LukFalse, LukBottom, LukBottom}},
+		{"~A + 1 == -1", "((~A + 1) == -1)", []int{LukTrue, LukTrue, LukFalse, LukBottom}},
+		{"!(C == 3) && require(A) || begins-with(D, 'x')", "((!(C == 3) && require(A)) || begins-with(D, 'x'))",
+			[]int{LukBottom, LukTrue, LukBottom, LukBottom}},
+	}
+
+	for _, test := range tests {
+		ast, err := ParseSubscription(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		canonical := ast.String()
+		if canonical != test.canonical {
+			t.Errorf("%s: expected canonical form %s got %s", test.expr, test.canonical, canonical)
+		}
+		reparsed, err := ParseSubscription(canonical)
+		if err != nil {
+			t.Errorf("%s: canonical form %s failed to parse: %v", test.expr, canonical, err)
+			continue
+		}
+		if reparsed.String() != canonical {
+			t.Errorf("%s: canonical form isn't stable: %s", canonical, reparsed.String())
+		}
+		for i, nfn := range nfns {
+			if result := ast.Eval(nfn); result != test.results[i] {
+				t.Errorf("%s with %v: expected %d got %d", test.expr, nfn, test.results[i], result)
+			}
+			if reparsed.Eval(nfn) != ast.Eval(nfn) {
+				t.Errorf("%s with %v: canonical form evaluates differently", test.expr, nfn)
+			}
+		}
+	}
+}
+
+func TestDeepNesting(t *testing.T) {
+	nfn := map[string]interface{}{"A": int32(1)}
+	for _, depth := range []int{1, 2, 63, 64, 1000} {
+		expr := "A == 1"
+		for i := 0; i < depth; i++ {
+			expr = "!(" + expr + ")"
+		}
+		ast, err := ParseSubscription(expr)
+		if err != nil {
+			t.Fatalf("%d NOTs: %v", depth, err)
+		}
+		expected := lukBool(depth%2 == 0)
+		if result := ast.Eval(nfn); result != expected {
+			t.Errorf("%d NOTs: expected %d got %d", depth, expected, result)
+		}
+		if result := ast.Eval(map[string]interface{}{}); result != LukBottom {
+			t.Errorf("%d NOTs of bottom: got %d", depth, result)
+		}
+
+		expr = strings.Repeat("(", depth) + "A" + strings.Repeat(")", depth) + " == 1"
+		if ast, err = ParseSubscription(expr); err != nil {
+			t.Fatalf("%d parentheses: %v", depth, err)
+		}
+		if ast.String() != "(A == 1)" {
+			t.Errorf("%d parentheses: got %s", depth, ast.String())
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	nfn := map[string]interface{}{"odd name": "it's", "1st": int64(1), "r": float64(2), "data": []byte{1, 2, 3}}
+	for _, expr := range []string{
+		"odd\\ name == 'it\\'s'",
+		"\\1st == 1L && r == 2.0",
+		"data == base64('AQID') && begins-with(data, hex('01'))",
+	} {
+		ast, err := ParseSubscription(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		reparsed, err := ParseSubscription(ast.String())
+		if err != nil {
+			t.Fatalf("%s: canonical form %s failed to parse: %v", expr, ast.String(), err)
+		}
+		if !ast.Match(nfn) || !reparsed.Match(nfn) {
+			t.Errorf("%s: canonical form %s doesn't match", expr, ast.String())
+		}
+	}
+}
+
+func TestRealRoundTrip(t *testing.T) {
+	for _, value := range []float64{1.5e300, -1.5e300, 1e21, 1.5e-300, 1.5e-7, 2, 0.5} {
+		ast := &AST{TypeCode: Real64TypeCode, Value: value}
+		reparsed, err := ParseSubscription("r == " + ast.String())
+		if err != nil {
+			t.Errorf("%v: canonical form %s failed to parse: %v", value, ast.String(), err)
+			continue
+		}
+		if !reparsed.Match(map[string]interface{}{"r": value}) {
+			t.Errorf("%v: canonical form %s doesn't match", value, ast.String())
+		}
+	}
+}
+
+func TestEvalReorder(t *testing.T) {
+	exprs := []string{
+		"regex(str, '^H.*d$') && i32 == 10",
+		"regex(str, '^x') || i32 == 10",
+		"wildcard(str, 'H*') && missing == 1",
+		"contains(str, 'o') || missing == 1 || i32 > 100",
+		"regex(str, 'W') && (fold-case(str) == 'x' || i64 == 20) && size(data) == 3",
+		"ends-with(str, 'd') && !(i32 == 10) || begins-with(str, 'H') && nan(r64)",
+		"regex(str, 'z') ^^ i32 == 10 && equals(i64, 1, 20)",
+	}
+	nfns := []map[string]interface{}{
+		{"i32": int32(10), "i64": int64(20), "r64": float64(2.5), "str": "Hello World", "data": []byte{1, 2, 3}},
+		{"i32": int32(1), "str": "xyz"},
+		{"str": 42},
+		{},
+	}
+
+	reorder := Parser{Reorder: true}
+	for _, expr := range exprs {
+		plain, err := ParseSubscription(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		ordered, err := reorder.Parse(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		for _, nfn := range nfns {
+			if plain.Eval(nfn) != ordered.Eval(nfn) {
+				t.Errorf("%s with %v: reordering changed the result", expr, nfn)
+			}
+		}
+	}
+
+	// The cheap equality is tested first
+	ast, _ := reorder.Parse("regex(str, 'x') && contains(str, 'y') && i32 == 1")
+	if len(ast.Children) != 3 || ast.Children[0].TypeCode != EqualsTypeCode ||
+		ast.Children[2].TypeCode != FuncRegexTypeCode {
+		t.Errorf("Unexpected order: %+v", ast.Children)
+	}
+}
+
+func benchmarkReorder(b *testing.B, reorder bool) {
+	parser := Parser{Reorder: reorder}
+	ast, err := parser.Parse("regex(str, '^(a|b)*c[0-9]+x?y{2,5}$') && i32 == 1")
+	if err != nil {
+		b.Fatal(err)
+	}
+	nfn := map[string]interface{}{"i32": int32(2), "str": "abababababababababc1234yyy"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ast.Eval(nfn)
+	}
+}
+
+func BenchmarkEvalParsedOrder(b *testing.B) {
+	benchmarkReorder(b, false)
+}
+
+func BenchmarkEvalReordered(b *testing.B) {
+	benchmarkReorder(b, true)
+}
+
+func BenchmarkReorderLongChain(b *testing.B) {
+	expr := "a == 1" + strings.Repeat(" && a == 1", 9999)
+	parser := Parser{Reorder: true}
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.Parse(expr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
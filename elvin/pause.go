@@ -0,0 +1,113 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elog"
+	"sync/atomic"
+	"time"
+)
+
+// Pausing a subscription stops its notifications being delivered
+// without deleting it. The router is asked to withhold them, and as
+// any already on their way are dropped here too, nothing is delivered
+// once SubscriptionPause returns until SubscriptionResume. Notifications
+// sent while paused are lost. Only routers that understand
+// SubPauseRequest support this.
+
+// Is delivery for this subscription paused?
+func (sub *Subscription) Paused() bool {
+	return atomic.LoadInt32(&sub.paused) != 0
+}
+
+// Pause delivery for a subscription. If the router refuses, delivery
+// is still suppressed here.
+func (client *Client) SubscriptionPause(sub *Subscription) (err error) {
+	atomic.StoreInt32(&sub.paused, 1)
+	return client.subscriptionPause(sub, true)
+}
+
+// Resume delivery for a paused subscription. If the router refuses the
+// subscription stays paused.
+func (client *Client) SubscriptionResume(sub *Subscription) (err error) {
+	if err = client.subscriptionPause(sub, false); err == nil {
+		atomic.StoreInt32(&sub.paused, 0)
+	}
+	return err
+}
+
+func (client *Client) subscriptionPause(sub *Subscription, paused bool) (err error) {
+	if client.State() != StateConnected {
+		return LocalError(ErrorsClientNotConnected)
+	}
+	if sub.subID == 0 {
+		return LocalError(ErrorsNotSubscribed)
+	}
+
+	pkt := new(SubPauseRequest)
+	pkt.SubID = sub.subID
+	pkt.Paused = paused
+
+	writeBuf := new(bytes.Buffer)
+	xID := pkt.Encode(writeBuf)
+
+	// Map the XID back to this request
+	client.mu.Lock()
+	client.subReplies[xID] = sub
+	client.mu.Unlock()
+
+	client.writeChannel <- writeBuf
+
+	// Wait for the reply
+	select {
+	case reply := <-sub.events:
+		switch reply.(type) {
+		case *SubReply:
+			subReply := reply.(*SubReply)
+			if sub.subID != subReply.SubID {
+				client.elog.Logf(elog.LogLevelError, "Protocol violation (%v)", reply)
+				err = LocalError(ErrorsMismatchedIDs, sub.subID, subReply.SubID)
+			}
+		case *Nack:
+			err = NackError(*reply.(*Nack))
+		case *cancelPacket:
+			err = reply.(*cancelPacket).err
+		default:
+			err = LocalError(ErrorsBadPacket)
+		}
+
+	case <-time.After(SubscriptionTimeout):
+		err = LocalError(ErrorsTimeout)
+	}
+
+	client.mu.Lock()
+	delete(client.subReplies, xID)
+	client.mu.Unlock()
+
+	// Drop any reply that raced us
+	select {
+	case <-sub.events:
+	default:
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sort"
+)
+
+// Helpers for reconciling a desired set of subscriptions and quenches
+// with those a client currently has, e.g., for declarative
+// configuration or replay after a reconnect.
+
+// Does this subscription have the same expression, AcceptInsecure,
+// keys and delivery options as another?
+func (sub *Subscription) Equal(other *Subscription) bool {
+	return sub.Expression == other.Expression &&
+		sub.AcceptInsecure == other.AcceptInsecure &&
+		KeyBlockEqual(sub.Keys, other.Keys) &&
+		sub.MaxNotificationSize == other.MaxNotificationSize &&
+		projectionEqual(sub.Projection, other.Projection) &&
+		sub.Reliable == other.Reliable &&
+		sub.ManualAck == other.ManualAck
+}
+
+// Do two projections deliver the same attributes, in whatever order?
+func projectionEqual(a, b []string) bool {
+	set := func(names []string) map[string]bool {
+		s := make(map[string]bool, len(names))
+		for _, name := range names {
+			s[name] = true
+		}
+		return s
+	}
+	as, bs := set(a), set(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for name := range as {
+		if !bs[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Does this quench have the same names, DeliverInsecure and keys as
+// another?
+func (quench *Quench) Equal(other *Quench) bool {
+	if quench.All != other.All ||
+		quench.DeliverInsecure != other.DeliverInsecure ||
+		!KeyBlockEqual(quench.Keys, other.Keys) {
+		return false
+	}
+	if quench.All {
+		return true
+	}
+	if len(quench.Names) != len(other.Names) {
+		return false
+	}
+	for name := range quench.Names {
+		if !other.Names[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// A set of subscriptions indexed by a name of the caller's choosing
+type SubscriptionSet map[string]*Subscription
+
+// Compare the desired set against the current one returning the
+// sorted names of subscriptions to add, remove and modify to make
+// current match desired.
+func (desired SubscriptionSet) Diff(current SubscriptionSet) (adds, removes, modifies []string) {
+	for name, sub := range desired {
+		if existing, ok := current[name]; !ok {
+			adds = append(adds, name)
+		} else if !existing.Equal(sub) {
+			modifies = append(modifies, name)
+		}
+	}
+	for name := range current {
+		if _, ok := desired[name]; !ok {
+			removes = append(removes, name)
+		}
+	}
+	sort.Strings(adds)
+	sort.Strings(removes)
+	sort.Strings(modifies)
+	return adds, removes, modifies
+}
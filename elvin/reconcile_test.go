@@ -0,0 +1,125 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptionEqual(t *testing.T) {
+	a := &Subscription{Expression: "a == 1", AcceptInsecure: true}
+	a.Keys = KeyBlock{KeySchemeSha256Dual: KeySetList{{Key("foo"), Key("bar")}, {Key("baz")}}}
+	b := &Subscription{Expression: "a == 1", AcceptInsecure: true}
+	b.Keys = KeyBlock{KeySchemeSha256Dual: KeySetList{{Key("bar"), Key("foo")}, {Key("baz")}}}
+
+	if !a.Equal(b) {
+		t.Fatalf("Key order changed equality")
+	}
+
+	// Swapping producer and consumer keysets matters
+	b.Keys = KeyBlock{KeySchemeSha256Dual: KeySetList{{Key("baz")}, {Key("bar"), Key("foo")}}}
+	if a.Equal(b) {
+		t.Fatalf("Differing keysets are equal")
+	}
+
+	b.Keys = a.Keys
+	b.Expression = "a == 2"
+	if a.Equal(b) {
+		t.Fatalf("Differing expressions are equal")
+	}
+
+	b.Expression = a.Expression
+	b.AcceptInsecure = false
+	if a.Equal(b) {
+		t.Fatalf("Differing AcceptInsecure are equal")
+	}
+
+	// nil and empty keys are the same
+	if !(&Subscription{Keys: KeyBlock{}}).Equal(&Subscription{}) {
+		t.Fatalf("Empty and nil keys differ")
+	}
+
+	// Delivery options matter, though projection order doesn't
+	b.AcceptInsecure = a.AcceptInsecure
+	a.Projection = []string{"a", "b"}
+	b.Projection = []string{"b", "a"}
+	if !a.Equal(b) {
+		t.Fatalf("Projection order changed equality")
+	}
+	for name, change := range map[string]func(s *Subscription){
+		"MaxNotificationSize": func(s *Subscription) { s.MaxNotificationSize = 1024 },
+		"Projection":          func(s *Subscription) { s.Projection = []string{"a"} },
+		"Reliable":            func(s *Subscription) { s.Reliable = true },
+		"ManualAck":           func(s *Subscription) { s.ManualAck = true },
+	} {
+		c := &Subscription{Expression: b.Expression, AcceptInsecure: b.AcceptInsecure, Keys: b.Keys, Projection: b.Projection}
+		change(c)
+		if a.Equal(c) {
+			t.Fatalf("Differing %s are equal", name)
+		}
+	}
+}
+
+func TestQuenchEqual(t *testing.T) {
+	a := &Quench{Names: map[string]bool{"a": true, "b": true}}
+	b := &Quench{Names: map[string]bool{"b": true, "a": true}}
+	if !a.Equal(b) {
+		t.Fatalf("Identical quenches differ")
+	}
+	b.Names["c"] = true
+	if a.Equal(b) {
+		t.Fatalf("Differing names are equal")
+	}
+	a.All, b.All = true, true
+	if !a.Equal(b) {
+		t.Fatalf("Wildcard quenches differ by names")
+	}
+}
+
+func TestSubscriptionSetDiff(t *testing.T) {
+	current := SubscriptionSet{
+		"keep":   {Expression: "a == 1"},
+		"change": {Expression: "b == 1"},
+		"drop":   {Expression: "c == 1"},
+	}
+	desired := SubscriptionSet{
+		"keep":   {Expression: "a == 1"},
+		"change": {Expression: "b == 2"},
+		"new":    {Expression: "d == 1"},
+	}
+
+	adds, removes, modifies := desired.Diff(current)
+	if !reflect.DeepEqual(adds, []string{"new"}) {
+		t.Fatalf("Unexpected adds %v", adds)
+	}
+	if !reflect.DeepEqual(removes, []string{"drop"}) {
+		t.Fatalf("Unexpected removes %v", removes)
+	}
+	if !reflect.DeepEqual(modifies, []string{"change"}) {
+		t.Fatalf("Unexpected modifies %v", modifies)
+	}
+
+	adds, removes, modifies = desired.Diff(desired)
+	if len(adds)+len(removes)+len(modifies) != 0 {
+		t.Fatalf("Diff with self: %v %v %v", adds, removes, modifies)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+// Handle a SubRemoved, forgetting the subscription the router
+// removed. Its deliveries stop as though SubscriptionDelete had been
+// called, and the removal is reported on the AnomalyChannel so the
+// application can subscribe again or raise the alarm.
+func (client *Client) handleSubRemoved(buffer []byte) (err error) {
+	removed := new(SubRemoved)
+	if err = removed.Decode(buffer); err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	sub, ok := client.subscriptions[removed.SubID]
+	if ok {
+		delete(client.subscriptions, removed.SubID)
+		client.spendQuota(1)
+	}
+	client.mu.Unlock()
+
+	if ok {
+		sub.halt()
+		if sub.coalescer != nil {
+			sub.coalescer.stop()
+			sub.coalescer = nil
+		}
+		sub.retire()
+	}
+	client.anomaly(AnomalySubscriptionRemoved, "Subscription %d removed by the router (reason %d): %s",
+		removed.SubID, removed.Reason, removed.Message)
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+)
+
+// A Schema describes the attributes a notification must or may
+// carry, mapping each attribute name to its Notification element
+// type (NotificationInt32 etc).
+type Schema struct {
+	Required map[string]int // Attributes that must be present
+	Optional map[string]int // Attributes that may be present
+	Open     bool           // Allow attributes not named in the schema
+}
+
+// The reason a notification failed validation, suitable for use as a
+// local error or a Nack
+type SchemaError struct {
+	ErrorCode uint16
+	Args      []interface{}
+}
+
+func (err *SchemaError) Error() string {
+	return fmt.Sprintf("[%d] %s", err.ErrorCode, fmt.Sprintf(ElvinStringToFormatString(LocalErrors[err.ErrorCode]), err.Args...))
+}
+
+// Return the Notification element type of an attribute's value
+func NotificationType(value interface{}) int {
+	switch value.(type) {
+	case int32:
+		return NotificationInt32
+	case int64:
+		return NotificationInt64
+	case float64:
+		return NotificationFloat64
+	case string:
+		return NotificationString
+	case []byte:
+		return NotificationOpaque
+	}
+	return NotificationReserved
+}
+
+// Return the name of a Notification element type
+func NotificationTypeString(t int) string {
+	switch t {
+	case NotificationInt32:
+		return "int32"
+	case NotificationInt64:
+		return "int64"
+	case NotificationFloat64:
+		return "real64"
+	case NotificationString:
+		return "string"
+	case NotificationOpaque:
+		return "opaque"
+	}
+	return "unknown"
+}
+
+// Check a notification conforms to the schema, returning a
+// *SchemaError describing the first problem found
+func (schema *Schema) Validate(nv map[string]interface{}) error {
+	for name, t := range schema.Required {
+		value, ok := nv[name]
+		if !ok {
+			return &SchemaError{ErrorsSchemaMissing, []interface{}{name}}
+		}
+		if err := checkType(name, value, t); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range nv {
+		if _, ok := schema.Required[name]; ok {
+			continue
+		}
+		if t, ok := schema.Optional[name]; ok {
+			if err := checkType(name, value, t); err != nil {
+				return err
+			}
+			continue
+		}
+		if !schema.Open {
+			return &SchemaError{ErrorsSchemaExtra, []interface{}{name}}
+		}
+	}
+
+	return nil
+}
+
+func checkType(name string, value interface{}, expected int) error {
+	if t := NotificationType(value); t != expected {
+		return &SchemaError{ErrorsSchemaType, []interface{}{name, NotificationTypeString(t), NotificationTypeString(expected)}}
+	}
+	return nil
+}
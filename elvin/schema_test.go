@@ -0,0 +1,88 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+)
+
+var testSchema = Schema{
+	Required: map[string]int{"Name": NotificationString, "Count": NotificationInt32},
+	Optional: map[string]int{"Data": NotificationOpaque},
+}
+
+func TestSchemaValid(t *testing.T) {
+	nv := map[string]interface{}{"Name": "foo", "Count": int32(1)}
+	if err := testSchema.Validate(nv); err != nil {
+		t.Fatalf("Valid notification failed: %v", err)
+	}
+	nv["Data"] = []byte("bar")
+	if err := testSchema.Validate(nv); err != nil {
+		t.Fatalf("Valid notification with optional failed: %v", err)
+	}
+}
+
+func TestSchemaMissing(t *testing.T) {
+	nv := map[string]interface{}{"Name": "foo"}
+	err := testSchema.Validate(nv)
+	if err == nil {
+		t.Fatalf("Missing required attribute passed")
+	}
+	if e := err.(*SchemaError); e.ErrorCode != ErrorsSchemaMissing || e.Args[0] != "Count" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestSchemaType(t *testing.T) {
+	nv := map[string]interface{}{"Name": "foo", "Count": int64(1)}
+	err := testSchema.Validate(nv)
+	if err == nil {
+		t.Fatalf("Wrong type required attribute passed")
+	}
+	if e := err.(*SchemaError); e.ErrorCode != ErrorsSchemaType {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err.Error() != "[2511] Attribute Count is int64, expected int32" {
+		t.Fatalf("Unexpected error string: %v", err)
+	}
+
+	nv = map[string]interface{}{"Name": "foo", "Count": int32(1), "Data": "bar"}
+	if err = testSchema.Validate(nv); err == nil {
+		t.Fatalf("Wrong type optional attribute passed")
+	}
+}
+
+func TestSchemaExtra(t *testing.T) {
+	nv := map[string]interface{}{"Name": "foo", "Count": int32(1), "Extra": int32(2)}
+	err := testSchema.Validate(nv)
+	if err == nil {
+		t.Fatalf("Extra attribute passed")
+	}
+	if e := err.(*SchemaError); e.ErrorCode != ErrorsSchemaExtra || e.Args[0] != "Extra" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	open := testSchema
+	open.Open = true
+	if err = open.Validate(nv); err != nil {
+		t.Fatalf("Extra attribute failed for open schema: %v", err)
+	}
+}
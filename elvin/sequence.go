@@ -0,0 +1,130 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The attribute carrying a producer's sequence number (int64) when
+// a Client's Sequence is set
+const SequenceAttribute = "elvin:Sequence"
+
+// Counts sequence numbers per key value
+type sequences struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// An attribute value as a map key. Opaques aren't hashable and are
+// kept distinct from strings by the type.
+func sequenceKey(value interface{}) string {
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+// Send a copy of nv stamped with the next sequence number for its
+// key, counting per client if key is "". The number is only used
+// once send succeeds, and the count is held until then so numbers
+// are queued in order.
+func (client *Client) sendSequenced(nv map[string]interface{}, send func(map[string]interface{}) error) error {
+	var id string
+	if len(client.SequenceKey) > 0 {
+		id = sequenceKey(nv[client.SequenceKey])
+	}
+
+	client.sequences.mu.Lock()
+	defer client.sequences.mu.Unlock()
+	if client.sequences.last == nil {
+		client.sequences.last = make(map[string]int64)
+	}
+	next := client.sequences.last[id] + 1
+
+	stamped := make(map[string]interface{}, len(nv)+1)
+	for name, value := range nv {
+		stamped[name] = value
+	}
+	stamped[SequenceAttribute] = next
+	if err := send(stamped); err != nil {
+		return err
+	}
+	client.sequences.last[id] = next
+	return nil
+}
+
+// Tracks the last sequence number seen for each value of a key
+// attribute, or for all notifications if the key is "", to detect
+// gaps from dropped notifications
+type SequenceTracker struct {
+	key   string
+	seen  sequences
+	OnGap func(key interface{}, expected int64, received int64) // Optional
+}
+
+// Create a tracker keyed on the named attribute
+func NewSequenceTracker(key string) *SequenceTracker {
+	return &SequenceTracker{key: key}
+}
+
+// Note a notification's sequence number, returning how many were
+// missed before it. Notifications without one, the first for a key,
+// and those at or behind the last seen (e.g. a restarted producer)
+// aren't gaps.
+func (tracker *SequenceTracker) Check(nv map[string]interface{}) (missed int64) {
+	sequence, ok := nv[SequenceAttribute].(int64)
+	if !ok {
+		return 0
+	}
+	var key interface{}
+	if len(tracker.key) > 0 {
+		key = nv[tracker.key]
+	}
+	id := sequenceKey(key)
+
+	tracker.seen.mu.Lock()
+	if tracker.seen.last == nil {
+		tracker.seen.last = make(map[string]int64)
+	}
+	last, seen := tracker.seen.last[id]
+	tracker.seen.last[id] = sequence
+	tracker.seen.mu.Unlock()
+
+	if !seen || sequence <= last+1 {
+		return 0
+	}
+	missed = sequence - last - 1
+	if tracker.OnGap != nil {
+		tracker.OnGap(key, last+1, sequence)
+	}
+	return missed
+}
+
+// Check a delivery against the subscription's tracker, reporting any
+// gap as an anomaly
+func (client *Client) checkSequence(sub *Subscription, nv map[string]interface{}) {
+	if sub.Sequence == nil {
+		return
+	}
+	if missed := sub.Sequence.Check(nv); missed > 0 {
+		client.anomaly(AnomalySequenceGap, "Subscription %d missed %d notifications before sequence %v",
+			sub.subID, missed, nv[SequenceAttribute])
+	}
+}
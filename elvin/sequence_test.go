@@ -0,0 +1,106 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSequenceGap(t *testing.T) {
+	producer := NewClient("elvin://", nil, nil, nil)
+	producer.Sequence = true
+	producer.SequenceKey = "Symbol"
+
+	consumer := fakeConnectedClient(func() {})
+	consumer.AnomalyChannel = make(chan Anomaly, 4)
+	sub := &Subscription{Expression: "require(Symbol)", subID: 7}
+	sub.Notifications = make(chan map[string]interface{}, 8)
+	sub.Sequence = NewSequenceTracker("Symbol")
+	consumer.subscriptions[7] = sub
+
+	deliver := func(nv map[string]interface{}) {
+		buf := new(bytes.Buffer)
+		pkt := &NotifyDeliver{NameValue: nv, Insecure: []int64{7}}
+		pkt.Encode(buf)
+		if err := consumer.handlePacket(buf.Bytes()); err != nil {
+			t.Fatalf("NotifyDeliver failed: %v", err)
+		}
+	}
+
+	stamp := func(nv map[string]interface{}) (stamped map[string]interface{}) {
+		producer.sendSequenced(nv, func(nv map[string]interface{}) error {
+			stamped = nv
+			return nil
+		})
+		return stamped
+	}
+
+	// Interleaved keys are counted separately
+	for i := 0; i < 3; i++ {
+		deliver(stamp(map[string]interface{}{"Symbol": "A"}))
+		deliver(stamp(map[string]interface{}{"Symbol": "B"}))
+	}
+	select {
+	case anomaly := <-consumer.AnomalyChannel:
+		t.Fatalf("Unexpected anomaly: %v", anomaly)
+	default:
+	}
+
+	// Drop A:4
+	stamp(map[string]interface{}{"Symbol": "A"})
+	nv := stamp(map[string]interface{}{"Symbol": "A"})
+	if nv[SequenceAttribute] != int64(5) {
+		t.Fatalf("Expected sequence 5, got %v", nv[SequenceAttribute])
+	}
+	deliver(nv)
+	select {
+	case anomaly := <-consumer.AnomalyChannel:
+		if anomaly.Type != AnomalySequenceGap {
+			t.Fatalf("Expected a sequence gap anomaly, got: %v", anomaly)
+		}
+	default:
+		t.Fatalf("No anomaly reported for a dropped sequence")
+	}
+
+	deliver(stamp(map[string]interface{}{"Symbol": "B"}))
+	select {
+	case anomaly := <-consumer.AnomalyChannel:
+		t.Fatalf("Unexpected anomaly: %v", anomaly)
+	default:
+	}
+	if len(sub.Notifications) != 8 {
+		t.Fatalf("Expected 8 deliveries, got %d", len(sub.Notifications))
+	}
+
+	// A failed send doesn't use up a number
+	failed := func(map[string]interface{}) error { return LocalError(ErrorsClientNotConnected) }
+	if err := producer.sendSequenced(map[string]interface{}{"Symbol": "B"}, failed); err == nil {
+		t.Fatalf("Failed send not reported")
+	}
+	<-sub.Notifications
+	deliver(stamp(map[string]interface{}{"Symbol": "B"}))
+	select {
+	case anomaly := <-consumer.AnomalyChannel:
+		t.Fatalf("Failed send left a gap: %v", anomaly)
+	default:
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"net"
+	"time"
+)
+
+// TCP tuning applied to connections once they're established. The
+// zero value leaves Go's defaults alone.
+type SocketOptions struct {
+	TCPNoDelay   *bool         // Disable Nagle's algorithm, nil for Go's default (true)
+	TCPKeepAlive time.Duration // Keepalive period, 0 for Go's default, negative to disable
+	ReadBuffer   int           // Socket buffer sizes, 0 for the system default
+	WriteBuffer  int
+}
+
+// The tuning methods of a *net.TCPConn
+type tcpConn interface {
+	SetNoDelay(noDelay bool) error
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// Apply the options to a connection. Connections other than TCP
+// (e.g. net.Pipe) are left alone.
+func (opts *SocketOptions) Apply(conn net.Conn) (err error) {
+	tcp, ok := conn.(tcpConn)
+	if opts == nil || !ok {
+		return nil
+	}
+
+	if opts.TCPNoDelay != nil {
+		if err = tcp.SetNoDelay(*opts.TCPNoDelay); err != nil {
+			return err
+		}
+	}
+	switch {
+	case opts.TCPKeepAlive < 0:
+		err = tcp.SetKeepAlive(false)
+	case opts.TCPKeepAlive > 0:
+		if err = tcp.SetKeepAlive(true); err == nil {
+			err = tcp.SetKeepAlivePeriod(opts.TCPKeepAlive)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if opts.ReadBuffer > 0 {
+		if err = tcp.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err = tcp.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrap a listener so the options are applied to each connection it
+// accepts. Wrap before adding TLS so the options reach the TCPConn.
+// As this is only tuning, connections are still accepted if the
+// options can't be applied.
+func (opts *SocketOptions) Listener(listener net.Listener) net.Listener {
+	if opts == nil {
+		return listener
+	}
+	return &socketListener{listener, opts}
+}
+
+type socketListener struct {
+	net.Listener
+	opts *SocketOptions
+}
+
+func (listener *socketListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		listener.opts.Apply(conn)
+	}
+	return conn, err
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A connection recording the TCP options set on it
+type optionsConn struct {
+	net.Conn
+	noDelay     *bool
+	keepAlive   *bool
+	period      time.Duration
+	readBuffer  int
+	writeBuffer int
+}
+
+func (conn *optionsConn) SetNoDelay(noDelay bool) error {
+	conn.noDelay = &noDelay
+	return nil
+}
+
+func (conn *optionsConn) SetKeepAlive(keepAlive bool) error {
+	conn.keepAlive = &keepAlive
+	return nil
+}
+
+func (conn *optionsConn) SetKeepAlivePeriod(d time.Duration) error {
+	conn.period = d
+	return nil
+}
+
+func (conn *optionsConn) SetReadBuffer(bytes int) error {
+	conn.readBuffer = bytes
+	return nil
+}
+
+func (conn *optionsConn) SetWriteBuffer(bytes int) error {
+	conn.writeBuffer = bytes
+	return nil
+}
+
+// Accepts a single connection
+type optionsListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (listener *optionsListener) Accept() (net.Conn, error) {
+	return listener.conn, nil
+}
+
+func TestSocketOptions(t *testing.T) {
+	noDelay := false
+	opts := &SocketOptions{TCPNoDelay: &noDelay, TCPKeepAlive: time.Minute, ReadBuffer: 1024, WriteBuffer: 2048}
+
+	conn := new(optionsConn)
+	if err := opts.Apply(conn); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if conn.noDelay == nil || *conn.noDelay || conn.keepAlive == nil || !*conn.keepAlive ||
+		conn.period != time.Minute || conn.readBuffer != 1024 || conn.writeBuffer != 2048 {
+		t.Fatalf("Options not applied: %+v", conn)
+	}
+
+	// Defaults are left alone
+	conn = new(optionsConn)
+	var defaults *SocketOptions
+	if err := defaults.Apply(conn); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if err := new(SocketOptions).Apply(conn); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if conn.noDelay != nil || conn.keepAlive != nil || conn.readBuffer != 0 || conn.writeBuffer != 0 {
+		t.Fatalf("Defaults changed: %+v", conn)
+	}
+
+	opts = &SocketOptions{TCPKeepAlive: -1}
+	accepted, _ := opts.Listener(&optionsListener{conn: conn}).Accept()
+	if accepted != conn || conn.keepAlive == nil || *conn.keepAlive {
+		t.Fatalf("Listener didn't disable keepalive: %+v", conn)
+	}
+
+	// Not TCP
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if err := opts.Apply(pipe); err != nil {
+		t.Fatalf("Apply to a pipe failed: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// The serializable part of a Subscription
+type SubscriptionState struct {
+	Expression     string
+	AcceptInsecure bool
+	InsecureOK     bool
+	Keys           KeyBlock
+	Payload        string
+	CoalesceKey    string
+}
+
+// The serializable part of a Quench
+type QuenchState struct {
+	Names           map[string]bool
+	All             bool
+	NotifySelf      bool
+	DeliverInsecure bool
+	Keys            KeyBlock
+}
+
+// A client's subscriptions and quenches as saved by ExportState
+type ClientState struct {
+	Subscriptions []SubscriptionState
+	Quenches      []QuenchState
+}
+
+// The capacity of the Notifications channels made by LoadState, so
+// the first deliveries to a restored subscription don't hold up the
+// connection before its caller starts reading
+const StateNotificationsBuffer = 64
+
+// Snapshot the client's active subscriptions and quenches so they
+// can be restored on another client with ImportState. Channels and
+// decoders can't be saved and must be set up again. Keys are only
+// saved if withKeys is set, and then as they are, unencrypted, so
+// the result must be kept as safe as the keys themselves.
+func (client *Client) ExportState(withKeys bool) ([]byte, error) {
+	var state ClientState
+
+	client.mu.Lock()
+	subIDs := make([]int64, 0, len(client.subscriptions))
+	for id := range client.subscriptions {
+		subIDs = append(subIDs, id)
+	}
+	sort.Slice(subIDs, func(i, j int) bool { return subIDs[i] < subIDs[j] })
+	for _, id := range subIDs {
+		sub := client.subscriptions[id]
+		state.Subscriptions = append(state.Subscriptions, SubscriptionState{
+			Expression:     sub.Expression,
+			AcceptInsecure: sub.AcceptInsecure,
+			InsecureOK:     sub.InsecureOK,
+			Keys:           sub.Keys,
+			Payload:        sub.Payload,
+			CoalesceKey:    sub.CoalesceKey,
+		})
+	}
+
+	quenchIDs := make([]int64, 0, len(client.quenches))
+	for id := range client.quenches {
+		quenchIDs = append(quenchIDs, id)
+	}
+	sort.Slice(quenchIDs, func(i, j int) bool { return quenchIDs[i] < quenchIDs[j] })
+	for _, id := range quenchIDs {
+		quench := client.quenches[id]
+		state.Quenches = append(state.Quenches, QuenchState{
+			Names:           quench.Names,
+			All:             quench.All,
+			NotifySelf:      quench.NotifySelf,
+			DeliverInsecure: quench.DeliverInsecure,
+			Keys:            quench.Keys,
+		})
+	}
+	client.mu.Unlock()
+
+	if !withKeys {
+		for i := range state.Subscriptions {
+			state.Subscriptions[i].Keys = nil
+		}
+		for i := range state.Quenches {
+			state.Quenches[i].Keys = nil
+		}
+	}
+	return json.Marshal(state)
+}
+
+// Rebuild the subscriptions and quenches saved by ExportState without
+// subscribing them. Each has a new Notifications channel buffering
+// StateNotificationsBuffer, which may be replaced before passing them
+// to Subscribe or Quench.
+func LoadState(data []byte) (subs []*Subscription, quenches []*Quench, err error) {
+	var state ClientState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range state.Subscriptions {
+		subs = append(subs, &Subscription{
+			Expression:     s.Expression,
+			AcceptInsecure: s.AcceptInsecure,
+			InsecureOK:     s.InsecureOK,
+			Keys:           s.Keys,
+			Payload:        s.Payload,
+			CoalesceKey:    s.CoalesceKey,
+			Notifications:  make(chan map[string]interface{}, StateNotificationsBuffer),
+		})
+	}
+	for _, q := range state.Quenches {
+		quenches = append(quenches, &Quench{
+			Names:           q.Names,
+			All:             q.All,
+			NotifySelf:      q.NotifySelf,
+			DeliverInsecure: q.DeliverInsecure,
+			Keys:            q.Keys,
+			Notifications:   make(chan QuenchNotification, StateNotificationsBuffer),
+		})
+	}
+	return subs, quenches, nil
+}
+
+// Restore the subscriptions and quenches saved by ExportState on
+// this (connected) client. On failure those already restored are
+// left in place.
+func (client *Client) ImportState(data []byte) (subs []*Subscription, quenches []*Quench, err error) {
+	if subs, quenches, err = LoadState(data); err != nil {
+		return nil, nil, err
+	}
+	for _, sub := range subs {
+		if err = client.Subscribe(sub); err != nil {
+			return subs, quenches, err
+		}
+	}
+	for _, quench := range quenches {
+		if err = client.Quench(quench); err != nil {
+			return subs, quenches, err
+		}
+	}
+	return subs, quenches, nil
+}
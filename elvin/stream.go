@@ -0,0 +1,109 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// How NotifyStream treats a record that can't be decoded or is an
+// invalid notification
+const (
+	StreamStopOnError = iota // Stop, returning the error
+	StreamSkipErrors         // Skip it, counting it in StreamStats
+)
+
+// Options for NotifyStream
+type StreamOptions struct {
+	DeliverInsecure bool
+	Keys            KeyBlock
+	BatchSize       int // Records sent per NotifyBatch, 1 if zero
+	OnError         int // StreamStopOnError or StreamSkipErrors
+	MaxRecordSize   int // Longest record in bytes, bufio.MaxScanTokenSize if zero
+}
+
+// What NotifyStream did
+type StreamStats struct {
+	Sent    int // Notifications sent
+	Skipped int // Records skipped under StreamSkipErrors
+}
+
+// Send a notification for each newline delimited record read from r,
+// as decoded by decode, until EOF. Empty lines are ignored. Records
+// are validated and sent in batches, see NotifyBatch. Under
+// StreamStopOnError a bad record stops the stream, and as batches are
+// all or nothing, none of its batch is sent.
+func (client *Client) NotifyStream(r io.Reader, decode func([]byte) (map[string]interface{}, error), opts StreamOptions) (stats StreamStats, err error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	skip := opts.OnError == StreamSkipErrors
+
+	scanner := bufio.NewScanner(r)
+	if opts.MaxRecordSize > 0 {
+		scanner.Buffer(nil, opts.MaxRecordSize)
+	}
+
+	var batch []map[string]interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := client.NotifyBatch(batch, opts.DeliverInsecure, opts.Keys, skip)
+		if batchErr, ok := err.(*BatchError); ok && batchErr.Sent {
+			stats.Sent += len(batch) - len(batchErr.Problems)
+			stats.Skipped += len(batchErr.Problems)
+			err = nil
+		} else if err == nil {
+			stats.Sent += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	for record := 1; scanner.Scan(); record++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		nv, e := decode(line)
+		if e != nil {
+			if !skip {
+				return stats, fmt.Errorf("record %d: %v", record, e)
+			}
+			stats.Skipped++
+			continue
+		}
+		batch = append(batch, nv)
+		if len(batch) >= batchSize {
+			if err = flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
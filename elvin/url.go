@@ -27,12 +27,19 @@ import (
 )
 
 type Protocol struct {
-	Network string
-	Marshal string
-	Address string
-	Args    string
-	Major   int
-	Minor   int
+	Network   string
+	Marshal   string
+	Address   string
+	Args      string
+	Major     int
+	Minor     int
+	Addresses []string       // Further addresses served the same way
+	Socket    *SocketOptions // TCP tuning, nil for the defaults
+}
+
+// Every address this protocol is served on, Address first
+func (protocol *Protocol) AllAddresses() []string {
+	return append([]string{protocol.Address}, protocol.Addresses...)
 }
 
 func ProtocolToURL(protocol *Protocol) (url string) {
@@ -70,7 +70,7 @@ func TestURLToProtocol(t *testing.T) {
 }
 
 func TestProtocolToURL(t *testing.T) {
-	protocol := Protocol{"tcp", "xdr", "localhost:2917", "args", 4, 1}
+	protocol := Protocol{"tcp", "xdr", "localhost:2917", "args", 4, 1, nil, nil}
 	expect := "elvin:4.1/tcp,xdr/localhost:2917/args"
 	get := ProtocolToURL(&protocol)
 	if expect != get {
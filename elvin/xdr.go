@@ -26,17 +26,56 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sync/atomic"
 )
 
 // Defined errors we return
 var NotEnoughSpace error = errors.New("Input buffer too small")
 
+// Limits applied while decoding so a peer can't claim an enormous
+// field and have us allocate it. A zero limit is unlimited.
+//
+// Regardless of these, lengths and counts that can't fit in the rest
+// of the frame are rejected, as are unknown value types. Together with
+// bools that aren't 0 or 1 and 16 bit values out of range, which are
+// rejected unless Lenient is set, these catch a peer sending
+// little-endian data before it decodes into garbage.
+type XdrLimits struct {
+	MaxStringLength int  // bytes in a string
+	MaxOpaqueLength int  // bytes in an opaque
+	MaxNameValues   int  // name/value pairs in a notification
+	Lenient         bool // accept any bool and truncate 16 bit values
+}
+
+var xdrLimits atomic.Value
+
+func init() {
+	xdrLimits.Store(XdrLimits{})
+}
+
+// Set the decoding limits
+func SetXdrLimits(limits XdrLimits) {
+	xdrLimits.Store(limits)
+}
+
+// Get the decoding limits
+func GetXdrLimits() XdrLimits {
+	return xdrLimits.Load().(XdrLimits)
+}
+
 // FIXME The current state is that the getters use a []byte and the
 // putters use a bytes.Buffer. This is because for now we're being
 // quick and dirty and experimental. Much will depend on subsequent
 // performance tuning
 
-// FIXME range checking
+// Check that count items of at least size bytes each fit in the
+// remaining bytes, as a byte-swapped count almost never does
+func xdrPlausible(what string, count int64, size int, remaining int) error {
+	if count < 0 || count*int64(size) > int64(remaining) {
+		return LocalError(ErrorsXdrLength, what, count, remaining)
+	}
+	return nil
+}
 
 // Get an xdr marshalled 32 bit signed int
 func XdrGetInt32(bytes []byte) (i int32, used int, err error) {
@@ -73,6 +112,9 @@ func XdrPutUint32(buffer *bytes.Buffer, u uint32) {
 
 // Get an xdr marshalled 64 bit signed int
 func XdrGetInt64(bytes []byte) (i int64, used int, err error) {
+	if len(bytes) < 8 {
+		return 0, 0, NotEnoughSpace
+	}
 	return int64(binary.BigEndian.Uint64(bytes)), 8, nil
 }
 
@@ -91,6 +133,9 @@ func XdrPutInt64(buffer *bytes.Buffer, i int64) {
 
 // Get an xdr marshalled 64 bit unsigned int
 func XdrGetUint64(bytes []byte) (u uint64, used int, err error) {
+	if len(bytes) < 8 {
+		return 0, 0, NotEnoughSpace
+	}
 	return binary.BigEndian.Uint64(bytes), 8, nil
 }
 
@@ -113,6 +158,9 @@ func XdrGetBool(bytes []byte) (b bool, used int, err error) {
 	if err != nil {
 		return false, 0, err
 	}
+	if i != 0 && i != 1 && !GetXdrLimits().Lenient {
+		return false, 0, LocalError(ErrorsXdrRange, "bool", i)
+	}
 	b = (i != 0)
 	return b, used, nil
 }
@@ -133,6 +181,9 @@ func XdrGetInt16(bytes []byte) (i16 int16, used int, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
+	if (i < math.MinInt16 || i > math.MaxInt16) && !GetXdrLimits().Lenient {
+		return 0, 0, LocalError(ErrorsXdrRange, "int16", i)
+	}
 	return int16(i), used, nil
 }
 
@@ -148,6 +199,9 @@ func XdrGetUint16(bytes []byte) (u16 uint16, used int, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
+	if u > math.MaxUint16 && !GetXdrLimits().Lenient {
+		return 0, 0, LocalError(ErrorsXdrRange, "uint16", u)
+	}
 	return uint16(u), used, nil
 }
 
@@ -164,6 +218,12 @@ func XdrGetString(bytes []byte) (s string, used int, err error) {
 	if err != nil {
 		return "", 0, err
 	}
+	if max := GetXdrLimits().MaxStringLength; max > 0 && int(length) > max {
+		return "", 0, LocalError(ErrorsStringTooLong, length, max)
+	}
+	if err = xdrPlausible("string length", int64(length), 1, len(bytes)-used); err != nil {
+		return "", 0, err
+	}
 	// name
 	return string(bytes[used : used+int(length)]), used + int(length) + (3 - (int(length)+3)%4), nil // strings use 4 byte boundaries
 }
@@ -188,6 +248,12 @@ func XdrGetOpaque(bytes []byte) (b []byte, used int, err error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	if max := GetXdrLimits().MaxOpaqueLength; max > 0 && int(length) > max {
+		return nil, 0, LocalError(ErrorsOpaqueTooLong, length, max)
+	}
+	if err = xdrPlausible("opaque length", int64(length), 1, len(bytes)-used); err != nil {
+		return nil, 0, err
+	}
 
 	// name
 	return bytes[used : used+int(length)], used + int(length) + (3 - (int(length)+3)%4), nil // opaques use 4 byte boundaries
@@ -208,6 +274,9 @@ func XdrPutOpaque(buffer *bytes.Buffer, b []byte) {
 
 // Get an xdr marshalled 64 bit floating point
 func XdrGetFloat64(bytes []byte) (f float64, used int, err error) {
+	if len(bytes) < 8 {
+		return 0, 0, NotEnoughSpace
+	}
 	f64 := math.Float64frombits(uint64(bytes[7]) | uint64(bytes[6])<<8 |
 		uint64(bytes[5])<<16 | uint64(bytes[4])<<24 |
 		uint64(bytes[3])<<32 | uint64(bytes[2])<<40 |
@@ -257,7 +326,7 @@ func XdrGetValue(bytes []byte) (val interface{}, used int, err error) {
 	case NotificationOpaque:
 		value, used, err = XdrGetOpaque(bytes[offset:])
 	default:
-		return nil, offset, errors.New("Marshalling failed: unknown element type")
+		return nil, 0, LocalError(ErrorsXdrRange, "value type", elementType)
 	}
 
 	if err != nil {
@@ -296,31 +365,55 @@ func XdrPutValue(buffer *bytes.Buffer, value interface{}) {
 
 // Get an xdr marshalled Elvin Notification
 func XdrGetNotification(bytes []byte) (nfn map[string]interface{}, used int, err error) {
+	nfn, _, used, err = xdrGetNotification(bytes, false)
+	return nfn, used, err
+}
+
+// Get an xdr marshalled Elvin Notification along with its names in
+// the order they first appear on the wire
+func XdrGetNotificationOrder(bytes []byte) (nfn map[string]interface{}, order []string, used int, err error) {
+	return xdrGetNotification(bytes, true)
+}
+
+func xdrGetNotification(bytes []byte, keepOrder bool) (nfn map[string]interface{}, order []string, used int, err error) {
 	nfn = make(map[string]interface{})
 	offset := 0
 
 	// Number of elements
 	elementCount, used, err := XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if max := GetXdrLimits().MaxNameValues; max > 0 && elementCount > uint32(max) {
+		return nil, nil, 0, LocalError(ErrorsTooManyNameValues, elementCount, max)
+	}
 	offset += used
+	// each at least an empty name, a type and a 4 byte value
+	if err = xdrPlausible("name/value count", int64(elementCount), 12, len(bytes)-offset); err != nil {
+		return nil, nil, 0, err
+	}
 
 	for elementCount > 0 {
 		var name string // Avoid warning from go vet -shadow
 		name, used, err = XdrGetString(bytes[offset:])
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, 0, err
 		}
 		offset += used
+		if _, dup := nfn[name]; keepOrder && !dup {
+			order = append(order, name)
+		}
 
 		// The value
 		nfn[name], used, err = XdrGetValue(bytes[offset:])
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, 0, err
 		}
 		offset += used
 		elementCount--
 	}
 
-	return nfn, offset, err
+	return nfn, order, offset, err
 }
 
 // Put an xdr marshalled Elvin Notification
@@ -338,6 +431,96 @@ func XdrPutNotification(buffer *bytes.Buffer, nfn map[string]interface{}) {
 	return
 }
 
+// Put an xdr marshalled Elvin Notification with the names in order,
+// which must not repeat, first, skipping any it no longer has, and
+// then the rest
+func XdrPutNotificationInOrder(buffer *bytes.Buffer, nfn map[string]interface{}, order []string) {
+	if len(order) == 0 {
+		XdrPutNotification(buffer, nfn)
+		return
+	}
+
+	// Number of elements
+	XdrPutInt32(buffer, int32(len(nfn)))
+
+	put := 0
+	for _, name := range order {
+		if value, ok := nfn[name]; ok {
+			XdrPutString(buffer, name)
+			XdrPutValue(buffer, value)
+			put++
+		}
+	}
+	if put == len(nfn) {
+		return
+	}
+
+	// Added since, e.g. by the router
+	ordered := make(map[string]bool, len(order))
+	for _, name := range order {
+		ordered[name] = true
+	}
+	for name, value := range nfn {
+		if !ordered[name] {
+			XdrPutString(buffer, name)
+			XdrPutValue(buffer, value)
+		}
+	}
+}
+
+// A name/value pair, for when attribute order matters
+type NameValuePair struct {
+	Name  string
+	Value interface{}
+}
+
+// Get an xdr marshalled Elvin Notification keeping the wire order
+func XdrGetNotificationOrdered(bytes []byte) (pairs []NameValuePair, used int, err error) {
+	offset := 0
+
+	// Number of elements
+	elementCount, used, err := XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	if max := GetXdrLimits().MaxNameValues; max > 0 && elementCount > uint32(max) {
+		return nil, 0, LocalError(ErrorsTooManyNameValues, elementCount, max)
+	}
+	offset += used
+	// each at least an empty name, a type and a 4 byte value
+	if err = xdrPlausible("name/value count", int64(elementCount), 12, len(bytes)-offset); err != nil {
+		return nil, 0, err
+	}
+
+	pairs = make([]NameValuePair, elementCount)
+	for i := range pairs {
+		if pairs[i].Name, used, err = XdrGetString(bytes[offset:]); err != nil {
+			return nil, 0, err
+		}
+		offset += used
+
+		if pairs[i].Value, used, err = XdrGetValue(bytes[offset:]); err != nil {
+			return nil, 0, err
+		}
+		offset += used
+	}
+
+	return pairs, offset, nil
+}
+
+// Put an xdr marshalled Elvin Notification in the given order
+func XdrPutNotificationOrdered(buffer *bytes.Buffer, pairs []NameValuePair) {
+
+	// Number of elements
+	XdrPutInt32(buffer, int32(len(pairs)))
+
+	for _, pair := range pairs {
+		XdrPutString(buffer, pair.Name)
+		XdrPutValue(buffer, pair.Value)
+	}
+	return
+}
+
 // Get an xdr marshalled list of Values
 func XdrGetValues(bytes []byte) (values []interface{}, used int, err error) {
 	offset := 0
@@ -348,6 +531,9 @@ func XdrGetValues(bytes []byte) (values []interface{}, used int, err error) {
 		return nil, 0, err
 	}
 	offset += used
+	if err = xdrPlausible("value count", int64(elementCount), 8, len(bytes)-offset); err != nil {
+		return nil, 0, err
+	}
 
 	v := make([]interface{}, elementCount)
 	for i := 0; i < int(elementCount); i++ {
@@ -383,6 +569,9 @@ func XdrGetKeys(bytes []byte) (keyBlock KeyBlock, used int, err error) {
 		return nil, 0, err
 	}
 	offset += used
+	if err = xdrPlausible("key scheme count", int64(kslCount), 8, len(bytes)-offset); err != nil {
+		return nil, 0, err
+	}
 	keyBlock = make(map[int]KeySetList)
 
 	for i := 0; i < int(kslCount); i++ {
@@ -398,6 +587,9 @@ func XdrGetKeys(bytes []byte) (keyBlock KeyBlock, used int, err error) {
 			return nil, 0, err
 		}
 		offset += used
+		if err = xdrPlausible("key set count", int64(ksCount), 4, len(bytes)-offset); err != nil {
+			return nil, 0, err
+		}
 
 		keyBlock[int(scheme)] = make([]KeySet, ksCount)
 
@@ -408,6 +600,9 @@ func XdrGetKeys(bytes []byte) (keyBlock KeyBlock, used int, err error) {
 				return nil, 0, err
 			}
 			offset += used
+			if err = xdrPlausible("key count", int64(keyCount), 4, len(bytes)-offset); err != nil {
+				return nil, 0, err
+			}
 
 			// And finally the keys
 			for k := 0; k < int(keyCount); k++ {
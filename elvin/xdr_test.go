@@ -22,8 +22,10 @@ package elvin
 
 import (
 	"bytes"
+	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -289,6 +291,25 @@ func TestXdrNotification(t *testing.T) {
 	}
 }
 
+func TestXdrNotificationInOrder(t *testing.T) {
+	// "gone" was dropped and "added" added since the order was taken
+	nfn := map[string]interface{}{"z": int32(1), "a": "two", "m": int64(3), "added": int32(4)}
+	order := []string{"z", "gone", "a", "m"}
+
+	buffer := new(bytes.Buffer)
+	XdrPutNotificationInOrder(buffer, nfn, order)
+	nfn2, order2, _, err := XdrGetNotificationOrder(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(nfn, nfn2) {
+		t.Fatalf("Expected %v, got %v", nfn, nfn2)
+	}
+	if expected := []string{"z", "a", "m", "added"}; !reflect.DeepEqual(order2, expected) {
+		t.Fatalf("Expected order %v, got %v", expected, order2)
+	}
+}
+
 func TestXdrKeys(t *testing.T) {
 	var buffer = new(bytes.Buffer)
 	pkb1, _ := DualExample()
@@ -309,6 +330,126 @@ func TestXdrKeys(t *testing.T) {
 
 // Benchmarks
 
+func TestXdrLimits(t *testing.T) {
+	defer SetXdrLimits(GetXdrLimits())
+	SetXdrLimits(XdrLimits{MaxStringLength: 4, MaxOpaqueLength: 4, MaxNameValues: 2})
+
+	var b bytes.Buffer
+	XdrPutString(&b, "abcd")
+	if _, _, err := XdrGetString(b.Bytes()); err != nil {
+		t.Fatalf("String at the limit failed: %v", err)
+	}
+	b.Reset()
+	XdrPutString(&b, "abcde")
+	_, _, err := XdrGetString(b.Bytes())
+	if err == nil || err.Error() != LocalError(ErrorsStringTooLong, 5, 4).Error() {
+		t.Fatalf("Expected string too long, got: %v", err)
+	}
+
+	b.Reset()
+	XdrPutOpaque(&b, []byte{0, 1, 2, 3, 4, 5})
+	_, _, err = XdrGetOpaque(b.Bytes())
+	if err == nil || err.Error() != LocalError(ErrorsOpaqueTooLong, 6, 4).Error() {
+		t.Fatalf("Expected opaque too long, got: %v", err)
+	}
+
+	b.Reset()
+	XdrPutNotification(&b, map[string]interface{}{"a": int32(1), "b": int32(2), "c": int32(3)})
+	_, _, err = XdrGetNotification(b.Bytes())
+	if err == nil || err.Error() != LocalError(ErrorsTooManyNameValues, 3, 2).Error() {
+		t.Fatalf("Expected too many name/values, got: %v", err)
+	}
+
+	// Names are strings too
+	b.Reset()
+	XdrPutNotification(&b, map[string]interface{}{"toolong": int32(1)})
+	_, _, err = XdrGetNotification(b.Bytes())
+	if err == nil || err.Error() != LocalError(ErrorsStringTooLong, 7, 4).Error() {
+		t.Fatalf("Expected name too long, got: %v", err)
+	}
+}
+
+// Swap the bytes of each 32 bit word, as a naive little-endian peer
+// would send them
+func byteSwapped(b []byte) []byte {
+	swapped := make([]byte, len(b))
+	for i := 0; i+4 <= len(b); i += 4 {
+		swapped[i], swapped[i+1], swapped[i+2], swapped[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return swapped
+}
+
+func TestXdrByteSwapped(t *testing.T) {
+	expect := func(what string, err error, code int) {
+		if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("[%d]", code)) {
+			t.Fatalf("Expected %s rejected with %d, got: %v", what, code, err)
+		}
+	}
+
+	var b bytes.Buffer
+	XdrPutString(&b, "abc")
+	_, _, err := XdrGetString(byteSwapped(b.Bytes()))
+	expect("string", err, ErrorsXdrLength)
+
+	b.Reset()
+	XdrPutOpaque(&b, []byte{1, 2, 3, 4, 5})
+	_, _, err = XdrGetOpaque(byteSwapped(b.Bytes()))
+	expect("opaque", err, ErrorsXdrLength)
+
+	b.Reset()
+	XdrPutValue(&b, int32(7))
+	_, _, err = XdrGetValue(byteSwapped(b.Bytes()))
+	expect("value", err, ErrorsXdrRange)
+
+	b.Reset()
+	XdrPutNotification(&b, map[string]interface{}{"a": int32(1)})
+	_, _, err = XdrGetNotification(byteSwapped(b.Bytes()))
+	expect("notification", err, ErrorsXdrLength)
+	_, _, err = XdrGetNotificationOrdered(byteSwapped(b.Bytes()))
+	expect("ordered notification", err, ErrorsXdrLength)
+
+	b.Reset()
+	XdrPutKeys(&b, KeyBlock{KeySchemeSha1Producer: KeySetList{KeySet{[]byte("key")}}})
+	_, _, err = XdrGetKeys(byteSwapped(b.Bytes()))
+	expect("keys", err, ErrorsXdrLength)
+
+	b.Reset()
+	XdrPutBool(&b, true)
+	_, _, err = XdrGetBool(byteSwapped(b.Bytes()))
+	expect("bool", err, ErrorsXdrRange)
+
+	b.Reset()
+	XdrPutUint16(&b, ErrorsParsing)
+	_, _, err = XdrGetUint16(byteSwapped(b.Bytes()))
+	expect("uint16", err, ErrorsXdrRange)
+
+	// A whole packet with only its header the right way round
+	b.Reset()
+	nack := &Nack{XID: 1, ErrorCode: ErrorsParsing, Message: "bad", Args: []interface{}{"x", int32(2)}}
+	nack.Encode(&b)
+	frame := append(b.Bytes()[:4:4], byteSwapped(b.Bytes()[4:])...)
+	if err = new(Nack).Decode(frame); err == nil {
+		t.Fatalf("Byte-swapped Nack decoded")
+	}
+
+	// Short fixed size values
+	if _, _, err = XdrGetInt64([]byte{0, 0, 0, 1}); err != NotEnoughSpace {
+		t.Fatalf("Expected a short int64 rejected, got: %v", err)
+	}
+	if _, _, err = XdrGetFloat64([]byte{0, 0, 0, 1}); err != NotEnoughSpace {
+		t.Fatalf("Expected a short float64 rejected, got: %v", err)
+	}
+
+	// Lenient accepts what older peers may send
+	defer SetXdrLimits(GetXdrLimits())
+	SetXdrLimits(XdrLimits{Lenient: true})
+	b.Reset()
+	XdrPutInt32(&b, 2)
+	if v, _, err := XdrGetBool(b.Bytes()); err != nil || !v {
+		t.Fatalf("Lenient bool failed: %v %v", v, err)
+	}
+}
+
 func BenchmarkXdrPutInt32(b *testing.B) {
 	var buf bytes.Buffer
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,96 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elog"
+	"sync/atomic"
+	"time"
+)
+
+// How often a paused listener checks the load
+const acceptPausePoll = 10 * time.Millisecond
+
+// Accept pausing so far, summed across listeners
+type AcceptPauseStats struct {
+	Pauses uint64        // Times a listener paused
+	Paused time.Duration // Time listeners spent paused
+}
+
+// Pause accepting connections while the router's Load is at least
+// high, resuming once it's no more than low. A high of zero never
+// pauses.
+func (router *Router) SetAcceptPause(high, low int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.acceptHigh = high
+	router.acceptLow = low
+}
+
+// The accept pause high and low water marks
+func (router *Router) AcceptPause() (high, low int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.acceptHigh, router.acceptLow
+}
+
+// The deliveries queued to all clients but not yet written
+func (router *Router) Load() (load int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	for _, c := range router.clients {
+		load += len(c.writeChannel)
+	}
+	return load
+}
+
+// How much accepting has been paused
+func (router *Router) AcceptPauseStats() AcceptPauseStats {
+	return AcceptPauseStats{
+		Pauses: atomic.LoadUint64(&router.acceptPauses),
+		Paused: time.Duration(atomic.LoadInt64(&router.acceptPaused)),
+	}
+}
+
+// Wait while the router is too loaded to take on a new connection,
+// returning false if it's stopping in the meantime
+func (router *Router) acceptWait(address string) bool {
+	high, low := router.AcceptPause()
+	if high <= 0 || router.Load() < high {
+		return true
+	}
+
+	router.elog.Logf(elog.LogLevelWarning, "Pausing accepts on %s under load", address)
+	atomic.AddUint64(&router.acceptPauses, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&router.acceptPaused, int64(time.Since(start)))
+	}()
+
+	for router.Load() > low {
+		if health := router.Health(); health == HealthDraining || health == HealthStopped {
+			return false
+		}
+		time.Sleep(acceptPausePoll)
+	}
+	router.elog.Logf(elog.LogLevelInfo1, "Resuming accepts on %s after %v", address, time.Since(start))
+	return true
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"github.com/cobaro/elvin/memtransport"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptPause(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := new(Router)
+	router.SetTestConnInterval(10 * time.Second)
+	router.SetTestConnTimeout(10 * time.Second)
+	router.SetAcceptPause(3, 1)
+	router.Start()
+	defer router.Stop()
+	listener := memtransport.Listen("paused")
+	go router.ServeListener("memory", listener)
+
+	connect := func() *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	consumer := connect()
+	defer consumer.Disconnect()
+	producer := connect()
+	defer producer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(PauseTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// The consumer doesn't read so deliveries queue up behind it
+	const count = 10
+	go func() {
+		for i := 0; i < count; i++ {
+			producer.Notify(map[string]interface{}{"PauseTest": int32(i)}, true, nil)
+		}
+	}()
+	for start := time.Now(); router.Load() < 3; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Load only reached %d", router.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	late := elvin.NewClient("elvin://paused", nil, nil, nil)
+	late.Dial = listener.Dial
+	connected := make(chan error, 1)
+	go func() { connected <- late.Connect() }()
+	select {
+	case err := <-connected:
+		t.Fatalf("Connected under load: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if stats := router.AcceptPauseStats(); stats.Pauses != 1 {
+		t.Fatalf("Expected one pause, got %+v", stats)
+	}
+
+	// Once the consumer catches up accepting resumes
+	for i := 0; i < count; i++ {
+		select {
+		case <-sub.Notifications:
+		case <-time.After(time.Second):
+			t.Fatalf("Consumer only got %d of %d", i, count)
+		}
+	}
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accepting didn't resume")
+	}
+	late.Disconnect()
+	if stats := router.AcceptPauseStats(); stats.Paused < 100*time.Millisecond {
+		t.Fatalf("Expected at least 100ms paused, got %+v", stats)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return an http.Handler for the router's administrative endpoints:
+//
+//	/metrics   Plain text metrics
+//	/healthz   The router's Health, failing once it's stopped
+//	/readyz    The router's Health, failing unless it's ready
+//	/selftest  Loopback subscribe and notify on each listening address
+//	/clients   The connected clients' IDs, connection IDs and addresses
+//	/quenches  The quenches, their owners and names
+//	/subscriptions  The subscriptions, their owners and evaluation cost
+//	/disconnect?id=N, ?conn=ID or ?addr=host:port (POST) Disconnect a client
+//	/unsubscribe?sub=N (POST) Remove a subscription, telling its owner
+func (router *Router) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", router.handleMetrics)
+	mux.HandleFunc("/healthz", router.handleHealth)
+	mux.HandleFunc("/readyz", router.handleReady)
+	mux.HandleFunc("/selftest", router.handleSelfTest)
+	mux.HandleFunc("/clients", router.handleClients)
+	mux.HandleFunc("/quenches", router.handleQuenches)
+	mux.HandleFunc("/subscriptions", router.handleSubscriptions)
+	mux.HandleFunc("/disconnect", router.handleDisconnect)
+	mux.HandleFunc("/unsubscribe", router.handleUnsubscribe)
+	return mux
+}
+
+// Serve the admin endpoints on address
+func (router *Router) ServeAdmin(address string) error {
+	return http.ListenAndServe(address, router.AdminHandler())
+}
+
+func (router *Router) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	latency := router.DeliveryLatency()
+	fmt.Fprintf(w, "elvind_delivery_latency_count %d\n", latency.Count)
+	fmt.Fprintf(w, "elvind_delivery_latency_seconds{quantile=\"0.5\"} %g\n", latency.P50.Seconds())
+	fmt.Fprintf(w, "elvind_delivery_latency_seconds{quantile=\"0.95\"} %g\n", latency.P95.Seconds())
+	fmt.Fprintf(w, "elvind_delivery_latency_seconds{quantile=\"0.99\"} %g\n", latency.P99.Seconds())
+	fmt.Fprintf(w, "elvind_notifications_expired_total %d\n", router.ExpiredNotifications())
+	fmt.Fprintf(w, "elvind_connections_shed_total %d\n", router.ShedConnections())
+	fmt.Fprintf(w, "elvind_notifications_dropped_total %d\n", router.DroppedNotifications())
+	fmt.Fprintf(w, "elvind_notifications_duplicate_total %d\n", router.DuplicateNotifications())
+	pauses := router.AcceptPauseStats()
+	fmt.Fprintf(w, "elvind_accept_pauses_total %d\n", pauses.Pauses)
+	fmt.Fprintf(w, "elvind_accept_paused_seconds_total %g\n", pauses.Paused.Seconds())
+
+	for address, stats := range router.ProtocolStats() {
+		fmt.Fprintf(w, "elvind_protocol_accepts_total{address=%q} %d\n", address, stats.Accepts)
+		fmt.Fprintf(w, "elvind_protocol_rejects_total{address=%q} %d\n", address, stats.Rejects)
+		fmt.Fprintf(w, "elvind_protocol_connections{address=%q} %d\n", address, stats.Active)
+		fmt.Fprintf(w, "elvind_protocol_bytes_in_total{address=%q} %d\n", address, stats.BytesIn)
+		fmt.Fprintf(w, "elvind_protocol_bytes_out_total{address=%q} %d\n", address, stats.BytesOut)
+	}
+}
+
+func (router *Router) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	health := router.Health()
+	if health == HealthStopped {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, health)
+}
+
+func (router *Router) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	health := router.Health()
+	if health != HealthReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, health)
+}
+
+func (router *Router) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	results := router.SelfTest(5 * time.Second)
+	for _, result := range results {
+		if result.Err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			break
+		}
+	}
+	for _, result := range results {
+		fmt.Fprintln(w, result)
+	}
+}
+
+func (router *Router) handleClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	for _, info := range router.Clients() {
+		fmt.Fprintf(w, "%d %s %s\n", info.ID, info.ConnectionID, info.RemoteAddr)
+	}
+}
+
+func (router *Router) handleQuenches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	for _, entry := range router.QuenchTable() {
+		names := strings.Join(entry.Names, ",")
+		if entry.All {
+			names = "*"
+		}
+		fmt.Fprintf(w, "%d %d %s insecure=%v keyed=%v self=%v\n", entry.QuenchID, entry.ClientID, names, entry.DeliverInsecure, entry.Keyed, entry.NotifySelf)
+	}
+}
+
+func (router *Router) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	for _, entry := range router.SubscriptionTable() {
+		fmt.Fprintf(w, "%d %d evaluations=%d eval_seconds=%g %q\n", entry.SubID, entry.ClientID, entry.Evaluations, entry.EvalTime.Seconds(), entry.Expression)
+	}
+}
+
+func (router *Router) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if id := r.FormValue("id"); len(id) > 0 {
+		var n int64
+		if n, err = strconv.ParseInt(id, 10, 32); err == nil {
+			err = router.DisconnectClient(int32(n))
+		}
+	} else if conn := r.FormValue("conn"); len(conn) > 0 {
+		err = router.DisconnectConnection(conn)
+	} else if addr := r.FormValue("addr"); len(addr) > 0 {
+		err = router.DisconnectAddress(addr)
+	} else {
+		err = fmt.Errorf("id, conn or addr required")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "disconnected")
+}
+
+func (router *Router) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	subID, err := strconv.ParseInt(r.FormValue("sub"), 10, 64)
+	if err == nil {
+		err = router.RemoveSubscription(subID, elvin.SubRemovedReasonAdmin, "removed by the router's administrator")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "unsubscribed")
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+)
+
+// What we know about a connection when authorizing its requests
+type ConnInfo struct {
+	ID           int32                  // Id assigned by router
+	ConnectionID string                 // Tracing ID, see SetConnectionIDScheme
+	RemoteAddr   string                 // Address of the remote end
+	Options      map[string]interface{} // Options from the ConnRequest
+	ServerName   string                 // TLS server name (SNI), if known
+}
+
+// An Authorizer is consulted by a client's request handlers. Any
+// non-nil error rejects the request with a Nack. Return an
+// *AuthError to choose the Nack's error code, otherwise
+// ErrorsAuthorizationFailure is used.
+type Authorizer interface {
+	AuthorizeConnect(info ConnInfo) error
+	AuthorizeSubscribe(info ConnInfo, expr string) error
+	AuthorizeNotify(info ConnInfo, nv map[string]interface{}) error
+	AuthorizeQuench(info ConnInfo, names map[string]bool) error // empty names is a wildcard quench
+}
+
+// An authorization failure with a specific Nack error code
+type AuthError struct {
+	ErrorCode uint16
+	Args      []interface{}
+}
+
+func (err *AuthError) Error() string {
+	return fmt.Sprintf("[%d] %s", err.ErrorCode, fmt.Sprintf(elvin.ElvinStringToFormatString(elvin.ProtocolErrors[err.ErrorCode].Message), err.Args...))
+}
+
+// The default Authorizer which allows everything
+type AllowAll struct{}
+
+func (AllowAll) AuthorizeConnect(info ConnInfo) error {
+	return nil
+}
+
+func (AllowAll) AuthorizeSubscribe(info ConnInfo, expr string) error {
+	return nil
+}
+
+func (AllowAll) AuthorizeNotify(info ConnInfo, nv map[string]interface{}) error {
+	return nil
+}
+
+func (AllowAll) AuthorizeQuench(info ConnInfo, names map[string]bool) error {
+	return nil
+}
+
+// Build the Nack for a rejected request
+func AuthNack(xID uint32, err error) *elvin.Nack {
+	nack := new(elvin.Nack)
+	nack.XID = xID
+	nack.ErrorCode = elvin.ErrorsAuthorizationFailure
+	if authErr, ok := err.(*AuthError); ok {
+		nack.ErrorCode = authErr.ErrorCode
+		nack.Args = authErr.Args
+	}
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	return nack
+}
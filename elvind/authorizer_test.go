@@ -0,0 +1,99 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"github.com/cobaro/elvin/elvin"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Rejects subscriptions to Secret and notifications containing Secret
+type testAuthorizer struct {
+	AllowAll
+}
+
+func (testAuthorizer) AuthorizeSubscribe(info ConnInfo, expr string) error {
+	if strings.Contains(expr, "Secret") {
+		return &AuthError{ErrorCode: elvin.ErrorsAuthorizationFailure}
+	}
+	return nil
+}
+
+func (testAuthorizer) AuthorizeNotify(info ConnInfo, nv map[string]interface{}) error {
+	if _, ok := nv["Secret"]; ok {
+		return errors.New("no secrets")
+	}
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	url := "elvin://localhost:3918"
+	router := startTestRouter(url, func(r *Router) { r.SetAuthorizer(testAuthorizer{}) })
+	defer router.Stop()
+
+	ac := elvin.NewClient(url, nil, nil, nil)
+	if err := ac.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer ac.Disconnect()
+
+	// A rejected subscription
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(Secret)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	err := ac.Subscribe(sub)
+	if err == nil {
+		t.Fatalf("Subscribe to Secret passed")
+	}
+	if !strings.HasPrefix(err.Error(), "[2]") {
+		t.Fatalf("Expected authorization failure, got %v", err)
+	}
+
+	// A rejected notification
+	events := make(chan elvin.Packet)
+	go func() { events <- <-ac.Events }()
+	nfn := map[string]interface{}{"Secret": int32(1)}
+	if err := ac.Notify(nfn, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		nack, ok := event.(*elvin.Nack)
+		if !ok {
+			t.Fatalf("Expected a Nack, got %v", event)
+		}
+		if nack.ErrorCode != elvin.ErrorsAuthorizationFailure {
+			t.Fatalf("Expected authorization failure, got %v", nack)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("No Nack for rejected notification")
+	}
+
+	// A new authorizer applies to the open connection
+	router.SetAuthorizer(AllowAll{})
+	if err := ac.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe after allowing all failed: %v", err)
+	}
+}
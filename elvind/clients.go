@@ -31,6 +31,7 @@ import (
 	"math"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -79,25 +80,69 @@ func (client *Client) SetTestConnState(state int) {
 
 // A Client (e.g. a socket)
 type Client struct {
-	id             int32 // Id assigned by router
+	id             int32  // Id assigned by router
+	connectionID   string // Tracing ID assigned by router
 	mu             sync.Mutex
 	elog           elog.Elog
 	channels       ClientChannels
-	subs           map[int32]*Subscription
-	quenches       map[int32]*Quench
+	subs           map[int32]*Subscription // guarded by subsMu
+	subsMu         sync.RWMutex
+	quenches       map[int32]*Quench // guarded by quenchMu, as are their contents
+	quenchMu       sync.RWMutex
 	reader         io.Reader
 	writer         io.Writer
 	closer         io.Closer
 	state          int
 	testConnState  int
-	keysNfn        elvin.KeyBlock
-	keysSub        elvin.KeyBlock
+	keysNfn        elvin.KeyBlock // replaced, never changed, under mu
+	keysSub        elvin.KeyBlock // replaced, never changed, under mu
 	writeChannel   chan *bytes.Buffer
 	writeTerminate chan int
+	remoteAddr     string
+	serverName     string // TLS SNI, if known
+	lastActivity   int64  // atomic, UnixNano of the last packet received
+	options        map[string]interface{}
+	established    bool              // Completed the handshake
+	priority       int32             // From the ConnRequest options
+	dropWarn       int32             // atomic, set when a delivery was dropped
+	removed        int32             // atomic, set once removal is requested
+	kicked         int32             // atomic, set when an administrator disconnects us
+	counters       *protocolCounters // the listener's, if any
+	creditWindow   int32             // flow control window, 0 if unused
+	processed      int32             // notifications not yet credited
+	quenchNames    int               // names across all our quenches
+
+	// Delivery ordering, see elvin.DeliveryOrderOption
+	unordered bool
+	gone      chan struct{} // closed once the connection closes
+	goneOnce  sync.Once
+
+	// The session this connection holds, if any, see Sessions
+	session  string
+	retained int32 // atomic, set once its subscriptions are retained or discarded
 
 	// Configurable options
 	testConnInterval time.Duration
 	testConnTimeout  time.Duration
+	authorizer       func() Authorizer        // the router's, as it may change
+	schema           func() *elvin.Schema     // the router's, as it may change
+	transforms       func() transformPipeline // the router's, as it may change
+	sessions         *Sessions
+	dedup            func() *Deduplicator // the router's for our protocol, as it may change
+	readOnly         func() bool          // the router's, as it may change
+	peers            func() []*Peer       // the router's, as they may change
+	onConnect        func(ConnInfo)
+
+	quenchLimits      func() (names int, connectionNames int) // the router's, as they may change
+	subscriptionQuota func() int                              // the router's, as it may change
+
+	busy func() (threshold int, backoff time.Duration) // the router's, as it may change
+
+	redelivery redelivery // Reliable subscriptions' unacked deliveries
+
+	// Queued deliveries with a deadline, see Router.deliverBefore
+	deadlines sync.Map // *bytes.Buffer to time.Time
+	expired   *uint64  // atomic, the router's count of those dropped
 }
 
 // A buffer pool as we use lots of these for writing to
@@ -112,15 +157,96 @@ func (client *Client) ID() int32 {
 	return client.id
 }
 
+// Note activity on this client
+func (client *Client) touch() {
+	atomic.StoreInt64(&client.lastActivity, time.Now().UnixNano())
+}
+
+// When this client last sent us a packet
+func (client *Client) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&client.lastActivity))
+}
+
+// The client's delivery priority (synchronized)
+func (client *Client) Priority() int32 {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.priority
+}
+
+// Has the client completed its handshake? (synchronized)
+func (client *Client) Established() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.established
+}
+
+// The connection's producer keys (synchronized)
+func (client *Client) nfnKeys() elvin.KeyBlock {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.keysNfn
+}
+
+// The connection's consumer keys (synchronized)
+func (client *Client) subKeys() elvin.KeyBlock {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.keysSub
+}
+
+// Return what we know about this client for authorization
+func (client *Client) ConnInfo() ConnInfo {
+	return ConnInfo{client.ID(), client.connectionID, client.remoteAddr, client.options, client.serverName}
+}
+
+// Send a Nack to this client
+func (client *Client) sendNack(nack *elvin.Nack) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	nack.Encode(buf)
+	client.writeChannel <- buf
+}
+
 func (client *Client) Close() {
-	client.elog.Logf(elog.LogLevelInfo2, "Closing client %d", client.ID())
+	client.elog.Logf(elog.LogLevelInfo2, "Closing client %d (connection %s)", client.ID(), client.connectionID)
 	select {
 	case client.writeTerminate <- 1:
 	default:
 	}
 	client.closer.Close()
-	client.channels.remove <- client.ID()
+	if client.gone != nil {
+		client.goneOnce.Do(func() { close(client.gone) })
+	}
+	client.retain()
+	client.remove()
+	client.dropUnacked(0)
+}
+
+// Retain our subscriptions if we named a session, once
+func (client *Client) retain() {
+	if client.session == "" || client.sessions == nil || !atomic.CompareAndSwapInt32(&client.retained, 0, 1) {
+		return
+	}
+	client.subsMu.RLock()
+	defer client.subsMu.RUnlock()
+	client.sessions.Retain(client.session, client, client.subs)
+}
+
+// End our session on a clean disconnect, instead of retaining it
+func (client *Client) discard() {
+	if client.session == "" || client.sessions == nil || !atomic.CompareAndSwapInt32(&client.retained, 0, 1) {
+		return
+	}
+	client.sessions.Discard(client.session, client)
+}
 
+// Ask the router to forget us, once. A disconnecting client is
+// removed on its DisconnRequest and again when its socket closes, and
+// the router's engine may have stopped by the second.
+func (client *Client) remove() {
+	if atomic.CompareAndSwapInt32(&client.removed, 0, 1) {
+		client.channels.remove <- client.ID()
+	}
 }
 
 // Read n bytes from reader into buffer which must be big enough
@@ -166,6 +292,7 @@ func (client *Client) readHandler() {
 		if length != packetSize || err != nil {
 			break // We're done
 		}
+		client.countIn(4 + packetSize)
 
 		// Deal with the packet
 		if err = client.HandlePacket(buffer); err != nil {
@@ -177,6 +304,24 @@ func (client *Client) readHandler() {
 	client.Close()
 }
 
+// Drop a queued delivery whose deadline passed before it could be
+// written, returning true if it was dropped
+func (client *Client) stale(buf *bytes.Buffer) bool {
+	deadline, ok := client.deadlines.Load(buf)
+	if !ok {
+		return false
+	}
+	client.deadlines.Delete(buf)
+	if time.Now().Before(deadline.(time.Time)) {
+		return false
+	}
+	client.elog.Logf(elog.LogLevelDebug2, "Client %d delivery expired", client.ID())
+	atomic.AddUint64(client.expired, 1)
+	buf.Reset()
+	bufferPool.Put(buf)
+	return true
+}
+
 // Handle writing for now run as a goroutine
 func (client *Client) writeHandler() {
 	client.elog.Logf(elog.LogLevelDebug1, "Write Handler starting")
@@ -207,6 +352,10 @@ func (client *Client) writeHandler() {
 	for {
 		select {
 		case buffer := <-client.writeChannel:
+			if client.stale(buffer) {
+				continue
+			}
+			disconn := elvin.PacketID(buffer.Bytes()) == elvin.PacketDisconn
 
 			// Write the frame header (packetsize)
 			binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
@@ -216,22 +365,33 @@ func (client *Client) writeHandler() {
 				if err != io.EOF {
 					client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
 				}
+				buffer.Reset()
 				bufferPool.Put(buffer)
 				return // We're done, cleanup done by read
 			}
 
 			// Write the packet
-			_, err = buffer.WriteTo(client.writer)
+			written, err := buffer.WriteTo(client.writer)
+			client.countOut(4 + int(written))
 			if err != nil {
 				// Deal with more errors
 				if err != io.EOF {
 					client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
 				}
+				buffer.Reset()
 				bufferPool.Put(buffer)
 				return // We're done, cleanup done by read
 			}
+
+			// An administrator's Disconn is our last word
+			if disconn && atomic.LoadInt32(&client.kicked) != 0 {
+				client.closer.Close()
+				return // We're done, cleanup done by read
+			}
 		case <-client.writeTerminate:
 			return // We're done, cleanup done by read
+		case <-client.gone:
+			return // Closed while we were busy writing
 
 		case <-time.After(currentTimeout):
 			client.elog.Logf(elog.LogLevelDebug3, "writeHandler timeout: %d", client.TestConnState())
@@ -264,10 +424,13 @@ func (client *Client) HandlePacket(buffer []byte) (err error) {
 
 	// Receiving any packet acts a ConfConn
 	client.SetTestConnState(TestConnHadResponse)
+	client.touch()
 
 	switch elvin.PacketID(buffer) {
 
 	// Client side packets a router shouldn't receive
+	case elvin.PacketCredit:
+	case elvin.PacketMatchCountReply:
 	case elvin.PacketDropWarn:
 	case elvin.PacketReserved:
 	case elvin.PacketNotifyDeliver:
@@ -329,17 +492,29 @@ func (client *Client) HandlePacket(buffer []byte) (err error) {
 		case elvin.PacketDisconn:
 			return errors.New("FIXME: Packet Disconn")
 		case elvin.PacketSecRequest:
-			return errors.New("FIXME: Packet SecRequest")
+			return client.HandleSecRequest(buffer)
 		case elvin.PacketSecReply:
 			return errors.New("FIXME: Packet SecReply")
 		case elvin.PacketNotifyEmit:
-			return client.HandleNotifyEmit(buffer)
+			err = client.HandleNotifyEmit(buffer)
+			client.replenishCredits()
+			return err
+		case elvin.PacketUNotify:
+			return client.HandleUNotify(buffer)
+		case elvin.PacketMatchCountRequest:
+			return client.HandleMatchCountRequest(buffer)
 		case elvin.PacketSubAddRequest:
 			return client.HandleSubAddRequest(buffer)
+		case elvin.PacketSubAddOptionsRequest:
+			return client.HandleSubAddOptionsRequest(buffer)
 		case elvin.PacketSubModRequest:
 			return client.HandleSubModRequest(buffer)
 		case elvin.PacketSubDelRequest:
 			return client.HandleSubDelRequest(buffer)
+		case elvin.PacketSubPauseRequest:
+			return client.HandleSubPauseRequest(buffer)
+		case elvin.PacketDeliveryAck:
+			return client.HandleDeliveryAck(buffer)
 		case elvin.PacketQuenchAddRequest:
 			return client.HandleQuenchAddRequest(buffer)
 		case elvin.PacketQuenchModRequest:
@@ -417,30 +592,98 @@ func (client *Client) HandleConnRequest(buffer []byte) (err error) {
 		return nil
 	}
 
+	client.options = connRequest.Options
+	if err = client.authorizer().AuthorizeConnect(client.ConnInfo()); err != nil {
+		client.elog.Logf(elog.LogLevelInfo1, "Client %d connect rejected: %v", client.ID(), err)
+		client.sendNack(AuthNack(connRequest.XID, err))
+		return nil
+	}
+
 	// We're now connected
-	client.SetState(StateConnected)
+	client.mu.Lock()
+	client.state = StateConnected
+	client.established = true
+	client.priority, _ = connRequest.Options[elvin.PriorityOption].(int32)
+	client.unordered = connRequest.Options[elvin.DeliveryOrderOption] == elvin.DeliveryOrderSubscription
+	client.mu.Unlock()
+	client.subsMu.Lock()
 	client.subs = make(map[int32]*Subscription)
+	client.subsMu.Unlock()
+	client.quenchMu.Lock()
 	client.quenches = make(map[int32]*Quench)
+	client.quenchMu.Unlock()
 
 	// Prime any keys if they gave us some
+	PrimeProducer(connRequest.KeysNfn)
+	PrimeConsumer(connRequest.KeysSub)
+	client.mu.Lock()
 	client.keysNfn = connRequest.KeysNfn
-	PrimeProducer(client.keysNfn)
 	client.keysSub = connRequest.KeysSub
-	PrimeConsumer(client.keysSub)
+	client.mu.Unlock()
 
 	// Respond with a ConnReply
 	connReply := new(elvin.ConnReply)
 	connReply.XID = connRequest.XID
 	// FIXME; totally bogus
 	connReply.Options = connRequest.Options
+	granted := make(map[string]interface{})
+	if window, ok := connRequest.Options[elvin.CreditsOption].(int32); ok && window > 0 {
+		if window > MaxCreditWindow {
+			window = MaxCreditWindow
+		}
+		client.creditWindow = window
+		granted[elvin.CreditsGrantedOption] = window
+	}
+	// Tell the client our keepalive so it can use it too
+	if client.testConnInterval > 0 {
+		granted[elvin.TestConnIntervalOption] = int32(client.testConnInterval / time.Millisecond)
+		granted[elvin.TestConnTimeoutOption] = int32(client.testConnTimeout / time.Millisecond)
+	}
+	if name, ok := connRequest.Options[elvin.SessionOption].(string); ok && len(name) > 0 && client.sessions != nil {
+		token, _ := connRequest.Options[elvin.SessionTokenOption].(string)
+		if issued, resumed := client.sessions.Resume(name, token, client); len(issued) > 0 {
+			client.session = name
+			granted[elvin.SessionTokenOption] = issued
+			if resumed {
+				granted[elvin.SessionResumedOption] = int32(1)
+			}
+		}
+	}
+	granted[elvin.ConnectionIDOption] = client.connectionID
+	if _, ok := connRequest.Options[elvin.MarshalOption].(string); ok {
+		// All we speak, whatever was asked for
+		granted[elvin.MarshalOption] = elvin.MarshalXDR
+	}
+	if quota := client.subscriptionQuota(); quota > 0 {
+		client.subsMu.RLock()
+		remaining := quota - len(client.subs)
+		client.subsMu.RUnlock()
+		if remaining < 0 {
+			remaining = 0
+		}
+		granted[elvin.SubscriptionQuotaOption] = int32(remaining)
+	}
+	if len(granted) > 0 {
+		connReply.Options = make(map[string]interface{})
+		for name, value := range connRequest.Options {
+			connReply.Options[name] = value
+		}
+		for name, value := range granted {
+			connReply.Options[name] = value
+		}
+	}
 
-	client.elog.Logf(elog.LogLevelInfo1, "New client %d connected", client.ID())
+	client.elog.Logf(elog.LogLevelInfo1, "New client %d connected (connection %s)", client.ID(), client.connectionID)
 
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	connReply.Encode(buf)
 	client.writeChannel <- buf
 
+	if client.onConnect != nil {
+		go client.onConnect(client.ConnInfo())
+	}
+
 	return nil
 }
 
@@ -466,13 +709,51 @@ func (client *Client) HandleDisconnRequest(buffer []byte) (err error) {
 	DisconnReply.Encode(buf)
 	client.writeChannel <- buf
 
+	client.discard()
+	client.subsMu.Lock()
 	for subID, _ := range client.subs {
 		// FIXME: send subscription removal to sub engine
 		delete(client.subs, subID)
 	}
+	client.subsMu.Unlock()
+
+	client.remove()
+
+	return nil
+}
+
+// Handle a SecRequest changing the connection keys
+func (client *Client) HandleSecRequest(buffer []byte) (err error) {
+	secRequest := new(elvin.SecRequest)
+	if err = secRequest.Decode(buffer); err != nil {
+		return err
+	}
+
+	// The engine may be using the current keys, so change copies
+	keysNfn := elvin.KeyBlockCopy(client.keysNfn)
+	keysSub := elvin.KeyBlockCopy(client.keysSub)
+
+	PrimeProducer(secRequest.AddNfnKeys)
+	PrimeProducer(secRequest.DelNfnKeys)
+	elvin.KeyBlockAddKeys(keysNfn, secRequest.AddNfnKeys)
+	elvin.KeyBlockDeleteKeys(keysNfn, secRequest.DelNfnKeys)
 
-	client.channels.remove <- client.ID()
+	PrimeConsumer(secRequest.AddSubKeys)
+	PrimeConsumer(secRequest.DelSubKeys)
+	elvin.KeyBlockAddKeys(keysSub, secRequest.AddSubKeys)
+	elvin.KeyBlockDeleteKeys(keysSub, secRequest.DelSubKeys)
 
+	client.mu.Lock()
+	client.keysNfn = keysNfn
+	client.keysSub = keysSub
+	client.mu.Unlock()
+
+	secReply := new(elvin.SecReply)
+	secReply.XID = secRequest.XID
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	secReply.Encode(buf)
+	client.writeChannel <- buf
 	return nil
 }
 
@@ -481,8 +762,9 @@ func (client *Client) HandleTestConn(buffer []byte) (err error) {
 	// Nothing to decode
 	client.elog.Logf(elog.LogLevelInfo2, "Received TestConn", client.ID())
 
-	// Only respond is there are no queued packets
-	if len(client.writeChannel) > 1 {
+	// Only respond if there are no queued packets, as they'll
+	// confirm the connection anyway
+	if len(client.writeChannel) == 0 {
 		confConn := new(elvin.ConfConn)
 		writeBuf := new(bytes.Buffer)
 		confConn.Encode(writeBuf)
@@ -508,10 +790,89 @@ func (client *Client) HandleNotifyEmit(buffer []byte) (err error) {
 		return err
 	}
 
-	client.channels.notify <- Notification{client.keysNfn, ne.NameValue, ne.DeliverInsecure, ne.Keys}
+	// There's no XID for a notification so any Nack has an XID of 0
+	if client.readOnly() {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d notification refused, read-only", client.ID())
+		client.sendNack(ReadOnlyNack(0))
+		return nil
+	}
+	if err = client.authorizer().AuthorizeNotify(client.ConnInfo(), ne.NameValue); err != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d notification rejected: %v", client.ID(), err)
+		client.sendNack(AuthNack(0, err))
+		return nil
+	}
+
+	if schema := client.schema(); schema != nil {
+		if err = schema.Validate(ne.NameValue); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Client %d notification invalid: %v", client.ID(), err)
+			client.sendNack(SchemaNack(0, err.(*elvin.SchemaError)))
+			return nil
+		}
+	}
+
+	if client.overloaded() {
+		return nil
+	}
+
+	stripRouterAttributes(ne.NameValue)
+	// Keyed notifications aren't deduplicated as who may receive them
+	// depends on their keys
+	received := time.Now()
+	keyed := !elvin.KeyBlockEmpty(ne.Keys) || !elvin.KeyBlockEmpty(client.keysNfn)
+	if dedup := client.dedup(); dedup != nil && !keyed && dedup.Duplicate(ne.NameValue, ne.DeliverInsecure, received) {
+		client.elog.Logf(elog.LogLevelDebug2, "Client %d duplicate notification suppressed", client.ID())
+		return nil
+	}
+	deadline := TakeDeadline(ne.NameValue, received)
+	if ne.NameValue = client.transform(ne.NameValue); ne.NameValue == nil {
+		return nil
+	}
+	nfn := Notification{client.keysNfn, ne.NameValue, ne.DeliverInsecure, ne.Keys, received, deadline, ne.Order}
+	for _, peer := range client.peers() {
+		peer.Put(nfn)
+	}
+	atomic.AddInt32(client.channels.pending, 1)
+	client.channels.notify <- nfn
+	atomic.AddInt32(client.channels.pending, -1)
 	return nil
 }
 
+// If the engine already has the busy threshold of notifications
+// waiting, tell the producer we're busy and return true so its
+// notification is dropped
+func (client *Client) overloaded() bool {
+	threshold, backoff := client.busy()
+	if threshold <= 0 || atomic.LoadInt32(client.channels.pending) < int32(threshold) {
+		return false
+	}
+	client.elog.Logf(elog.LogLevelDebug2, "Client %d notification dropped, busy", client.ID())
+	busy := &elvin.Busy{Backoff: uint32(backoff / time.Millisecond)}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	busy.Encode(buf)
+	client.writeChannel <- buf
+	return true
+}
+
+// The largest credit window we grant, whatever a client asks for
+const MaxCreditWindow = 1024
+
+// Once we've processed half a window of notifications, credit the
+// client with them so it may send more
+func (client *Client) replenishCredits() {
+	if client.creditWindow == 0 {
+		return
+	}
+	client.processed++
+	if client.processed < (client.creditWindow+1)/2 {
+		return
+	}
+	credit := &elvin.Credit{Credits: uint32(client.processed)}
+	client.processed = 0
+	buf := bufferPool.Get().(*bytes.Buffer)
+	credit.Encode(buf)
+	client.writeChannel <- buf
+}
+
 // Handle a UNotify
 func (client *Client) HandleUNotify(buffer []byte) (err error) {
 	unotify := new(elvin.UNotify)
@@ -521,7 +882,59 @@ func (client *Client) HandleUNotify(buffer []byte) (err error) {
 
 	// FIXME: Check version and ?
 
-	client.channels.notify <- Notification{client.keysNfn, unotify.NameValue, unotify.DeliverInsecure, unotify.Keys}
+	// Unconnected so there's nobody to Nack
+	if client.readOnly() {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d unotify refused, read-only", client.ID())
+		return nil
+	}
+	if err = client.authorizer().AuthorizeNotify(client.ConnInfo(), unotify.NameValue); err != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d unotify rejected: %v", client.ID(), err)
+		return nil
+	}
+	if schema := client.schema(); schema != nil {
+		if err = schema.Validate(unotify.NameValue); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Client %d unotify invalid: %v", client.ID(), err)
+			return nil
+		}
+	}
+
+	stripRouterAttributes(unotify.NameValue)
+	received := time.Now()
+	deadline := TakeDeadline(unotify.NameValue, received)
+	if unotify.NameValue = client.transform(unotify.NameValue); unotify.NameValue == nil {
+		return nil
+	}
+	nfn := Notification{client.keysNfn, unotify.NameValue, unotify.DeliverInsecure, unotify.Keys, received, deadline, nil}
+	for _, peer := range client.peers() {
+		peer.Put(nfn)
+	}
+	client.channels.notify <- nfn
+	return nil
+}
+
+// Handle a MatchCountRequest
+func (client *Client) HandleMatchCountRequest(buffer []byte) (err error) {
+	matchRequest := new(elvin.MatchCountRequest)
+	if err = matchRequest.Decode(buffer); err != nil {
+		return err
+	}
+
+	m := matchCount{client: client, xID: matchRequest.XID}
+	if len(matchRequest.NameValue) > 0 {
+		m.nfn = &Notification{ClientKeys: client.keysNfn, NameValue: matchRequest.NameValue,
+			DeliverInsecure: matchRequest.DeliverInsecure, Keys: matchRequest.Keys}
+	} else if len(matchRequest.Expression) > 0 {
+		ast, nack := Parse(matchRequest.Expression)
+		if nack != nil {
+			nack.XID = matchRequest.XID
+			client.sendNack(nack)
+			return nil
+		}
+		m.names = ast.Names()
+	}
+
+	// The engine counts and replies
+	client.channels.matches <- m
 	return nil
 }
 
@@ -532,8 +945,60 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 	if err != nil {
 		// FIXME: Protocol violation
 	}
+	return client.addSubscription(subRequest, 0, nil, false)
+}
+
+// Handle a Subscription Add with delivery options
+func (client *Client) HandleSubAddOptionsRequest(buffer []byte) (err error) {
+	optionsRequest := new(elvin.SubAddOptionsRequest)
+	if err = optionsRequest.Decode(buffer); err != nil {
+		return err
+	}
+
+	subRequest := new(elvin.SubAddRequest)
+	subRequest.XID = optionsRequest.XID
+	subRequest.Expression = optionsRequest.Expression
+	subRequest.AcceptInsecure = optionsRequest.AcceptInsecure
+	subRequest.Keys = optionsRequest.Keys
+	return client.addSubscription(subRequest, int(optionsRequest.MaxSize), optionsRequest.Projection, optionsRequest.Reliable)
+}
+
+// A Nack if another subscription would exceed the client's quota,
+// otherwise nil
+func (client *Client) subscriptionQuotaNack(xID uint32) *elvin.Nack {
+	quota := client.subscriptionQuota()
+	if quota <= 0 {
+		return nil
+	}
+	client.subsMu.RLock()
+	subs := len(client.subs)
+	client.subsMu.RUnlock()
+	if subs < quota {
+		return nil
+	}
+	client.elog.Logf(elog.LogLevelInfo2, "Client %d subscription refused, quota of %d reached", client.ID(), quota)
+	nack := new(elvin.Nack)
+	nack.XID = xID
+	nack.ErrorCode = elvin.ErrorsQOSLimit
+	nack.Args = []interface{}{"subscriptions per connection"}
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	return nack
+}
+
+// Add a subscription, withholding notifications larger than maxSize
+// bytes from it if that's positive, delivering only the attributes
+// in projection if that's not empty, and expecting acks if reliable
+func (client *Client) addSubscription(subRequest *elvin.SubAddRequest, maxSize int, projection []string, reliable bool) (err error) {
+	if err = client.authorizer().AuthorizeSubscribe(client.ConnInfo(), subRequest.Expression); err != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d subscription rejected: %v", client.ID(), err)
+		client.sendNack(AuthNack(subRequest.XID, err))
+		return nil
+	}
 
 	ast, nack := Parse(subRequest.Expression)
+	if nack == nil {
+		nack = client.subscriptionQuotaNack(subRequest.XID)
+	}
 	if nack != nil {
 		nack.XID = subRequest.XID
 		buf := bufferPool.Get().(*bytes.Buffer)
@@ -544,12 +1009,17 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 
 	// Create a subscription and add it to the subscription store
 	var sub Subscription
+	sub.Expression = subRequest.Expression
 	sub.Ast = ast
 	sub.AcceptInsecure = subRequest.AcceptInsecure
 	sub.Keys = subRequest.Keys
+	sub.MaxSize = maxSize
+	sub.Projection = projection
+	sub.Reliable = reliable
 	PrimeConsumer(sub.Keys)
 
 	// Create a unique sub id
+	client.subsMu.Lock()
 	var s int32 = rand.Int31()
 	for {
 		_, err := client.subs[s]
@@ -558,8 +1028,9 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 		}
 		s++
 	}
-	client.subs[s] = &sub
 	sub.SubID = (int64(client.ID()) << 32) | int64(s)
+	client.subs[s] = &sub
+	client.subsMu.Unlock()
 
 	client.channels.subAdd <- &sub
 
@@ -573,9 +1044,103 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	subReply.Encode(buf)
 	client.writeChannel <- buf
+
+	// Catch up with the last values, and anything missed while a
+	// resumed session was closed, delivered by the engine like live
+	// notifications
+	client.channels.replay <- replay{client, s, &sub}
 	return nil
 }
 
+// Build the NotifyDelivers of a notification for the given
+// subscriptions of this client. Insecure matches share a NotifyDeliver
+// while secure ones are grouped by the key that matched, which is
+// passed on so the subscriber knows.
+func (client *Client) Deliveries(nfn Notification, subs map[int32]*Subscription) (delivers []*elvin.NotifyDeliver) {
+	var insecure []int64
+	secure := make(map[string][]int64)
+	size := -1 // encoded size, worked out if a subscription cares
+	keysSub := client.subKeys()
+	for id, sub := range subs {
+		if sub.Ast == nil || atomic.LoadInt32(&sub.Paused) != 0 {
+			continue
+		}
+		start := time.Now()
+		matched := sub.Ast.Match(nfn.NameValue)
+		atomic.AddUint64(&sub.Evaluations, 1)
+		atomic.AddUint64(&sub.EvalNanos, uint64(time.Since(start)))
+		if !matched {
+			continue
+		}
+
+		if sub.MaxSize > 0 {
+			if size < 0 {
+				size = EncodedSize(nfn.NameValue)
+			}
+			if size > sub.MaxSize {
+				atomic.AddUint64(&sub.Oversize, 1)
+				continue
+			}
+		}
+
+		if !SecurityMatches(nfn, *sub, nfn.ClientKeys, keysSub) {
+			client.elog.Logf(elog.LogLevelDebug1, "SecurityMatches false")
+			continue
+		}
+		client.elog.Logf(elog.LogLevelDebug1, "SecurityMatches true")
+		subID := int64(client.ID())<<32 | int64(id)
+		key, ok := SecureMatchingKey(nfn, *sub, nfn.ClientKeys, keysSub)
+
+		// Projected and reliable subscriptions get a delivery of
+		// their own, the latter with an id to ack
+		if len(sub.Projection) > 0 || sub.Reliable {
+			deliver := &elvin.NotifyDeliver{Order: nfn.Order}
+			if len(sub.Projection) > 0 {
+				deliver.NameValue = Project(nfn.NameValue, sub.Projection)
+			} else {
+				deliver.NameValue = make(map[string]interface{}, len(nfn.NameValue)+2)
+				for name, value := range nfn.NameValue {
+					deliver.NameValue[name] = value
+				}
+			}
+			if sub.Reliable {
+				deliver.NameValue[elvin.DeliveryIDAttribute] = client.nextDeliveryID()
+			}
+			if ok {
+				deliver.NameValue[elvin.MatchedKeyAttribute] = []byte(key)
+				deliver.Secure = []int64{subID}
+			} else {
+				deliver.Insecure = []int64{subID}
+			}
+			delivers = append(delivers, deliver)
+		} else if ok {
+			secure[string(key)] = append(secure[string(key)], subID)
+		} else {
+			insecure = append(insecure, subID)
+		}
+	}
+
+	if len(insecure) > 0 {
+		deliver := new(elvin.NotifyDeliver)
+		deliver.NameValue = nfn.NameValue
+		deliver.Insecure = insecure
+		deliver.Order = nfn.Order
+		delivers = append(delivers, deliver)
+	}
+	for key, ids := range secure {
+		deliver := new(elvin.NotifyDeliver)
+		deliver.NameValue = make(map[string]interface{}, len(nfn.NameValue)+1)
+		for name, value := range nfn.NameValue {
+			deliver.NameValue[name] = value
+		}
+		deliver.NameValue[elvin.MatchedKeyAttribute] = []byte(key)
+		deliver.Secure = ids
+		deliver.Order = nfn.Order
+		delivers = append(delivers, deliver)
+	}
+	return delivers
+}
+
 // Handle a Subscription Delete
 func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 	subDelRequest := new(elvin.SubDelRequest)
@@ -584,9 +1149,14 @@ func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 		// FIXME: Protocol violation
 	}
 
-	// If deletion fails then nack and disconn
+	// Remove it from the client, unless the router already has
 	idx := int32(subDelRequest.SubID & 0xfffffffff)
+	client.subsMu.Lock()
 	sub, exists := client.subs[idx]
+	delete(client.subs, idx)
+	client.subsMu.Unlock()
+
+	// If deletion fails then nack and disconn
 	if !exists {
 		nack := new(elvin.Nack)
 		nack.XID = subDelRequest.XID
@@ -602,8 +1172,7 @@ func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 		return nil
 	}
 
-	// Remove it from the client
-	delete(client.subs, idx)
+	client.dropUnacked(sub.SubID)
 
 	// Send it to the subscription engine
 	client.channels.subDel <- sub
@@ -620,6 +1189,42 @@ func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 	return nil
 }
 
+// Handle a Subscription Pause, suspending or resuming its delivery
+func (client *Client) HandleSubPauseRequest(buffer []byte) (err error) {
+	pauseRequest := new(elvin.SubPauseRequest)
+	if err = pauseRequest.Decode(buffer); err != nil {
+		return err
+	}
+
+	client.subsMu.RLock()
+	sub, exists := client.subs[int32(pauseRequest.SubID&0xffffffff)]
+	client.subsMu.RUnlock()
+	if !exists {
+		nack := new(elvin.Nack)
+		nack.XID = pauseRequest.XID
+		nack.ErrorCode = elvin.ErrorsUnknownSubID
+		nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+		nack.Args = []interface{}{pauseRequest.SubID}
+		client.sendNack(nack)
+		return nil
+	}
+
+	var paused int32
+	if pauseRequest.Paused {
+		paused = 1
+	}
+	atomic.StoreInt32(&sub.Paused, paused)
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d subscription:%d paused %v", client.ID(), pauseRequest.SubID, pauseRequest.Paused)
+
+	subReply := new(elvin.SubReply)
+	subReply.XID = pauseRequest.XID
+	subReply.SubID = pauseRequest.SubID
+	buf := bufferPool.Get().(*bytes.Buffer)
+	subReply.Encode(buf)
+	client.writeChannel <- buf
+	return nil
+}
+
 func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 	subModRequest := new(elvin.SubModRequest)
 	err = subModRequest.Decode(buffer)
@@ -630,7 +1235,9 @@ func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 
 	// If modify fails then nack and disconn
 	idx := int32(subModRequest.SubID & 0xfffffffff)
+	client.subsMu.RLock()
 	sub, exists := client.subs[idx]
+	client.subsMu.RUnlock()
 	if !exists {
 		nack := new(elvin.Nack)
 		nack.XID = subModRequest.XID
@@ -647,20 +1254,32 @@ func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 		return nil
 	}
 
-	// FIXME: At some point this sub will need a lock but for now it's all handled in the read goroutine
 	// FIXME: And any update to the sub should be all or nothing
 
 	// Check the subscription expression. Empty is ok. Incorrect means bail.
+	var ast *elvin.AST
 	if len(subModRequest.Expression) > 0 {
-		ast, nack := Parse(subModRequest.Expression)
-		if nack != nil {
+		if err = client.authorizer().AuthorizeSubscribe(client.ConnInfo(), subModRequest.Expression); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Client %d subscription rejected: %v", client.ID(), err)
+			client.sendNack(AuthNack(subModRequest.XID, err))
+			return nil
+		}
+		var nack *elvin.Nack
+		if ast, nack = Parse(subModRequest.Expression); nack != nil {
 			nack.XID = subModRequest.XID
 			buf := bufferPool.Get().(*bytes.Buffer)
 			nack.Encode(buf)
 			client.writeChannel <- buf
 			return nil
 		}
+	}
+
+	// The engine matches against the subscription as it goes so
+	// change it under the lock
+	client.subsMu.Lock()
+	if ast != nil {
 		sub.Ast = ast
+		sub.Expression = subModRequest.Expression
 	}
 
 	// AcceptInsecure is the only piece that must have a value - and it is allowed to be the same
@@ -677,6 +1296,7 @@ func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 		PrimeConsumer(subModRequest.DelKeys)
 		elvin.KeyBlockDeleteKeys(sub.Keys, subModRequest.DelKeys)
 	}
+	client.subsMu.Unlock()
 
 	// Send it to the subscription engine
 	client.channels.subMod <- sub
@@ -702,6 +1322,11 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 	}
 
 	// FIXME: what checking do we need to do here
+	if err = client.authorizer().AuthorizeQuench(client.ConnInfo(), quenchRequest.Names); err != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d quench rejected: %v", client.ID(), err)
+		client.sendNack(AuthNack(quenchRequest.XID, err))
+		return nil
+	}
 
 	// Create a quench and add it to the quench store
 	var quench Quench
@@ -709,10 +1334,22 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 	for name, _ := range quenchRequest.Names {
 		quench.Names[name] = true
 	}
+	quench.NotifySelf = quench.Names[elvin.QuenchNotifySelfName]
+	delete(quench.Names, elvin.QuenchNotifySelfName)
+	quench.All = len(quench.Names) == 0
 	quench.DeliverInsecure = quenchRequest.DeliverInsecure
 	quench.Keys = quenchRequest.Keys
+	PrimeProducer(quench.Keys)
+
+	if nack := client.quenchLimitNack(quenchRequest.XID, len(quench.Names), 0); nack != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d quench of %d names refused", client.ID(), len(quench.Names))
+		client.sendNack(nack)
+		return nil
+	}
+	client.quenchNames += len(quench.Names)
 
 	// Create a unique quench id
+	client.quenchMu.Lock()
 	var q int32 = rand.Int31()
 	for {
 		_, err := client.quenches[q]
@@ -721,8 +1358,9 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 		}
 		q++
 	}
-	client.quenches[q] = &quench
 	quench.QuenchID = (int64(client.ID()) << 32) | int64(q)
+	client.quenches[q] = &quench
+	client.quenchMu.Unlock()
 
 	// send quench to sub engine
 	client.channels.quenchAdd <- &quench
@@ -749,7 +1387,9 @@ func (client *Client) HandleQuenchModRequest(buffer []byte) (err error) {
 
 	// If modify fails then nack and disconn
 	idx := int32(quenchModRequest.QuenchID & 0xfffffffff)
+	client.quenchMu.RLock()
 	quench, exists := client.quenches[idx]
+	client.quenchMu.RUnlock()
 	if !exists {
 		nack := new(elvin.Nack)
 		nack.XID = quenchModRequest.XID
@@ -766,14 +1406,52 @@ func (client *Client) HandleQuenchModRequest(buffer []byte) (err error) {
 		return nil
 	}
 
-	for name, _ := range quenchModRequest.AddNames {
-		quench.Names[name] = true
+	if len(quenchModRequest.AddNames) > 0 {
+		if err = client.authorizer().AuthorizeQuench(client.ConnInfo(), quenchModRequest.AddNames); err != nil {
+			client.elog.Logf(elog.LogLevelInfo2, "Client %d quench rejected: %v", client.ID(), err)
+			client.sendNack(AuthNack(quenchModRequest.XID, err))
+			return nil
+		}
+	}
+
+	// Check the names we'd end up with before changing anything
+	names := make(map[string]bool, len(quench.Names)+len(quenchModRequest.AddNames))
+	for name := range quench.Names {
+		names[name] = true
+	}
+	for name := range quenchModRequest.AddNames {
+		names[name] = true
+	}
+	delete(names, elvin.QuenchNotifySelfName) // a flag, not counted, as on add
+	for name := range quenchModRequest.DelNames {
+		delete(names, name)
 	}
-	for name, _ := range quenchModRequest.DelNames {
-		delete(quench.Names, name)
+	if nack := client.quenchLimitNack(quenchModRequest.XID, len(names), len(quench.Names)); nack != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d quench of %d names refused", client.ID(), len(names))
+		client.sendNack(nack)
+		return nil
+	}
+	client.quenchNames += len(names) - len(quench.Names)
+
+	// Change a copy of the keys, leaving the ones in use alone
+	keys := quench.Keys
+	if len(quenchModRequest.AddKeys) > 0 || len(quenchModRequest.DelKeys) > 0 {
+		keys = elvin.KeyBlockCopy(quench.Keys)
+		PrimeProducer(quenchModRequest.AddKeys)
+		elvin.KeyBlockAddKeys(keys, quenchModRequest.AddKeys)
+		PrimeProducer(quenchModRequest.DelKeys)
+		elvin.KeyBlockDeleteKeys(keys, quenchModRequest.DelKeys)
 	}
+
+	// The engine reads quenches as it goes so change it under the lock
+	client.quenchMu.Lock()
+	quench.Names = names // NotifySelf is only set on add
+	quench.All = len(names) == 0
 	quench.DeliverInsecure = quenchModRequest.DeliverInsecure
-	// FIXME: implement key changes
+	quench.Keys = keys
+
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d  quench:%d modified %+v", client.ID(), quench.QuenchID, quench)
+	client.quenchMu.Unlock()
 
 	// send quench to sub engine
 	client.channels.quenchMod <- quench
@@ -783,8 +1461,6 @@ func (client *Client) HandleQuenchModRequest(buffer []byte) (err error) {
 	quenchReply.XID = quenchModRequest.XID
 	quenchReply.QuenchID = quench.QuenchID
 
-	client.elog.Logf(elog.LogLevelInfo2, "Client:%d  quench:%d modified %+v", client.ID(), quench.QuenchID, quench)
-
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	quenchReply.Encode(buf)
@@ -801,7 +1477,9 @@ func (client *Client) HandleQuenchDelRequest(buffer []byte) (err error) {
 
 	// If deletion fails then nack and disconn
 	idx := int32(quenchDelRequest.QuenchID & 0xfffffffff)
+	client.quenchMu.RLock()
 	quench, exists := client.quenches[idx]
+	client.quenchMu.RUnlock()
 	if !exists {
 		nack := new(elvin.Nack)
 		nack.XID = quenchDelRequest.XID
@@ -818,7 +1496,10 @@ func (client *Client) HandleQuenchDelRequest(buffer []byte) (err error) {
 	}
 
 	// Remove it from the client
+	client.quenchMu.Lock()
 	delete(client.quenches, idx)
+	client.quenchMu.Unlock()
+	client.quenchNames -= len(quench.Names)
 
 	// send quench to sub engine
 	client.channels.quenchDel <- quench
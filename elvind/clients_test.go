@@ -0,0 +1,1040 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elog"
+	"github.com/cobaro/elvin/elvin"
+	"github.com/cobaro/elvin/memtransport"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnectStats(t *testing.T) {
+	// Nothing listens here to start with
+	url := "elvin://localhost:3921"
+	rc := elvin.NewClient(url, nil, nil, nil)
+
+	var mu sync.Mutex
+	var attempts, successes int
+	done := make(chan bool, 10)
+	rc.OnReconnect = func(attempt int, err error, success bool) {
+		mu.Lock()
+		attempts++
+		if success {
+			successes++
+		}
+		mu.Unlock()
+		done <- true
+	}
+
+	if err := rc.DefaultReconnect(3, 0, 10*time.Millisecond); err == nil {
+		t.Fatalf("Reconnect to nothing passed")
+	}
+
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+	if err := rc.DefaultReconnect(3, 0, 10*time.Millisecond); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	defer rc.Disconnect()
+
+	stats := rc.Stats()
+	if stats.ReconnectAttempts != 4 || stats.Reconnects != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Missing OnReconnect callback")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 4 || successes != 1 {
+		t.Fatalf("Callback saw %d attempts, %d successes", attempts, successes)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3924"
+	router := startTestRouter(url, func(r *Router) { r.SetHandshakeTimeout(100 * time.Millisecond) })
+	defer router.Stop()
+
+	// A well behaved client is unaffected
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer ec.Disconnect()
+
+	// Connect and say nothing
+	conn, err := net.Dial("tcp", "localhost:3924")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 4)); err != io.EOF {
+		t.Fatalf("Silent connection not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Silent connection closed early after %v", elapsed)
+	}
+
+	if ec.State() != elvin.StateConnected {
+		t.Fatalf("Connected client was closed")
+	}
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := startTestRouter("elvin://localhost:3928", func(r *Router) {
+		r.protocols["localhost:3928"].Addresses = []string{"127.0.0.1:3929"}
+	})
+	defer router.Stop()
+
+	for _, url := range []string{"elvin://localhost:3928", "elvin://127.0.0.1:3929"} {
+		ec := elvin.NewClient(url, nil, nil, nil)
+		if err := ec.Connect(); err != nil {
+			t.Fatalf("Connect to %s failed: %v", url, err)
+		}
+		if err := ec.Disconnect(); err != nil {
+			t.Fatalf("Disconnect from %s failed: %v", url, err)
+		}
+	}
+
+	// Both go when the protocol does
+	router.DeleteProtocol("localhost:3928")
+	for _, address := range []string{"localhost:3928", "127.0.0.1:3929"} {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			t.Fatalf("Still listening on %s", address)
+		}
+	}
+}
+
+func TestAddRemoveProtocol(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := startTestRouter("elvin://localhost:3939", nil)
+	defer router.Stop()
+
+	protocol, _ := elvin.URLToProtocol("elvin://localhost:3940")
+	if err := router.AddProtocol(protocol.Address, protocol); err != nil {
+		t.Fatalf("AddProtocol failed: %v", err)
+	}
+	ec := elvin.NewClient("elvin://localhost:3940", nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect to added protocol failed: %v", err)
+	}
+
+	// Conflicts
+	if err := router.AddProtocol(protocol.Address, protocol); err == nil {
+		t.Fatalf("Adding a protocol twice succeeded")
+	}
+	clash, _ := elvin.URLToProtocol("elvin://localhost:3939")
+	if err := router.AddProtocol("clash", clash); err == nil {
+		t.Fatalf("Adding a protocol on an address in use succeeded")
+	}
+	busy, err := net.Listen("tcp", "localhost:3941")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	taken, _ := elvin.URLToProtocol("elvin://localhost:3941")
+	if err := router.AddProtocol(taken.Address, taken); err == nil {
+		t.Fatalf("Adding a protocol on a bound port succeeded")
+	}
+	busy.Close()
+	if err := router.RemoveProtocol(taken.Address); err == nil {
+		t.Fatalf("Failed protocol was added")
+	}
+
+	if err := router.RemoveProtocol(protocol.Address); err != nil {
+		t.Fatalf("RemoveProtocol failed: %v", err)
+	}
+	if err := router.RemoveProtocol(protocol.Address); err == nil {
+		t.Fatalf("Removing an unknown protocol succeeded")
+	}
+	if conn, err := net.Dial("tcp", "localhost:3940"); err == nil {
+		conn.Close()
+		t.Fatalf("Still listening after RemoveProtocol")
+	}
+
+	// Existing connections are left alone
+	sub := &elvin.Subscription{Expression: "require(a)"}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Existing client's Subscribe failed: %v", err)
+	}
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
+
+func TestConnectCallbacks(t *testing.T) {
+	defer checkLeaks(t)()
+
+	connected := make(chan ConnInfo, 1)
+	disconnected := make(chan ConnInfo, 1)
+	router := startTestRouter("elvin://localhost:3930", func(r *Router) {
+		r.SetOnConnect(func(info ConnInfo) { connected <- info })
+		r.SetOnDisconnect(func(info ConnInfo) { disconnected <- info })
+	})
+	defer router.Stop()
+
+	ec := elvin.NewClient("elvin://localhost:3930", map[string]interface{}{"Name": "callbacks"}, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	var info ConnInfo
+	select {
+	case info = <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("OnConnect not called")
+	}
+	if info.Options["Name"] != "callbacks" || len(info.RemoteAddr) == 0 || info.ID == 0 {
+		t.Fatalf("OnConnect has bad info: %+v", info)
+	}
+	router.Mu.Lock()
+	_, ok := router.clients[info.ID]
+	router.Mu.Unlock()
+	if !ok {
+		t.Fatalf("OnConnect id %d is not a client", info.ID)
+	}
+
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	select {
+	case gone := <-disconnected:
+		if gone.ID != info.ID || gone.RemoteAddr != info.RemoteAddr {
+			t.Fatalf("OnDisconnect for %+v, expected %+v", gone, info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnDisconnect not called")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var log []string
+	tc := elvin.NewClient("elvin://localhost:3917", nil, nil, nil)
+	tc.SetLogLevel(elog.LogLevelDebug1)
+	tc.SetLogFunc(func(w io.Writer, format string, a ...interface{}) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		line := fmt.Sprintf(format, a...)
+		if strings.Contains(line, "trace") {
+			log = append(log, line)
+		}
+		return len(line), nil
+	})
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	mu.Lock()
+	if len(log) != 0 {
+		t.Fatalf("Traced without tracing enabled: %v", log)
+	}
+	mu.Unlock()
+
+	tc.SetTracing(true)
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TraceTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := tc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := tc.Notify(map[string]interface{}{"TraceTest": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case <-sub.Notifications:
+	case <-time.After(time.Second):
+		t.Fatalf("Notification not delivered")
+	}
+	tc.SetTracing(false)
+	if err := tc.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	trace := strings.Join(log, "")
+	for _, expected := range []string{
+		"trace send SubAddRequest XID",
+		"require(TraceTest)",
+		"trace recv SubReply XID",
+		"trace send NotifyEmit",
+		"trace recv NotifyDeliver",
+	} {
+		if !strings.Contains(trace, expected) {
+			t.Fatalf("Trace missing %q:\n%s", expected, trace)
+		}
+	}
+	if strings.Contains(trace, "Disconn") {
+		t.Fatalf("Traced after tracing disabled:\n%s", trace)
+	}
+}
+
+func TestMaxConnectionsShed(t *testing.T) {
+	url := "elvin://localhost:3925"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	var clients []*elvin.Client
+	for i := 0; i < 3; i++ {
+		c := elvin.NewClient(url, nil, nil, nil)
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		clients = append(clients, c)
+	}
+	idle := clients[0]
+	for _, c := range clients[1:] {
+		defer c.Disconnect()
+		// Make the others busier than the first
+		sub := &elvin.Subscription{Expression: "require(Busy)"}
+		sub.Notifications = make(chan map[string]interface{})
+		if err := c.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	// Without shedding lowering the limit only refuses new connections
+	router.SetMaxConnections(2)
+	if idle.State() != elvin.StateConnected {
+		t.Fatalf("Client shed without ShedIdle")
+	}
+	refused := elvin.NewClient("elvin://localhost:3925", nil, nil, nil)
+	if err := refused.Connect(); err == nil || !strings.Contains(err.Error(), fmt.Sprint(elvin.ErrorsQOSLimit)) {
+		t.Fatalf("Connection beyond the limit not refused with a Nack: %v", err)
+	}
+
+	// With shedding the most idle goes
+	events := make(chan elvin.Packet)
+	go func() { events <- <-idle.Events }()
+	router.SetShedIdle(true)
+	router.SetMaxConnections(2)
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("Idle client not shed")
+	}
+	if router.ShedConnections() != 1 {
+		t.Fatalf("Shed %d connections, expected 1", router.ShedConnections())
+	}
+	for _, c := range clients[1:] {
+		if c.State() != elvin.StateConnected {
+			t.Fatalf("Busy client was shed")
+		}
+	}
+}
+
+func TestMaxConnectionsConcurrent(t *testing.T) {
+	defer checkLeaks(t)()
+
+	urls := []string{"elvin://localhost:3970", "elvin://localhost:3971"}
+	router := startTestRouter(urls[0], func(r *Router) {
+		protocol, _ := elvin.URLToProtocol(urls[1])
+		r.AddProtocol(protocol.Address, protocol)
+		r.SetMaxConnections(3)
+	})
+	defer router.Stop()
+
+	// Accepts on both listeners race for the last slots
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var connected []*elvin.Client
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			c := elvin.NewClient(url, nil, nil, nil)
+			if err := c.Connect(); err != nil {
+				if !strings.Contains(err.Error(), fmt.Sprint(elvin.ErrorsQOSLimit)) {
+					t.Errorf("Refused without a Nack: %v", err)
+				}
+				return
+			}
+			mu.Lock()
+			connected = append(connected, c)
+			mu.Unlock()
+		}(urls[i%2])
+	}
+	wg.Wait()
+
+	if len(connected) != 3 || router.ClientCount() != 3 {
+		t.Errorf("Connected %d clients with %d on the router, expected 3", len(connected), router.ClientCount())
+	}
+	for _, c := range connected {
+		c.Disconnect()
+	}
+}
+
+// Drop the selected client connections from the router side
+func dropClients(router *Router, selected func(*Client) bool) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	for _, c := range router.clients {
+		if selected(c) {
+			c.closer.Close()
+		}
+	}
+}
+
+func TestConnectionKeysReplay(t *testing.T) {
+	url := "elvin://localhost:3922"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	secret := []byte("TestConnectionKeys")
+	nfnKeys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{secret}}}
+	subKeys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{elvin.PrimeSha1(secret)}}}
+
+	producer := elvin.NewClient(url, nil, nil, nil)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer producer.Disconnect()
+
+	consumer := elvin.NewClient(url, nil, nil, nil)
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer consumer.Disconnect()
+	go func() {
+		for range consumer.Events {
+		}
+	}()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestKeys)"
+	sub.AcceptInsecure = false
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Secure notifications only arrive once we have the keys
+	expect := func(delivered bool) {
+		if err := producer.Notify(map[string]interface{}{"TestKeys": int32(1)}, false, nfnKeys); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+		select {
+		case <-sub.Notifications:
+			if !delivered {
+				t.Fatalf("Delivered without keys")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if delivered {
+				t.Fatalf("Not delivered with keys")
+			}
+		}
+	}
+	expect(false)
+
+	if err := consumer.AddConnectionKeys(nil, subKeys); err != nil {
+		t.Fatalf("AddConnectionKeys failed: %v", err)
+	}
+	expect(true)
+
+	// Drop the consumer and reconnect, the keys must be resent
+	dropClients(router, func(c *Client) bool { return len(c.subs) > 0 })
+	for consumer.State() != elvin.StateClosed {
+		time.Sleep(time.Millisecond)
+	}
+	if err := consumer.DefaultReconnect(3, 0, 10*time.Millisecond); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	expect(true)
+
+	if err := consumer.RemoveConnectionKeys(nil, subKeys); err != nil {
+		t.Fatalf("RemoveConnectionKeys failed: %v", err)
+	}
+	expect(false)
+}
+
+func TestPublishDuringReconnect(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3933"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	sc := elvin.NewClient(url, nil, nil, nil)
+	if err := sc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Disconnect()
+	sub := &elvin.Subscription{
+		Expression:     "require(TestPublish)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 2),
+	}
+	if err := sc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	received := func(value int32) {
+		select {
+		case nfn := <-sub.Notifications:
+			if nfn["TestPublish"] != value {
+				t.Fatalf("Expected %d, got %v", value, nfn)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Notification %d not delivered", value)
+		}
+	}
+
+	// Not reconnecting so fails as usual
+	pc := elvin.NewClient(url, nil, nil, nil)
+	pc.Backoff = &elvin.BackoffPolicy{Initial: 100 * time.Millisecond, Max: 100 * time.Millisecond, Multiplier: 1}
+	pc.PublishQueue = 1
+	if err := pc.Notify(map[string]interface{}{"TestPublish": int32(0)}, true, nil); err == nil {
+		t.Fatalf("Notify while closed passed")
+	}
+
+	// Queued while reconnecting
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- pc.Reconnect(1) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := pc.Notify(map[string]interface{}{"TestPublish": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify while reconnecting failed: %v", err)
+	}
+	if err := pc.Notify(map[string]interface{}{"TestPublish": int32(2)}, true, nil); err == nil {
+		t.Fatalf("Notify passed with the queue full")
+	}
+	if err := <-reconnected; err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	received(1)
+	pc.Disconnect()
+
+	// Waits for the reconnection
+	pc.PublishQueue = 0
+	pc.PublishWait = time.Second
+	go func() { reconnected <- pc.Reconnect(1) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := pc.Notify(map[string]interface{}{"TestPublish": int32(3)}, true, nil); err != nil {
+		t.Fatalf("Notify while reconnecting failed: %v", err)
+	}
+	if err := <-reconnected; err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	received(3)
+	pc.Disconnect()
+}
+
+func TestProtocolStats(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := startTestRouter("elvin://localhost:3934", func(r *Router) {
+		protocol, _ := elvin.URLToProtocol("elvin://localhost:3935")
+		r.AddProtocol(protocol.Address, protocol)
+		r.SetMaxConnections(3)
+	})
+	defer router.Stop()
+
+	var clients []*elvin.Client
+	for _, url := range []string{"elvin://localhost:3934", "elvin://localhost:3934", "elvin://localhost:3935"} {
+		ec := elvin.NewClient(url, nil, nil, nil)
+		if err := ec.Connect(); err != nil {
+			t.Fatalf("Connect to %s failed: %v", url, err)
+		}
+		clients = append(clients, ec)
+	}
+
+	// Over MaxConnections
+	if conn, err := net.Dial("tcp", "localhost:3935"); err == nil {
+		defer conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	stats := router.ProtocolStats()
+	first, second := stats["localhost:3934"], stats["localhost:3935"]
+	if first.Accepts != 2 || first.Active != 2 || first.Rejects != 0 {
+		t.Errorf("Unexpected stats for 3934: %+v", first)
+	}
+	if second.Accepts != 1 || second.Active != 1 || second.Rejects != 1 {
+		t.Errorf("Unexpected stats for 3935: %+v", second)
+	}
+	if first.BytesIn == 0 || first.BytesOut == 0 || first.BytesIn <= second.BytesIn {
+		t.Errorf("Unexpected byte counts: %+v %+v", first, second)
+	}
+
+	for _, ec := range clients {
+		ec.Disconnect()
+	}
+	for i := 0; i < 100; i++ {
+		stats = router.ProtocolStats()
+		if stats["localhost:3934"].Active == 0 && stats["localhost:3935"].Active == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Connections still active after disconnecting: %+v", stats)
+}
+
+func TestKeepaliveFromConnReply(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3946"
+	router := startTestRouter(url, func(r *Router) {
+		r.SetTestConnInterval(200 * time.Millisecond)
+		r.SetTestConnTimeout(100 * time.Millisecond)
+	})
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	ec.KeepaliveInterval = time.Hour
+	ec.KeepaliveTimeout = time.Minute
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if interval, timeout := ec.Keepalive(); interval != 200*time.Millisecond || timeout != 100*time.Millisecond {
+		t.Fatalf("Expected the router's keepalive, got %v %v", interval, timeout)
+	}
+
+	// Both ends check an idle connection and it survives
+	time.Sleep(time.Second)
+	if ec.State() != elvin.StateConnected || router.ClientCount() != 1 {
+		t.Fatalf("Idle connection was closed")
+	}
+	ec.Disconnect()
+
+	// Without one from the router we use our own
+	quiet := "elvin://localhost:3947"
+	other := startTestRouter(quiet, func(r *Router) { r.SetTestConnInterval(0) })
+	defer other.Stop()
+
+	ec = elvin.NewClient(quiet, nil, nil, nil)
+	ec.KeepaliveInterval = time.Hour
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if interval, timeout := ec.Keepalive(); interval != time.Hour || timeout != elvin.TestConnTimeout {
+		t.Fatalf("Expected our own keepalive, got %v %v", interval, timeout)
+	}
+	ec.Disconnect()
+}
+
+func TestDisconnectClient(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3951"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	// Disconnect one client directly and another via the admin endpoint
+	for i, disconnect := range []func(id int32) error{
+		router.DisconnectClient,
+		func(id int32) error {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", fmt.Sprintf("/disconnect?id=%d", id), nil)
+			router.AdminHandler().ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("%d %s", w.Code, w.Body)
+			}
+			return nil
+		},
+	} {
+		ec := elvin.NewClient(url, nil, nil, nil)
+		if err := ec.Connect(); err != nil {
+			t.Fatalf("Connect %d failed: %v", i, err)
+		}
+		events := make(chan elvin.Packet, 1)
+		go func() { events <- <-ec.Events }()
+
+		clients := router.Clients()
+		if len(clients) != 1 {
+			t.Fatalf("Expected one client, got %v", clients)
+		}
+		if err := disconnect(clients[0].ID); err != nil {
+			t.Fatalf("Disconnect %d failed: %v", i, err)
+		}
+
+		select {
+		case event := <-events:
+			disconn, ok := event.(*elvin.Disconn)
+			if !ok || disconn.Reason != elvin.DisconnReasonRouterAdmin {
+				t.Fatalf("Expected an admin Disconn, got %v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No Disconn for client %d", i)
+		}
+		for start := time.Now(); router.ClientCount() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("Client %d wasn't removed", i)
+			}
+		}
+	}
+
+	if err := router.DisconnectClient(12345); err == nil {
+		t.Fatalf("Disconnecting an unknown client succeeded")
+	}
+}
+
+func TestOfflinePolicy(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3952"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	notConnected := func(err error) bool {
+		return err != nil && strings.HasPrefix(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsClientNotConnected))
+	}
+	newSub := func() *elvin.Subscription {
+		return &elvin.Subscription{
+			Expression:     "require(Offline)",
+			AcceptInsecure: true,
+			Notifications:  make(chan map[string]interface{}, 4),
+		}
+	}
+	nv := map[string]interface{}{"Offline": int32(1)}
+
+	// FailFast, the default, refuses both before and after a connection
+	ff := elvin.NewClient(url, nil, nil, nil)
+	if err := ff.Subscribe(newSub()); !notConnected(err) {
+		t.Fatalf("Expected not connected, got %v", err)
+	}
+	if err := ff.Notify(nv, true, nil); !notConnected(err) {
+		t.Fatalf("Expected not connected, got %v", err)
+	}
+	if err := ff.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := ff.Subscribe(newSub()); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := ff.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if err := ff.Notify(nv, true, nil); !notConnected(err) {
+		t.Fatalf("Expected not connected, got %v", err)
+	}
+
+	// Queue holds both until a connection, subscriptions first
+	q := elvin.NewClient(url, nil, nil, nil)
+	q.OfflinePolicy = elvin.OfflineQueue
+	for round := 0; round < 2; round++ {
+		sub := newSub()
+		if err := q.Subscribe(sub); err != nil {
+			t.Fatalf("Queued Subscribe failed: %v", err)
+		}
+		if err := q.Notify(nv, true, nil); err != nil {
+			t.Fatalf("Queued Notify failed: %v", err)
+		}
+		if sub.SubID() != 0 {
+			t.Fatalf("Queued subscription was sent")
+		}
+		if err := q.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		select {
+		case <-sub.Notifications:
+		case <-time.After(time.Second):
+			t.Fatalf("Queued notification wasn't delivered")
+		}
+		if err := q.Disconnect(); err != nil {
+			t.Fatalf("Disconnect failed: %v", err)
+		}
+	}
+
+	// A queued subscription can be deleted before it's sent
+	sub := newSub()
+	if err := q.Subscribe(sub); err != nil {
+		t.Fatalf("Queued Subscribe failed: %v", err)
+	}
+	if err := q.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Deleting queued subscription failed: %v", err)
+	}
+	if err := q.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if sub.SubID() != 0 {
+		t.Fatalf("Deleted subscription was sent")
+	}
+	q.Disconnect()
+}
+
+func TestReconnectInMemory(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := new(Router)
+	router.SetTestConnInterval(10 * time.Second)
+	router.SetTestConnTimeout(10 * time.Second)
+	router.Start()
+	defer router.Stop()
+	listener := memtransport.Listen("elvind")
+	go router.ServeListener("memory", listener)
+
+	// Keep each connection we dial so we can break it
+	conns := make(chan *memtransport.Conn, 2)
+	rc := elvin.NewClient("elvin://elvind", nil, nil, nil)
+	rc.Events = make(chan elvin.Packet, 1) // So we see the lost connection
+	rc.Backoff = &elvin.BackoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	rc.Dial = func(network, address string) (net.Conn, error) {
+		conn, err := listener.Dial(network, address)
+		if err == nil {
+			conns <- conn.(*memtransport.Conn)
+		}
+		return conn, err
+	}
+	if err := rc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	conn := <-conns
+	conn.SetChunk(3) // Frames arrive in pieces
+
+	sub := &elvin.Subscription{
+		Expression:     "require(InMemory)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 1),
+	}
+	if err := rc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	delivered := func(value int32) {
+		if err := rc.Notify(map[string]interface{}{"InMemory": value}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+		select {
+		case nv := <-sub.Notifications:
+			if nv["InMemory"] != value {
+				t.Fatalf("Expected %d got %v", value, nv)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Notification %d not delivered", value)
+		}
+	}
+	delivered(1)
+
+	// Break the connection, the subscription survives reconnection
+	conn.InjectError(io.ErrUnexpectedEOF)
+	select {
+	case event := <-rc.Events:
+		if disconn, ok := event.(*elvin.Disconn); !ok || disconn.Reason != elvin.DisconnReasonClientConnectionLost {
+			t.Fatalf("Unexpected event %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Lost connection not reported")
+	}
+	for rc.State() != elvin.StateClosed {
+		time.Sleep(time.Millisecond)
+	}
+	if err := rc.Reconnect(1); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	<-conns
+	delivered(2)
+	rc.Disconnect()
+}
+
+func TestSubscriptionHandle(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := new(Router)
+	router.SetTestConnInterval(10 * time.Second)
+	router.SetTestConnTimeout(10 * time.Second)
+	router.Start()
+	defer router.Stop()
+	listener := memtransport.Listen("handles")
+	go router.ServeListener("memory", listener)
+
+	conns := make(chan *memtransport.Conn, 2)
+	rc := elvin.NewClient("elvin://handles", nil, nil, nil)
+	rc.Events = make(chan elvin.Packet, 1)
+	rc.Backoff = &elvin.BackoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	rc.Dial = func(network, address string) (net.Conn, error) {
+		conn, err := listener.Dial(network, address)
+		if err == nil {
+			conns <- conn.(*memtransport.Conn)
+		}
+		return conn, err
+	}
+	if err := rc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	conn := <-conns
+
+	subscribe := func(attr string) *elvin.SubscriptionHandle {
+		h, err := rc.SubscribeHandle(&elvin.Subscription{
+			Expression:     "require(" + attr + ")",
+			AcceptInsecure: true,
+			Notifications:  make(chan map[string]interface{}, 1),
+		})
+		if err != nil {
+			t.Fatalf("SubscribeHandle failed: %v", err)
+		}
+		return h
+	}
+	delivered := func(h *elvin.SubscriptionHandle, attr string) bool {
+		if err := rc.Notify(map[string]interface{}{attr: int32(1)}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+		select {
+		case <-h.Subscription.Notifications:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	// Closing while connected unsubscribes
+	connected := subscribe("Connected")
+	if !delivered(connected, "Connected") {
+		t.Fatalf("Notification not delivered")
+	}
+	if err := connected.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := connected.Close(); err != nil {
+		t.Fatalf("Second Close failed: %v", err)
+	}
+	if delivered(connected, "Connected") {
+		t.Fatalf("Notification delivered after Close")
+	}
+
+	// Closing while the connection is down means it isn't restored
+	lost := subscribe("Lost")
+	conn.InjectError(io.ErrUnexpectedEOF)
+	<-rc.Events
+	for rc.State() != elvin.StateClosed {
+		time.Sleep(time.Millisecond)
+	}
+	if err := lost.Close(); err != nil {
+		t.Fatalf("Close while disconnected failed: %v", err)
+	}
+	if err := lost.Close(); err != nil {
+		t.Fatalf("Second Close failed: %v", err)
+	}
+	if err := rc.Reconnect(1); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	<-conns
+	if delivered(lost, "Lost") {
+		t.Fatalf("Closed subscription restored on reconnect")
+	}
+	rc.Disconnect()
+}
+
+func TestConnectionID(t *testing.T) {
+	defer checkLeaks(t)()
+	router := startTestRouter("elvin://localhost:3963", func(router *Router) {
+		router.SetConnectionIDScheme(ConnectionIDUUID)
+	})
+	defer router.Stop()
+
+	tc := elvin.NewClient("elvin://localhost:3963", nil, nil, nil)
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	go func() { <-tc.Events }()
+	connectionID := tc.ConnectionID()
+	if len(connectionID) != 36 {
+		t.Fatalf("Expected a UUID connection ID, got %q", connectionID)
+	}
+
+	clients := router.Clients()
+	if len(clients) != 1 || clients[0].ConnectionID != connectionID {
+		t.Fatalf("Router's clients %+v don't have connection %s", clients, connectionID)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/clients", nil))
+	if !strings.Contains(recorder.Body.String(), connectionID) {
+		t.Fatalf("Admin clients missing %s:\n%s", connectionID, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/disconnect?conn="+connectionID, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Disconnect by connection ID failed: %s", recorder.Body.String())
+	}
+	for start := time.Now(); router.ClientCount() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Connection %s wasn't removed", connectionID)
+		}
+	}
+}
+
+func TestMarshalFallback(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3966"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	// We only speak XDR, so asking for protobuf falls back to it
+	ec := elvin.NewClient(url, nil, nil, nil).WithMarshal("protobuf")
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if marshal := ec.EffectiveMarshal(); marshal != elvin.MarshalXDR {
+		t.Fatalf("Expected to fall back to %s, got %q", elvin.MarshalXDR, marshal)
+	}
+
+	sub := &elvin.Subscription{
+		Expression:     "require(Marshalled)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 1),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := ec.Notify(map[string]interface{}{"Marshalled": "round trip"}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["Marshalled"] != "round trip" {
+			t.Fatalf("Unexpected notification %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Notification wasn't delivered")
+	}
+
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if marshal := ec.EffectiveMarshal(); marshal != "" {
+		t.Fatalf("Disconnected client has marshal %q", marshal)
+	}
+}
@@ -22,9 +22,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"github.com/cobaro/elvin/elog"
+	"github.com/cobaro/elvin/elvin"
 	"os"
+	"time"
 )
 
 type Configuration struct {
@@ -32,10 +36,55 @@ type Configuration struct {
 	Failover         string
 	DoFailover       bool
 	MaxConnections   int
+	ShedIdle         bool  // Shed the most idle clients when MaxConnections is lowered
+	DropBelow        int32 // Drop rather than wait for clients below this priority
+	ReadOnly         bool  // Refuse client notifications, delivering only those from peers
 	TestConnInterval int64 // idle seconds to trigger, 0 to disable
 	TestConnTimeout  int64 // Time to await a response
+	HandshakeTimeout int64 // seconds allowed before a ConnRequest, 0 to disable
+	ShutdownTimeout  int64 // seconds allowed for clients to leave on shutdown
 	LogLevel         int
 	LogDateFormat    int
+	AdminAddress     string // host:port for the admin http endpoints, "" to disable
+	SelfTest         bool   // Run a loopback self test at startup
+	TLS              TLSConfiguration
+	Socket           SocketConfiguration
+	LastValueKey     string   // Attribute keying the last value cache, "" to disable
+	LastValueSize    int      // Maximum entries in the last value cache
+	LastValueTTL     int64    // seconds a last value is kept, 0 for ever
+	StateFile        string   // Where SIGUSR1 writes the router's state as JSON, "" to log the clients
+	SessionTTL       int64    // seconds a closed session is retained, 0 to disable sessions
+	SessionBuffer    int      // Notifications buffered per retained session
+	DedupSize        int      // Notifications remembered for duplicate suppression, 0 to disable
+	DedupWindow      int64    // milliseconds a duplicate is suppressed for
+	DedupKey         string   // Attribute identifying duplicates, "" to compare content
+	DedupProtocols   []string // Protocol URLs to deduplicate, all if empty
+	MaxStringLength  int      // Decoding limits, 0 for unlimited
+	MaxOpaqueLength  int
+	MaxNameValues    int
+	XdrLenient       bool // Accept out of range bools and 16 bit values
+
+	ProtocolAddresses map[string][]string // Further addresses to serve each protocol on, keyed by its URL
+
+	MaxQuenchNames           int // Names allowed in one quench, 0 for unlimited
+	MaxConnectionQuenchNames int // Names allowed across a connection's quenches, 0 for unlimited
+	MaxSubscriptions         int // Subscriptions allowed per connection, 0 for unlimited
+
+	BusyThreshold int   // Notifications awaiting the engine before producers are told to back off, 0 to disable
+	BusyBackoff   int64 // milliseconds a busy producer is asked to back off
+
+	SlowDelivery      int64 // milliseconds a delivery may take before it's logged, 0 to disable
+	SlowDeliveryLevel int   // log level for slow deliveries
+
+	AcceptPauseHigh int // Queued deliveries at which accepting pauses, 0 to never pause
+	AcceptPauseLow  int // Queued deliveries at which accepting resumes
+
+	RedeliveryTimeout  int64 // milliseconds a reliable delivery awaits its ack
+	RedeliveryAttempts int   // times an unacked delivery is sent again
+	RedeliveryBuffer   int   // unacked deliveries held per connection
+
+	ConnectionIDScheme string // "sequence" or "uuid", see SetConnectionIDScheme
+	TransformErrorPass bool   // Route notifications a transform fails on rather than drop them
 }
 
 func LoadConfig(configFile string) (config *Configuration, err error) {
@@ -46,10 +95,115 @@ func LoadConfig(configFile string) (config *Configuration, err error) {
 	}
 	decoder := json.NewDecoder(file)
 	configuration := Configuration{}
-	err = decoder.Decode(&configuration)
+	if err = decoder.Decode(&configuration); err != nil {
+		return &configuration, err
+	}
+	err = configuration.TLS.Validate()
 	return &configuration, err
 }
 
+// TCP tuning for every protocol, zero values leave Go's defaults
+type SocketConfiguration struct {
+	TCPNoDelay   *bool
+	TCPKeepAlive int64 // seconds, negative to disable
+	ReadBuffer   int
+	WriteBuffer  int
+}
+
+// The elvin.SocketOptions, nil if nothing is set
+func (c *SocketConfiguration) Options() *elvin.SocketOptions {
+	if *c == (SocketConfiguration{}) {
+		return nil
+	}
+	return &elvin.SocketOptions{
+		TCPNoDelay:   c.TCPNoDelay,
+		TCPKeepAlive: time.Duration(c.TCPKeepAlive) * time.Second,
+		ReadBuffer:   c.ReadBuffer,
+		WriteBuffer:  c.WriteBuffer,
+	}
+}
+
+// Settings for ssl protocols
+type TLSConfiguration struct {
+	CertFile                 string
+	KeyFile                  string
+	MinVersion               string   // "1.0" to "1.3", "" for Go's default
+	CipherSuites             []string // e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty for Go's defaults
+	PreferServerCipherSuites bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Check the version and cipher suite names
+func (c *TLSConfiguration) Validate() (err error) {
+	if _, err = c.minVersion(); err != nil {
+		return err
+	}
+	_, err = c.cipherSuites()
+	return err
+}
+
+func (c *TLSConfiguration) minVersion() (uint16, error) {
+	if len(c.MinVersion) == 0 {
+		return 0, nil
+	}
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS MinVersion %q", c.MinVersion)
+	}
+	return version, nil
+}
+
+func (c *TLSConfiguration) cipherSuites() (ids []uint16, err error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Build a tls.Config, loading the certificate
+func (c *TLSConfiguration) Config() (config *tls.Config, err error) {
+	config = new(tls.Config)
+	if config.MinVersion, err = c.minVersion(); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = c.cipherSuites(); err != nil {
+		return nil, err
+	}
+	config.PreferServerCipherSuites = c.PreferServerCipherSuites
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// The TLS configuration for ssl protocols, nil without a certificate
+func (config *Configuration) tlsConfig() (*tls.Config, error) {
+	if len(config.TLS.CertFile) == 0 {
+		return nil, nil
+	}
+	return config.TLS.Config()
+}
+
 func DefaultConfig() (config *Configuration) {
 	config = new(Configuration)
 
@@ -57,9 +211,25 @@ func DefaultConfig() (config *Configuration) {
 	config.Protocols = []string{"elvin://0.0.0.0"}
 	config.DoFailover = false
 	config.MaxConnections = 64
+	config.ShedIdle = false
 	config.TestConnInterval = 0
 	config.TestConnTimeout = 10
+	config.HandshakeTimeout = 10
+	config.ShutdownTimeout = 5
 	config.LogLevel = elog.LogLevelInfo1
+	config.LastValueSize = 1024
+	config.SessionBuffer = 1024
+	config.MaxStringLength = 1024 * 1024
+	config.MaxOpaqueLength = 1024 * 1024
+	config.MaxNameValues = 1024
+	config.MaxQuenchNames = 1024
+	config.MaxConnectionQuenchNames = 16 * 1024
+	config.BusyBackoff = 100
+	config.SlowDeliveryLevel = elog.LogLevelWarning
+	config.RedeliveryTimeout = 1000
+	config.RedeliveryAttempts = 3
+	config.RedeliveryBuffer = 1024
+	config.ConnectionIDScheme = ConnectionIDSequence
 	config.LogDateFormat = elog.LogDateLocaltime
 	// config.Logfile = os.Stderr
 
@@ -0,0 +1,86 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, json string) (*Configuration, error) {
+	file, err := ioutil.TempFile("", "elvind-config")
+	if err != nil {
+		t.Fatalf("TempFile failed: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(json)
+	file.Close()
+	return LoadConfig(file.Name())
+}
+
+func TestConfigTLS(t *testing.T) {
+	config, err := loadTestConfig(t, `{"TLS": {"MinVersion": "1.2", "CipherSuites": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"]}}`)
+	if err != nil {
+		t.Fatalf("Valid TLS config failed: %v", err)
+	}
+	if ids, _ := config.TLS.cipherSuites(); len(ids) != 1 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("Cipher suite mapped to %v", ids)
+	}
+	if version, _ := config.TLS.minVersion(); version != tls.VersionTLS12 {
+		t.Fatalf("MinVersion mapped to %v", version)
+	}
+
+	_, err = loadTestConfig(t, `{"TLS": {"CipherSuites": ["TLS_RSA_WITH_ROT13"]}}`)
+	if err == nil || !strings.Contains(err.Error(), "TLS_RSA_WITH_ROT13") {
+		t.Fatalf("Expected unknown cipher suite error, got: %v", err)
+	}
+
+	_, err = loadTestConfig(t, `{"TLS": {"MinVersion": "0.9"}}`)
+	if err == nil || !strings.Contains(err.Error(), "MinVersion") {
+		t.Fatalf("Expected unknown version error, got: %v", err)
+	}
+}
+
+func TestConfigReloadTLS(t *testing.T) {
+	var manager Manager
+	manager.config = DefaultConfig()
+
+	file, err := ioutil.TempFile("", "elvind-config")
+	if err != nil {
+		t.Fatalf("TempFile failed: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"MaxConnections": 7, "TLS": {"CertFile": "/nonexistent/cert.pem", "KeyFile": "/nonexistent/key.pem"}}`)
+	file.Close()
+
+	if err := manager.Reload(file.Name()); err == nil {
+		t.Fatalf("Reload with a missing certificate succeeded")
+	}
+	if manager.config.MaxConnections == 7 {
+		t.Fatalf("Failed reload applied its configuration")
+	}
+	if manager.router.TLSConfig() != nil {
+		t.Fatalf("Failed reload set a TLS configuration")
+	}
+}
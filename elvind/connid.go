@@ -0,0 +1,87 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+)
+
+// Schemes for the connection IDs given to each accepted connection,
+// see SetConnectionIDScheme
+const (
+	ConnectionIDSequence = "sequence" // 1, 2, 3... for the life of the router
+	ConnectionIDUUID     = "uuid"     // random (version 4) UUIDs
+)
+
+// Choose how connections accepted from now on are identified. The ID
+// is stable for the life of the connection and unique within the
+// router (or, for ConnectionIDUUID, everywhere). It's logged, shown in
+// Clients, accepted by DisconnectConnection and given to the client
+// in its ConnReply as elvin.ConnectionIDOption, so that one
+// connection can be traced on both sides. "" means ConnectionIDSequence.
+func (router *Router) SetConnectionIDScheme(scheme string) error {
+	switch scheme {
+	case "", ConnectionIDSequence, ConnectionIDUUID:
+	default:
+		return fmt.Errorf("Unknown connection ID scheme %q", scheme)
+	}
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.connectionIDScheme = scheme
+	return nil
+}
+
+// The connection ID scheme
+func (router *Router) ConnectionIDScheme() string {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.connectionIDScheme == "" {
+		return ConnectionIDSequence
+	}
+	return router.connectionIDScheme
+}
+
+// The next connection ID. Called with router.Mu held.
+func (router *Router) nextConnectionID() string {
+	if router.connectionIDScheme == ConnectionIDUUID {
+		var u [16]byte
+		if _, err := rand.Read(u[:]); err == nil {
+			u[6] = (u[6] & 0x0f) | 0x40 // version 4
+			u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+			return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+		}
+		// Fall back to the sequence rather than leave it unnamed
+	}
+	router.connectionSeq++
+	return strconv.FormatUint(router.connectionSeq, 10)
+}
+
+// Disconnect a client, as an administrator, by its connection ID
+func (router *Router) DisconnectConnection(connectionID string) error {
+	for _, info := range router.Clients() {
+		if info.ConnectionID == connectionID {
+			return router.DisconnectClient(info.ID)
+		}
+	}
+	return fmt.Errorf("No such connection %s", connectionID)
+}
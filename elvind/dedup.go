@@ -0,0 +1,124 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Suppresses duplicate notifications seen within a window of the
+// first. Notifications are identified by the value of a key attribute
+// if set, otherwise by a hash of their content. Keys aren't part of
+// the identity so keyed notifications shouldn't be offered. A bounded
+// number of identities are remembered, the least recently seen are
+// forgotten.
+type Deduplicator struct {
+	mu         sync.Mutex
+	key        string        // Attribute identifying a notification, "" to hash
+	size       int           // Maximum identities remembered
+	window     time.Duration // How long a duplicate is suppressed
+	entries    map[string]*list.Element
+	order      *list.List // of *dedupEntry, most recently seen at the front
+	suppressed uint64     // atomic
+}
+
+type dedupEntry struct {
+	id    string
+	first time.Time
+}
+
+// Create a deduplicator keyed on the named attribute, or on content
+// if key is ""
+func NewDeduplicator(key string, size int, window time.Duration) *Deduplicator {
+	dedup := new(Deduplicator)
+	dedup.key = key
+	dedup.size = size
+	dedup.window = window
+	dedup.entries = make(map[string]*list.Element)
+	dedup.order = list.New()
+	return dedup
+}
+
+// Is this a duplicate of a notification seen within the window? If
+// not it's remembered.
+func (dedup *Deduplicator) Duplicate(nv map[string]interface{}, deliverInsecure bool, now time.Time) bool {
+	id, ok := dedup.identify(nv, deliverInsecure)
+	if !ok {
+		return false
+	}
+
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+
+	if element, ok := dedup.entries[id]; ok {
+		dedup.order.MoveToFront(element)
+		entry := element.Value.(*dedupEntry)
+		if now.Sub(entry.first) < dedup.window {
+			atomic.AddUint64(&dedup.suppressed, 1)
+			return true
+		}
+		entry.first = now
+		return false
+	}
+	dedup.entries[id] = dedup.order.PushFront(&dedupEntry{id, now})
+
+	for dedup.size > 0 && dedup.order.Len() > dedup.size {
+		oldest := dedup.order.Back()
+		delete(dedup.entries, oldest.Value.(*dedupEntry).id)
+		dedup.order.Remove(oldest)
+	}
+	return false
+}
+
+// The number of duplicates suppressed
+func (dedup *Deduplicator) Suppressed() uint64 {
+	return atomic.LoadUint64(&dedup.suppressed)
+}
+
+// The identity of a notification, false if it has no key attribute
+func (dedup *Deduplicator) identify(nv map[string]interface{}, deliverInsecure bool) (string, bool) {
+	if len(dedup.key) > 0 {
+		value, ok := nv[dedup.key]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%T:%v", value, value), true
+	}
+
+	names := make([]string, 0, len(nv))
+	for name := range nv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%v\x00", deliverInsecure)
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%T\x00%v\x00", name, nv[name], nv[name])
+	}
+	return string(hash.Sum(nil)), true
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Now()
+	dedup := NewDeduplicator("", 2, time.Second)
+	a := map[string]interface{}{"Name": "a", "Value": int32(1)}
+	if dedup.Duplicate(a, true, now) {
+		t.Fatalf("First notification is a duplicate")
+	}
+	if !dedup.Duplicate(map[string]interface{}{"Value": int32(1), "Name": "a"}, true, now) {
+		t.Fatalf("Same content not a duplicate")
+	}
+	for _, nv := range []map[string]interface{}{
+		{"Name": "a", "Value": int64(1)},
+		{"Name": []byte("a"), "Value": int32(1)},
+	} {
+		if dedup.Duplicate(nv, true, now) {
+			t.Fatalf("%v is a duplicate of %v", nv, a)
+		}
+	}
+	if dedup.Duplicate(a, false, now) {
+		t.Fatalf("DeliverInsecure ignored")
+	}
+
+	// The window is from the first sighting and a was evicted
+	if dedup.Duplicate(a, true, now.Add(2*time.Second)) {
+		t.Fatalf("Duplicate outside the window")
+	}
+	if dedup.Suppressed() != 1 {
+		t.Fatalf("Expected 1 suppressed, got %d", dedup.Suppressed())
+	}
+
+	dedup = NewDeduplicator("ID", 0, time.Second)
+	if dedup.Duplicate(map[string]interface{}{"ID": int32(7), "Retry": int32(1)}, true, now) ||
+		!dedup.Duplicate(map[string]interface{}{"ID": int32(7), "Retry": int32(2)}, true, now) {
+		t.Fatalf("Key attribute not used")
+	}
+	if dedup.Duplicate(map[string]interface{}{"Retry": int32(1)}, true, now) ||
+		dedup.Duplicate(map[string]interface{}{"Retry": int32(1)}, true, now) {
+		t.Fatalf("Notification without the key deduplicated")
+	}
+}
+
+func TestDeduplicateIngest(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3936"
+	dedup := NewDeduplicator("", 16, time.Minute)
+	router := startTestRouter(url, func(r *Router) { r.SetProtocolDeduplicator("localhost:3936", dedup) })
+	defer router.Stop()
+
+	c := elvin.NewClient(url, nil, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestDedup)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{}, 4)
+	if err := c.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	for _, value := range []int32{1, 1, 2} {
+		if err := c.Notify(map[string]interface{}{"TestDedup": value}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	for _, value := range []int32{1, 2} {
+		select {
+		case nv := <-sub.Notifications:
+			if nv["TestDedup"] != value {
+				t.Fatalf("Expected %d, got %v", value, nv)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Notification %d not delivered", value)
+		}
+	}
+	if router.DuplicateNotifications() != 1 {
+		t.Fatalf("Expected 1 duplicate, got %d", router.DuplicateNotifications())
+	}
+
+	// The same content with keys isn't a duplicate
+	keys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{[]byte("secret")}}}
+	if err := c.Notify(map[string]interface{}{"TestDedup": int32(2)}, true, keys); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["TestDedup"] != int32(2) {
+			t.Fatalf("Expected 2, got %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Keyed notification not delivered")
+	}
+	if router.DuplicateNotifications() != 1 {
+		t.Fatalf("Keyed notification suppressed, %d duplicates", router.DuplicateNotifications())
+	}
+
+	// Removing the deduplicator applies to the existing connection
+	router.SetProtocolDeduplicator("localhost:3936", nil)
+	if err := c.Notify(map[string]interface{}{"TestDedup": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["TestDedup"] != int32(1) {
+			t.Fatalf("Expected 1, got %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Notification suppressed without a deduplicator")
+	}
+}
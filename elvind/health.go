@@ -0,0 +1,68 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+// The router's lifecycle as seen by orchestrators' liveness and
+// readiness probes
+type Health int
+
+const (
+	HealthStarting Health = iota // Not yet listening on every address
+	HealthReady                  // Listening and accepting connections
+	HealthDraining               // Listeners closed, clients remain
+	HealthStopped                // Stopped, clients told to go
+)
+
+func (health Health) String() string {
+	switch health {
+	case HealthStarting:
+		return "Starting"
+	case HealthReady:
+		return "Ready"
+	case HealthDraining:
+		return "Draining"
+	case HealthStopped:
+		return "Stopped"
+	}
+	return "Unknown"
+}
+
+// The router's current health
+func (router *Router) Health() Health {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.health
+}
+
+// Whether the router is listening on all its addresses and accepting
+// connections
+func (router *Router) Ready() bool {
+	return router.Health() == HealthReady
+}
+
+// Note a listener is bound, becoming ready once they all are. Called
+// with router.Mu held.
+func (router *Router) bound() {
+	router.unbound--
+	if router.unbound <= 0 && router.health == HealthStarting {
+		router.health = HealthReady
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3954"
+	protocol, _ := elvin.URLToProtocol(url)
+	router := new(Router)
+	router.AddProtocol(protocol.Address, protocol)
+	admin := router.AdminHandler()
+
+	probe := func(path string, status int, health Health) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != status || recorder.Body.String() != health.String()+"\n" {
+			t.Fatalf("%s: expected %d %s got %d %s", path, status, health, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if router.Health() != HealthStarting || router.Ready() {
+		t.Fatalf("Unstarted router is %s", router.Health())
+	}
+	probe("/readyz", http.StatusServiceUnavailable, HealthStarting)
+
+	if err := router.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !router.Ready() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if router.Health() != HealthReady {
+		t.Fatalf("Started router is %s", router.Health())
+	}
+	probe("/readyz", http.StatusOK, HealthReady)
+	probe("/healthz", http.StatusOK, HealthReady)
+
+	// A router that can't bind its address never becomes ready
+	blocked := startTestRouter(url, nil)
+	time.Sleep(50 * time.Millisecond)
+	if blocked.Health() != HealthStarting {
+		t.Fatalf("Unbound router is %s", blocked.Health())
+	}
+	blocked.Stop()
+
+	router.StopListeners()
+	probe("/readyz", http.StatusServiceUnavailable, HealthDraining)
+	probe("/healthz", http.StatusOK, HealthDraining)
+
+	router.Stop()
+	probe("/readyz", http.StatusServiceUnavailable, HealthStopped)
+	probe("/healthz", http.StatusServiceUnavailable, HealthStopped)
+}
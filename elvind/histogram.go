@@ -0,0 +1,95 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Number of latency buckets. Bucket i counts durations below
+// 2^i microseconds with the last bucket catching everything else.
+const histogramBuckets = 32
+
+// A fixed bucket latency histogram that is cheap enough to update on
+// every notification
+type Histogram struct {
+	counts [histogramBuckets]uint64
+}
+
+// Record a duration
+func (h *Histogram) Observe(d time.Duration) {
+	us := uint64(d / time.Microsecond)
+	i := bits.Len64(us)
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// Return the number of durations recorded
+func (h *Histogram) Count() (count uint64) {
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+	}
+	return count
+}
+
+// Return the upper bound of the bucket holding the p'th (0-1)
+// percentile, or zero if nothing has been recorded
+func (h *Histogram) Percentile(p float64) time.Duration {
+	var counts [histogramBuckets]uint64
+	var total uint64
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(p * float64(total))
+	if rank >= total {
+		rank = total - 1
+	}
+	var seen uint64
+	for i, count := range counts {
+		seen += count
+		if seen > rank {
+			return time.Duration(uint64(1)<<uint(i)) * time.Microsecond
+		}
+	}
+	return time.Duration(uint64(1)<<uint(histogramBuckets-1)) * time.Microsecond
+}
+
+// Latency percentiles
+type Latency struct {
+	Count uint64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// Return the summary percentiles of a histogram
+func (h *Histogram) Latency() Latency {
+	return Latency{h.Count(), h.Percentile(0.50), h.Percentile(0.95), h.Percentile(0.99)}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	var h Histogram
+	if h.Percentile(0.5) != 0 {
+		t.Fatalf("Empty histogram has a percentile")
+	}
+
+	// 90 fast, 10 slow
+	for i := 0; i < 90; i++ {
+		h.Observe(100 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(10 * time.Millisecond)
+	}
+
+	latency := h.Latency()
+	if latency.Count != 100 {
+		t.Fatalf("Count %d != 100", latency.Count)
+	}
+	if latency.P50 < 100*time.Microsecond || latency.P50 >= 200*time.Microsecond {
+		t.Fatalf("Bad p50 %v", latency.P50)
+	}
+	if latency.P95 < 10*time.Millisecond || latency.P95 >= 20*time.Millisecond {
+		t.Fatalf("Bad p95 %v", latency.P95)
+	}
+	if latency.P99 != latency.P95 {
+		t.Fatalf("Bad p99 %v", latency.P99)
+	}
+
+	// Very slow ones land in the last bucket
+	h.Observe(24 * time.Hour)
+	if h.Percentile(1) <= time.Hour/2 {
+		t.Fatalf("Overflow not recorded")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	var router Router
+	router.latency.Observe(time.Millisecond)
+
+	w := httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "elvind_delivery_latency_count 1\n") {
+		t.Fatalf("Missing count in %s", body)
+	}
+	if !strings.Contains(body, "elvind_delivery_latency_seconds{quantile=\"0.99\"}") {
+		t.Fatalf("Missing p99 in %s", body)
+	}
+}
+
+// Observe is on the delivery path for every notification
+func BenchmarkHistogramObserve(b *testing.B) {
+	var h Histogram
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		h.Observe(time.Since(start))
+	}
+}
+
+// Notify to delivery through a router, so the histogram's share of the
+// delivery path shows up as the difference between these two
+func benchmarkDelivery(b *testing.B, url string, untimed bool) {
+	router := startTestRouter(url, func(r *Router) { r.untimed = untimed })
+	defer router.Stop()
+
+	nc := elvin.NewClient(url, nil, nil, nil)
+	if err := nc.Connect(); err != nil {
+		b.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Disconnect()
+
+	sub := &elvin.Subscription{Expression: "require(Bench)", AcceptInsecure: true}
+	sub.Notifications = make(chan map[string]interface{})
+	if err := nc.Subscribe(sub); err != nil {
+		b.Fatalf("Subscribe failed: %v", err)
+	}
+	defer nc.SubscriptionDelete(sub)
+
+	nfn := map[string]interface{}{"Bench": int32(1)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := nc.Notify(nfn, true, nil); err != nil {
+			b.Fatalf("Notify failed: %v", err)
+		}
+		<-sub.Notifications
+	}
+	b.StopTimer()
+}
+
+func BenchmarkDeliveryTimed(b *testing.B) {
+	benchmarkDelivery(b, "elvin://localhost:3972", false)
+}
+
+func BenchmarkDeliveryUntimed(b *testing.B) {
+	benchmarkDelivery(b, "elvin://localhost:3973", true)
+}
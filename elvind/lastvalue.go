@@ -0,0 +1,126 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A bounded cache of the most recent notification for each distinct
+// value of a key attribute. New subscriptions are sent the cached
+// notifications they match before any live ones.
+type LastValueCache struct {
+	mu      sync.Mutex
+	key     string        // Attribute whose value distinguishes entries
+	size    int           // Maximum entries, the least recently updated are evicted
+	ttl     time.Duration // How long an entry is valid, 0 for ever
+	entries map[cacheKey]*list.Element
+	order   *list.List // of *lastValue, most recently updated at the front
+}
+
+// Opaque values aren't hashable so they're held as strings, flagged
+// to keep them distinct from string values
+type cacheKey struct {
+	opaque bool
+	value  interface{}
+}
+
+type lastValue struct {
+	key cacheKey
+	nfn Notification
+}
+
+// Create a cache keyed on the named attribute
+func NewLastValueCache(key string, size int, ttl time.Duration) *LastValueCache {
+	cache := new(LastValueCache)
+	cache.key = key
+	cache.size = size
+	cache.ttl = ttl
+	cache.entries = make(map[cacheKey]*list.Element)
+	cache.order = list.New()
+	return cache
+}
+
+// Remember a notification if it has the key attribute
+func (cache *LastValueCache) Put(nfn Notification) {
+	value, ok := nfn.NameValue[cache.key]
+	if !ok {
+		return
+	}
+	var key cacheKey
+	if opaque, ok := value.([]byte); ok {
+		key = cacheKey{true, string(opaque)}
+	} else {
+		key = cacheKey{false, value}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*lastValue).nfn = nfn
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&lastValue{key, nfn})
+
+	for cache.size > 0 && cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		delete(cache.entries, oldest.Value.(*lastValue).key)
+		cache.order.Remove(oldest)
+	}
+}
+
+// Return the unexpired notifications, least recently updated first
+func (cache *LastValueCache) Values() (values []Notification) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	for element := cache.order.Back(); element != nil; {
+		lv := element.Value.(*lastValue)
+		prev := element.Prev()
+		if cache.expired(lv.nfn, now) {
+			delete(cache.entries, lv.key)
+			cache.order.Remove(element)
+		} else {
+			values = append(values, lv.nfn)
+		}
+		element = prev
+	}
+	return values
+}
+
+// The number of cached notifications
+func (cache *LastValueCache) Len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.order.Len()
+}
+
+func (cache *LastValueCache) expired(nfn Notification, now time.Time) bool {
+	if cache.ttl > 0 && now.Sub(nfn.Received) > cache.ttl {
+		return true
+	}
+	return !nfn.Deadline.IsZero() && now.After(nfn.Deadline)
+}
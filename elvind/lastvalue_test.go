@@ -0,0 +1,99 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+func TestLastValueCacheEviction(t *testing.T) {
+	cache := NewLastValueCache("Symbol", 2, 0)
+	for _, symbol := range []interface{}{"A", "B", "A", []byte("A"), "C"} {
+		cache.Put(Notification{NameValue: map[string]interface{}{"Symbol": symbol}, Received: time.Now()})
+	}
+	cache.Put(Notification{NameValue: map[string]interface{}{"NoSymbol": int32(1)}, Received: time.Now()})
+
+	values := cache.Values()
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 values, got %v", values)
+	}
+	if _, ok := values[0].NameValue["Symbol"].([]byte); !ok || values[1].NameValue["Symbol"] != "C" {
+		t.Fatalf("Unexpected values %v", values)
+	}
+
+	cache = NewLastValueCache("Symbol", 0, time.Millisecond)
+	cache.Put(Notification{NameValue: map[string]interface{}{"Symbol": "A"}, Received: time.Now().Add(-time.Second)})
+	if values := cache.Values(); len(values) != 0 || cache.Len() != 0 {
+		t.Fatalf("Expired value returned %v", values)
+	}
+}
+
+func TestLastValueSubscribe(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3926"
+	cache := NewLastValueCache("Symbol", 16, time.Minute)
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	c := elvin.NewClient(url, nil, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	// Set once connected, as it applies to existing connections
+	router.SetLastValueCache(cache)
+
+	for _, price := range []int32{1, 2} {
+		if err := c.Notify(map[string]interface{}{"Symbol": "CBRO", "Price": price}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	for start := time.Now(); ; {
+		values := cache.Values()
+		if len(values) == 1 && values[0].NameValue["Price"] == int32(2) {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Notifications not cached: %v", values)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "Symbol == \"CBRO\""
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := c.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["Price"] != int32(2) {
+			t.Fatalf("Expected the last value, got %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Cached notification not delivered")
+	}
+}
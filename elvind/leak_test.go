@@ -0,0 +1,127 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Leak detection for lifecycle tests. Start it before the code under
+// test and defer the check:
+//
+//	defer checkLeaks(t)()
+//
+// The check waits up to a second for goroutines started since to
+// exit, then fails the test listing any still running, flagging those
+// blocked sending on a channel. Goroutines running beforehand, such
+// as the shared TestMain router's, aren't counted so this works
+// alongside other tests provided they don't run in parallel.
+func checkLeaks(t *testing.T) func() {
+	before := goroutines()
+	return func() {
+		var leaked []string
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			leaked = leaked[:0]
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+		}
+		for _, stack := range leaked {
+			if strings.Contains(stack, "[chan send") {
+				t.Errorf("Leaked goroutine blocked sending on a channel:\n%s", stack)
+			} else {
+				t.Errorf("Leaked goroutine:\n%s", stack)
+			}
+		}
+	}
+}
+
+// The stacks of all goroutines but our own keyed by their header,
+// e.g. "goroutine 7"
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[string]string)
+	for i, stack := range strings.Split(string(buf), "\n\n") {
+		if i == 0 {
+			continue // the caller
+		}
+		header := strings.SplitN(stack, " [", 2)[0]
+		stacks[header] = stack
+	}
+	return stacks
+}
+
+func TestClientLifecycleLeaks(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3917"
+	lc := elvin.NewClient(url, nil, nil, nil)
+	if err := lc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(TestLeaks)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}),
+	}
+	if err := lc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := lc.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+	if err := lc.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
+
+func TestRouterLifecycleLeaks(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3938"
+	router := startTestRouter(url, nil)
+	lc := elvin.NewClient(url, nil, nil, nil)
+	if err := lc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := lc.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	router.Stop()
+}
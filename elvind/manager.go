@@ -22,10 +22,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/cobaro/elvin/elog"
 	"github.com/cobaro/elvin/elvin"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -54,20 +56,42 @@ func main() {
 	manager.router.elog.Logf(elog.LogLevelInfo1, "Logging at log level %d", manager.router.elog.LogLevel())
 	manager.router.elog.SetLogDateFormat(elog.LogDateEpochMilli)
 	manager.router.elog.Logf(elog.LogLevelInfo2, "Loaded config:  %+v", *manager.config)
+	manager.router.SetShedIdle(manager.config.ShedIdle)
 	manager.router.SetMaxConnections(manager.config.MaxConnections)
+	manager.router.SetDropBelowPriority(manager.config.DropBelow)
+	manager.router.SetReadOnly(manager.config.ReadOnly)
+	manager.router.SetQuenchLimits(manager.config.MaxQuenchNames, manager.config.MaxConnectionQuenchNames)
+	manager.router.SetSubscriptionQuota(manager.config.MaxSubscriptions)
+	manager.router.SetBusy(manager.config.BusyThreshold, time.Duration(manager.config.BusyBackoff)*time.Millisecond)
+	manager.router.SetSlowDelivery(time.Duration(manager.config.SlowDelivery)*time.Millisecond, manager.config.SlowDeliveryLevel)
+	manager.router.SetAcceptPause(manager.config.AcceptPauseHigh, manager.config.AcceptPauseLow)
+	manager.router.SetRedelivery(time.Duration(manager.config.RedeliveryTimeout)*time.Millisecond,
+		manager.config.RedeliveryAttempts, manager.config.RedeliveryBuffer)
+	if err := manager.router.SetConnectionIDScheme(manager.config.ConnectionIDScheme); err != nil {
+		manager.router.elog.Logf(elog.LogLevelError, "%v", err)
+	}
+	manager.router.SetTransformErrorPass(manager.config.TransformErrorPass)
 	manager.router.SetDoFailover(manager.config.DoFailover)
 	manager.router.SetTestConnInterval(time.Duration(manager.config.TestConnInterval) * time.Second)
 	manager.router.SetTestConnTimeout(time.Duration(manager.config.TestConnTimeout) * time.Second)
-
-	manager.protocols = make(map[string]*elvin.Protocol)
-	for _, url := range manager.config.Protocols {
-		if protocol, e := elvin.URLToProtocol(url); e != nil {
-			manager.router.elog.Logf(elog.LogLevelWarning, "Can't convert url %s to protocol: %v", e)
-		} else {
-			manager.protocols[protocol.Address] = protocol
-			manager.router.AddProtocol(protocol.Address, protocol)
-		}
+	manager.router.SetHandshakeTimeout(time.Duration(manager.config.HandshakeTimeout) * time.Second)
+	manager.SetXdrLimits()
+	if tlsConfig, err := manager.config.tlsConfig(); err != nil {
+		manager.router.elog.Logf(elog.LogLevelError, "TLS configuration failed: %v", err)
+		os.Exit(1)
+	} else {
+		manager.router.SetTLSConfig(tlsConfig)
+	}
+	if len(manager.config.LastValueKey) > 0 {
+		manager.router.SetLastValueCache(NewLastValueCache(manager.config.LastValueKey, manager.config.LastValueSize, time.Duration(manager.config.LastValueTTL)*time.Second))
 	}
+	if manager.config.SessionTTL > 0 {
+		manager.router.SetSessions(NewSessions(time.Duration(manager.config.SessionTTL)*time.Second, manager.config.SessionBuffer))
+	}
+
+	manager.SetDeduplication()
+
+	manager.SetProtocols()
 
 	if manager.failover, err = elvin.URLToProtocol(manager.config.Failover); err != nil {
 		manager.router.SetFailoverProtocol(manager.failover)
@@ -78,15 +102,39 @@ func main() {
 	manager.router.elog.Logf(elog.LogLevelInfo1, "Start router")
 	go manager.router.Start()
 
+	if manager.config.SelfTest {
+		go func() {
+			time.Sleep(100 * time.Millisecond) // let the listeners start
+			for _, result := range manager.router.SelfTest(5 * time.Second) {
+				if result.Err != nil {
+					manager.router.elog.Logf(elog.LogLevelError, "Self test %v", result)
+				} else {
+					manager.router.elog.Logf(elog.LogLevelInfo1, "Self test %v", result)
+				}
+			}
+		}()
+	}
+
+	if len(manager.config.AdminAddress) > 0 {
+		go func() {
+			if err := manager.router.ServeAdmin(manager.config.AdminAddress); err != nil {
+				manager.router.elog.Logf(elog.LogLevelError, "Admin endpoint failed: %v", err)
+			}
+		}()
+	}
+
 	// Set up sigint handling and wait for one
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 
-	// FIXME: SIGUSR[12] not supported on windows. Bring this back
+	// Reload what we can at runtime on SIGHUP
+	signal.Notify(ch, syscall.SIGHUP)
+
+	// FIXME: SIGUSR2 not supported on windows. Bring this back
 	// via REST api at some point
 
-	// State reporting on SIGUSR1 (testing/debugging)
-	// signal.Notify(ch, syscall.SIGUSR1)
+	// State reporting on SIGUSR1, where there is one
+	notifyStateDump(ch)
 
 	// Failover on SIGUSR2 (testing)
 	// if manager.router.doFailover {
@@ -99,14 +147,174 @@ func main() {
 		switch sig {
 		case os.Interrupt:
 			manager.router.elog.Logf(elog.LogLevelInfo1, "Exiting on %v", sig)
-			// FIXME: Flush logs
-			// FIXME: wait group
-			os.Exit(0)
-			// case syscall.SIGUSR1:
-			// manager.router.LogClients()
+			if err := manager.Shutdown(time.Duration(manager.config.ShutdownTimeout) * time.Second); err != nil {
+				manager.router.elog.Logf(elog.LogLevelWarning, "Shutdown: %v", err)
+			}
+			return
+		case syscall.SIGHUP:
+			manager.Reload(*configFile)
 			// case syscall.SIGUSR2:
 			// manager.router.Failover()
+		default:
+			if isStateDump(sig) {
+				manager.DumpState()
+			}
+		}
+	}
+
+}
+
+// Reload the configuration file applying those settings that may be
+// changed at runtime. Nothing is applied if it fails. A new TLS
+// configuration is used by ssl protocols added from then on.
+func (manager *Manager) Reload(configFile string) (err error) {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		manager.router.elog.Logf(elog.LogLevelWarning, "config reload failed: %v", err)
+		return err
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		manager.router.elog.Logf(elog.LogLevelWarning, "config reload failed: TLS configuration: %v", err)
+		return err
+	}
+	manager.config = config
+	manager.router.elog.Logf(elog.LogLevelInfo1, "Reloaded config:  %+v", *manager.config)
+	manager.router.SetShedIdle(manager.config.ShedIdle)
+	manager.router.SetMaxConnections(manager.config.MaxConnections)
+	manager.router.SetDropBelowPriority(manager.config.DropBelow)
+	manager.router.SetReadOnly(manager.config.ReadOnly)
+	manager.router.SetQuenchLimits(manager.config.MaxQuenchNames, manager.config.MaxConnectionQuenchNames)
+	manager.router.SetSubscriptionQuota(manager.config.MaxSubscriptions)
+	manager.router.SetBusy(manager.config.BusyThreshold, time.Duration(manager.config.BusyBackoff)*time.Millisecond)
+	manager.router.SetSlowDelivery(time.Duration(manager.config.SlowDelivery)*time.Millisecond, manager.config.SlowDeliveryLevel)
+	manager.router.SetAcceptPause(manager.config.AcceptPauseHigh, manager.config.AcceptPauseLow)
+	manager.router.SetRedelivery(time.Duration(manager.config.RedeliveryTimeout)*time.Millisecond,
+		manager.config.RedeliveryAttempts, manager.config.RedeliveryBuffer)
+	if err := manager.router.SetConnectionIDScheme(manager.config.ConnectionIDScheme); err != nil {
+		manager.router.elog.Logf(elog.LogLevelError, "%v", err)
+	}
+	manager.router.SetTransformErrorPass(manager.config.TransformErrorPass)
+	manager.router.SetTLSConfig(tlsConfig)
+	manager.SetXdrLimits()
+	manager.SetProtocols()
+	return nil
+}
+
+// Write the router's state as JSON to the configured StateFile, or
+// if there isn't one, log the clients
+func (manager *Manager) DumpState() {
+	if len(manager.config.StateFile) == 0 {
+		manager.router.LogClients()
+		return
+	}
+	if err := manager.router.WriteState(manager.config.StateFile); err != nil {
+		manager.router.elog.Logf(elog.LogLevelWarning, "State dump to %s failed: %v", manager.config.StateFile, err)
+	} else {
+		manager.router.elog.Logf(elog.LogLevelInfo1, "State dumped to %s", manager.config.StateFile)
+	}
+}
+
+// Bring the router's protocols into line with the configuration,
+// removing those no longer listed and adding new ones. Those in both
+// are left alone so their listeners aren't disturbed, unless their
+// further addresses changed.
+func (manager *Manager) SetProtocols() {
+	if manager.protocols == nil {
+		manager.protocols = make(map[string]*elvin.Protocol)
+	}
+
+	wanted := make(map[string]*elvin.Protocol)
+	for _, url := range manager.config.Protocols {
+		if protocol, e := elvin.URLToProtocol(url); e != nil {
+			manager.router.elog.Logf(elog.LogLevelWarning, "Can't convert url %s to protocol: %v", url, e)
+		} else {
+			protocol.Socket = manager.config.Socket.Options()
+			protocol.Addresses = manager.config.ProtocolAddresses[url]
+			wanted[protocol.Address] = protocol
+		}
+	}
+
+	for address, existing := range manager.protocols {
+		if protocol, ok := wanted[address]; !ok || !sameAddresses(protocol.Addresses, existing.Addresses) {
+			if err := manager.router.RemoveProtocol(address); err != nil {
+				manager.router.elog.Logf(elog.LogLevelWarning, "Removing protocol %s failed: %v", address, err)
+			}
+			delete(manager.protocols, address)
+		}
+	}
+	for address, protocol := range wanted {
+		if _, ok := manager.protocols[address]; ok {
+			continue
+		}
+		if err := manager.router.AddProtocol(address, protocol); err != nil {
+			manager.router.elog.Logf(elog.LogLevelWarning, "Adding protocol %s failed: %v", address, err)
+		} else {
+			manager.protocols[address] = protocol
+		}
+	}
+}
+
+// Do two protocols serve the same further addresses?
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Set up duplicate suppression, router wide or for the configured
+// protocols
+func (manager *Manager) SetDeduplication() {
+	if manager.config.DedupSize <= 0 {
+		return
+	}
+	dedup := NewDeduplicator(manager.config.DedupKey, manager.config.DedupSize, time.Duration(manager.config.DedupWindow)*time.Millisecond)
+	if len(manager.config.DedupProtocols) == 0 {
+		manager.router.SetDeduplicator(dedup)
+		return
+	}
+	for _, url := range manager.config.DedupProtocols {
+		if protocol, err := elvin.URLToProtocol(url); err != nil {
+			manager.router.elog.Logf(elog.LogLevelWarning, "Can't convert dedup url %s to protocol: %v", url, err)
+		} else {
+			manager.router.SetProtocolDeduplicator(protocol.Address, dedup)
 		}
 	}
+}
+
+// Apply the configured decoding limits
+func (manager *Manager) SetXdrLimits() {
+	elvin.SetXdrLimits(elvin.XdrLimits{
+		MaxStringLength: manager.config.MaxStringLength,
+		MaxOpaqueLength: manager.config.MaxOpaqueLength,
+		MaxNameValues:   manager.config.MaxNameValues,
+		Lenient:         manager.config.XdrLenient})
+}
+
+// Shut down in order: stop accepting connections, tell the clients
+// we're going and wait for them to leave, then flush the logs. Any
+// clients still connected at the deadline are closed.
+func (manager *Manager) Shutdown(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+
+	manager.router.StopListeners()
+	manager.router.Stop()
+
+	for manager.router.ClientCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if remaining := manager.router.ClientCount(); remaining > 0 {
+		err = fmt.Errorf("%d clients still connected after %v", remaining, timeout)
+		manager.router.CloseClients()
+	}
 
+	manager.router.elog.Logf(elog.LogLevelInfo1, "Shutdown complete")
+	manager.router.elog.Flush()
+	return err
 }
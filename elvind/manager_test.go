@@ -0,0 +1,104 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestManagerShutdown(t *testing.T) {
+	url := "elvin://localhost:3927"
+	protocol, _ := elvin.URLToProtocol(url)
+	manager := new(Manager)
+	manager.router.AddProtocol(protocol.Address, protocol)
+	go manager.router.Start()
+	time.Sleep(time.Millisecond * 10) // Yield to get that started
+
+	c := elvin.NewClient(url, nil, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	// By the time we're told to go nobody new should get in
+	refused := make(chan bool, 1)
+	go func() {
+		<-c.Events
+		conn, err := net.Dial("tcp", "localhost:3927")
+		if err == nil {
+			conn.Close()
+		}
+		refused <- err != nil
+		c.Disconnect()
+	}()
+
+	start := time.Now()
+	if err := manager.Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown took %v", elapsed)
+	}
+	if !<-refused {
+		t.Fatalf("Connection accepted after Disconn")
+	}
+	if manager.router.ClientCount() != 0 {
+		t.Fatalf("Clients remain after shutdown")
+	}
+}
+
+func TestManagerProtocolAddresses(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3968"
+	manager := new(Manager)
+	manager.config = &Configuration{
+		Protocols:         []string{url},
+		ProtocolAddresses: map[string][]string{url: {"127.0.0.1:3969"}},
+	}
+	manager.SetProtocols()
+	go manager.router.Start()
+	defer manager.router.Stop()
+	time.Sleep(time.Millisecond * 10) // Yield to get that started
+
+	listening := func(address string) bool {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}
+	if !listening("localhost:3968") || !listening("127.0.0.1:3969") {
+		t.Fatalf("Not listening on every configured address")
+	}
+
+	// Changing the addresses on reload rebinds the protocol
+	manager.config.ProtocolAddresses = nil
+	manager.SetProtocols()
+	if !listening("localhost:3968") {
+		t.Fatalf("Not listening on the protocol's address")
+	}
+	if listening("127.0.0.1:3969") {
+		t.Fatalf("Still listening on a removed address")
+	}
+}
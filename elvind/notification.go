@@ -21,7 +21,10 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/cobaro/elvin/elvin"
+	"time"
 )
 
 // A notification inside the router needs some additional info from
@@ -32,4 +35,71 @@ type Notification struct {
 	NameValue       map[string]interface{}
 	DeliverInsecure bool
 	Keys            elvin.KeyBlock
+	Received        time.Time // When the router received it
+	Deadline        time.Time // Drop rather than deliver after this, zero for never
+	Order           []string  // NameValue's names as the producer sent them, if known
+}
+
+// Remove any TTL attribute from a notification returning the deadline
+// it implies, or the zero time if it has none
+func TakeDeadline(nv map[string]interface{}, received time.Time) (deadline time.Time) {
+	ttl, ok := nv[elvin.TTLAttribute]
+	if !ok {
+		return deadline
+	}
+	delete(nv, elvin.TTLAttribute)
+
+	var ms int64
+	switch ttl.(type) {
+	case int32:
+		ms = int64(ttl.(int32))
+	case int64:
+		ms = ttl.(int64)
+	}
+	if ms > 0 {
+		deadline = received.Add(time.Duration(ms) * time.Millisecond)
+	}
+	return deadline
+}
+
+// Attributes only the router may set on a delivery
+var routerAttributes = []string{elvin.DeliveryIDAttribute, elvin.MatchedKeyAttribute}
+
+// Remove any attributes only the router may set from a producer's
+// notification so they can't be forged
+func stripRouterAttributes(nv map[string]interface{}) {
+	for _, name := range routerAttributes {
+		delete(nv, name)
+	}
+}
+
+// Build a Nack refusing a notification to a read-only router
+func ReadOnlyNack(xID uint32) *elvin.Nack {
+	nack := new(elvin.Nack)
+	nack.XID = xID
+	nack.ErrorCode = elvin.ErrorsReadOnly
+	nack.Message = elvin.LocalErrors[nack.ErrorCode]
+	return nack
+}
+
+// Build the Nack for a notification that fails schema validation. The
+// schema error codes are local so the wire carries a request out of
+// bounds with the detail as its argument.
+func SchemaNack(xID uint32, err *elvin.SchemaError) *elvin.Nack {
+	nack := new(elvin.Nack)
+	nack.XID = xID
+	nack.ErrorCode = elvin.ErrorsQOSLimit
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	nack.Args = []interface{}{fmt.Sprintf(elvin.ElvinStringToFormatString(elvin.LocalErrors[err.ErrorCode]), err.Args...)}
+	return nack
+}
+
+// The number of bytes a notification's attributes take on the wire
+func EncodedSize(nv map[string]interface{}) (size int) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	elvin.XdrPutNotification(buf, nv)
+	size = buf.Len()
+	buf.Reset()
+	bufferPool.Put(buf)
+	return size
 }
@@ -21,8 +21,18 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/cobaro/elvin/elog"
 	"github.com/cobaro/elvin/elvin"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // I wanted to see how long it takes to create a router's Notification
@@ -35,7 +45,7 @@ func BenchmarkFillNotification(b *testing.B) {
 	var n Notification
 
 	for i := 0; i < b.N; i++ {
-		n = Notification{client.keysNfn, ne.NameValue, ne.DeliverInsecure, ne.Keys}
+		n = Notification{client.keysNfn, ne.NameValue, ne.DeliverInsecure, ne.Keys, time.Now(), time.Time{}, nil}
 	}
 	// Required to use n
 	if n.Keys == nil {
@@ -43,3 +53,737 @@ func BenchmarkFillNotification(b *testing.B) {
 	}
 
 }
+
+func TestNotificationSchema(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3920"
+	schema := &elvin.Schema{Required: map[string]int{"Count": elvin.NotificationInt32}}
+	router := startTestRouter(url, func(r *Router) { r.SetSchema(schema) })
+	defer router.Stop()
+
+	nc := elvin.NewClient(url, nil, nil, nil)
+	if err := nc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Disconnect()
+
+	// The router Nacks a non-conforming notification
+	events := make(chan elvin.Packet)
+	go func() { events <- <-nc.Events }()
+	if err := nc.Notify(map[string]interface{}{"Count": "one"}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		nack, ok := event.(*elvin.Nack)
+		if !ok || nack.ErrorCode != elvin.ErrorsQOSLimit || len(nack.Args) != 1 || !strings.Contains(nack.Args[0].(string), "Count") {
+			t.Fatalf("Expected schema Nack, got %v", event)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("No Nack for invalid notification")
+	}
+
+	// Dropping the schema applies to the open connection
+	router.SetSchema(nil)
+	sub := &elvin.Subscription{Expression: "Count == \"one\"", AcceptInsecure: true, Notifications: make(chan map[string]interface{}, 1)}
+	if err := nc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := nc.Notify(map[string]interface{}{"Count": "one"}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case <-sub.Notifications:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Notification rejected after schema removed")
+	}
+	if err := nc.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("SubscriptionDelete failed: %v", err)
+	}
+
+	// The client rejects it before sending
+	nc.Schema = schema
+	if err := nc.Notify(map[string]interface{}{}, true, nil); err == nil {
+		t.Fatalf("Notify of invalid notification passed")
+	}
+}
+
+func TestNotificationTTL(t *testing.T) {
+	router := new(Router)
+	router.Init()
+
+	// net.Pipe is unbuffered so a consumer that doesn't read quickly
+	// backs up the router
+	connect := func() *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	consumer := connect()
+	defer consumer.Disconnect()
+	producer := connect()
+	defer producer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TTLTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// Send more short lived notifications than can be queued while
+	// the consumer isn't reading, then one that never expires. The
+	// router backs up so the producer does too.
+	notified := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			nv := map[string]interface{}{"TTLTest": int32(i)}
+			elvin.SetTTL(nv, 50*time.Millisecond)
+			if err := producer.Notify(nv, true, nil); err != nil {
+				notified <- err
+				return
+			}
+		}
+		notified <- producer.Notify(map[string]interface{}{"TTLTest": int32(100)}, true, nil)
+	}()
+
+	// Let the queued ones' TTLs pass before the consumer starts
+	// reading
+	time.Sleep(200 * time.Millisecond)
+
+	seen := make(map[int32]bool)
+	for !seen[100] {
+		select {
+		case nv := <-sub.Notifications:
+			if _, ok := nv[elvin.TTLAttribute]; ok {
+				t.Fatalf("TTL attribute was delivered: %v", nv)
+			}
+			seen[nv["TTLTest"].(int32)] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Notification without a TTL not delivered, saw %v", seen)
+		}
+	}
+
+	if err := <-notified; err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	if len(seen) == 11 {
+		t.Fatalf("Notifications delivered after their TTL, saw %v", seen)
+	}
+	if router.ExpiredNotifications() == 0 {
+		t.Fatalf("No expired notifications counted")
+	}
+}
+
+func TestNotificationTTLQueued(t *testing.T) {
+	router := new(Router)
+	router.Init()
+
+	connect := func() *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	consumer := connect()
+	defer consumer.Disconnect()
+	producer := connect()
+	defer producer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TTLTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// More notifications than can be queued while the consumer
+	// isn't reading wait for room rather than expiring early
+	notified := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			nv := map[string]interface{}{"TTLTest": int32(i)}
+			elvin.SetTTL(nv, 10*time.Second)
+			if err := producer.Notify(nv, true, nil); err != nil {
+				notified <- err
+				return
+			}
+		}
+		notified <- nil
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 1; i <= 10; i++ {
+		select {
+		case <-sub.Notifications:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d of 10 notifications delivered", i-1)
+		}
+	}
+	if err := <-notified; err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	if expired := router.ExpiredNotifications(); expired != 0 {
+		t.Fatalf("%d notifications expired before their TTL", expired)
+	}
+}
+
+func TestPriorityDrop(t *testing.T) {
+	router := new(Router)
+	router.Init()
+	router.SetDropBelowPriority(0)
+
+	connect := func(priority int32) *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", map[string]interface{}{elvin.PriorityOption: priority}, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	subscribe := func(c *elvin.Client) *elvin.Subscription {
+		sub := new(elvin.Subscription)
+		sub.Expression = "require(PriorityTest)"
+		sub.AcceptInsecure = true
+		sub.Notifications = make(chan map[string]interface{}, 1)
+		if err := c.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed %v", err)
+		}
+		return sub
+	}
+	receive := func(sub *elvin.Subscription, what string) {
+		select {
+		case <-sub.Notifications:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s consumer got nothing", what)
+		}
+	}
+	low := connect(-1)
+	defer low.Disconnect()
+	low.AnomalyChannel = make(chan elvin.Anomaly, 1)
+	high := connect(1)
+	defer high.Disconnect()
+	producer := connect(0)
+	defer producer.Disconnect()
+	// Deleting the subscriptions before disconnecting stops any
+	// delivery nobody's taking from holding up the Disconnect
+	lowSub := subscribe(low)
+	defer low.SubscriptionDelete(lowSub)
+	highSub := subscribe(high)
+	defer high.SubscriptionDelete(highSub)
+
+	// Neither consumer reads so both back up, but the router only
+	// waits for the high priority one
+	const count = 50
+	go func() {
+		for i := 0; i < count; i++ {
+			producer.Notify(map[string]interface{}{"PriorityTest": int32(i)}, true, nil)
+		}
+	}()
+	for i := 0; i < count; i++ {
+		select {
+		case <-highSub.Notifications:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("High priority consumer only got %d of %d", i, count)
+		}
+	}
+
+	// Every notification is either delivered to or dropped for the
+	// low priority consumer
+	lowCount := 0
+	deadline := time.After(2 * time.Second)
+	for uint64(lowCount)+router.DroppedNotifications() < count {
+		select {
+		case <-lowSub.Notifications:
+			lowCount++
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("Low priority consumer got %d, %d dropped, of %d", lowCount, router.DroppedNotifications(), count)
+		}
+	}
+	if lowCount >= count {
+		t.Fatalf("Low priority consumer missed nothing")
+	}
+	if router.DroppedNotifications() != uint64(count-lowCount) {
+		t.Fatalf("Dropped %d, low priority consumer missed %d", router.DroppedNotifications(), count-lowCount)
+	}
+
+	// The warning precedes the next delivery
+	producer.Notify(map[string]interface{}{"PriorityTest": int32(count)}, true, nil)
+	receive(highSub, "High priority")
+	receive(lowSub, "Low priority")
+	select {
+	case anomaly := <-low.AnomalyChannel:
+		if anomaly.Type != elvin.AnomalyDropWarn {
+			t.Fatalf("Expected a DropWarn, got %v", anomaly)
+		}
+	default:
+		t.Fatalf("Low priority consumer wasn't warned")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3937"
+	router := startTestRouter(url, func(r *Router) { r.SetReadOnly(true) })
+	defer router.Stop()
+
+	nc := elvin.NewClient(url, nil, nil, nil)
+	if err := nc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestReadOnly)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{}, 2)
+	if err := nc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// A client's notification is Nacked
+	events := make(chan elvin.Packet, 1)
+	go func() { events <- <-nc.Events }()
+	if err := nc.Notify(map[string]interface{}{"TestReadOnly": "client"}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		nack, ok := event.(*elvin.Nack)
+		if !ok || nack.ErrorCode != elvin.ErrorsReadOnly {
+			t.Fatalf("Expected read-only Nack, got %v", event)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("No Nack for notification to a read-only router")
+	}
+
+	// A peer's is delivered
+	router.Forward(map[string]interface{}{"TestReadOnly": "peer"}, true, nil)
+	select {
+	case nv := <-sub.Notifications:
+		if nv["TestReadOnly"] != "peer" {
+			t.Fatalf("Expected the peer's notification, got %v", nv)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Forwarded notification not delivered")
+	}
+
+	// Turning it off applies to the existing connection
+	router.SetReadOnly(false)
+	if err := nc.Notify(map[string]interface{}{"TestReadOnly": "writable"}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["TestReadOnly"] != "writable" {
+			t.Fatalf("Expected the client's notification, got %v", nv)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Notification not delivered once writable")
+	}
+}
+
+// An authorizer holding up notifications until released
+type gatedAuthorizer struct {
+	AllowAll
+	gate chan bool
+}
+
+func (auth gatedAuthorizer) AuthorizeNotify(info ConnInfo, nv map[string]interface{}) error {
+	<-auth.gate
+	return nil
+}
+
+func TestFlowControlCredits(t *testing.T) {
+	defer checkLeaks(t)()
+
+	gate := make(chan bool)
+	url := "elvin://localhost:3942"
+	router := startTestRouter(url, func(r *Router) { r.SetAuthorizer(gatedAuthorizer{gate: gate}) })
+	defer router.Stop()
+
+	consumer := elvin.NewClient(url, nil, nil, nil)
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{Expression: "require(Credit)", AcceptInsecure: true}
+	sub.Notifications = make(chan map[string]interface{}, 64)
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	const window, count = 4, 20
+	producer := elvin.NewClient(url, nil, nil, nil)
+	producer.CreditWindow = window
+	producer.SetWriteQueueSize(count)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if producer.CreditsAvailable() != window {
+		t.Fatalf("Expected a window of %d, got %d", window, producer.CreditsAvailable())
+	}
+	for i := 0; i < count; i++ {
+		if err := producer.Notify(map[string]interface{}{"Credit": int32(i)}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+
+	// With the router stalled the producer holds on to all but a
+	// window's worth
+	time.Sleep(50 * time.Millisecond)
+	if producer.CreditsAvailable() != 0 {
+		t.Fatalf("Producer still has %d credits", producer.CreditsAvailable())
+	}
+	if depth := producer.WriteQueueDepth(); depth != count-window {
+		t.Fatalf("Expected %d queued, got %d", count-window, depth)
+	}
+
+	close(gate)
+	for i := 0; i < count; i++ {
+		select {
+		case nfn := <-sub.Notifications:
+			if nfn["Credit"] != int32(i) {
+				t.Fatalf("Expected notification %d, got %v", i, nfn)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Consumer only got %d of %d", i, count)
+		}
+	}
+	if producer.WriteQueueDepth() != 0 {
+		t.Fatalf("Producer still has %d queued", producer.WriteQueueDepth())
+	}
+
+	// A client that doesn't ask runs without
+	if consumer.CreditsAvailable() != -1 {
+		t.Fatalf("Consumer has credits: %d", consumer.CreditsAvailable())
+	}
+
+	// and one asking for too much gets the most we grant
+	greedy := elvin.NewClient(url, nil, nil, nil)
+	greedy.CreditWindow = 1 << 20
+	if err := greedy.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if greedy.CreditsAvailable() != MaxCreditWindow {
+		t.Fatalf("Expected a window of %d, got %d", MaxCreditWindow, greedy.CreditsAvailable())
+	}
+	greedy.Disconnect()
+
+	producer.Disconnect()
+	consumer.Disconnect()
+}
+
+func TestNotifyStream(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3950"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(Stream)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 16),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	records := `{"Stream": 1, "Name": "one"}
+{"Stream": 2, "Name": "two"}
+not json
+
+{"Stream": 3, "Valid": false}
+{"Stream": 4, "Name": "four"}
+{"Stream": 5, "Name": "five"}
+{"Stream": 6, "Name": "six"}
+`
+	decode := func(record []byte) (nv map[string]interface{}, err error) {
+		err = json.Unmarshal(record, &nv)
+		return nv, err
+	}
+
+	opts := elvin.StreamOptions{DeliverInsecure: true, BatchSize: 2, OnError: elvin.StreamSkipErrors}
+	stats, err := ec.NotifyStream(strings.NewReader(records), decode, opts)
+	if err != nil || stats.Sent != 5 || stats.Skipped != 2 {
+		t.Fatalf("Expected 5 sent and 2 skipped, got %+v %v", stats, err)
+	}
+	for _, expected := range []float64{1, 2, 4, 5, 6} {
+		select {
+		case nv := <-sub.Notifications:
+			if nv["Stream"] != expected {
+				t.Fatalf("Expected record %v got %v", expected, nv)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Record %v wasn't delivered", expected)
+		}
+	}
+
+	// Stopping at the first bad record
+	opts.OnError = elvin.StreamStopOnError
+	stats, err = ec.NotifyStream(strings.NewReader(records), decode, opts)
+	if err == nil || stats.Sent != 2 {
+		t.Fatalf("Expected to stop after 2 sent, got %+v %v", stats, err)
+	}
+	ec.Disconnect()
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3955"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	producer := elvin.NewClient(url, nil, nil, nil)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer producer.Disconnect()
+
+	const count = 200
+	for _, order := range []string{elvin.DeliveryOrderFIFO, elvin.DeliveryOrderSubscription} {
+		consumer := elvin.NewClient(url, nil, nil, nil)
+		consumer.Options = map[string]interface{}{elvin.DeliveryOrderOption: order}
+		if err := consumer.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+
+		// Both subscriptions share a channel so it sees the
+		// connection's order
+		received := make(chan map[string]interface{}, count)
+		for _, expr := range []string{"Order == 0", "Order == 1"} {
+			sub := &elvin.Subscription{Expression: expr, AcceptInsecure: true, Notifications: received}
+			if err := consumer.Subscribe(sub); err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+		}
+
+		for seq := 0; seq < count; seq++ {
+			nv := map[string]interface{}{"Order": int32(seq % 2), "Seq": int32(seq)}
+			if err := producer.Notify(nv, true, nil); err != nil {
+				t.Fatalf("Notify failed: %v", err)
+			}
+		}
+
+		last := []int32{-1, -1}
+		for i := 0; i < count; i++ {
+			select {
+			case nv := <-received:
+				seq := nv["Seq"].(int32)
+				switch {
+				case order == elvin.DeliveryOrderFIFO && seq != int32(i):
+					t.Fatalf("FIFO delivery %d was %d", i, seq)
+				case seq <= last[seq%2]:
+					t.Fatalf("%s delivery %d after %d", order, seq, last[seq%2])
+				}
+				last[seq%2] = seq
+			case <-time.After(time.Second):
+				t.Fatalf("%s delivery %d missing", order, i)
+			}
+		}
+		consumer.Disconnect()
+	}
+}
+
+func TestRouterBusy(t *testing.T) {
+	router := new(Router)
+	router.Init()
+
+	connect := func() *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	consumer := connect()
+	defer consumer.Disconnect()
+	flood := connect()
+	defer flood.Disconnect()
+	producer := connect()
+	defer producer.Disconnect()
+	producer.AnomalyChannel = make(chan elvin.Anomaly, 1)
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(BusyTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// Set once connected, as it applies to existing connections
+	router.SetBusy(1, 250*time.Millisecond)
+
+	// The consumer doesn't read so the engine backs up behind it
+	flooded := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			flood.Notify(map[string]interface{}{"BusyTest": int32(i)}, true, nil)
+		}
+		close(flooded)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(router.channels.pending) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The engine didn't back up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := producer.Notify(map[string]interface{}{"BusyTest": int32(-1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	select {
+	case anomaly := <-producer.AnomalyChannel:
+		if anomaly.Type != elvin.AnomalyRouterBusy {
+			t.Fatalf("Expected busy, got %v", anomaly)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Producer wasn't told the router is busy")
+	}
+	if backoff := producer.Busy(); backoff <= 0 || backoff > 250*time.Millisecond {
+		t.Fatalf("Unexpected back-off %v", backoff)
+	}
+	err := producer.Notify(map[string]interface{}{"BusyTest": int32(-2)}, true, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsRouterBusy)) {
+		t.Fatalf("Expected router busy, got %v", err)
+	}
+
+	// Let everything drain
+	go func() {
+		for {
+			select {
+			case <-sub.Notifications:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}()
+	<-flooded
+}
+
+func TestSlowDelivery(t *testing.T) {
+	router := new(Router)
+	router.Init()
+	router.SetSlowDelivery(20*time.Millisecond, elog.LogLevelWarning)
+
+	var mu sync.Mutex
+	var slow []string
+	router.elog.SetLogLevel(elog.LogLevelWarning)
+	router.elog.SetLogFunc(func(w io.Writer, format string, a ...interface{}) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		line := fmt.Sprintf(format, a...)
+		if strings.Contains(line, "Slow delivery") {
+			slow = append(slow, line)
+		}
+		return len(line), nil
+	})
+
+	connect := func() *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+	consumer := connect()
+	defer consumer.Disconnect()
+	producer := connect()
+	defer producer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(SlowTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// Enough to fill the consumer's queue, which it's slow to drain
+	const count = 10
+	go func() {
+		for i := 0; i < count; i++ {
+			producer.Notify(map[string]interface{}{"SlowTest": int32(i)}, true, nil)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		select {
+		case <-sub.Notifications:
+		case <-time.After(time.Second):
+			t.Fatalf("Consumer only got %d of %d", i, count)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(slow) == 0 {
+		t.Fatalf("Slow delivery not logged")
+	}
+	if expected := fmt.Sprintf("insecure [%d]", sub.SubID()); !strings.Contains(slow[0], expected) {
+		t.Fatalf("Expected %q in %q", expected, slow[0])
+	}
+}
+
+func TestOrderedNotification(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3974"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	nc := elvin.NewClient(url, nil, nil, nil)
+	if err := nc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Disconnect()
+
+	ordered := &elvin.Subscription{Expression: "require(Ordered)", AcceptInsecure: true}
+	ordered.Ordered = make(chan []elvin.NameValuePair, 1)
+	if err := nc.Subscribe(ordered); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer nc.SubscriptionDelete(ordered)
+
+	// Enough names that a map's order would give them away
+	var pairs []elvin.NameValuePair
+	for i, name := range []string{"Ordered", "z", "a", "y", "b", "x", "c", "w"} {
+		pairs = append(pairs, elvin.NameValuePair{Name: name, Value: int32(i)})
+	}
+	if err := nc.NotifyOrdered(pairs, true, nil); err != nil {
+		t.Fatalf("NotifyOrdered failed: %v", err)
+	}
+
+	select {
+	case received := <-ordered.Ordered:
+		if !reflect.DeepEqual(received, pairs) {
+			t.Fatalf("Expected %v, got %v", pairs, received)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Ordered subscription got nothing")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elvin"
+	"time"
+)
+
+// Queue a NotifyDeliver to a client that asked for
+// elvin.DeliveryOrderSubscription, split into a delivery per
+// subscription
+func (router *Router) deliverUnordered(client *Client, deliver *elvin.NotifyDeliver, deadline time.Time) {
+	queue := func(single *elvin.NotifyDeliver) {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		single.Encode(buf)
+		router.enqueue(client, buf, deadline)
+	}
+	for _, subID := range deliver.Secure {
+		queue(&elvin.NotifyDeliver{NameValue: deliver.NameValue, Secure: []int64{subID}, Order: deliver.Order})
+	}
+	for _, subID := range deliver.Insecure {
+		queue(&elvin.NotifyDeliver{NameValue: deliver.NameValue, Insecure: []int64{subID}, Order: deliver.Order})
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"net"
+	"sync"
+	"time"
+)
+
+// A link to a peer router, forwarding it the notifications our clients
+// send. We connect to the peer as a client of its own. While the link
+// is down notifications are held in a PeerQueue and sending is retried
+// until it comes back.
+type Peer struct {
+	URL  string
+	Dial func(network, address string) (net.Conn, error) // net.Dial if nil
+
+	client *elvin.Client
+	queue  *PeerQueue
+	done   chan bool
+}
+
+// Create a link to the router at url, holding up to size notifications
+// while it's down and retrying every retry interval
+func NewPeer(url string, size int, retry time.Duration) *Peer {
+	peer := new(Peer)
+	peer.URL = url
+	peer.client = elvin.NewClient(url, nil, nil, nil)
+	// Reconnecting is left to the queue rather than the client
+	peer.client.Events = make(chan elvin.Packet, 16)
+	peer.done = make(chan bool)
+	peer.queue = NewPeerQueue(peer.send, size, retry)
+	go peer.ignoreEvents()
+	return peer
+}
+
+// Queue a notification for the peer. It never blocks.
+func (peer *Peer) Put(nfn Notification) {
+	peer.queue.Put(nfn)
+}
+
+// Is the link up?
+func (peer *Peer) Connected() bool {
+	return peer.client.State() == elvin.StateConnected
+}
+
+// The number of notifications waiting for the link
+func (peer *Peer) Pending() int {
+	return peer.queue.Len()
+}
+
+// The number of notifications dropped as too many were waiting
+func (peer *Peer) Dropped() uint64 {
+	return peer.queue.Dropped()
+}
+
+// Close the link. Anything pending is discarded.
+func (peer *Peer) Stop() {
+	peer.queue.Stop()
+	close(peer.done)
+	if peer.Connected() {
+		peer.client.Disconnect()
+	}
+}
+
+// Send a notification, connecting first if the link is down
+func (peer *Peer) send(nfn Notification) error {
+	if !peer.Connected() {
+		peer.client.Dial = peer.Dial
+		if err := peer.client.Connect(); err != nil {
+			return err
+		}
+	}
+	return peer.client.Notify(nfn.NameValue, nfn.DeliverInsecure, nfn.Keys)
+}
+
+// Drain the client's connection events, which would otherwise see it
+// reconnect or exit
+func (peer *Peer) ignoreEvents() {
+	for {
+		select {
+		case <-peer.client.Events:
+		case <-peer.done:
+			return
+		}
+	}
+}
+
+// Forward our clients' notifications to a peer, starting with the next
+// one. It applies to existing connections too. Notifications the peer
+// forwards us aren't sent back.
+func (router *Router) AddPeer(peer *Peer) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	peers := make([]*Peer, len(router.peers), len(router.peers)+1)
+	copy(peers, router.peers)
+	router.peers = append(peers, peer)
+}
+
+// The peers notifications are forwarded to
+func (router *Router) Peers() []*Peer {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.peers
+}
+
+// Remove and stop the peers, as the router stops
+func (router *Router) stopPeers() {
+	router.Mu.Lock()
+	peers := router.peers
+	router.peers = nil
+	router.Mu.Unlock()
+	for _, peer := range peers {
+		peer.Stop()
+	}
+}
+
+// An outbound buffer for notifications forwarded to a peer router.
+// Put never blocks the source: while the link is down notifications
+// are held, oldest dropped first once size is reached, and sending
+// is retried every retry interval until it succeeds.
+type PeerQueue struct {
+	send  func(nfn Notification) error
+	size  int
+	retry time.Duration
+
+	mu      sync.Mutex
+	pending []Notification
+	dropped uint64
+	ready   chan bool
+	done    chan bool
+	exited  chan bool
+}
+
+// Create a queue delivering with send and start it
+func NewPeerQueue(send func(nfn Notification) error, size int, retry time.Duration) *PeerQueue {
+	q := new(PeerQueue)
+	q.send = send
+	q.size = size
+	q.retry = retry
+	q.ready = make(chan bool, 1)
+	q.done = make(chan bool)
+	q.exited = make(chan bool)
+	go q.run()
+	return q
+}
+
+// Queue a notification for the peer
+func (q *PeerQueue) Put(nfn Notification) {
+	q.mu.Lock()
+	if len(q.pending) >= q.size {
+		q.pending = q.pending[1:]
+		q.dropped++
+	}
+	q.pending = append(q.pending, nfn)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// The number of notifications waiting to be sent
+func (q *PeerQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// The number of notifications dropped as the queue was full
+func (q *PeerQueue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// Stop sending, waiting for a send in progress. Anything pending is
+// discarded.
+func (q *PeerQueue) Stop() {
+	close(q.done)
+	<-q.exited
+}
+
+func (q *PeerQueue) run() {
+	defer close(q.exited)
+	for {
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		}
+
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			nfn := q.pending[0]
+			dropped := q.dropped
+			q.mu.Unlock()
+
+			if err := q.send(nfn); err != nil {
+				// Link is down, hold on to it and try again
+				select {
+				case <-time.After(q.retry):
+				case <-q.done:
+					return
+				}
+				continue
+			}
+
+			// Sent, unless it was pushed out while we were sending
+			q.mu.Lock()
+			if q.dropped == dropped {
+				q.pending = q.pending[1:]
+			}
+			q.mu.Unlock()
+		}
+	}
+}
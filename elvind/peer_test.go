@@ -0,0 +1,185 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"github.com/cobaro/elvin/elvin"
+	"github.com/cobaro/elvin/memtransport"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerQueueBounce(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	var sent []int32
+	send := func(nfn Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return errors.New("link down")
+		}
+		sent = append(sent, nfn.NameValue["n"].(int32))
+		return nil
+	}
+
+	q := NewPeerQueue(send, 5, 10*time.Millisecond)
+	defer q.Stop()
+
+	// The link is down so these pile up
+	for i := int32(0); i < 10; i++ {
+		q.Put(Notification{NameValue: map[string]interface{}{"n": i}})
+	}
+	if q.Dropped() != 5 || q.Len() != 5 {
+		t.Fatalf("Expected 5 held and 5 dropped, got %d and %d", q.Len(), q.Dropped())
+	}
+
+	// Reconnect
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	for i := 0; i < 100 && q.Len() > 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 5 {
+		t.Fatalf("Expected 5 delivered after reconnect, got %v", sent)
+	}
+	for i, n := range sent {
+		if n != int32(i+5) {
+			t.Fatalf("Expected the newest 5 in order, got %v", sent)
+		}
+	}
+}
+
+func TestPeerBounce(t *testing.T) {
+	defer checkLeaks(t)()
+
+	newRouter := func() *Router {
+		router := new(Router)
+		router.SetTestConnInterval(10 * time.Second)
+		router.SetTestConnTimeout(10 * time.Second)
+		router.Start()
+		return router
+	}
+	connect := func(router *Router) *elvin.Client {
+		clientEnd, routerEnd := net.Pipe()
+		router.Serve(routerEnd)
+		c := elvin.NewClient("elvin://", nil, nil, nil)
+		if err := c.ConnectOver(clientEnd); err != nil {
+			t.Fatalf("ConnectOver failed: %v", err)
+		}
+		return c
+	}
+
+	// The far router listens in memory so we can cut the link
+	far := newRouter()
+	defer far.Stop()
+	listener := memtransport.Listen("peer")
+	go far.ServeListener("memory", listener)
+
+	consumer := connect(far)
+	defer consumer.Disconnect()
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(PeerTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	receive := func(expected int32) {
+		select {
+		case nv := <-sub.Notifications:
+			if nv["PeerTest"] != expected {
+				t.Fatalf("Expected %d, got %v", expected, nv)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Nothing forwarded, expected %d", expected)
+		}
+	}
+
+	near := newRouter()
+	defer near.Stop()
+	producer := connect(near)
+	defer producer.Disconnect()
+
+	const size = 5
+	var mu sync.Mutex
+	up := true
+	var link net.Conn
+	peer := NewPeer("elvin://peer", size, 10*time.Millisecond)
+	peer.Dial = func(network, address string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return nil, errors.New("link down")
+		}
+		var err error
+		link, err = listener.Dial(network, address)
+		return link, err
+	}
+	near.AddPeer(peer)
+
+	producer.Notify(map[string]interface{}{"PeerTest": int32(-1)}, true, nil)
+	receive(-1)
+
+	// Cut the link and keep it down
+	mu.Lock()
+	up = false
+	link.Close()
+	mu.Unlock()
+	for start := time.Now(); peer.Connected(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Peer link didn't go down")
+		}
+	}
+
+	const count = 2 * size
+	for i := int32(0); i < count; i++ {
+		producer.Notify(map[string]interface{}{"PeerTest": i}, true, nil)
+	}
+	for start := time.Now(); peer.Dropped() < count-size; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected %d dropped, got %d", count-size, peer.Dropped())
+		}
+	}
+	if peer.Pending() != size {
+		t.Fatalf("Expected %d pending, got %d", size, peer.Pending())
+	}
+
+	// The newest size are delivered once it's back
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	for i := int32(count - size); i < count; i++ {
+		receive(i)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		t.Fatalf("Unexpected %v", nv)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
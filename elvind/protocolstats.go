@@ -0,0 +1,90 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Connection counts for one listening address
+type ProtocolStats struct {
+	Accepts  uint64 // Connections accepted
+	Rejects  uint64 // Connections refused at MaxConnections
+	Active   int64  // Connections currently open
+	BytesIn  uint64 // Including frame headers
+	BytesOut uint64
+}
+
+// The live counters behind ProtocolStats, updated atomically
+type protocolCounters struct {
+	accepts  uint64
+	rejects  uint64
+	active   int64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// Get (creating if need be) the counters for a listening address
+func (router *Router) protocolCounters(address string) *protocolCounters {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.protocolStats == nil {
+		router.protocolStats = make(map[string]*protocolCounters)
+	}
+	counters, ok := router.protocolStats[address]
+	if !ok {
+		counters = new(protocolCounters)
+		router.protocolStats[address] = counters
+	}
+	return counters
+}
+
+// A snapshot of connection counts keyed by listening address.
+// Connections passed directly to Serve aren't counted.
+func (router *Router) ProtocolStats() map[string]ProtocolStats {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	stats := make(map[string]ProtocolStats)
+	for address, counters := range router.protocolStats {
+		stats[address] = ProtocolStats{
+			Accepts:  atomic.LoadUint64(&counters.accepts),
+			Rejects:  atomic.LoadUint64(&counters.rejects),
+			Active:   atomic.LoadInt64(&counters.active),
+			BytesIn:  atomic.LoadUint64(&counters.bytesIn),
+			BytesOut: atomic.LoadUint64(&counters.bytesOut),
+		}
+	}
+	return stats
+}
+
+// Count bytes read by a client, if it came from one of our listeners
+func (client *Client) countIn(n int) {
+	if client.counters != nil {
+		atomic.AddUint64(&client.counters.bytesIn, uint64(n))
+	}
+}
+
+// Count bytes written to a client
+func (client *Client) countOut(n int) {
+	if client.counters != nil {
+		atomic.AddUint64(&client.counters.bytesOut, uint64(n))
+	}
+}
@@ -22,6 +22,7 @@ package main
 
 import (
 	"github.com/cobaro/elvin/elvin"
+	"sort"
 )
 
 // A quench
@@ -30,4 +31,95 @@ type Quench struct {
 	DeliverInsecure bool
 	Keys            elvin.KeyBlock
 	Names           map[string]bool // easy insert/delete, values irrelevant
+	All             bool            // Wildcard, requested with no names
+	NotifySelf      bool            // Include the owner's own subscriptions
+}
+
+// A quench as listed by QuenchTable
+type QuenchEntry struct {
+	QuenchID        int64
+	ClientID        int32    // The owning connection
+	Names           []string // Sorted, empty for a wildcard
+	All             bool
+	NotifySelf      bool
+	DeliverInsecure bool
+	Keyed           bool // Has keys, which aren't listed
+}
+
+// A snapshot of every client's quenches, ordered by QuenchID
+func (router *Router) QuenchTable() (table []QuenchEntry) {
+	for _, c := range router.clientList() {
+		c.quenchMu.RLock()
+		for _, quench := range c.quenches {
+			entry := QuenchEntry{
+				QuenchID:        quench.QuenchID,
+				ClientID:        c.ID(),
+				All:             quench.All,
+				NotifySelf:      quench.NotifySelf,
+				DeliverInsecure: quench.DeliverInsecure,
+				Keyed:           !elvin.KeyBlockEmpty(quench.Keys),
+			}
+			for name := range quench.Names {
+				entry.Names = append(entry.Names, name)
+			}
+			sort.Strings(entry.Names)
+			table = append(table, entry)
+		}
+		c.quenchMu.RUnlock()
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].QuenchID < table[j].QuenchID })
+	return table
+}
+
+// The client that owns a quench or subscription id
+func ownerID(id int64) int32 {
+	return int32(id >> 32)
+}
+
+// Is a subscription referencing names of interest to this quench?
+func (quench *Quench) Matches(names map[string]bool) bool {
+	if quench.All {
+		return true
+	}
+	for name := range names {
+		if quench.Names[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the owner of this quench may be told about sub and if so
+// whether that's secure. The quench acts as a producer, with its
+// owner's connection keys pKeys, and the subscription as a consumer
+// with its owner's connection keys cKeys.
+func (quench *Quench) Authorized(sub *Subscription, pKeys, cKeys elvin.KeyBlock) (ok bool, secure bool) {
+	if quench.DeliverInsecure && sub.AcceptInsecure {
+		return true, false
+	}
+	nfn := Notification{Keys: quench.Keys}
+	if _, ok = SecureMatchingKey(nfn, *sub, pKeys, cKeys); ok {
+		return true, true
+	}
+	return false, false
+}
+
+// A Nack if a quench of names names, replacing one of previous names,
+// would exceed the client's per quench or per connection limits,
+// otherwise nil
+func (client *Client) quenchLimitNack(xID uint32, names int, previous int) *elvin.Nack {
+	maxNames, maxConnectionNames := client.quenchLimits()
+	nack := new(elvin.Nack)
+	nack.XID = xID
+	switch {
+	case maxNames > 0 && names > maxNames:
+		nack.ErrorCode = elvin.ErrorsImplementationLimit
+	case maxConnectionNames > 0 && client.quenchNames-previous+names > maxConnectionNames:
+		nack.ErrorCode = elvin.ErrorsQOSLimit
+		nack.Args = []interface{}{"quench names per connection"}
+	default:
+		return nil
+	}
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	return nack
 }
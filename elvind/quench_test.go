@@ -0,0 +1,360 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuenchWildcard(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3923"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	qc := elvin.NewClient(url, nil, nil, nil)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer qc.Disconnect()
+
+	sc := elvin.NewClient(url, nil, nil, nil)
+	if err := sc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Disconnect()
+
+	named := new(elvin.Quench)
+	named.Names = map[string]bool{"Price": true}
+	named.DeliverInsecure = true
+	named.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(named); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	all := new(elvin.Quench)
+	all.All = true
+	all.DeliverInsecure = true
+	all.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(all); err != nil {
+		t.Fatalf("Wildcard quench failed: %v", err)
+	}
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "Volume > 10"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := sc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	select {
+	case <-all.Notifications:
+	case <-time.After(time.Second):
+		t.Fatalf("Wildcard quench missed the subscription")
+	}
+
+	if err := sc.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("SubscriptionDelete failed: %v", err)
+	}
+	select {
+	case <-all.Notifications:
+	case <-time.After(time.Second):
+		t.Fatalf("Wildcard quench missed the subscription delete")
+	}
+
+	select {
+	case qn := <-named.Notifications:
+		t.Fatalf("Named quench saw an unrelated subscription: %+v", qn)
+	default:
+	}
+}
+
+func TestQuenchNotifySelf(t *testing.T) {
+	url := "elvin://localhost:3932"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	qc := elvin.NewClient(url, nil, nil, nil)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer qc.Disconnect()
+
+	// Naming the pseudo-name doesn't turn NotifySelf on
+	others := new(elvin.Quench)
+	others.Names = map[string]bool{"Price": true, elvin.QuenchNotifySelfName: true}
+	others.DeliverInsecure = true
+	others.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(others); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	self := new(elvin.Quench)
+	self.Names = map[string]bool{"Price": true}
+	self.NotifySelf = true
+	self.DeliverInsecure = true
+	self.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(self); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	// Our own subscription
+	sub := new(elvin.Subscription)
+	sub.Expression = "Price > 10"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := qc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	select {
+	case <-self.Notifications:
+	case <-time.After(time.Second):
+		t.Fatalf("NotifySelf quench missed our subscription")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case qn := <-others.Notifications:
+		t.Fatalf("Quench saw its owner's subscription: %+v", qn)
+	default:
+	}
+
+	// Someone else's
+	sc := elvin.NewClient(url, nil, nil, nil)
+	if err := sc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Disconnect()
+	other := new(elvin.Subscription)
+	other.Expression = "Price < 5"
+	other.AcceptInsecure = true
+	other.Notifications = make(chan map[string]interface{})
+	if err := sc.Subscribe(other); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	select {
+	case <-others.Notifications:
+	case <-time.After(time.Second):
+		t.Fatalf("Quench missed another client's subscription")
+	}
+}
+
+func TestQuenchNameLimits(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3949"
+	router := startTestRouter(url, func(r *Router) { r.SetQuenchLimits(3, 5) })
+	defer router.Stop()
+
+	qc := elvin.NewClient(url, nil, nil, nil)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer qc.Disconnect()
+
+	nacked := func(err error, code int) bool {
+		return err != nil && strings.HasPrefix(err.Error(), fmt.Sprintf("[%d]", code))
+	}
+	quench := func(names ...string) *elvin.Quench {
+		q := &elvin.Quench{Names: make(map[string]bool), DeliverInsecure: true}
+		for _, name := range names {
+			q.Names[name] = true
+		}
+		return q
+	}
+
+	// Too many in one quench
+	if err := qc.Quench(quench("a", "b", "c", "d")); !nacked(err, elvin.ErrorsImplementationLimit) {
+		t.Fatalf("Expected an implementation limit Nack, got %v", err)
+	}
+
+	// Within the per quench limit but too many across the connection
+	first := quench("a", "b", "c")
+	if err := qc.Quench(first); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+	if err := qc.Quench(quench("d", "e", "f")); !nacked(err, elvin.ErrorsQOSLimit) {
+		t.Fatalf("Expected a QoS limit Nack, got %v", err)
+	}
+	if err := qc.Quench(quench("d", "e")); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	// Modifications count too, and freeing names makes room
+	if err := qc.QuenchModify(first, map[string]bool{"x": true}, nil, true, nil, nil); !nacked(err, elvin.ErrorsImplementationLimit) {
+		t.Fatalf("Expected an implementation limit Nack, got %v", err)
+	}
+	if err := qc.QuenchModify(first, map[string]bool{"x": true}, map[string]bool{"a": true, "b": true}, true, nil, nil); err != nil {
+		t.Fatalf("QuenchModify failed: %v", err)
+	}
+	if err := qc.Quench(quench("y")); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+	if err := qc.Quench(quench("z")); !nacked(err, elvin.ErrorsQOSLimit) {
+		t.Fatalf("Expected a QoS limit Nack, got %v", err)
+	}
+
+	// The NotifySelf pseudo-name isn't counted on add or modify
+	self := quench("c")
+	self.NotifySelf = true
+	if err := qc.Quench(self); !nacked(err, elvin.ErrorsQOSLimit) {
+		t.Fatalf("Expected a QoS limit Nack, got %v", err)
+	}
+	self.Names = nil
+	if err := qc.Quench(self); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+	if err := qc.QuenchModify(first, map[string]bool{elvin.QuenchNotifySelfName: true}, nil, true, nil, nil); err != nil {
+		t.Fatalf("QuenchModify failed: %v", err)
+	}
+	if err := qc.QuenchModify(first, nil, map[string]bool{elvin.QuenchNotifySelfName: true, "x": true}, true, nil, nil); err != nil {
+		t.Fatalf("QuenchModify failed: %v", err)
+	}
+	if err := qc.Quench(quench("z")); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+	if err := qc.Quench(quench("w")); !nacked(err, elvin.ErrorsQOSLimit) {
+		t.Fatalf("Expected a QoS limit Nack, got %v", err)
+	}
+
+	// Changed limits apply to the existing connection
+	router.SetQuenchLimits(0, 0)
+	if err := qc.Quench(quench("z")); err != nil {
+		t.Fatalf("Quench failed after lifting limits: %v", err)
+	}
+}
+
+func TestQuenchKeys(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3953"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	secret := []byte("TestQuenchKeys")
+	quenchKeys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{secret}}}
+	subKeys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{elvin.PrimeSha1(secret)}}}
+
+	qc := elvin.NewClient(url, nil, nil, nil)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer qc.Disconnect()
+
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"Secret": true}
+	quench.Keys = quenchKeys
+	quench.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(quench); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	sc := elvin.NewClient(url, nil, nil, nil)
+	if err := sc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Disconnect()
+
+	// Neither insecure nor keyed differently is reported
+	insecure := new(elvin.Subscription)
+	insecure.Expression = "Secret == 1"
+	insecure.AcceptInsecure = true
+	insecure.Notifications = make(chan map[string]interface{})
+	if err := sc.Subscribe(insecure); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	other := new(elvin.Subscription)
+	other.Expression = "Secret == 2"
+	other.Keys = elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{elvin.PrimeSha1([]byte("other"))}}}
+	other.Notifications = make(chan map[string]interface{})
+	if err := sc.Subscribe(other); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	secured := new(elvin.Subscription)
+	secured.Expression = "Secret == 3"
+	secured.Keys = subKeys
+	secured.Notifications = make(chan map[string]interface{})
+	if err := sc.Subscribe(secured); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	select {
+	case qn := <-quench.Notifications:
+		if qn.TermID != uint64(secured.SubID()) {
+			t.Fatalf("Quench told of subscription %d not %d", qn.TermID, secured.SubID())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Quench missed the keyed subscription")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case qn := <-quench.Notifications:
+		t.Fatalf("Quench told of an unauthorized subscription: %+v", qn)
+	default:
+	}
+}
+
+func TestQuenchTable(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3957"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	qc := elvin.NewClient(url, nil, nil, nil)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer qc.Disconnect()
+
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"Volume": true, "Price": true}
+	quench.DeliverInsecure = true
+	quench.Notifications = make(chan elvin.QuenchNotification, 4)
+	if err := qc.Quench(quench); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	table := router.QuenchTable()
+	if len(table) != 1 {
+		t.Fatalf("Expected one quench, got %v", table)
+	}
+	entry := table[0]
+	if entry.QuenchID != quench.QuenchID() || ownerID(entry.QuenchID) != entry.ClientID {
+		t.Fatalf("Unexpected ids %+v for quench %d", entry, quench.QuenchID())
+	}
+	if strings.Join(entry.Names, ",") != "Price,Volume" || entry.All || !entry.DeliverInsecure || entry.Keyed {
+		t.Fatalf("Unexpected entry %+v", entry)
+	}
+
+	if err := qc.QuenchDelete(quench); err != nil {
+		t.Fatalf("QuenchDelete failed: %v", err)
+	}
+	if table := router.QuenchTable(); len(table) != 0 {
+		t.Fatalf("Deleted quench listed %v", table)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elog"
+	"github.com/cobaro/elvin/elvin"
+	"sync"
+	"time"
+)
+
+// Redelivery defaults, see SetRedelivery
+const (
+	DefaultRedeliveryTimeout  = time.Second
+	DefaultRedeliveryAttempts = 3
+	DefaultRedeliveryBuffer   = 1024
+)
+
+// A client's deliveries to Reliable subscriptions awaiting their Ack
+type redelivery struct {
+	mu       sync.Mutex
+	timeout  time.Duration // Before a delivery is sent again
+	attempts int           // Times a delivery is sent again before it's abandoned
+	buffer   int           // Unacked deliveries held, the oldest are abandoned
+	nextID   int64
+	unacked  map[int64]*unacked // by delivery id
+	order    []int64            // delivery ids, oldest first, some perhaps acked
+}
+
+type unacked struct {
+	deliver  *elvin.NotifyDeliver
+	subID    int64
+	attempts int
+	timer    *time.Timer
+}
+
+// Set how long a Reliable subscription's delivery waits for its Ack
+// before it's sent again, how many times it's sent again before it's
+// abandoned, and how many unacked deliveries each client may have
+// before the oldest are abandoned. Zero values take the defaults.
+func (router *Router) SetRedelivery(timeout time.Duration, attempts int, buffer int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.redeliveryTimeout = timeout
+	router.redeliveryAttempts = attempts
+	router.redeliveryBuffer = buffer
+}
+
+// The redelivery timeout, attempts and buffer with defaults applied
+func (router *Router) Redelivery() (timeout time.Duration, attempts int, buffer int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	timeout, attempts, buffer = router.redeliveryTimeout, router.redeliveryAttempts, router.redeliveryBuffer
+	if timeout <= 0 {
+		timeout = DefaultRedeliveryTimeout
+	}
+	if attempts <= 0 {
+		attempts = DefaultRedeliveryAttempts
+	}
+	if buffer <= 0 {
+		buffer = DefaultRedeliveryBuffer
+	}
+	return timeout, attempts, buffer
+}
+
+// The next id for a delivery to a Reliable subscription
+func (client *Client) nextDeliveryID() int64 {
+	client.redelivery.mu.Lock()
+	defer client.redelivery.mu.Unlock()
+	client.redelivery.nextID++
+	return client.redelivery.nextID
+}
+
+// Hold a delivery to a Reliable subscription until it's acked. Others
+// are ignored. Only the router sets delivery ids, see
+// stripRouterAttributes.
+func (client *Client) track(deliver *elvin.NotifyDeliver) {
+	id, ok := deliver.NameValue[elvin.DeliveryIDAttribute].(int64)
+	if !ok {
+		return
+	}
+	r := &client.redelivery
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unacked == nil {
+		r.unacked = make(map[int64]*unacked)
+	}
+
+	pending := &unacked{deliver: deliver, subID: append(deliver.Secure, deliver.Insecure...)[0]}
+	pending.timer = time.AfterFunc(r.timeout, func() { client.redeliver(id) })
+	r.unacked[id] = pending
+	r.order = append(r.order, id)
+
+	for len(r.unacked) > r.buffer {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		if abandoned, ok := r.unacked[oldest]; ok {
+			abandoned.timer.Stop()
+			delete(r.unacked, oldest)
+			client.elog.Logf(elog.LogLevelWarning, "Client %d delivery %d abandoned, too many unacked", client.ID(), oldest)
+		}
+	}
+}
+
+// Send a delivery again if it's still unacked and has attempts left
+func (client *Client) redeliver(id int64) {
+	r := &client.redelivery
+	r.mu.Lock()
+	pending, ok := r.unacked[id]
+	if ok && pending.attempts >= r.attempts {
+		delete(r.unacked, id)
+		client.elog.Logf(elog.LogLevelWarning, "Client %d delivery %d abandoned after %d attempts", client.ID(), id, pending.attempts)
+		r.prune()
+		ok = false
+	}
+	if ok {
+		pending.attempts++
+		pending.timer.Reset(r.timeout)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	client.elog.Logf(elog.LogLevelDebug1, "Client %d redelivering %d", client.ID(), id)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	pending.deliver.Encode(buf)
+	select {
+	case client.writeChannel <- buf:
+	case <-client.gone:
+		client.dropUnacked(0)
+	}
+}
+
+// Handle a DeliveryAck, forgetting the delivery
+func (client *Client) HandleDeliveryAck(buffer []byte) (err error) {
+	ack := new(elvin.DeliveryAck)
+	if err = ack.Decode(buffer); err != nil {
+		return err
+	}
+
+	r := &client.redelivery
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pending, ok := r.unacked[ack.DeliveryID]; ok && pending.subID == ack.SubID {
+		pending.timer.Stop()
+		delete(r.unacked, ack.DeliveryID)
+	}
+	r.prune()
+	return nil
+}
+
+// Drop the ids of deliveries no longer held from the order once
+// they're the bulk of it, with r.mu held
+func (r *redelivery) prune() {
+	if len(r.order) <= 2*len(r.unacked) {
+		return
+	}
+	held := r.order[:0]
+	for _, id := range r.order {
+		if _, ok := r.unacked[id]; ok {
+			held = append(held, id)
+		}
+	}
+	r.order = held
+}
+
+// Forget the unacked deliveries to a subscription, or all of them if
+// subID is zero
+func (client *Client) dropUnacked(subID int64) {
+	r := &client.redelivery
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, pending := range r.unacked {
+		if subID == 0 || pending.subID == subID {
+			pending.timer.Stop()
+			delete(r.unacked, id)
+		}
+	}
+	r.prune()
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+func TestReliableRedelivery(t *testing.T) {
+	defer checkLeaks(t)()
+
+	timeout := 50 * time.Millisecond
+	url := "elvin://localhost:3959"
+	router := startTestRouter(url, func(router *Router) {
+		router.SetRedelivery(timeout, 3, 16)
+	})
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(Critical)",
+		AcceptInsecure: true,
+		Reliable:       true,
+		ManualAck:      true,
+		Notifications:  make(chan map[string]interface{}, 4),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if err := ec.Notify(map[string]interface{}{"Critical": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	receive := func() map[string]interface{} {
+		select {
+		case nv := <-sub.Notifications:
+			return nv
+		case <-time.After(time.Second):
+			t.Fatalf("Notification wasn't delivered")
+		}
+		return nil
+	}
+
+	// Drop the first ack, so it's delivered again
+	first := receive()
+	id, ok := first[elvin.DeliveryIDAttribute].(int64)
+	if !ok {
+		t.Fatalf("Delivery has no id: %v", first)
+	}
+	again := receive()
+	if again[elvin.DeliveryIDAttribute] != id {
+		t.Fatalf("Expected redelivery of %d got %v", id, again)
+	}
+	if err := ec.Ack(sub, again); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	select {
+	case nv := <-sub.Notifications:
+		t.Fatalf("Unexpected delivery after ack: %v", nv)
+	case <-time.After(4 * timeout):
+	}
+
+	if err := ec.Ack(sub, map[string]interface{}{"Critical": int32(1)}); err == nil {
+		t.Fatalf("Ack without a delivery id succeeded")
+	}
+
+	// Producers can't supply a delivery id
+	forged := map[string]interface{}{"Critical": int32(2), elvin.DeliveryIDAttribute: id}
+	if err := ec.Notify(forged, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	nv := receive()
+	if nv[elvin.DeliveryIDAttribute] == id {
+		t.Fatalf("Forged delivery id was delivered: %v", nv)
+	}
+	if err := ec.Ack(sub, nv); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	ec.Disconnect()
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cobaro/elvin/elog"
+	"github.com/cobaro/elvin/elvin"
+)
+
+// Remove a subscription, by the SubID given in SubscriptionTable, and
+// tell its owner with a SubRemoved giving reason (one of
+// elvin.SubRemovedReason*) and message.
+func (router *Router) RemoveSubscription(subID int64, reason uint32, message string) error {
+	router.Mu.Lock()
+	client, ok := router.clients[int32(subID>>32)]
+	router.Mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No such subscription %d", subID)
+	}
+	return client.removeSubscription(subID, reason, message)
+}
+
+// Remove one of our subscriptions on the router's behalf
+func (client *Client) removeSubscription(subID int64, reason uint32, message string) error {
+	idx := int32(subID & 0xffffffff)
+	client.subsMu.Lock()
+	sub, ok := client.subs[idx]
+	delete(client.subs, idx)
+	client.subsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("No such subscription %d", subID)
+	}
+
+	client.elog.Logf(elog.LogLevelInfo1, "Removing client %d subscription %d: %s", client.ID(), subID, message)
+	client.dropUnacked(subID)
+	client.channels.subDel <- sub
+
+	removed := &elvin.SubRemoved{SubID: subID, Reason: reason, Message: message}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	removed.Encode(buf)
+	select {
+	case client.writeChannel <- buf:
+	case <-client.gone:
+	}
+	return nil
+}
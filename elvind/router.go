@@ -22,38 +22,96 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"github.com/cobaro/elvin/elog"
 	"github.com/cobaro/elvin/elvin"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // An Elvin router instance
 type Router struct {
 	Mu        sync.Mutex
-	listeners map[string]net.Listener
+	listeners map[string][]net.Listener
 	clients   map[int32]*Client // Required to be initialized by Init()
 	channels  ClientChannels    // For notifications, subs, quenches, delete etc to engine
+	done      chan bool         // Closed to stop the engine goroutines
 	elog      elog.Elog
+	latency   Histogram // NotifyEmit ingestion to delivery
+	untimed   bool      // Skip the histogram, to measure its overhead
+	expired   uint64    // Deliveries dropped as their TTL passed
+	shed      uint64    // Clients shed when MaxConnections was lowered
+	dropped   uint64    // Deliveries dropped to low priority clients
+	dropBelow int32     // atomic, see SetDropBelowPriority
+	readOnly  bool      // Refuse client notifications
+
+	// Per listening address connection counts
+	protocolStats map[string]*protocolCounters
+
+	// Duplicate suppression, router wide and per protocol
+	dedup       *Deduplicator
+	protocolDup map[string]*Deduplicator
 
 	// Configurable
 	protocols        map[string]*elvin.Protocol
 	failoverProtocol *elvin.Protocol
 	testConnInterval time.Duration
 	testConnTimeout  time.Duration
+	handshakeTimeout time.Duration
 	maxConnections   int
+	shedIdle         bool
 	doFailover       bool
 	logLevel         int
 	logFormat        int
 	logPath          string // FIXME: implement
+	authorizer       Authorizer
+	schema           *elvin.Schema
+	lastValues       *LastValueCache
+	sessions         *Sessions
+	onConnect        func(ConnInfo)
+	onDisconnect     func(ConnInfo)
+	tlsConfig        *tls.Config
+	virtualHosts     map[string]*VirtualHost // by TLS server name
+
+	maxQuenchNames           int // see SetQuenchLimits
+	maxConnectionQuenchNames int
+
+	busyThreshold int // see SetBusy
+	busyBackoff   time.Duration
+
+	slowDelivery      time.Duration // see SetSlowDelivery
+	slowDeliveryLevel int
+
+	redeliveryTimeout  time.Duration // see SetRedelivery
+	redeliveryAttempts int
+	redeliveryBuffer   int
+
+	acceptHigh   int // see SetAcceptPause
+	acceptLow    int
+	acceptPauses uint64 // atomic, see AcceptPauseStats
+	acceptPaused int64  // atomic, nanoseconds
+
+	connectionIDScheme string // see SetConnectionIDScheme
+	connectionSeq      uint64
+
+	transforms transformPipeline // see AddTransform
+
+	peers []*Peer // see AddPeer, replaced rather than modified
+
+	subscriptionQuota int // see SetSubscriptionQuota
 
 	// state
 	initialized bool
 	running     bool
+	health      Health // see Health
+	unbound     int    // addresses still to listen on while starting
 }
 
 // Operations from a client handled via channel to clients
@@ -66,13 +124,72 @@ type ClientChannels struct {
 	quenchAdd chan *Quench       // Quench Add
 	quenchMod chan *Quench       // Quench Mod
 	quenchDel chan *Quench       // Quench Del
+	replay    chan replay        // New subscriptions catching up
+	matches   chan matchCount    // MatchCountRequests
+	pending   *int32             // atomic, notifications awaiting the engine
 }
 
-// Set the maximum allowed number of clients
+// A new subscription to catch up with the last values and anything
+// missed while its resumed session was closed
+type replay struct {
+	client *Client
+	subID  int32
+	sub    *Subscription
+}
+
+// A MatchCountRequest for the engine to count and reply to
+type matchCount struct {
+	client *Client
+	xID    uint32
+	names  map[string]bool
+	nfn    *Notification
+}
+
+// Set the maximum allowed number of clients (0 for no limit). New
+// connections beyond the limit are refused. Lowering it below the
+// current number of clients sheds the most idle of them if ShedIdle
+// is set, otherwise existing clients are left alone.
 func (router *Router) SetMaxConnections(max int) {
 	router.Mu.Lock()
 	defer router.Mu.Unlock()
 	router.maxConnections = max
+
+	if max <= 0 || !router.shedIdle || len(router.clients) <= max {
+		return
+	}
+
+	// Most idle first
+	clients := make([]*Client, 0, len(router.clients))
+	for _, c := range router.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].LastActivity().Before(clients[j].LastActivity())
+	})
+	for _, c := range clients[:len(clients)-max] {
+		router.elog.Logf(elog.LogLevelInfo1, "Shedding client %d, idle since %v", c.ID(), c.LastActivity())
+		atomic.AddUint64(&router.shed, 1)
+		c.closer.Close()
+	}
+}
+
+// Set whether lowering MaxConnections sheds existing clients
+func (router *Router) SetShedIdle(shed bool) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.shedIdle = shed
+}
+
+// Get whether lowering MaxConnections sheds existing clients
+func (router *Router) ShedIdle() bool {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.shedIdle
+}
+
+// The number of clients shed by lowering MaxConnections
+func (router *Router) ShedConnections() uint64 {
+	return atomic.LoadUint64(&router.shed)
 }
 
 // Get the maximum allowed number of clients
@@ -110,6 +227,281 @@ func (router *Router) TestConnTimeout() time.Duration {
 	return router.testConnTimeout
 }
 
+// Set the cache of last values sent to new subscriptions (nil to disable)
+func (router *Router) SetLastValueCache(cache *LastValueCache) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.lastValues = cache
+}
+
+// Get the current last value cache
+func (router *Router) LastValueCache() *LastValueCache {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.lastValues
+}
+
+// Set the store of sessions retained after their connections close
+// (nil to disable)
+func (router *Router) SetSessions(sessions *Sessions) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.sessions = sessions
+}
+
+// Get the current session store
+func (router *Router) Sessions() *Sessions {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.sessions
+}
+
+// Set the router read-only, refusing notifications from clients
+// while still delivering those forwarded from peers. It applies to
+// existing connections too.
+func (router *Router) SetReadOnly(readOnly bool) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.readOnly = readOnly
+}
+
+// Is the router read-only?
+func (router *Router) ReadOnly() bool {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.readOnly
+}
+
+// Limit the subscriptions each connection may have, refusing more
+// with a QOSLimit Nack. Zero means unlimited. Connections are told
+// their quota in the ConnReply. It applies to existing connections
+// too, though they aren't told of the change.
+func (router *Router) SetSubscriptionQuota(max int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.subscriptionQuota = max
+}
+
+// The subscriptions allowed per connection
+func (router *Router) SubscriptionQuota() int {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.subscriptionQuota
+}
+
+// Limit the names in a quench, and across all of a connection's
+// quenches, refusing requests that would exceed them. Zero means
+// unlimited. It applies to existing connections too.
+func (router *Router) SetQuenchLimits(names int, connectionNames int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.maxQuenchNames = names
+	router.maxConnectionQuenchNames = connectionNames
+}
+
+// The per quench and per connection quench name limits
+func (router *Router) QuenchLimits() (names int, connectionNames int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.maxQuenchNames, router.maxConnectionQuenchNames
+}
+
+// When threshold notifications are already awaiting the engine, drop
+// further NotifyEmits and reply with a Busy suggesting the producer
+// backs off for backoff. Zero disables it. It applies to existing
+// connections too.
+func (router *Router) SetBusy(threshold int, backoff time.Duration) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.busyThreshold = threshold
+	router.busyBackoff = backoff
+}
+
+// The busy threshold and back-off
+func (router *Router) Busy() (threshold int, backoff time.Duration) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.busyThreshold, router.busyBackoff
+}
+
+// Log deliveries to a client that take threshold or longer at level,
+// to find slow consumers. A threshold of zero disables this.
+func (router *Router) SetSlowDelivery(threshold time.Duration, level int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.slowDelivery = threshold
+	router.slowDeliveryLevel = level
+}
+
+// The slow delivery threshold and log level
+func (router *Router) SlowDelivery() (threshold time.Duration, level int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.slowDelivery, router.slowDeliveryLevel
+}
+
+// Deliver a notification forwarded from a peer router. Unlike client
+// notifications these are accepted when the router is read-only.
+func (router *Router) Forward(nv map[string]interface{}, deliverInsecure bool, keys elvin.KeyBlock) {
+	received := time.Now()
+	deadline := TakeDeadline(nv, received)
+	pipeline := router.transformPipeline()
+	nv, err := pipeline.apply(nv)
+	if err != nil {
+		router.elog.Logf(elog.LogLevelInfo2, "Forwarded notification transform failed: %v", err)
+	}
+	if nv == nil {
+		return
+	}
+	router.channels.notify <- Notification{nil, nv, deliverInsecure, keys, received, deadline, nil}
+}
+
+// Set a router wide Deduplicator for incoming notifications (nil to
+// disable). It applies to existing connections too.
+func (router *Router) SetDeduplicator(dedup *Deduplicator) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.dedup = dedup
+}
+
+// Get the router wide Deduplicator
+func (router *Router) Deduplicator() *Deduplicator {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.dedup
+}
+
+// Set a Deduplicator for connections to the named protocol (nil to
+// remove), used in preference to the router wide one
+func (router *Router) SetProtocolDeduplicator(name string, dedup *Deduplicator) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.protocolDup == nil {
+		router.protocolDup = make(map[string]*Deduplicator)
+	}
+	if dedup == nil {
+		delete(router.protocolDup, name)
+	} else {
+		router.protocolDup[name] = dedup
+	}
+}
+
+// The Deduplicator for a protocol's connections, if any
+func (router *Router) deduplicatorFor(name string) *Deduplicator {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if dedup, ok := router.protocolDup[name]; ok {
+		return dedup
+	}
+	return router.dedup
+}
+
+// The number of duplicate notifications suppressed
+func (router *Router) DuplicateNotifications() (total uint64) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.dedup != nil {
+		total = router.dedup.Suppressed()
+	}
+	for _, dedup := range router.protocolDup {
+		if dedup != router.dedup {
+			total += dedup.Suppressed()
+		}
+	}
+	return total
+}
+
+// Set how long a new connection has to send its ConnRequest (0 to disable)
+func (router *Router) SetHandshakeTimeout(timeout time.Duration) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.handshakeTimeout = timeout
+}
+
+// Get the current handshake timeout
+func (router *Router) HandshakeTimeout() time.Duration {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.handshakeTimeout
+}
+
+// Set the Authorizer consulted on connect, subscribe and notify. It
+// applies to existing connections too.
+func (router *Router) SetAuthorizer(authorizer Authorizer) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.authorizer = authorizer
+}
+
+// Get the current Authorizer (the default allows everything)
+func (router *Router) Authorizer() Authorizer {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.authorizer == nil {
+		return AllowAll{}
+	}
+	return router.authorizer
+}
+
+// Set the Schema notifications must conform to (nil for none). It
+// applies to existing connections too.
+func (router *Router) SetSchema(schema *elvin.Schema) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.schema = schema
+}
+
+// Get the current Schema
+func (router *Router) Schema() *elvin.Schema {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.schema
+}
+
+// Set a function called, in its own goroutine, after each client
+// completes its handshake
+func (router *Router) SetOnConnect(onConnect func(ConnInfo)) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.onConnect = onConnect
+}
+
+// Get the function called after each handshake
+func (router *Router) OnConnect() func(ConnInfo) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.onConnect
+}
+
+// Set a function called, in its own goroutine, when a client that
+// completed its handshake is removed
+func (router *Router) SetOnDisconnect(onDisconnect func(ConnInfo)) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.onDisconnect = onDisconnect
+}
+
+// Get the function called when a client is removed
+func (router *Router) OnDisconnect() func(ConnInfo) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.onDisconnect
+}
+
+// Set the TLS configuration used by ssl protocols
+func (router *Router) SetTLSConfig(config *tls.Config) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.tlsConfig = config
+}
+
+// Get the TLS configuration used by ssl protocols
+func (router *Router) TLSConfig() *tls.Config {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.tlsConfig
+}
+
 // Set the maximum allowed number of clients
 func (router *Router) SetDoFailover(failover bool) {
 	router.Mu.Lock()
@@ -166,36 +558,100 @@ func (router *Router) LogFile() (file os.File) {
 	return router.LogFile()
 }
 
-// Add a protocol
-func (router *Router) AddProtocol(name string, protocol *elvin.Protocol) {
+// Add a protocol, named by its address by convention. It's an error
+// if the name or any of its addresses are already in use. If we're
+// running it's listened on at once, so it's also an error if we can't.
+func (router *Router) AddProtocol(name string, protocol *elvin.Protocol) (err error) {
 	router.Mu.Lock()
 	defer router.Mu.Unlock()
 	if router.protocols == nil {
 		router.protocols = make(map[string]*elvin.Protocol)
 	}
-	router.protocols[name] = protocol
+	if _, ok := router.protocols[name]; ok {
+		return fmt.Errorf("Protocol '%s' already exists", name)
+	}
+	for other, existing := range router.protocols {
+		for _, address := range existing.AllAddresses() {
+			for _, wanted := range protocol.AllAddresses() {
+				if wanted == address {
+					return fmt.Errorf("Address %s already in use by protocol '%s'", address, other)
+				}
+			}
+		}
+	}
 
-	if router.running {
-		go router.Listener(name, protocol)
+	if !router.running {
+		router.protocols[name] = protocol
+		return nil
+	}
+
+	if err = router.checkProtocol(protocol); err != nil {
+		return err
 	}
+	addresses := protocol.AllAddresses()
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		var listener net.Listener
+		if listener, err = router.bind(protocol, address, router.tlsConfig); err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	router.protocols[name] = protocol
+	router.listeners[name] = append(router.listeners[name], listeners...)
+	for i, listener := range listeners {
+		go router.accept(name, protocol, addresses[i], listener)
+	}
+	return nil
 }
 
-// Delete a protocol
-func (router *Router) DeleteProtocol(name string) (err error) {
+// Remove a protocol, closing its listeners. Clients that connected
+// through it are left connected as they are by StopListeners.
+func (router *Router) RemoveProtocol(name string) (err error) {
 	router.Mu.Lock()
 	defer router.Mu.Unlock()
 	if _, ok := router.protocols[name]; ok {
 		delete(router.protocols, name)
-		if listener, ok := router.listeners[name]; ok {
+		for _, listener := range router.listeners[name] {
 			listener.Close() // Tell it to exit
-			delete(router.listeners, name)
 		}
+		delete(router.listeners, name)
 		return nil
 	} else {
 		return fmt.Errorf("No such protocol '%s'", name)
 	}
 }
 
+// Delete a protocol
+//
+// Deprecated: Use RemoveProtocol.
+func (router *Router) DeleteProtocol(name string) (err error) {
+	return router.RemoveProtocol(name)
+}
+
+// Check we support a protocol
+func (router *Router) checkProtocol(protocol *elvin.Protocol) error {
+	switch protocol.Network {
+	case "tcp":
+	case "ssl":
+		if router.tlsConfig == nil {
+			return fmt.Errorf("network protocol ssl needs a TLS configuration")
+		}
+	default:
+		return fmt.Errorf("network protocol %s is currently unsupported", protocol.Network)
+	}
+
+	switch protocol.Marshal {
+	case "xdr":
+	default:
+		return fmt.Errorf("marshal protocol %s is currently unsupported", protocol.Marshal)
+	}
+	return nil
+}
+
 // Add a failover host
 func (router *Router) SetFailoverProtocol(protocol *elvin.Protocol) {
 	router.Mu.Lock()
@@ -214,13 +670,15 @@ func (router *Router) FailoverProtocol() (protocol *elvin.Protocol) {
 // Log info about our clients
 func (router *Router) LogClients() {
 	router.Mu.Lock()
-	defer router.Mu.Unlock()
 	router.elog.Logf(elog.LogLevelInfo1, "We have %d clients:", len(router.clients))
 	for i, c := range router.clients {
 		router.elog.Logf(elog.LogLevelInfo1, "%d: %+v", i, c)
 	}
-	return
+	router.Mu.Unlock()
 
+	for _, entry := range router.QuenchTable() {
+		router.elog.Logf(elog.LogLevelInfo1, "Quench %d: %+v", entry.QuenchID, entry)
+	}
 }
 
 // Tell our clients to Failover to the configured failover host
@@ -243,6 +701,34 @@ func (router *Router) Failover() {
 	return
 }
 
+// Return the percentiles of the time taken from receiving a
+// notification to queueing it for all matching subscribers
+func (router *Router) DeliveryLatency() Latency {
+	return router.latency.Latency()
+}
+
+// The number of deliveries dropped as their TTL passed
+func (router *Router) ExpiredNotifications() uint64 {
+	return atomic.LoadUint64(&router.expired)
+}
+
+// Deliveries to clients with a priority below this are dropped when
+// the client's queue is full rather than waiting for it to drain.
+// Clients have priority 0 unless they ask otherwise.
+func (router *Router) SetDropBelowPriority(priority int32) {
+	atomic.StoreInt32(&router.dropBelow, priority)
+}
+
+// Get the priority below which deliveries may be dropped
+func (router *Router) DropBelowPriority() int32 {
+	return atomic.LoadInt32(&router.dropBelow)
+}
+
+// The number of deliveries dropped to low priority clients
+func (router *Router) DroppedNotifications() uint64 {
+	return atomic.LoadUint64(&router.dropped)
+}
+
 // Router initialization
 func (router *Router) Init() {
 	router.clients = make(map[int32]*Client)
@@ -254,6 +740,10 @@ func (router *Router) Init() {
 	router.channels.quenchAdd = make(chan *Quench)
 	router.channels.quenchMod = make(chan *Quench)
 	router.channels.quenchDel = make(chan *Quench)
+	router.channels.replay = make(chan replay)
+	router.channels.matches = make(chan matchCount)
+	router.channels.pending = new(int32)
+	router.done = make(chan bool)
 	router.initialized = true
 
 	// Start remove goroutine for client cleanup
@@ -282,26 +772,27 @@ func (router *Router) Start() (err error) {
 
 	// Check Protocols
 	for name, protocol := range router.protocols {
-		switch protocol.Network {
-		case "tcp":
-		default:
-			router.elog.Logf(elog.LogLevelWarning, "network protocol %s is currently unsupported", protocol.Network)
-			delete(router.protocols, name)
-		}
-
-		switch protocol.Marshal {
-		case "xdr":
-		default:
-			router.elog.Logf(elog.LogLevelWarning, "marshal protocol %s is currently unsupported", protocol.Marshal)
+		if err := router.checkProtocol(protocol); err != nil {
+			router.elog.Logf(elog.LogLevelWarning, "%v", err)
 			delete(router.protocols, name)
 		}
 	}
 
 	// We're away
 	router.running = true
+	router.health = HealthStarting
+	router.unbound = 0
+	for _, protocol := range router.protocols {
+		router.unbound += len(protocol.AllAddresses())
+	}
+	if router.unbound == 0 {
+		router.health = HealthReady
+	}
 
 	// Set up listeners
-	router.listeners = make(map[string]net.Listener)
+	if router.listeners == nil {
+		router.listeners = make(map[string][]net.Listener)
+	}
 	for name, protocol := range router.protocols {
 		go router.Listener(name, protocol)
 	}
@@ -311,19 +802,18 @@ func (router *Router) Start() (err error) {
 
 // Stop a router, taking us back to a running but clean state
 func (router *Router) Stop() (err error) {
+	// Peer links first, as a peer may be us
+	router.stopPeers()
+
 	router.Mu.Lock()
 	defer router.Mu.Unlock()
 
 	// We're stopping
 	router.running = false
+	router.health = HealthStopped
 
 	// Shut down the listeners
-	router.elog.Logf(elog.LogLevelInfo2, "Closing listeners")
-	for name, listener := range router.listeners {
-		listener.Close()
-		delete(router.listeners, name)
-
-	}
+	router.closeListeners()
 
 	// Shut down the clients
 	router.elog.Logf(elog.LogLevelInfo2, "Closing clients")
@@ -336,11 +826,125 @@ func (router *Router) Stop() (err error) {
 		c.writeChannel <- buf
 	}
 
-	// FIXME: Shut down our goroutines
+	if router.initialized {
+		go router.stopEngine(router.done)
+	}
 	router.elog.Logf(elog.LogLevelInfo2, "Stopped")
 	return nil
 }
 
+// Once the clients have gone, stop the engine goroutines so a stopped
+// router doesn't leak them. A later Start will Init again.
+func (router *Router) stopEngine(done chan bool) {
+	for router.ClientCount() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.running || router.done != done {
+		return // Restarted in the meantime
+	}
+	close(done)
+	router.initialized = false
+}
+
+// Stop accepting new connections, leaving existing clients connected
+func (router *Router) StopListeners() {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.health != HealthStopped {
+		router.health = HealthDraining
+	}
+	router.closeListeners()
+}
+
+// Close the listeners, with router.Mu held
+func (router *Router) closeListeners() {
+	router.elog.Logf(elog.LogLevelInfo2, "Closing listeners")
+	for name, listeners := range router.listeners {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		delete(router.listeners, name)
+	}
+}
+
+// The number of connected clients
+func (router *Router) ClientCount() int {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return len(router.clients)
+}
+
+// A copy of the client list, safe to range over while clients come
+// and go
+func (router *Router) clientList() []*Client {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	clients := make([]*Client, 0, len(router.clients))
+	for _, client := range router.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// A snapshot of the connected clients, ordered by ID
+func (router *Router) Clients() (clients []ConnInfo) {
+	router.Mu.Lock()
+	for _, c := range router.clients {
+		clients = append(clients, c.ConnInfo())
+	}
+	router.Mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// Disconnect a client, as an administrator, by the ID given in
+// Clients. It's sent a Disconn with DisconnReasonRouterAdmin and its
+// connection is closed once that's written, or at once if it's so
+// far behind the Disconn can't be queued.
+func (router *Router) DisconnectClient(id int32) error {
+	router.Mu.Lock()
+	client, ok := router.clients[id]
+	router.Mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No such client %d", id)
+	}
+
+	router.elog.Logf(elog.LogLevelInfo1, "Disconnecting client %d (%s)", id, client.remoteAddr)
+	atomic.StoreInt32(&client.kicked, 1)
+	disconn := new(elvin.Disconn)
+	disconn.Reason = elvin.DisconnReasonRouterAdmin
+	buf := bufferPool.Get().(*bytes.Buffer)
+	disconn.Encode(buf)
+	select {
+	case client.writeChannel <- buf:
+	default:
+		client.closer.Close()
+	}
+	return nil
+}
+
+// As DisconnectClient for the client at a remote address
+func (router *Router) DisconnectAddress(remoteAddr string) error {
+	for _, info := range router.Clients() {
+		if info.RemoteAddr == remoteAddr {
+			return router.DisconnectClient(info.ID)
+		}
+	}
+	return fmt.Errorf("No client at %s", remoteAddr)
+}
+
+// Close all client connections without ceremony
+func (router *Router) CloseClients() {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	for _, c := range router.clients {
+		c.closer.Close()
+	}
+}
+
 // Shutdown
 func (router *Router) Shutdown() (err error) {
 	router.Mu.Lock()
@@ -356,42 +960,221 @@ func (router *Router) Shutdown() (err error) {
 	return nil
 }
 
+// Listen on each of a protocol's addresses, returning when they have
+// all stopped
 func (router *Router) Listener(name string, protocol *elvin.Protocol) (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, address := range protocol.AllAddresses() {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if e := router.listen(name, protocol, address); e != nil {
+				router.elog.Logf(elog.LogLevelError, "%v", e)
+				mu.Lock()
+				err = e
+				mu.Unlock()
+			}
+		}(address)
+	}
+	wg.Wait()
+	return err
+}
 
-	router.elog.Logf(elog.LogLevelInfo1, "Start listening on %s %s %s", protocol.Network, protocol.Marshal, protocol.Address)
-	defer router.elog.Logf(elog.LogLevelInfo1, "Stop listening on %s %s %s", protocol.Network, protocol.Marshal, protocol.Address)
-
-	listener, err := net.Listen(protocol.Network, protocol.Address)
+// Listen on one address
+func (router *Router) listen(name string, protocol *elvin.Protocol, address string) (err error) {
+	listener, err := router.bind(protocol, address, router.TLSConfig())
 	if err != nil {
-		return fmt.Errorf("FIXME: Listen failed: %v", err)
+		return err
 	}
 	router.Mu.Lock()
-	router.listeners[name] = listener
+	router.listeners[name] = append(router.listeners[name], listener)
+	router.bound()
 	router.Mu.Unlock()
+	router.accept(name, protocol, address, listener)
+	return nil
+}
 
-	var conn net.Conn
+// Open a listener on one of a protocol's addresses
+func (router *Router) bind(protocol *elvin.Protocol, address string, tlsConfig *tls.Config) (listener net.Listener, err error) {
+	if protocol.Network == "ssl" {
+		if listener, err = net.Listen("tcp", address); err == nil {
+			listener = tls.NewListener(protocol.Socket.Listener(listener), router.virtualConfig(tlsConfig))
+		}
+	} else if listener, err = net.Listen(protocol.Network, address); err == nil {
+		listener = protocol.Socket.Listener(listener)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FIXME: Listen failed: %v", err)
+	}
+	return listener, nil
+}
+
+// Serve a listener's connections until it's closed
+func (router *Router) accept(name string, protocol *elvin.Protocol, address string, listener net.Listener) {
+	router.elog.Logf(elog.LogLevelInfo1, "Start listening on %s %s %s", protocol.Network, protocol.Marshal, address)
+	defer router.elog.Logf(elog.LogLevelInfo1, "Stop listening on %s %s %s", protocol.Network, protocol.Marshal, address)
+
+	counters := router.protocolCounters(address)
 	for {
-		if conn, err = listener.Accept(); err != nil {
-			return nil // Happens when we're closed so simply bail
+		conn, err := listener.Accept()
+		if err != nil {
+			return // Happens when we're closed so simply bail
+		}
+		// Hold a connection accepted under load until things ease
+		if !router.acceptWait(address) {
+			conn.Close()
+			return
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok && router.virtualHosting() {
+			go router.serveVirtual(tlsConn, name, counters)
+			continue
+		}
+		router.serve(conn, name, counters)
+	}
+}
+
+// Accept connections from a listener made elsewhere, e.g. an in-memory
+// one for testing, until it's closed. It's closed along with the
+// router's own listeners.
+func (router *Router) ServeListener(name string, listener net.Listener) {
+	router.Mu.Lock()
+	if router.listeners == nil {
+		router.listeners = make(map[string][]net.Listener)
+	}
+	router.listeners[name] = append(router.listeners[name], listener)
+	router.Mu.Unlock()
+
+	protocol := &elvin.Protocol{Network: listener.Addr().Network(), Marshal: "xdr"}
+	router.accept(name, protocol, listener.Addr().String(), listener)
+}
+
+// Serve a newly established connection. This is used by the
+// Listener but may also be used for connections established elsewhere.
+func (router *Router) Serve(conn net.Conn) {
+	router.serve(conn, "", nil)
+}
+
+// Serve a connection accepted for the named protocol, counting it
+// against the listener's counters if set
+func (router *Router) serve(conn net.Conn, name string, counters *protocolCounters) {
+	var client Client
+	client.counters = counters
+
+	client.elog = router.elog
+	client.reader = conn
+	client.writer = conn
+	client.closer = conn
+	client.testConnInterval = router.testConnInterval
+	client.testConnTimeout = router.testConnTimeout
+	client.authorizer = router.Authorizer
+	client.schema = router.Schema
+	client.sessions = router.Sessions()
+	client.dedup = func() *Deduplicator { return router.deduplicatorFor(name) }
+	client.readOnly = router.ReadOnly
+	client.peers = router.Peers
+	client.quenchLimits = router.QuenchLimits
+	client.subscriptionQuota = router.SubscriptionQuota
+	client.busy = router.Busy
+	client.redelivery.timeout, client.redelivery.attempts, client.redelivery.buffer = router.Redelivery()
+	client.onConnect = router.OnConnect()
+	client.expired = &router.expired
+	client.transforms = router.transformPipeline
+	client.remoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		client.serverName = tlsConn.ConnectionState().ServerName
+	}
+	client.touch()
+
+	client.SetState(StateNew)
+	// Some queuing allowed to smooth things out
+	client.writeChannel = make(chan *bytes.Buffer, 4)
+	client.writeTerminate = make(chan int)
+	client.gone = make(chan struct{})
+
+	if !router.admitClient(&client) {
+		router.elog.Logf(elog.LogLevelWarning, "Refusing connection from %s, at MaxConnections", conn.RemoteAddr())
+		if counters != nil {
+			atomic.AddUint64(&counters.rejects, 1)
 		}
+		go router.refuse(conn)
+		return
+	}
+	if counters != nil {
+		atomic.AddUint64(&counters.accepts, 1)
+		atomic.AddInt64(&counters.active, 1)
+	}
+	go client.readHandler()
+	go client.writeHandler()
+
+	// Don't let a connection sit in StateNew tying up resources
+	if timeout := router.HandshakeTimeout(); timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			if client.State() == StateNew {
+				client.elog.Logf(elog.LogLevelInfo1, "Closing client %d for not sending a ConnRequest", client.ID())
+				client.closer.Close()
+			}
+		})
+	}
+}
+
+// Track a client unless we're at MaxConnections. The check and the
+// add share the lock so concurrent accepts can't overshoot the limit.
+func (router *Router) admitClient(conn *Client) bool {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if router.maxConnections > 0 && len(router.clients) >= router.maxConnections {
+		return false
+	}
+	router.addClient(conn)
+	return true
+}
 
-		var client Client
+// Limits on reading a refused connection's ConnRequest
+const (
+	refuseTimeout   = 10 * time.Second // When there's no handshake timeout
+	refuseMaxPacket = 2048
+)
 
-		client.elog = router.elog
-		client.reader = conn
-		client.writer = conn
-		client.closer = conn
-		client.testConnInterval = router.testConnInterval
-		client.testConnTimeout = router.testConnTimeout
+// Refuse a connection over MaxConnections, answering its ConnRequest
+// with a Nack if one arrives within the handshake timeout
+func (router *Router) refuse(conn net.Conn) {
+	defer conn.Close()
+	timeout := router.HandshakeTimeout()
+	if timeout <= 0 {
+		timeout = refuseTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
 
-		client.SetState(StateNew)
-		// Some queuing allowed to smooth things out
-		client.writeChannel = make(chan *bytes.Buffer, 4)
-		client.writeTerminate = make(chan int)
+	// A ConnRequest is small so don't read anything larger
+	header := make([]byte, 4)
+	if length, err := readBytes(conn, header, 4); length != 4 || err != nil {
+		return
+	}
+	packetSize := int(binary.BigEndian.Uint32(header))
+	if packetSize > refuseMaxPacket {
+		return
+	}
+	buffer := make([]byte, packetSize)
+	if length, err := readBytes(conn, buffer, packetSize); length != packetSize || err != nil {
+		return
+	}
+	connRequest := new(elvin.ConnRequest)
+	if elvin.PacketID(buffer) != elvin.PacketConnRequest || connRequest.Decode(buffer) != nil {
+		return
+	}
 
-		router.AddClient(&client) // track it
-		go client.readHandler()
-		go client.writeHandler()
+	nack := new(elvin.Nack)
+	nack.XID = connRequest.XID
+	nack.ErrorCode = elvin.ErrorsQOSLimit
+	nack.Args = []interface{}{"connections"}
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	buf := new(bytes.Buffer)
+	nack.Encode(buf)
+	binary.BigEndian.PutUint32(header, uint32(buf.Len()))
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(header); err == nil {
+		buf.WriteTo(conn)
 	}
 }
 
@@ -399,6 +1182,11 @@ func (router *Router) Listener(name string, protocol *elvin.Protocol) (err error
 func (router *Router) AddClient(conn *Client) {
 	router.Mu.Lock()
 	defer router.Mu.Unlock()
+	router.addClient(conn)
+}
+
+// Track a client, called with router.Mu held
+func (router *Router) addClient(conn *Client) {
 	var id int32 = rand.Int31()
 	for {
 		_, err := router.clients[id]
@@ -408,8 +1196,9 @@ func (router *Router) AddClient(conn *Client) {
 		id++
 	}
 
-	router.elog.Logf(elog.LogLevelDebug1, "New client %d", id)
 	conn.id = id
+	conn.connectionID = router.nextConnectionID()
+	router.elog.Logf(elog.LogLevelDebug1, "New client %d (connection %s)", id, conn.connectionID)
 	router.clients[id] = conn
 	conn.channels = router.channels
 	return
@@ -418,12 +1207,26 @@ func (router *Router) AddClient(conn *Client) {
 // Remove will purge a client from the set of clients (run as goroutine)
 func (router *Router) RemoveClient() {
 	for {
-		id := <-router.channels.remove
+		var id int32
+		select {
+		case id = <-router.channels.remove:
+		case <-router.done:
+			return
+		}
 		router.elog.Logf(elog.LogLevelDebug1, "Remove client %d", id)
 
 		router.Mu.Lock()
+		client, ok := router.clients[id]
 		delete(router.clients, id)
+		onDisconnect := router.onDisconnect
 		router.Mu.Unlock()
+
+		if ok && client.counters != nil {
+			atomic.AddInt64(&client.counters.active, -1)
+		}
+		if ok && onDisconnect != nil && client.Established() {
+			go onDisconnect(client.ConnInfo())
+		}
 		// FIXME: Clean up the subscriptions and quenches
 	}
 }
@@ -431,64 +1234,310 @@ func (router *Router) RemoveClient() {
 // Notify is our queue of incoming messages (run as goroutine)
 func (router *Router) Notify() {
 	for {
-		nfn := <-router.channels.notify
+		var nfn Notification
+		select {
+		case nfn = <-router.channels.notify:
+		case r := <-router.channels.replay:
+			router.replay(r)
+			continue
+		case m := <-router.channels.matches:
+			router.replyMatchCount(m)
+			continue
+		case <-router.done:
+			return
+		}
 		router.elog.Logf(elog.LogLevelDebug3, "notification %+v", nfn)
 
-		// FIXME: eval
-		// As a dummy for now we're going to send every message we see
-		// to every subscription as if all evaluate to true.
-		deliver := new(elvin.NotifyDeliver)
-		deliver.NameValue = nfn.NameValue
+		// Security check needs the producer's keys primed, once
+		PrimeProducer(nfn.Keys)
 
 		// Grab a copy of the current client list
 		// For now we don't care if one updates mid stream
+		clients := router.clientList()
 		router.Mu.Lock()
-		clients := router.clients
+		lastValues := router.lastValues
+		sessions := router.sessions
+		slow, slowLevel := router.slowDelivery, router.slowDeliveryLevel
 		router.Mu.Unlock()
 
-		for connid, client := range clients {
-			if len(client.subs) > 0 {
-				deliver.Insecure = make([]int64, len(client.subs))
-				i := 0
-				for id, sub := range client.subs {
-					// Security check first
-					PrimeProducer(nfn.Keys)
-
-					if SecurityMatches(nfn, *sub, nfn.ClientKeys, client.keysSub) {
-						router.elog.Logf(elog.LogLevelDebug1, "SecurityMatches true")
-						deliver.Insecure[i] = int64(connid)<<32 | int64(id)
-						i++
-					} else {
-						router.elog.Logf(elog.LogLevelDebug1, "SecurityMatches false")
-					}
+		if lastValues != nil {
+			lastValues.Put(nfn)
+		}
+		if sessions != nil {
+			sessions.Put(nfn)
+		}
 
+		for _, client := range clients {
+			client.subsMu.RLock()
+			delivers := client.Deliveries(nfn, client.subs)
+			client.subsMu.RUnlock()
+			for _, deliver := range delivers {
+				if slow == 0 {
+					router.deliver(client, deliver, nfn.Deadline)
+					continue
+				}
+				start := time.Now()
+				router.deliver(client, deliver, nfn.Deadline)
+				if took := time.Since(start); took >= slow {
+					router.elog.Logf(slowLevel, "Slow delivery to client %d took %v, subscriptions secure %v insecure %v",
+						client.ID(), took, deliver.Secure, deliver.Insecure)
 				}
-				buf := bufferPool.Get().(*bytes.Buffer)
-				deliver.Encode(buf)
-				client.writeChannel <- buf
 			}
 		}
+		if !router.untimed {
+			router.latency.Observe(time.Since(nfn.Received))
+		}
 	}
 }
 
-// FIXME: implement
+// Deliver the notifications a new subscription catches up with, unless
+// it's already gone
+func (router *Router) replay(r replay) {
+	router.Mu.Lock()
+	lastValues := router.lastValues
+	router.Mu.Unlock()
+
+	var nfns []Notification
+	if lastValues != nil {
+		nfns = lastValues.Values()
+	}
+	if r.client.session != "" {
+		nfns = append(nfns, r.client.sessions.Resubscribe(r.client.session, r.sub.Expression, r.sub.AcceptInsecure)...)
+	}
+
+	subs := map[int32]*Subscription{r.subID: r.sub}
+	for _, nfn := range nfns {
+		r.client.subsMu.RLock()
+		var delivers []*elvin.NotifyDeliver
+		if r.client.subs[r.subID] == r.sub {
+			delivers = r.client.Deliveries(nfn, subs)
+		}
+		r.client.subsMu.RUnlock()
+		for _, deliver := range delivers {
+			router.deliver(r.client, deliver, nfn.Deadline)
+		}
+	}
+}
+
+// Queue a NotifyDeliver to a client, honoring any deadline
+func (router *Router) deliver(client *Client, deliver *elvin.NotifyDeliver, deadline time.Time) {
+	client.track(deliver)
+	if client.unordered {
+		router.deliverUnordered(client, deliver, deadline)
+		return
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	deliver.Encode(buf)
+	router.enqueue(client, buf, deadline)
+}
+
+// Queue an encoded delivery for a client, honoring any deadline
+func (router *Router) enqueue(client *Client, buf *bytes.Buffer, deadline time.Time) {
+	if client.Priority() < router.DropBelowPriority() {
+		router.deliverOrDrop(client, buf)
+	} else if deadline.IsZero() {
+		client.writeChannel <- buf
+	} else {
+		router.deliverBefore(client, buf, deadline)
+	}
+}
+
+// Queue a delivery to a low priority client only if there's room,
+// otherwise drop it. The client gets a DropWarn before its next
+// delivery.
+func (router *Router) deliverOrDrop(client *Client, buf *bytes.Buffer) {
+	if atomic.LoadInt32(&client.dropWarn) != 0 {
+		warn := bufferPool.Get().(*bytes.Buffer)
+		new(elvin.DropWarn).Encode(warn)
+		select {
+		case client.writeChannel <- warn:
+			atomic.StoreInt32(&client.dropWarn, 0)
+		default:
+			warn.Reset()
+			bufferPool.Put(warn)
+		}
+	}
+
+	select {
+	case client.writeChannel <- buf:
+	default:
+		router.elog.Logf(elog.LogLevelDebug2, "Client %d delivery dropped", client.ID())
+		atomic.AddUint64(&router.dropped, 1)
+		atomic.StoreInt32(&client.dropWarn, 1)
+		buf.Reset()
+		bufferPool.Put(buf)
+	}
+}
+
+// Queue a delivery to a client unless its deadline has already
+// passed, in which case drop it and count it as expired. Like any
+// other delivery it waits for room, and the writer drops it if the
+// deadline passes while it's queued.
+func (router *Router) deliverBefore(client *Client, buf *bytes.Buffer, deadline time.Time) {
+	if time.Now().Before(deadline) {
+		client.deadlines.Store(buf, deadline)
+		client.writeChannel <- buf
+		return
+	}
+
+	router.elog.Logf(elog.LogLevelDebug2, "Client %d delivery expired", client.ID())
+	atomic.AddUint64(&router.expired, 1)
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
 // Subscriptions deals with changes to all of our client's subscriptions (run as goroutine)
 func (router *Router) Subscriptions() {
 	for {
 		var sub *Subscription
+		var packetType int
 		select {
 		case sub = <-router.channels.subAdd:
 			router.elog.Logf(elog.LogLevelInfo2, "SubAdd")
+			packetType = elvin.PacketSubAddNotify
 		case sub = <-router.channels.subMod:
 			router.elog.Logf(elog.LogLevelInfo2, "SubMod")
+			packetType = elvin.PacketSubModNotify
 		case sub = <-router.channels.subDel:
 			router.elog.Logf(elog.LogLevelInfo2, "SubDel")
+			packetType = elvin.PacketSubDelNotify
+		case <-router.done:
+			return
+		}
+		router.QuenchNotify(packetType, sub)
+	}
+}
+
+// Count the subscriptions that would be delivered nfn, or if it's
+// nil, that share an attribute name with names. With neither, count
+// them all.
+func (router *Router) MatchCount(names map[string]bool, nfn *Notification) (count int) {
+	if nfn != nil {
+		PrimeProducer(nfn.Keys)
+	}
+	for _, client := range router.clientList() {
+		keysSub := client.subKeys()
+		client.subsMu.RLock()
+		for _, sub := range client.subs {
+			switch {
+			case nfn != nil:
+				if sub.Ast.Match(nfn.NameValue) && SecurityMatches(*nfn, *sub, nfn.ClientKeys, keysSub) {
+					count++
+				}
+			case len(names) > 0:
+				for name := range sub.Ast.Names() {
+					if names[name] {
+						count++
+						break
+					}
+				}
+			default:
+				count++
+			}
 		}
+		client.subsMu.RUnlock()
+	}
+	return count
+}
+
+// Answer a MatchCountRequest, counting on the engine so it's
+// consistent with the notifications delivered around it
+func (router *Router) replyMatchCount(m matchCount) {
+	matchReply := new(elvin.MatchCountReply)
+	matchReply.XID = m.xID
+	matchReply.Count = uint32(router.MatchCount(m.names, m.nfn))
 
-		if sub.SubID == 0 {
-			router.elog.Logf(elog.LogLevelError, "FIXME: Use sub to keep compiler happy")
+	buf := bufferPool.Get().(*bytes.Buffer)
+	matchReply.Encode(buf)
+	m.client.writeChannel <- buf
+}
+
+// The number of notifications withheld from a subscription as they
+// exceeded its maximum size
+func (router *Router) Oversize(subID int64) uint64 {
+	router.Mu.Lock()
+	client, ok := router.clients[int32(subID>>32)]
+	router.Mu.Unlock()
+	if !ok {
+		return 0
+	}
+	client.subsMu.RLock()
+	sub, ok := client.subs[int32(subID)]
+	client.subsMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(&sub.Oversize)
+}
+
+// QuenchNotify tells the owners of matching quenches about a
+// subscription change. A quench matches if it's a wildcard or if it
+// shares an attribute name with the subscription, and its keys and
+// DeliverInsecure allow it to see the subscription.
+func (router *Router) QuenchNotify(packetType int, sub *Subscription) {
+	var names map[string]bool
+	if sub.Ast != nil {
+		names = sub.Ast.Names()
+	}
+
+	// Grab a copy of the current client list
+	router.Mu.Lock()
+	owner, ok := router.clients[ownerID(sub.SubID)]
+	router.Mu.Unlock()
+	clients := router.clientList()
+
+	var subKeys elvin.KeyBlock
+	if ok {
+		subKeys = owner.subKeys()
+	}
+
+	for _, client := range clients {
+		var secureIDs, insecureIDs []int64
+		keysNfn := client.nfnKeys()
+		client.quenchMu.RLock()
+		for _, quench := range client.quenches {
+			if !quench.Matches(names) {
+				continue
+			}
+			if !quench.NotifySelf && ownerID(sub.SubID) == client.ID() {
+				continue
+			}
+			ok, secure := quench.Authorized(sub, keysNfn, subKeys)
+			switch {
+			case !ok:
+			case secure:
+				secureIDs = append(secureIDs, quench.QuenchID)
+			default:
+				insecureIDs = append(insecureIDs, quench.QuenchID)
+			}
+		}
+		client.quenchMu.RUnlock()
+		if len(secureIDs) == 0 && len(insecureIDs) == 0 {
+			continue
 		}
 
+		buf := bufferPool.Get().(*bytes.Buffer)
+		switch packetType {
+		case elvin.PacketSubAddNotify:
+			notify := new(elvin.SubAddNotify)
+			notify.SecureQuenchIDs = secureIDs
+			notify.InsecureQuenchIDs = insecureIDs
+			notify.TermID = uint64(sub.SubID)
+			notify.Encode(buf)
+		case elvin.PacketSubModNotify:
+			notify := new(elvin.SubModNotify)
+			notify.SecureQuenchIDs = secureIDs
+			notify.InsecureQuenchIDs = insecureIDs
+			notify.TermID = uint64(sub.SubID)
+			notify.Encode(buf)
+		case elvin.PacketSubDelNotify:
+			notify := new(elvin.SubDelNotify)
+			notify.QuenchIDs = append(secureIDs, insecureIDs...)
+			notify.TermID = uint64(sub.SubID)
+			notify.Encode(buf)
+		}
+		router.elog.Logf(elog.LogLevelDebug2, "Quench notify client %d for sub %d: secure %v insecure %v", client.ID(), sub.SubID, secureIDs, insecureIDs)
+		client.writeChannel <- buf
 	}
 }
 
@@ -504,6 +1553,8 @@ func (router *Router) Quenches() {
 			router.elog.Logf(elog.LogLevelInfo2, "QuenchMod")
 		case quench = <-router.channels.quenchDel:
 			router.elog.Logf(elog.LogLevelInfo2, "QuenchDel")
+		case <-router.done:
+			return
 		}
 		if quench.QuenchID == 0 {
 			router.elog.Logf(elog.LogLevelError, "FIXME: Use quench to keep compiler happy")
@@ -137,9 +137,29 @@ func SecurityMatches(nfn Notification, sub Subscription, pKeys, cKeys elvin.KeyB
 	return false
 }
 
+// Return the consumer key by which a notification securely matches a
+// subscription, if any. This is the key as held by the router so it's
+// primed for consumer schemes.
+func SecureMatchingKey(nfn Notification, sub Subscription, pKeys, cKeys elvin.KeyBlock) (elvin.Key, bool) {
+	for _, producer := range []elvin.KeyBlock{nfn.Keys, pKeys} {
+		for _, consumer := range []elvin.KeyBlock{sub.Keys, cKeys} {
+			if key, ok := KeyBlocksMatchingKey(producer, consumer); ok {
+				return key, true
+			}
+		}
+	}
+	return nil, false
+}
+
 func KeyBlocksMatches(producer, consumer elvin.KeyBlock) bool {
+	_, ok := KeyBlocksMatchingKey(producer, consumer)
+	return ok
+}
+
+// As KeyBlocksMatches but returning the consumer's key that matched
+func KeyBlocksMatchingKey(producer, consumer elvin.KeyBlock) (elvin.Key, bool) {
 	if len(producer) == 0 || len(consumer) == 0 {
-		return false
+		return nil, false
 	}
 	for scheme, ksl := range producer {
 		if _, ok := consumer[scheme]; !ok {
@@ -148,16 +168,16 @@ func KeyBlocksMatches(producer, consumer elvin.KeyBlock) bool {
 		}
 		switch scheme {
 		case elvin.KeySchemeSha1Dual:
-			if KeySetMatches(ksl[elvin.KeySetDualProducer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualProducer]) && KeySetMatches(ksl[elvin.KeySetDualConsumer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualConsumer]) {
-				return true
+			if key, ok := KeySetMatchingKey(ksl[elvin.KeySetDualProducer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualProducer]); ok && KeySetMatches(ksl[elvin.KeySetDualConsumer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualConsumer]) {
+				return key, true
 			}
 		case elvin.KeySchemeSha1Producer:
-			if KeySetMatches(ksl[elvin.KeySetProducer], consumer[elvin.KeySchemeSha1Producer][elvin.KeySetProducer]) {
-				return true
+			if key, ok := KeySetMatchingKey(ksl[elvin.KeySetProducer], consumer[elvin.KeySchemeSha1Producer][elvin.KeySetProducer]); ok {
+				return key, true
 			}
 		case elvin.KeySchemeSha1Consumer:
-			if KeySetMatches(ksl[elvin.KeySetConsumer], consumer[elvin.KeySchemeSha1Consumer][elvin.KeySetConsumer]) {
-				return true
+			if key, ok := KeySetMatchingKey(ksl[elvin.KeySetConsumer], consumer[elvin.KeySchemeSha1Consumer][elvin.KeySetConsumer]); ok {
+				return key, true
 			}
 		case elvin.KeySchemeSha256Dual:
 		case elvin.KeySchemeSha256Producer:
@@ -165,17 +185,23 @@ func KeyBlocksMatches(producer, consumer elvin.KeyBlock) bool {
 		}
 	}
 
-	return false
+	return nil, false
 }
 
 // A match occurs if there is a match across any of the two sets of keys
 func KeySetMatches(first, second elvin.KeySet) bool {
+	_, ok := KeySetMatchingKey(first, second)
+	return ok
+}
+
+// As KeySetMatches but returning the matching key
+func KeySetMatchingKey(first, second elvin.KeySet) (elvin.Key, bool) {
 	for _, f := range first {
 		for _, s := range second {
 			if bytes.Equal(f, s) {
-				return true
+				return s, true
 			}
 		}
 	}
-	return false
+	return nil, false
 }
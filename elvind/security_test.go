@@ -25,6 +25,7 @@ import (
 	"encoding/hex"
 	"github.com/cobaro/elvin/elvin"
 	"testing"
+	"time"
 )
 
 var k1 = []byte("foo")
@@ -157,7 +158,7 @@ func TestMatching(t *testing.T) {
 	producerKeyBlock[elvin.KeySchemeSha1Producer] = producerKeySetList
 
 	// Make a notification with that key block that must match
-	nfn := Notification{nil, namevalue, false, producerKeyBlock}
+	nfn := Notification{nil, namevalue, false, producerKeyBlock, time.Time{}, time.Time{}, nil}
 
 	// Consumer keyblock
 	var consumerKeySet elvin.KeySet
@@ -167,7 +168,7 @@ func TestMatching(t *testing.T) {
 	consumerKeyBlock[elvin.KeySchemeSha1Producer] = consumerKeySetList
 
 	// Make s subscription with that keyBlock that must match
-	sub := Subscription{1, false, consumerKeyBlock, nil}
+	sub := Subscription{SubID: 1, Keys: consumerKeyBlock}
 
 	// Because the producer key is not yet primed, these should not match
 	if SecurityMatches(nfn, sub, nil, nil) {
@@ -215,3 +216,54 @@ func TestMatching(t *testing.T) {
 		t.Fatalf("empty subscriber keys should not match")
 	}
 }
+
+// A subscriber holding two keys is told which one matched
+func TestSecureDelivery(t *testing.T) {
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(SecureDelivery)"
+	sub.Keys = elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{{k1SHA1, k2SHA1}}}
+	sub.Deliveries = make(chan elvin.Delivery)
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer client.SubscriptionDelete(sub)
+
+	insecure := new(elvin.Subscription)
+	insecure.Expression = "require(SecureDelivery)"
+	insecure.AcceptInsecure = true
+	insecure.Deliveries = make(chan elvin.Delivery)
+	if err := client.Subscribe(insecure); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer client.SubscriptionDelete(insecure)
+
+	keys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{{k2}}}
+	if err := client.Notify(map[string]interface{}{"SecureDelivery": int32(1)}, false, keys); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case d := <-sub.Deliveries:
+		if !d.Secure || !bytes.Equal(d.Key, k2SHA1) {
+			t.Fatalf("Expected secure delivery with k2, got %+v", d)
+		}
+		if _, ok := d.NameValue[elvin.MatchedKeyAttribute]; ok {
+			t.Fatalf("Matched key attribute delivered: %v", d.NameValue)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Secure delivery missing")
+	}
+
+	// A producer can't forge the matched key
+	forged := map[string]interface{}{"SecureDelivery": int32(2), elvin.MatchedKeyAttribute: k2SHA1}
+	if err := client.Notify(forged, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case d := <-insecure.Deliveries:
+		if d.Secure || d.Key != nil {
+			t.Fatalf("Expected insecure delivery, got %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Insecure delivery missing")
+	}
+}
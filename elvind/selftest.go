@@ -0,0 +1,106 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// The outcome of a self test against one listening address
+type SelfTestResult struct {
+	URL     string
+	Latency time.Duration // Notify to delivery
+	Err     error         // nil on success
+}
+
+func (result SelfTestResult) String() string {
+	if result.Err != nil {
+		return fmt.Sprintf("fail %s: %v", result.URL, result.Err)
+	}
+	return fmt.Sprintf("ok %s %v", result.URL, result.Latency)
+}
+
+// Connect to each of our own listening addresses as a client,
+// subscribe, notify and wait for the notification to come back
+func (router *Router) SelfTest(timeout time.Duration) (results []SelfTestResult) {
+	router.Mu.Lock()
+	var protocols []*elvin.Protocol
+	for _, protocol := range router.protocols {
+		protocols = append(protocols, protocol)
+	}
+	router.Mu.Unlock()
+
+	for _, protocol := range protocols {
+		for _, address := range protocol.AllAddresses() {
+			p := *protocol
+			p.Address = loopbackAddress(address)
+			url := elvin.ProtocolToURL(&p)
+			result := SelfTestResult{URL: url}
+			result.Latency, result.Err = selfTest(url, timeout)
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// A wildcard listening address can't be dialled everywhere so use loopback
+func loopbackAddress(address string) string {
+	switch {
+	case strings.HasPrefix(address, "0.0.0.0:"):
+		return "127.0.0.1" + address[len("0.0.0.0"):]
+	case strings.HasPrefix(address, "[::]:"):
+		return "[::1]" + address[len("[::]"):]
+	}
+	return address
+}
+
+func selfTest(url string, timeout time.Duration) (latency time.Duration, err error) {
+	client := elvin.NewClient(url, nil, nil, nil)
+	if err = client.Connect(); err != nil {
+		return 0, err
+	}
+	defer client.Disconnect()
+
+	nonce := rand.Int63()
+	sub := new(elvin.Subscription)
+	sub.Expression = fmt.Sprintf("ElvinSelfTest == %dL", nonce)
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{}, 1)
+	if err = client.Subscribe(sub); err != nil {
+		return 0, err
+	}
+	defer client.SubscriptionDelete(sub)
+
+	start := time.Now()
+	if err = client.Notify(map[string]interface{}{"ElvinSelfTest": nonce}, true, nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-sub.Notifications:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("No delivery after %v", timeout)
+	}
+}
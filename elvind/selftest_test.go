@@ -0,0 +1,58 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	defer checkLeaks(t)()
+
+	router := startTestRouter("elvin://localhost:3931", nil)
+	defer router.Stop()
+
+	results := router.SelfTest(time.Second)
+	if len(results) != 1 {
+		t.Fatalf("Expected one result, got %v", results)
+	}
+	if results[0].Err != nil {
+		t.Fatalf("Self test failed: %v", results[0])
+	}
+	if !strings.HasSuffix(results[0].URL, ":3931") {
+		t.Fatalf("Self test used %s", results[0].URL)
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0:2917":   "127.0.0.1:2917",
+		"[::]:2917":      "[::1]:2917",
+		"localhost:2917": "localhost:2917",
+	}
+	for address, expected := range tests {
+		if loopback := loopbackAddress(address); loopback != expected {
+			t.Errorf("%s: expected %s, got %s", address, expected, loopback)
+		}
+	}
+}
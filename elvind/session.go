@@ -0,0 +1,196 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sessions retains the subscriptions of connections that named a
+// session, see elvin.SessionOption, for a while after they close.
+// Notifications matching them are buffered, and a connection resuming
+// the session is sent those a subscription missed when it subscribes
+// again with the same expression. Only a connection sending back the
+// secret token the session was issued, see elvin.SessionTokenOption,
+// may resume it, and a clean disconnect ends it.
+type Sessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration // How long a closed session is retained
+	size     int           // Notifications buffered per session, the oldest are dropped
+	sessions map[string]*session
+}
+
+type session struct {
+	token  string                  // Issued to its first connection, needed to resume it
+	client *Client                 // Its connection, open or closed, for matching
+	subs   map[int32]*Subscription // Retained and not yet subscribed again
+	missed []Notification          // Matching at least one of subs
+	live   bool                    // Resumed by an open connection
+	expiry *time.Timer
+}
+
+// Create a session store retaining sessions for ttl and buffering up
+// to size notifications for each
+func NewSessions(ttl time.Duration, size int) *Sessions {
+	sessions := new(Sessions)
+	sessions.ttl = ttl
+	sessions.size = size
+	sessions.sessions = make(map[string]*session)
+	return sessions
+}
+
+// Retain a closing connection's subscriptions under the session it
+// holds, along with any it hadn't yet taken back
+func (sessions *Sessions) Retain(name string, client *Client, subs map[int32]*Subscription) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	s, ok := sessions.sessions[name]
+	if !ok || !s.live || s.client != client {
+		return // Another connection has it
+	}
+	s.live = false
+	for id, sub := range subs {
+		s.subs[id] = sub
+	}
+	if len(s.subs) == 0 {
+		delete(sessions.sessions, name)
+		return
+	}
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.expiry = time.AfterFunc(sessions.ttl, func() {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+		if sessions.sessions[name] == s && !s.live {
+			delete(sessions.sessions, name)
+		}
+	})
+}
+
+// Give a new connection the named session, resuming it if it was
+// retained and token is the one it was issued, otherwise starting it.
+// Returns the session's token for the connection, or "" if the
+// session is held by another connection or the token is wrong.
+func (sessions *Sessions) Resume(name string, token string, client *Client) (issued string, resumed bool) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	s, ok := sessions.sessions[name]
+	if !ok {
+		if token = newSessionToken(); len(token) == 0 {
+			return "", false
+		}
+		s = &session{token: token, client: client, subs: make(map[int32]*Subscription), live: true}
+		sessions.sessions[name] = s
+		return s.token, false
+	}
+	if s.live || s.token != token {
+		return "", false
+	}
+	s.expiry.Stop()
+	s.client = client
+	s.live = true
+	return s.token, true
+}
+
+// End a connection's session when it disconnects cleanly
+func (sessions *Sessions) Discard(name string, client *Client) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	if s, ok := sessions.sessions[name]; ok && s.client == client {
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		delete(sessions.sessions, name)
+	}
+}
+
+// A secret for resuming a session, or "" if there's no randomness
+func newSessionToken() string {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", token)
+}
+
+// Take back a retained subscription with this expression, returning
+// the notifications it missed, oldest first. It's still up to the
+// caller to match them.
+func (sessions *Sessions) Resubscribe(name string, expression string, acceptInsecure bool) (missed []Notification) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	s, ok := sessions.sessions[name]
+	if !ok || !s.live {
+		return nil
+	}
+	for id, sub := range s.subs {
+		if sub.Expression == expression && sub.AcceptInsecure == acceptInsecure {
+			delete(s.subs, id)
+			missed = s.missed
+			if len(s.subs) == 0 {
+				s.missed = nil
+			}
+			break
+		}
+	}
+
+	now := time.Now()
+	unexpired := missed[:0:0]
+	for _, nfn := range missed {
+		if nfn.Deadline.IsZero() || now.Before(nfn.Deadline) {
+			unexpired = append(unexpired, nfn)
+		}
+	}
+	return unexpired
+}
+
+// Buffer a notification for each session with a retained subscription
+// it matches
+func (sessions *Sessions) Put(nfn Notification) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	for _, s := range sessions.sessions {
+		if len(s.client.Deliveries(nfn, s.subs)) == 0 {
+			continue
+		}
+		s.missed = append(s.missed, nfn)
+		if sessions.size > 0 && len(s.missed) > sessions.size {
+			s.missed = s.missed[len(s.missed)-sessions.size:]
+		}
+	}
+}
+
+// The number of sessions, retained or held by a connection
+func (sessions *Sessions) Len() int {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	return len(sessions.sessions)
+}
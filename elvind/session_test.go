@@ -0,0 +1,142 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+func TestSessionResume(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3956"
+	sessions := NewSessions(time.Minute, 2)
+	router := startTestRouter(url, func(r *Router) { r.SetSessions(sessions) })
+	defer router.Stop()
+
+	producer := elvin.NewClient(url, nil, nil, nil)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer producer.Disconnect()
+	notify := func(values ...int32) {
+		for _, value := range values {
+			if err := producer.Notify(map[string]interface{}{"Session": value}, true, nil); err != nil {
+				t.Fatalf("Notify failed: %v", err)
+			}
+		}
+	}
+
+	subscribe := func(options map[string]interface{}, resumed bool) (*elvin.Client, *elvin.Subscription) {
+		c := elvin.NewClient(url, options, nil, nil)
+		c.Events = make(chan elvin.Packet, 1) // No reconnecting
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if c.Resumed() != resumed {
+			t.Fatalf("Expected resumed %v", resumed)
+		}
+		sub := &elvin.Subscription{
+			Expression:     "require(Session)",
+			AcceptInsecure: true,
+			Notifications:  make(chan map[string]interface{}, 4),
+		}
+		if err := c.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		return c, sub
+	}
+	received := func(sub *elvin.Subscription, values ...int32) {
+		for _, value := range values {
+			select {
+			case nv := <-sub.Notifications:
+				if nv["Session"] != value {
+					t.Fatalf("Expected %d, got %v", value, nv)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Notification %d not delivered", value)
+			}
+		}
+	}
+
+	consumer, sub := subscribe(map[string]interface{}{elvin.SessionOption: "durable"}, false)
+	token := consumer.SessionToken()
+	if len(token) == 0 {
+		t.Fatalf("No session token issued")
+	}
+	notify(1)
+	received(sub, 1)
+
+	// Lose the connection
+	dropClients(router, func(c *Client) bool { return c.session == "durable" })
+	<-consumer.Events
+
+	// Only the latest two are buffered
+	notify(2, 3, 4)
+	for start := time.Now(); ; {
+		sessions.mu.Lock()
+		missed := len(sessions.sessions["durable"].missed)
+		sessions.mu.Unlock()
+		if missed == 2 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Notifications not buffered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Naming the session isn't enough to take it over
+	thief, _ := subscribe(map[string]interface{}{elvin.SessionOption: "durable"}, false)
+	if len(thief.SessionToken()) != 0 {
+		t.Fatalf("Session token issued without the secret")
+	}
+	thief.Disconnect()
+
+	consumer, sub = subscribe(map[string]interface{}{elvin.SessionOption: "durable", elvin.SessionTokenOption: token}, true)
+	received(sub, 3, 4)
+	notify(5)
+	received(sub, 5)
+
+	// A clean disconnect ends the session
+	if err := consumer.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if sessions.Len() != 0 {
+		t.Fatalf("Session retained after Disconnect")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	sessions := NewSessions(time.Millisecond, 2)
+	client := new(Client)
+	token, _ := sessions.Resume("expiring", "", client)
+	sessions.Retain("expiring", client, map[int32]*Subscription{1: &Subscription{Expression: "require(a)"}})
+	if sessions.Len() != 1 {
+		t.Fatalf("Session not retained")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, resumed := sessions.Resume("expiring", token, client); sessions.Len() != 1 || resumed {
+		t.Fatalf("Session not expired")
+	}
+}
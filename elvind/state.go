@@ -0,0 +1,95 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot of the router, see WriteState
+type RouterState struct {
+	Time          time.Time
+	Health        string
+	Clients       []ConnInfo
+	Subscriptions []SubscriptionEntry
+	Quenches      []QuenchEntry
+	Stats         RouterStats
+}
+
+// The router's counters
+type RouterStats struct {
+	DeliveryLatency        Latency
+	ExpiredNotifications   uint64
+	ShedConnections        uint64
+	DroppedNotifications   uint64
+	DuplicateNotifications uint64
+	AcceptPauses           AcceptPauseStats
+	Protocols              map[string]ProtocolStats
+}
+
+// Take a snapshot of the router
+func (router *Router) State() RouterState {
+	return RouterState{
+		Time:          time.Now(),
+		Health:        router.Health().String(),
+		Clients:       router.Clients(),
+		Subscriptions: router.SubscriptionTable(),
+		Quenches:      router.QuenchTable(),
+		Stats: RouterStats{
+			DeliveryLatency:        router.DeliveryLatency(),
+			ExpiredNotifications:   router.ExpiredNotifications(),
+			ShedConnections:        router.ShedConnections(),
+			DroppedNotifications:   router.DroppedNotifications(),
+			DuplicateNotifications: router.DuplicateNotifications(),
+			AcceptPauses:           router.AcceptPauseStats(),
+			Protocols:              router.ProtocolStats(),
+		},
+	}
+}
+
+// Write a snapshot of the router to path as JSON. It's written to a
+// temporary file first so readers never see part of one.
+func (router *Router) WriteState(path string) error {
+	data, err := json.MarshalIndent(router.State(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
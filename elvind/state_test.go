@@ -0,0 +1,94 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/cobaro/elvin/elvin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	defer checkLeaks(t)()
+
+	dir, err := ioutil.TempDir("", "elvind-state")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	url := "elvin://localhost:3958"
+	protocol, _ := elvin.URLToProtocol(url)
+	manager := new(Manager)
+	manager.config = DefaultConfig()
+	manager.config.StateFile = filepath.Join(dir, "state.json")
+	manager.router.AddProtocol(protocol.Address, protocol)
+	go manager.router.Start()
+	defer manager.router.Stop()
+	time.Sleep(time.Millisecond * 10) // Yield to get that started
+
+	c := elvin.NewClient(url, nil, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+	sub := &elvin.Subscription{Expression: "require(StateDump)", AcceptInsecure: true}
+	if err := c.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	quench := &elvin.Quench{Names: map[string]bool{"StateDump": true}, DeliverInsecure: true}
+	if err := c.Quench(quench); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	manager.DumpState()
+	data, err := ioutil.ReadFile(manager.config.StateFile)
+	if err != nil {
+		t.Fatalf("State not written: %v", err)
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		t.Fatalf("State isn't JSON: %v\n%s", err, data)
+	}
+	for _, section := range []string{"Health", "Clients", "Subscriptions", "Quenches", "Stats"} {
+		if _, ok := sections[section]; !ok {
+			t.Fatalf("State missing %s:\n%s", section, data)
+		}
+	}
+
+	var state RouterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("State doesn't decode: %v", err)
+	}
+	if len(state.Clients) != 1 || len(state.Subscriptions) != 1 || len(state.Quenches) != 1 {
+		t.Fatalf("Unexpected state:\n%s", data)
+	}
+	if state.Subscriptions[0].SubID != sub.SubID() || state.Subscriptions[0].Expression != sub.Expression {
+		t.Fatalf("Unexpected subscription %+v", state.Subscriptions[0])
+	}
+	if state.Quenches[0].QuenchID != quench.QuenchID() || state.Quenches[0].ClientID != state.Clients[0].ID {
+		t.Fatalf("Unexpected quench %+v", state.Quenches[0])
+	}
+}
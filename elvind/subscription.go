@@ -22,27 +22,88 @@ package main
 
 import (
 	"github.com/cobaro/elvin/elvin"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // A Subscription
 type Subscription struct {
 	SubID          int64
+	Expression     string // As the client gave it
 	AcceptInsecure bool
 	Keys           elvin.KeyBlock
 	Ast            *elvin.AST
+	MaxSize        int      // Withhold larger notifications if positive
+	Oversize       uint64   // atomic, notifications withheld by MaxSize
+	Paused         int32    // atomic, withhold all notifications if set
+	Projection     []string // Deliver only these attributes if set
+	Reliable       bool     // Redeliver until acked
+	Evaluations    uint64   // atomic, notifications matched against it
+	EvalNanos      uint64   // atomic, time spent matching them
 }
 
-// Parse a subscription expression into an AST
+// A subscription as listed by SubscriptionTable
+type SubscriptionEntry struct {
+	SubID          int64
+	ClientID       int32 // The owning connection
+	Expression     string
+	AcceptInsecure bool
+	Keyed          bool // Has keys, which aren't listed
+	Paused         bool
+	MaxSize        int
+	Projection     []string
+	Evaluations    uint64
+	EvalTime       time.Duration // Spent matching notifications
+}
+
+// A snapshot of every client's subscriptions, ordered by SubID
+func (router *Router) SubscriptionTable() (table []SubscriptionEntry) {
+	for _, c := range router.clientList() {
+		c.subsMu.RLock()
+		for _, sub := range c.subs {
+			table = append(table, SubscriptionEntry{
+				SubID:          sub.SubID,
+				ClientID:       c.ID(),
+				Expression:     sub.Expression,
+				AcceptInsecure: sub.AcceptInsecure,
+				Keyed:          !elvin.KeyBlockEmpty(sub.Keys),
+				Paused:         atomic.LoadInt32(&sub.Paused) != 0,
+				MaxSize:        sub.MaxSize,
+				Projection:     sub.Projection,
+				Evaluations:    atomic.LoadUint64(&sub.Evaluations),
+				EvalTime:       time.Duration(atomic.LoadUint64(&sub.EvalNanos)),
+			})
+		}
+		c.subsMu.RUnlock()
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].SubID < table[j].SubID })
+	return table
+}
+
+// Parse a subscription expression into an AST, ordered to test
+// cheap operands first
 func Parse(subexpr string) (ast *elvin.AST, n *elvin.Nack) {
-	// For now 'bogus' fails and everything else succeeds
-	if subexpr == "bogus" {
+	parser := elvin.Parser{Reorder: true}
+	ast, err := parser.Parse(subexpr)
+	if err != nil {
+		parseError := err.(*elvin.ParseError)
 		nack := new(elvin.Nack)
-		nack.ErrorCode = elvin.ErrorsParsing
-		nack.Message = elvin.ProtocolErrors[elvin.ErrorsParsing].Message
-		nack.Args = make([]interface{}, 2)
-		nack.Args[0] = "bogus"
-		nack.Args[1] = int32(0)
+		nack.ErrorCode = parseError.ErrorCode
+		nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+		nack.Args = parseError.Args
 		return nil, nack
 	}
-	return nil, nil
+	return ast, nil
+}
+
+// A copy of a notification with only the named attributes
+func Project(nv map[string]interface{}, names []string) map[string]interface{} {
+	projected := make(map[string]interface{}, len(names)+1)
+	for _, name := range names {
+		if value, ok := nv[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected
 }
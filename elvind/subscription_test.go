@@ -21,10 +21,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/cobaro/elvin/elvin"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -64,10 +71,28 @@ func TestMain(m *testing.M) {
 	os.Exit(ret)
 }
 
+// Start an extra router for tests needing their own configuration.
+// The configure function is called before the router starts.
+func startTestRouter(url string, configure func(*Router)) *Router {
+	protocol, _ := elvin.URLToProtocol(url)
+	router := new(Router)
+	router.SetMaxConnections(10)
+	router.SetDoFailover(false)
+	router.SetTestConnInterval(10 * time.Second)
+	router.SetTestConnTimeout(10 * time.Second)
+	router.AddProtocol(protocol.Address, protocol)
+	if configure != nil {
+		configure(router)
+	}
+	go router.Start()
+	time.Sleep(time.Millisecond * 10) // Yield to get that started
+	return router
+}
+
 func TestSubscriptionFail(t *testing.T) {
 	// Add a subscription
 	sub := new(elvin.Subscription)
-	sub.Expression = "bogus"
+	sub.Expression = "bogus =="
 	sub.AcceptInsecure = true
 	sub.Keys = nil
 	sub.Notifications = make(chan map[string]interface{})
@@ -79,6 +104,8 @@ func TestSubscriptionFail(t *testing.T) {
 }
 
 func TestSubscriptionPass(t *testing.T) {
+	defer checkLeaks(t)()
+
 	// Create a client
 	// Add a subscription
 	sub := new(elvin.Subscription)
@@ -116,3 +143,794 @@ func TestSubscriptionPass(t *testing.T) {
 	}
 
 }
+
+// A stand in for a generated protobuf message
+type testMessage struct {
+	Text string
+}
+
+func (m *testMessage) Unmarshal(data []byte) error {
+	if len(data) == 0 || data[0] != 0x0a {
+		return errors.New("bad tag")
+	}
+	m.Text = string(data[1:])
+	return nil
+}
+
+func TestSubscriptionTyped(t *testing.T) {
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestTyped)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	sub.Payload = "Payload"
+	sub.Decoder = elvin.UnmarshalDecoder(new(testMessage))
+	sub.Typed = make(chan interface{})
+
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	defer client.SubscriptionDelete(sub)
+
+	// A decodable payload arrives typed
+	nfn := map[string]interface{}{"TestTyped": int32(1), "Payload": []byte("\x0ahello")}
+	if err := client.Notify(nfn, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	select {
+	case v := <-sub.Typed:
+		m, ok := v.(*testMessage)
+		if !ok || m.Text != "hello" {
+			t.Fatalf("Received bad typed notification %v", v)
+		}
+	case <-sub.Notifications:
+		t.Fatalf("Received map instead of typed notification")
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+
+	// An undecodable payload falls back to the map
+	nfn = map[string]interface{}{"TestTyped": int32(2), "Payload": []byte("junk")}
+	if err := client.Notify(nfn, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	select {
+	case nfn := <-sub.Notifications:
+		if nfn["TestTyped"] != int32(2) {
+			t.Fatalf("Received unmatched notification")
+		}
+	case <-sub.Typed:
+		t.Fatalf("Received typed notification for bad payload")
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+}
+
+// Holds up subscriptions until released
+type stallAuthorizer struct {
+	AllowAll
+	release chan bool
+}
+
+func (a stallAuthorizer) AuthorizeSubscribe(info ConnInfo, expr string) error {
+	<-a.release
+	return nil
+}
+
+func TestSubscribeContextCancel(t *testing.T) {
+	url := "elvin://localhost:3919"
+	stall := stallAuthorizer{release: make(chan bool)}
+	router := startTestRouter(url, func(r *Router) { r.SetAuthorizer(stall) })
+	defer router.Stop()
+
+	sc := elvin.NewClient(url, nil, nil, nil)
+	if err := sc.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer sc.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestCancel)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := sc.SubscribeContext(ctx, sub); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Let the router reply late, which must be ignored, and check
+	// the connection is still usable
+	close(stall.release)
+	if err := sc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe after cancel failed: %v", err)
+	}
+
+	// The late subscription is deleted, leaving only that one
+	subs := func() (n int) {
+		router.Mu.Lock()
+		defer router.Mu.Unlock()
+		for _, c := range router.clients {
+			c.subsMu.RLock()
+			n += len(c.subs)
+			c.subsMu.RUnlock()
+		}
+		return n
+	}
+	for start := time.Now(); subs() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected 1 subscription on the router, got %d", subs())
+		}
+	}
+}
+
+func TestSubscriptionExistence(t *testing.T) {
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestExists"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	defer client.SubscriptionDelete(sub)
+
+	// Lacking the attribute must not match, having it with a zero
+	// value must
+	if err := client.Notify(map[string]interface{}{"TestOther": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	if err := client.Notify(map[string]interface{}{"TestExists": int32(0)}, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+
+	select {
+	case nfn := <-sub.Notifications:
+		if v, ok := nfn["TestExists"]; !ok || v != int32(0) {
+			t.Fatalf("Received unmatched notification %v", nfn)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+}
+
+func TestConnectOver(t *testing.T) {
+	router := new(Router)
+	router.Init()
+
+	clientEnd, routerEnd := net.Pipe()
+	router.Serve(routerEnd)
+
+	pc := elvin.NewClient("elvin://", nil, nil, nil)
+	if err := pc.ConnectOver(clientEnd); err != nil {
+		t.Fatalf("ConnectOver failed: %v", err)
+	}
+	if err := pc.ConnectOver(clientEnd); err == nil {
+		t.Fatalf("ConnectOver when connected passed")
+	}
+
+	// Exercise the connection
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestPipe)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := pc.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	if err := pc.Notify(map[string]interface{}{"TestPipe": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed %v", err)
+	}
+	select {
+	case <-sub.Notifications:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+
+	if err := pc.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3917"
+	keys := elvin.KeyBlock{elvin.KeySchemeSha1Dual: elvin.KeySetList{{elvin.Key("secret")}, {}}}
+
+	old := elvin.NewClient(url, nil, nil, nil)
+	if err := old.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(TestExport)",
+		AcceptInsecure: true,
+		Keys:           keys,
+		Notifications:  make(chan map[string]interface{}),
+	}
+	if err := old.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	quench := &elvin.Quench{
+		Names:         map[string]bool{"TestExport": true},
+		Keys:          keys,
+		Notifications: make(chan elvin.QuenchNotification),
+	}
+	if err := old.Quench(quench); err != nil {
+		t.Fatalf("Quench failed: %v", err)
+	}
+
+	// Keys are only exported on request
+	if state, err := old.ExportState(false); err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	} else if subs, quenches, err := elvin.LoadState(state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	} else if !elvin.KeyBlockEmpty(subs[0].Keys) || !elvin.KeyBlockEmpty(quenches[0].Keys) {
+		t.Fatalf("ExportState included keys: %s", state)
+	}
+	state, err := old.ExportState(true)
+	if err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
+	old.Disconnect()
+
+	fresh := elvin.NewClient(url, nil, nil, nil)
+	if err := fresh.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer fresh.Disconnect()
+
+	subs, quenches, err := fresh.ImportState(state)
+	if err != nil {
+		t.Fatalf("ImportState failed: %v", err)
+	}
+	if len(subs) != 1 || len(quenches) != 1 {
+		t.Fatalf("Expected 1 subscription and 1 quench, got %d and %d", len(subs), len(quenches))
+	}
+	if subs[0].Expression != sub.Expression || !subs[0].AcceptInsecure || !elvin.KeyBlockEqual(subs[0].Keys, keys) {
+		t.Errorf("Subscription didn't round trip: %+v", subs[0])
+	}
+	if !quenches[0].Names["TestExport"] || !elvin.KeyBlockEqual(quenches[0].Keys, keys) {
+		t.Errorf("Quench didn't round trip: %+v", quenches[0])
+	}
+
+	if err := fresh.Notify(map[string]interface{}{"TestExport": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nfn := <-subs[0].Notifications:
+		if nfn["TestExport"] != int32(1) {
+			t.Errorf("Received unmatched notification")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Imported subscription not re-established")
+	}
+
+	fresh.SubscriptionDelete(subs[0])
+	fresh.QuenchDelete(quenches[0])
+}
+
+func TestMatchCount(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3943"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	var clients []*elvin.Client
+	for i, exprs := range [][]string{
+		{"Price > 10", "Symbol == 'ACME'", "Volume > 100"},
+		{"Price < 5 && Symbol == 'XYZ'", "Other == 1"},
+	} {
+		ec := elvin.NewClient(url, nil, nil, nil)
+		if err := ec.Connect(); err != nil {
+			t.Fatalf("Connect %d failed: %v", i, err)
+		}
+		clients = append(clients, ec)
+		for _, expr := range exprs {
+			if err := ec.Subscribe(&elvin.Subscription{Expression: expr, AcceptInsecure: true}); err != nil {
+				t.Fatalf("Subscribe %s failed: %v", expr, err)
+			}
+		}
+	}
+	ec := clients[0]
+
+	for expr, expected := range map[string]int{
+		"":                              5,
+		"Price == 1":                    2,
+		"Symbol":                        2,
+		"Volume > 0 || Other == 2":      2,
+		"require(Nothing)":              0,
+		"Price > 0 && Symbol == 'ACME'": 3,
+	} {
+		if count, err := ec.MatchCount(expr); err != nil || count != expected {
+			t.Errorf("MatchCount(%s): expected %d got %d %v", expr, expected, count, err)
+		}
+	}
+
+	nv := map[string]interface{}{"Price": int32(20), "Symbol": "ACME"}
+	if count, err := ec.MatchCountNotification(nv, true, nil); err != nil || count != 2 {
+		t.Errorf("MatchCountNotification(%v): expected 2 got %d %v", nv, count, err)
+	}
+	nv = map[string]interface{}{"Price": int32(1), "Symbol": "XYZ", "Other": int32(1)}
+	if count, err := clients[1].MatchCountNotification(nv, true, nil); err != nil || count != 2 {
+		t.Errorf("MatchCountNotification(%v): expected 2 got %d %v", nv, count, err)
+	}
+
+	// Only subscriptions the notification could reach count
+	secret := []byte("TestMatchCount")
+	keyed := &elvin.Subscription{
+		Expression: "require(Other)",
+		Keys:       elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{elvin.PrimeSha1(secret)}}},
+	}
+	if err := ec.Subscribe(keyed); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if count, err := clients[1].MatchCountNotification(nv, true, nil); err != nil || count != 2 {
+		t.Errorf("Unkeyed MatchCountNotification(%v): expected 2 got %d %v", nv, count, err)
+	}
+	keys := elvin.KeyBlock{elvin.KeySchemeSha1Producer: elvin.KeySetList{elvin.KeySet{secret}}}
+	if count, err := clients[1].MatchCountNotification(nv, false, keys); err != nil || count != 1 {
+		t.Errorf("Keyed MatchCountNotification(%v): expected 1 got %d %v", nv, count, err)
+	}
+	if err := ec.SubscriptionDelete(keyed); err != nil {
+		t.Fatalf("SubscriptionDelete failed: %v", err)
+	}
+
+	if _, err := ec.MatchCount("Price =="); err == nil {
+		t.Errorf("MatchCount with a bad expression succeeded")
+	}
+
+	// Point in time
+	clients[1].Disconnect()
+	if count, err := ec.MatchCount("Symbol"); err != nil || count != 1 {
+		t.Errorf("MatchCount after disconnect: expected 1 got %d %v", count, err)
+	}
+	ec.Disconnect()
+}
+
+func TestMaxNotificationSize(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3944"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	limited := &elvin.Subscription{
+		Expression:          "require(Control)",
+		AcceptInsecure:      true,
+		MaxNotificationSize: 64,
+		Notifications:       make(chan map[string]interface{}, 4),
+	}
+	unlimited := &elvin.Subscription{
+		Expression:     "require(Control)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 4),
+	}
+	for _, sub := range []*elvin.Subscription{limited, unlimited} {
+		if err := ec.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	large := map[string]interface{}{"Control": int32(1), "Bulk": make([]byte, 1024)}
+	small := map[string]interface{}{"Control": int32(2)}
+	for _, nv := range []map[string]interface{}{large, small} {
+		if err := ec.Notify(nv, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+
+	for _, expected := range []int32{1, 2} {
+		select {
+		case nv := <-unlimited.Notifications:
+			if nv["Control"] != expected {
+				t.Fatalf("Unlimited expected %d got %v", expected, nv["Control"])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Unlimited timed out waiting for %d", expected)
+		}
+	}
+	select {
+	case nv := <-limited.Notifications:
+		if nv["Control"] != int32(2) {
+			t.Fatalf("Limited was delivered %v", nv["Control"])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Limited timed out")
+	}
+
+	if n := router.Oversize(limited.SubID()); n != 1 {
+		t.Errorf("Expected 1 oversize notification withheld, got %d", n)
+	}
+	if n := router.Oversize(unlimited.SubID()); n != 0 {
+		t.Errorf("Expected nothing withheld without a limit, got %d", n)
+	}
+	ec.Disconnect()
+}
+
+func TestDedupSubscriptions(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3945"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	ec.DedupSubscriptions = elvin.DedupReuse
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	first := &elvin.Subscription{Expression: "require(Retry)", AcceptInsecure: true}
+	if err := ec.Subscribe(first); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	again := &elvin.Subscription{Expression: "require(Retry)", AcceptInsecure: true}
+	err := ec.Subscribe(again)
+	if dup, ok := err.(*elvin.DuplicateSubscriptionError); !ok || dup.Existing != first {
+		t.Fatalf("Expected a DuplicateSubscriptionError for the first subscription, got %v", err)
+	}
+	if count := router.MatchCount(nil, nil); count != 1 {
+		t.Fatalf("Expected one router subscription, got %d", count)
+	}
+
+	// Anything different isn't a duplicate
+	other := &elvin.Subscription{Expression: "require(Retry)"}
+	if err := ec.Subscribe(other); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if count := router.MatchCount(nil, nil); count != 2 {
+		t.Fatalf("Expected two router subscriptions, got %d", count)
+	}
+	ec.Disconnect()
+}
+
+func TestSubscriptionPause(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3948"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(Pause)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 4),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	expect := func(n int32, delivered bool) {
+		if err := ec.Notify(map[string]interface{}{"Pause": n}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+		select {
+		case nv := <-sub.Notifications:
+			if !delivered || nv["Pause"] != n {
+				t.Fatalf("Unexpected delivery %v", nv)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if delivered {
+				t.Fatalf("Notification %d wasn't delivered", n)
+			}
+		}
+	}
+
+	expect(1, true)
+	if err := ec.SubscriptionPause(sub); err != nil || !sub.Paused() {
+		t.Fatalf("SubscriptionPause failed: %v", err)
+	}
+	expect(2, false)
+	expect(3, false)
+	if err := ec.SubscriptionResume(sub); err != nil || sub.Paused() {
+		t.Fatalf("SubscriptionResume failed: %v", err)
+	}
+	expect(4, true)
+
+	// An unknown subscription is refused
+	if err := ec.SubscriptionPause(&elvin.Subscription{}); err == nil {
+		t.Fatalf("Pausing an unknown subscription succeeded")
+	}
+	ec.Disconnect()
+}
+
+func TestProjection(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3952"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	projected := &elvin.Subscription{
+		Expression:     "require(Symbol)",
+		AcceptInsecure: true,
+		Projection:     []string{"Symbol", "Price", "Missing"},
+		Notifications:  make(chan map[string]interface{}, 1),
+	}
+	full := &elvin.Subscription{
+		Expression:     "require(Symbol)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 1),
+	}
+	for _, sub := range []*elvin.Subscription{projected, full} {
+		if err := ec.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	nv := map[string]interface{}{"Symbol": "ACME", "Price": 12.5, "Volume": int32(100), "Bulk": make([]byte, 512)}
+	if err := ec.Notify(nv, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		sub      *elvin.Subscription
+		expected []string
+	}{
+		{projected, []string{"Symbol", "Price"}},
+		{full, []string{"Symbol", "Price", "Volume", "Bulk"}},
+	} {
+		select {
+		case got := <-c.sub.Notifications:
+			if len(got) != len(c.expected) {
+				t.Fatalf("Expected %v got %v", c.expected, got)
+			}
+			for _, name := range c.expected {
+				if _, ok := got[name]; !ok {
+					t.Fatalf("Expected %v got %v", c.expected, got)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Notification wasn't delivered")
+		}
+	}
+	ec.Disconnect()
+}
+
+func TestOpaqueEquality(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3960"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "Key == hex('deadbeef')",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 4),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	for i, key := range []interface{}{
+		[]byte{0xde, 0xad},
+		"deadbeef",
+		[]byte{0xde, 0xad, 0xbe, 0xef, 0},
+		[]byte{0xde, 0xad, 0xbe, 0xef},
+	} {
+		if err := ec.Notify(map[string]interface{}{"Key": key, "n": int32(i)}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	if err := ec.Notify(map[string]interface{}{"n": int32(4)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	select {
+	case nv := <-sub.Notifications:
+		if nv["n"] != int32(3) {
+			t.Fatalf("Expected only the matching key, got %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Notification wasn't delivered")
+	}
+	select {
+	case nv := <-sub.Notifications:
+		t.Fatalf("Unexpected %v", nv)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ec.Disconnect()
+}
+
+func TestEvaluationCost(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3961"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	cheap := &elvin.Subscription{
+		Expression:     "require(Text)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 16),
+	}
+	costly := &elvin.Subscription{
+		Expression:     "regex(Text, '(a|b)*c(a|b)*d$', '^(ab|ba)*x')",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 16),
+	}
+	for _, sub := range []*elvin.Subscription{cheap, costly} {
+		if err := ec.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	text := strings.Repeat("ab", 32*1024)
+	for i := 0; i < 10; i++ {
+		if err := ec.Notify(map[string]interface{}{"Text": text}, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+		select {
+		case <-cheap.Notifications:
+		case <-time.After(time.Second):
+			t.Fatalf("Notification wasn't delivered")
+		}
+	}
+
+	// The engine may still be evaluating the last one
+	var c, e SubscriptionEntry
+	for i := 0; i < 100 && (c.Evaluations < 10 || e.Evaluations < 10); i++ {
+		time.Sleep(time.Millisecond)
+		for _, entry := range router.SubscriptionTable() {
+			switch entry.SubID {
+			case cheap.SubID():
+				c = entry
+			case costly.SubID():
+				e = entry
+			}
+		}
+	}
+	if c.Evaluations != 10 || e.Evaluations != 10 {
+		t.Fatalf("Expected 10 evaluations each, got %d and %d", c.Evaluations, e.Evaluations)
+	}
+	if e.EvalTime <= c.EvalTime {
+		t.Fatalf("Expected the regex to cost more, got %v and %v", e.EvalTime, c.EvalTime)
+	}
+
+	w := httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/subscriptions", nil))
+	if body := w.Body.String(); !strings.Contains(body, "evaluations=10 ") {
+		t.Fatalf("Missing evaluations in %s", body)
+	}
+	ec.Disconnect()
+}
+
+func TestSubscriptionQuota(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3965"
+	router := startTestRouter(url, func(router *Router) { router.SetSubscriptionQuota(2) })
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if remaining := ec.SubscriptionQuotaRemaining(); remaining != -1 {
+		t.Fatalf("Expected no quota before connecting, got %d", remaining)
+	}
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if remaining := ec.SubscriptionQuotaRemaining(); remaining != 2 {
+		t.Fatalf("Expected a quota of 2, got %d", remaining)
+	}
+
+	var subs []*elvin.Subscription
+	for i, expr := range []string{"Quota == 0", "Quota == 1"} {
+		sub := &elvin.Subscription{Expression: expr, Notifications: make(chan map[string]interface{})}
+		if err := ec.Subscribe(sub); err != nil {
+			t.Fatalf("Subscribe %d failed: %v", i, err)
+		}
+		if remaining := ec.SubscriptionQuotaRemaining(); remaining != 1-i {
+			t.Fatalf("Expected %d remaining, got %d", 1-i, remaining)
+		}
+		subs = append(subs, sub)
+	}
+
+	over := &elvin.Subscription{Expression: "Quota == 2", Notifications: make(chan map[string]interface{})}
+	if err := ec.Subscribe(over); err == nil {
+		t.Fatalf("Subscribe beyond the quota succeeded")
+	}
+	if remaining := ec.SubscriptionQuotaRemaining(); remaining != 0 {
+		t.Fatalf("Refused subscription changed the quota to %d", remaining)
+	}
+
+	if err := ec.SubscriptionDelete(subs[0]); err != nil {
+		t.Fatalf("SubscriptionDelete failed: %v", err)
+	}
+	if remaining := ec.SubscriptionQuotaRemaining(); remaining != 1 {
+		t.Fatalf("Expected 1 remaining after a delete, got %d", remaining)
+	}
+	if err := ec.Subscribe(over); err != nil {
+		t.Fatalf("Subscribe within the quota failed: %v", err)
+	}
+
+	// A lowered quota applies to the existing connection
+	router.SetSubscriptionQuota(1)
+	if err := ec.SubscriptionDelete(subs[1]); err != nil {
+		t.Fatalf("SubscriptionDelete failed: %v", err)
+	}
+	again := &elvin.Subscription{Expression: "Quota == 3", Notifications: make(chan map[string]interface{})}
+	if err := ec.Subscribe(again); err == nil {
+		t.Fatalf("Subscribe beyond the lowered quota succeeded")
+	}
+
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
+
+func TestSubscriptionRemoved(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3967"
+	router := startTestRouter(url, nil)
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	ec.AnomalyChannel = make(chan elvin.Anomaly, 4)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(Removed)",
+		AcceptInsecure: true,
+		CloseOnDelete:  true,
+		Notifications:  make(chan map[string]interface{}, 1),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	table := router.SubscriptionTable()
+	if len(table) != 1 {
+		t.Fatalf("Expected one subscription, got %v", table)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("POST", fmt.Sprintf("/unsubscribe?sub=%d", table[0].SubID), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Unsubscribe failed: %s", recorder.Body.String())
+	}
+
+	select {
+	case anomaly := <-ec.AnomalyChannel:
+		if anomaly.Type != elvin.AnomalySubscriptionRemoved || !strings.Contains(anomaly.Description, "administrator") {
+			t.Fatalf("Unexpected anomaly %v", anomaly)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Removal wasn't reported")
+	}
+	if _, open := <-sub.Notifications; open {
+		t.Fatalf("Removed subscription's channel is still open")
+	}
+	if table := router.SubscriptionTable(); len(table) != 0 {
+		t.Fatalf("Subscription wasn't removed: %v", table)
+	}
+	if err := router.RemoveSubscription(table[0].SubID, elvin.SubRemovedReasonAdmin, "again"); err == nil {
+		t.Fatalf("Removing a removed subscription succeeded")
+	}
+
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elog"
+)
+
+// A Transformer rewrites each notification once as it's accepted,
+// before it's matched against subscriptions, e.g. to add, rename or
+// remove attributes. It may modify nv in place and return it, or
+// return a new map. On error it should leave nv unchanged.
+type Transformer interface {
+	Transform(nv map[string]interface{}) (map[string]interface{}, error)
+}
+
+// Adapt a function to a Transformer
+type TransformFunc func(nv map[string]interface{}) (map[string]interface{}, error)
+
+func (f TransformFunc) Transform(nv map[string]interface{}) (map[string]interface{}, error) {
+	return f(nv)
+}
+
+// The transforms applied to each notification, in order. The slice
+// is replaced rather than appended to, so a copy of the pipeline is
+// safe to use while transforms are added.
+type transformPipeline struct {
+	transforms []Transformer
+	pass       bool // on error skip the transform rather than drop the notification
+}
+
+// Append a transform to the pipeline run on each notification from
+// clients and peers. It applies to existing connections too.
+func (router *Router) AddTransform(transform Transformer) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	transforms := make([]Transformer, len(router.transforms.transforms), len(router.transforms.transforms)+1)
+	copy(transforms, router.transforms.transforms)
+	router.transforms.transforms = append(transforms, transform)
+}
+
+// Choose what happens to a notification when a transform fails: drop
+// it (the default), or pass it on to the remaining transforms and
+// routing as though the failing transform wasn't there.
+func (router *Router) SetTransformErrorPass(pass bool) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.transforms.pass = pass
+}
+
+// The current pipeline, for one notification
+func (router *Router) transformPipeline() transformPipeline {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.transforms
+}
+
+// Run nv through the pipeline. A nil result means it should be
+// dropped, and err is the first transform error, if any.
+func (pipeline *transformPipeline) apply(nv map[string]interface{}) (result map[string]interface{}, err error) {
+	result = nv
+	for _, transform := range pipeline.transforms {
+		transformed, terr := transform.Transform(result)
+		if terr != nil {
+			if err == nil {
+				err = terr
+			}
+			if !pipeline.pass {
+				return nil, err
+			}
+			continue
+		}
+		result = transformed
+	}
+	return result, err
+}
+
+// Run a client's notification through its transforms, logging any
+// error. A nil result means it's dropped.
+func (client *Client) transform(nv map[string]interface{}) map[string]interface{} {
+	pipeline := client.transforms()
+	if len(pipeline.transforms) == 0 {
+		return nv
+	}
+	result, err := pipeline.apply(nv)
+	if err != nil {
+		client.elog.Logf(elog.LogLevelInfo2, "Client %d notification transform failed: %v", client.ID(), err)
+	}
+	return result
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+func TestTransformPipeline(t *testing.T) {
+	defer checkLeaks(t)()
+
+	url := "elvin://localhost:3964"
+	router := startTestRouter(url, func(router *Router) {
+		// Stamp every notification, then refuse those marked Reject
+		router.AddTransform(TransformFunc(func(nv map[string]interface{}) (map[string]interface{}, error) {
+			nv["Received"] = time.Now().UnixNano()
+			return nv, nil
+		}))
+		router.AddTransform(TransformFunc(func(nv map[string]interface{}) (map[string]interface{}, error) {
+			if _, ok := nv["Reject"]; ok {
+				return nv, fmt.Errorf("rejected")
+			}
+			return nv, nil
+		}))
+	})
+	defer router.Stop()
+
+	ec := elvin.NewClient(url, nil, nil, nil)
+	if err := ec.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := &elvin.Subscription{
+		Expression:     "require(Transformed)",
+		AcceptInsecure: true,
+		Notifications:  make(chan map[string]interface{}, 4),
+	}
+	if err := ec.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// The failing transform drops the first, the second is stamped
+	before := time.Now().UnixNano()
+	for _, nv := range []map[string]interface{}{
+		{"Transformed": int32(1), "Reject": int32(1)},
+		{"Transformed": int32(2)},
+	} {
+		if err := ec.Notify(nv, true, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["Transformed"] != int32(2) {
+			t.Fatalf("Expected the rejected notification to be dropped, got %v", nv)
+		}
+		if received, ok := nv["Received"].(int64); !ok || received < before {
+			t.Fatalf("Notification wasn't stamped: %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Notification wasn't delivered")
+	}
+
+	// Changes to the pipeline apply to the existing connection
+	router.SetTransformErrorPass(true)
+	router.AddTransform(TransformFunc(func(nv map[string]interface{}) (map[string]interface{}, error) {
+		nv["Added"] = int32(1)
+		return nv, nil
+	}))
+	if err := ec.Notify(map[string]interface{}{"Transformed": int32(3), "Reject": int32(1)}, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case nv := <-sub.Notifications:
+		if nv["Transformed"] != int32(3) || nv["Added"] != int32(1) {
+			t.Fatalf("Expected the rejected notification passed and transformed, got %v", nv)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Notification wasn't delivered")
+	}
+
+	if err := ec.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/cobaro/elvin/elog"
+	"sync/atomic"
+	"time"
+)
+
+// A logical router served on ssl protocols to connections naming it
+// by TLS SNI. Once any are set, connections for other names are
+// refused.
+type VirtualHost struct {
+	Config *tls.Config // Certificate etc, nil for the router's TLSConfig
+	Router *Router     // Where its clients are served, nil for this router
+}
+
+// Serve a TLS server name as a virtual host, or stop if host is nil
+func (router *Router) SetVirtualHost(serverName string, host *VirtualHost) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	if host == nil {
+		delete(router.virtualHosts, serverName)
+		return
+	}
+	if router.virtualHosts == nil {
+		router.virtualHosts = make(map[string]*VirtualHost)
+	}
+	router.virtualHosts[serverName] = host
+}
+
+// Get the virtual host for a TLS server name, nil if there's none
+func (router *Router) VirtualHost(serverName string) *VirtualHost {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.virtualHosts[serverName]
+}
+
+// Are we serving any virtual hosts?
+func (router *Router) virtualHosting() bool {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return len(router.virtualHosts) > 0
+}
+
+// Extend a listener's TLS configuration to choose each connection's
+// configuration by its server name
+func (router *Router) virtualConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		return nil
+	}
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !router.virtualHosting() {
+			return nil, nil
+		}
+		host := router.VirtualHost(hello.ServerName)
+		if host == nil {
+			return nil, fmt.Errorf("Unknown server name %q", hello.ServerName)
+		}
+		return host.Config, nil
+	}
+	return config
+}
+
+// Complete the TLS handshake to learn which virtual host a connection
+// is for, then serve it there
+func (router *Router) serveVirtual(conn *tls.Conn, name string, counters *protocolCounters) {
+	if timeout := router.HandshakeTimeout(); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+
+	var host *VirtualHost
+	if err == nil {
+		if host = router.VirtualHost(conn.ConnectionState().ServerName); host == nil {
+			err = fmt.Errorf("Unknown server name %q", conn.ConnectionState().ServerName)
+		}
+	}
+	if err != nil {
+		router.elog.Logf(elog.LogLevelInfo1, "Refusing connection from %s: %v", conn.RemoteAddr(), err)
+		if counters != nil {
+			atomic.AddUint64(&counters.rejects, 1)
+		}
+		conn.Close()
+		return
+	}
+
+	if host.Router != nil && host.Router != router {
+		host.Router.Serve(conn)
+	} else {
+		router.serve(conn, name, counters)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/cobaro/elvin/elvin"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate for a server name
+func testCertificate(t *testing.T, serverName string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestVirtualHosts(t *testing.T) {
+	defer checkLeaks(t)()
+
+	certA, x509A := testCertificate(t, "a.example")
+	certB, x509B := testCertificate(t, "b.example")
+	roots := x509.NewCertPool()
+	roots.AddCert(x509A)
+	roots.AddCert(x509B)
+
+	other := new(Router)
+	other.SetTestConnInterval(10 * time.Second)
+	other.SetTestConnTimeout(10 * time.Second)
+	go other.Start()
+	defer other.Stop()
+
+	connected := make(chan ConnInfo, 1)
+	router := startTestRouter("elvin:/ssl,xdr/localhost:3944", func(r *Router) {
+		r.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{certA}})
+		r.SetVirtualHost("a.example", &VirtualHost{})
+		r.SetVirtualHost("b.example", &VirtualHost{
+			Config: &tls.Config{Certificates: []tls.Certificate{certB}},
+			Router: other})
+		r.SetOnConnect(func(info ConnInfo) { connected <- info })
+	})
+	defer router.Stop()
+
+	connect := func(serverName string) (*elvin.Client, error) {
+		conn, err := tls.Dial("tcp", "localhost:3944", &tls.Config{ServerName: serverName, RootCAs: roots})
+		if err != nil {
+			return nil, err
+		}
+		ec := elvin.NewClient("elvin://localhost:3944", nil, nil, nil)
+		return ec, ec.ConnectOver(conn)
+	}
+
+	a, err := connect("a.example")
+	if err != nil {
+		t.Fatalf("Connect to a.example failed: %v", err)
+	}
+	select {
+	case info := <-connected:
+		if info.ServerName != "a.example" {
+			t.Fatalf("Expected a.example, got %q", info.ServerName)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("a.example wasn't served here")
+	}
+
+	b, err := connect("b.example")
+	if err != nil {
+		t.Fatalf("Connect to b.example failed: %v", err)
+	}
+	if router.ClientCount() != 1 || other.ClientCount() != 1 {
+		t.Fatalf("Expected one client each, got %d and %d", router.ClientCount(), other.ClientCount())
+	}
+
+	if _, err := connect("c.example"); err == nil {
+		t.Fatalf("Connect to an unknown server name succeeded")
+	}
+
+	a.Disconnect()
+	b.Disconnect()
+}
@@ -0,0 +1,356 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package memtransport provides in-memory connections for testing
+// clients and routers without sockets. Each end of a Pipe is a
+// net.Conn whose behaviour can be changed while it's in use:
+//
+//	SetLatency   Delay before written data can be read by the peer
+//	SetBandwidth Limit the bytes per second written
+//	SetChunk     Limit the bytes returned by each Read (partial reads)
+//	InjectError  Fail Reads and Writes with an error until cleared
+//	Partition    Silently drop data in both directions until Heal
+//	Close        Disconnect, the peer reads io.EOF once it's caught up
+//
+// A Listener pairs Dial with Accept so a Client's Dial and a Router's
+// ServeListener can be joined in memory.
+package memtransport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The address of an in-memory endpoint
+type Addr string
+
+func (addr Addr) Network() string { return "mem" }
+func (addr Addr) String() string  { return string(addr) }
+
+// One end of an in-memory connection
+type Conn struct {
+	in        *stream // what we read
+	out       *stream // what we write, our peer's in
+	link      *link
+	local     Addr
+	remote    Addr
+	mu        sync.Mutex
+	closed    bool
+	err       error // see InjectError
+	latency   time.Duration
+	bandwidth int
+	chunk     int
+	deadline  time.Time // for reads
+}
+
+// State shared by both ends
+type link struct {
+	partitioned int32 // atomic
+}
+
+// Data written but not yet read
+type segment struct {
+	data  []byte
+	ready time.Time // readable from
+}
+
+// One direction of a connection
+type stream struct {
+	mu       sync.Mutex
+	segments []segment
+	closed   bool
+	changed  chan struct{} // closed and replaced on every change
+}
+
+func newStream() *stream {
+	return &stream{changed: make(chan struct{})}
+}
+
+// Wake any waiting reader. Called with s.mu held.
+func (s *stream) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stream) wake() {
+	s.mu.Lock()
+	s.signal()
+	s.mu.Unlock()
+}
+
+func (s *stream) write(data []byte, ready time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	// Data stays in order whatever the latency was when written
+	if last := len(s.segments) - 1; last >= 0 && ready.Before(s.segments[last].ready) {
+		ready = s.segments[last].ready
+	}
+	s.segments = append(s.segments, segment{data, ready})
+	s.signal()
+	return nil
+}
+
+// A channel closed on the next change
+func (s *stream) watch() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// Read what's ready, up to limit bytes if that's positive. With
+// nothing ready it returns how long until something is, negative if
+// there's nothing to wait for.
+func (s *stream) read(b []byte, limit int) (n int, wait time.Duration, eof bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 && limit < len(b) {
+		b = b[:limit]
+	}
+	now := time.Now()
+	for len(s.segments) > 0 && n < len(b) {
+		first := &s.segments[0]
+		if first.ready.After(now) {
+			break
+		}
+		copied := copy(b[n:], first.data)
+		n += copied
+		if first.data = first.data[copied:]; len(first.data) == 0 {
+			s.segments = s.segments[1:]
+		}
+	}
+	if n > 0 {
+		return n, 0, false
+	}
+	if len(s.segments) > 0 {
+		return 0, s.segments[0].ready.Sub(now), false
+	}
+	return 0, -1, s.closed
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.signal()
+	s.mu.Unlock()
+}
+
+// A connected pair of in-memory endpoints
+func Pipe() (*Conn, *Conn) {
+	return pipe("mem:a", "mem:b")
+}
+
+func pipe(a, b Addr) (*Conn, *Conn) {
+	ab, ba := newStream(), newStream()
+	shared := new(link)
+	return &Conn{in: ba, out: ab, link: shared, local: a, remote: b},
+		&Conn{in: ab, out: ba, link: shared, local: b, remote: a}
+}
+
+// Read data written by the peer, waiting for it to arrive
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		// Watch before looking so we can't miss a change
+		changed := c.in.watch()
+		c.mu.Lock()
+		closed, err, chunk, deadline := c.closed, c.err, c.chunk, c.deadline
+		c.mu.Unlock()
+		switch {
+		case closed:
+			return 0, io.ErrClosedPipe
+		case err != nil:
+			return 0, err
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		n, wait, eof := c.in.read(b, chunk)
+		if n > 0 {
+			return n, nil
+		}
+		if eof {
+			return 0, io.EOF
+		}
+		if !deadline.IsZero() && (wait < 0 || time.Until(deadline) < wait) {
+			wait = time.Until(deadline)
+		}
+		if wait < 0 {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Write data for the peer. Writes never block unless a bandwidth
+// limit is set.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, err, latency, bandwidth := c.closed, c.err, c.latency, c.bandwidth
+	c.mu.Unlock()
+	switch {
+	case closed:
+		return 0, io.ErrClosedPipe
+	case err != nil:
+		return 0, err
+	}
+
+	if bandwidth > 0 {
+		time.Sleep(time.Duration(len(b)) * time.Second / time.Duration(bandwidth))
+	}
+	if atomic.LoadInt32(&c.link.partitioned) != 0 {
+		return len(b), nil // Lost
+	}
+	if err = c.out.write(append([]byte(nil), b...), time.Now().Add(latency)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close this end. Our reads fail and the peer reads io.EOF once it
+// has read what was written before.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// Reads fail with os.ErrDeadlineExceeded after t, zero for never.
+// Writes don't block so have no deadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	c.in.wake()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Delay data we write by latency before the peer can read it
+func (c *Conn) SetLatency(latency time.Duration) {
+	c.mu.Lock()
+	c.latency = latency
+	c.mu.Unlock()
+}
+
+// Limit our writes to bytesPerSecond, 0 for no limit
+func (c *Conn) SetBandwidth(bytesPerSecond int) {
+	c.mu.Lock()
+	c.bandwidth = bytesPerSecond
+	c.mu.Unlock()
+}
+
+// Return at most size bytes from each Read, 0 for no limit
+func (c *Conn) SetChunk(size int) {
+	c.mu.Lock()
+	c.chunk = size
+	c.mu.Unlock()
+}
+
+// Fail our Reads and Writes with err, nil to clear it
+func (c *Conn) InjectError(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	c.in.wake()
+}
+
+// Silently drop data written in either direction until Heal
+func (c *Conn) Partition() {
+	atomic.StoreInt32(&c.link.partitioned, 1)
+}
+
+// Stop dropping data after a Partition
+func (c *Conn) Heal() {
+	atomic.StoreInt32(&c.link.partitioned, 0)
+}
+
+// Returned by a Listener's Dial and Accept once it's closed
+var ErrListenerClosed = errors.New("memtransport: listener closed")
+
+// A net.Listener accepting connections made with its Dial
+type Listener struct {
+	addr  Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	count int32 // atomic, for naming the dialing ends
+}
+
+// A Listener named name
+func Listen(name string) *Listener {
+	return &Listener{addr: Addr(name), conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Connect to the listener, returning our end once it's accepted. The
+// arguments are ignored so this can be used as a Client's Dial.
+func (l *Listener) Dial(network, address string) (net.Conn, error) {
+	n := atomic.AddInt32(&l.count, 1)
+	local, remote := pipe(Addr(l.addr.String()+"#"+strconv.Itoa(int(n))), l.addr)
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package memtransport
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+
+	buf := make([]byte, 16)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read %q %v", buf[:n], err)
+	}
+
+	// Partial reads
+	b.SetChunk(2)
+	a.Write([]byte("hello"))
+	for _, expected := range []string{"he", "ll", "o"} {
+		if n, err := b.Read(buf); err != nil || string(buf[:n]) != expected {
+			t.Fatalf("Expected %q read %q %v", expected, buf[:n], err)
+		}
+	}
+	b.SetChunk(0)
+
+	// Latency
+	a.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	a.Write([]byte("late"))
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read %q %v", buf[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Read after %v", elapsed)
+	}
+	a.SetLatency(0)
+
+	// Deadlines
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	b.SetReadDeadline(time.Time{})
+
+	// Injected errors
+	injected := errors.New("injected")
+	b.InjectError(injected)
+	if _, err := b.Read(buf); err != injected {
+		t.Fatalf("Expected injected error, got %v", err)
+	}
+	if _, err := b.Write(buf); err != injected {
+		t.Fatalf("Expected injected error, got %v", err)
+	}
+	b.InjectError(nil)
+
+	// Partitions lose data
+	a.Partition()
+	a.Write([]byte("lost"))
+	b.Heal()
+	a.Write([]byte("found"))
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "found" {
+		t.Fatalf("Read %q %v", buf[:n], err)
+	}
+
+	// The peer reads what was written before the close
+	a.Write([]byte("bye"))
+	a.Close()
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("Read %q %v", buf[:n], err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	if _, err := b.Write(buf); err != io.ErrClosedPipe {
+		t.Fatalf("Expected closed pipe, got %v", err)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+
+	a.SetBandwidth(1000)
+	start := time.Now()
+	a.Write(make([]byte, 100))
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("100 bytes at 1000 bytes/s written in %v", elapsed)
+	}
+	if n, err := b.Read(make([]byte, 200)); n != 100 || err != nil {
+		t.Fatalf("Read %d %v", n, err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l := Listen("test")
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("welcome"))
+		}
+		accepted <- err
+	}()
+
+	conn, err := l.Dial("tcp", "ignored")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if err = <-accepted; err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "welcome" {
+		t.Fatalf("Read %q %v", buf[:n], err)
+	}
+	conn.Close()
+
+	l.Close()
+	if _, err := l.Accept(); err != ErrListenerClosed {
+		t.Fatalf("Expected closed listener, got %v", err)
+	}
+	if _, err := l.Dial("tcp", "ignored"); err != ErrListenerClosed {
+		t.Fatalf("Expected closed listener, got %v", err)
+	}
+}
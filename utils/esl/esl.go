@@ -80,13 +80,16 @@ func main() {
 		}
 	}
 
-	// Create parser.
-
-	// Parse content, and run reductions.
-
 	fmt.Println(subExpr)
 
-	elvin.Lexer(subExpr)
+	// Parse content
+	ast, err := elvin.ParseSubscription(subExpr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%+v\n", *ast)
 
 	os.Exit(0)
 }